@@ -11,11 +11,21 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/media"
+	"github.com/ardanlabs/service/internal/money"
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/blob"
 	"github.com/ardanlabs/service/internal/platform/conf"
 	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/report"
 	"github.com/ardanlabs/service/internal/schema"
 	"github.com/ardanlabs/service/internal/user"
 	"github.com/pkg/errors"
@@ -35,12 +45,20 @@ func run() error {
 
 	var cfg struct {
 		DB struct {
+			Driver     string `conf:"default:postgres"`
 			User       string `conf:"default:postgres"`
 			Password   string `conf:"default:postgres,noprint"`
 			Host       string `conf:"default:0.0.0.0"`
 			Name       string `conf:"default:postgres"`
 			DisableTLS bool   `conf:"default:false"`
 		}
+		Blobs struct {
+			Dir string `conf:"default:/var/lib/sales/blobs"`
+		}
+		Import struct {
+			DryRun bool `conf:"default:false,help:check every row without keeping any product"`
+			Atomic bool `conf:"default:false,help:keep no product unless every row is valid"`
+		}
 		Args conf.Args
 	}
 
@@ -58,6 +76,7 @@ func run() error {
 
 	// This is used for multiple commands below.
 	dbConfig := database.Config{
+		Driver:     cfg.DB.Driver,
 		User:       cfg.DB.User,
 		Password:   cfg.DB.Password,
 		Host:       cfg.DB.Host,
@@ -73,8 +92,25 @@ func run() error {
 		err = seed(dbConfig)
 	case "useradd":
 		err = useradd(dbConfig, cfg.Args.Num(1), cfg.Args.Num(2))
+	case "unlock":
+		err = unlock(dbConfig, cfg.Args.Num(1))
 	case "keygen":
 		err = keygen(cfg.Args.Num(1))
+	case "events":
+		err = events(dbConfig, cfg.Args.Num(1))
+	case "events-requeue":
+		err = eventsRequeue(dbConfig, cfg.Args.Num(1))
+	case "purge":
+		err = purge(dbConfig, cfg.Blobs.Dir, cfg.Args.Num(1))
+	case "rates":
+		err = rates(dbConfig, cfg.Args.Num(1))
+	case "reports":
+		err = reports(dbConfig)
+	case "import":
+		opts := product.ImportOptions{DryRun: cfg.Import.DryRun, Atomic: cfg.Import.Atomic}
+		err = importProducts(dbConfig, cfg.Args.Num(1), cfg.Args.Num(2), opts)
+	case "export":
+		err = exportProducts(dbConfig, cfg.Args.Num(1))
 	default:
 		err = errors.New("Must specify a command")
 	}
@@ -149,7 +185,11 @@ func useradd(cfg database.Config, email, password string) error {
 		Roles:           []string{auth.RoleAdmin, auth.RoleUser},
 	}
 
-	u, err := user.Create(ctx, db, nu, time.Now())
+	// Whoever runs the command is trusted with the roles of the admin.
+	now := time.Now()
+	claims := auth.NewClaims("", nu.Roles, now, time.Minute)
+
+	u, err := user.NewDB(db, user.Config{}).Create(ctx, claims, nu, now)
 	if err != nil {
 		return err
 	}
@@ -158,6 +198,308 @@ func useradd(cfg database.Config, email, password string) error {
 	return nil
 }
 
+// unlock forgets the failed logins of the user with the email so they can log
+// in again right away.
+func unlock(cfg database.Config, email string) error {
+	if email == "" {
+		return errors.New("unlock command must be called with the email of a user")
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	users := user.NewDB(db, user.Config{})
+
+	list, err := users.List(ctx, user.Filter{})
+	if err != nil {
+		return err
+	}
+	for _, u := range list {
+		if strings.EqualFold(u.Email, email) {
+			if err := users.Unlock(ctx, u.ID, time.Now()); err != nil {
+				return err
+			}
+			fmt.Println("User unlocked:", u.ID)
+			return nil
+		}
+	}
+
+	return errors.Errorf("no user with email %q", email)
+}
+
+// events reports the delivery status of domain events in the outbox. If a
+// status is provided the most recent events with that status are listed.
+func events(cfg database.Config, status string) error {
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	counts, err := event.Counts(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("pending: %d  delivered: %d  failed: %d\n",
+		counts[event.StatusPending], counts[event.StatusDelivered], counts[event.StatusFailed])
+
+	if status == "" {
+		return nil
+	}
+
+	evts, err := event.List(ctx, db, status, 100)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTYPE\tAGGREGATE\tSTATUS\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+	for _, e := range evts {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			e.Seq, e.Type, e.AggregateID, e.Status, e.Attempts,
+			e.NextAttempt.Format(time.RFC3339), e.LastError)
+	}
+
+	return w.Flush()
+}
+
+// eventsRequeue returns a failed event to the pending state so it is
+// delivered again.
+func eventsRequeue(cfg database.Config, seqStr string) error {
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if err != nil {
+		return errors.New("events-requeue command must be called with the sequence number of a failed event")
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := event.Requeue(context.Background(), db, seq, time.Now()); err != nil {
+		return err
+	}
+
+	fmt.Println("Event requeued:", seq)
+	return nil
+}
+
+// purge permanently removes products and users that were deleted longer ago
+// than the retention period along with the images and blobs of the purged
+// products. The retention defaults to 30 days.
+func purge(cfg database.Config, blobDir, retention string) error {
+	if retention == "" {
+		retention = "720h"
+	}
+
+	d, err := time.ParseDuration(retention)
+	if err != nil || d < 0 {
+		return errors.New("purge command must be called with a retention period like 720h")
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	before := time.Now().Add(-d)
+
+	blobs, err := blob.NewLocal(blobDir)
+	if err != nil {
+		return err
+	}
+
+	ps := product.NewDB(db)
+	products, err := ps.Purge(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	// Images outlive their products so their blobs can be removed here.
+	images, err := media.NewDB(db, ps, blobs).Purge(ctx)
+	if err != nil {
+		return err
+	}
+
+	users, err := user.NewDB(db, user.Config{}).Purge(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Purged %d products with %d images and %d users deleted before %s\n", products, images, users, before.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// rates loads exchange rates from a CSV file with the columns from, to and
+// rate. Rates already stored for the same currencies are replaced.
+func rates(cfg database.Config, path string) error {
+	if path == "" {
+		return errors.New("rates command must be called with the path of a CSV file")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening rates file")
+	}
+	defer f.Close()
+
+	rs, err := money.ParseRates(f)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := product.NewDB(db).SetRates(context.Background(), rs, time.Now()); err != nil {
+		return err
+	}
+
+	fmt.Printf("Loaded %d exchange rates\n", len(rs))
+	return nil
+}
+
+// reports rebuilds every sales rollup the reports read. The API refreshes
+// recent rollups on its own so this is only needed after changing old sales
+// directly in the database.
+func reports(cfg database.Config) error {
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := report.NewDB(db).Refresh(context.Background(), time.Time{}); err != nil {
+		return err
+	}
+
+	fmt.Println("Reports refreshed")
+	return nil
+}
+
+// importProducts creates the products of a CSV or NDJSON file on behalf of
+// the user with the given email. The format is taken from the extension of
+// the file. Every rejected row is printed.
+func importProducts(cfg database.Config, path, email string, opts product.ImportOptions) error {
+	if path == "" || email == "" {
+		return errors.New("import command must be called with the path of a file and the email of the owner")
+	}
+
+	format, err := fileFormat(path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening import file")
+	}
+	defer f.Close()
+
+	rows, err := product.DecodeProducts(f, format)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	users, err := user.NewDB(db, user.Config{}).List(ctx, user.Filter{})
+	if err != nil {
+		return err
+	}
+	var owner *user.User
+	for i := range users {
+		if strings.EqualFold(users[i].Email, email) {
+			owner = &users[i]
+		}
+	}
+	if owner == nil {
+		return errors.Errorf("no user with email %q", email)
+	}
+
+	claims := auth.NewClaims(owner.ID, owner.Roles, now, time.Hour)
+	res, err := product.NewDB(db).Import(ctx, claims, rows, opts, now)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range res.Rows {
+		if row.Error != "" {
+			fmt.Printf("Row %d: %s\n", row.Row, row.Error)
+		}
+	}
+	fmt.Printf("%d valid rows, %d failed rows, %d products created\n", res.Valid, res.Failed, res.Created)
+	return nil
+}
+
+// exportProducts writes the active products to a CSV or NDJSON file that can
+// be imported again. The format is taken from the extension of the file.
+func exportProducts(cfg database.Config, path string) error {
+	if path == "" {
+		return errors.New("export command must be called with the path of a file")
+	}
+
+	format, err := fileFormat(path)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	products, err := product.NewDB(db).List(context.Background(), product.Filter{})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "creating export file")
+	}
+	defer f.Close()
+
+	if err := product.EncodeProducts(f, format, products); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d products\n", len(products))
+	return f.Close()
+}
+
+// fileFormat gives the bulk format of a file from its extension.
+func fileFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return product.FormatCSV, nil
+	case ".ndjson", ".jsonl":
+		return product.FormatNDJSON, nil
+	}
+	return "", errors.Errorf("file %q must end with .csv, .ndjson or .jsonl", path)
+}
+
 // keygen creates an x509 private key for signing auth tokens.
 func keygen(path string) error {
 	if path == "" {
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// maxImportSize is the largest import body accepted.
+const maxImportSize = 10 << 20
+
+// formatTypes maps the bulk formats to their content types.
+var formatTypes = map[string]string{
+	product.FormatCSV:    "text/csv; charset=utf-8",
+	product.FormatNDJSON: "application/x-ndjson",
+}
+
+// Import creates products from the CSV or NDJSON rows of the request body.
+// The format query parameter names the format of the body and defaults to the
+// one of its Content-Type. The dry_run query parameter only checks the rows
+// and atomic keeps no product unless every row is valid. The outcome of every
+// row is sent back. An atomic import with invalid rows responds with 422.
+func (p *Product) Import(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Import")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var opts product.ImportOptions
+	for name, dst := range map[string]*bool{"dry_run": &opts.DryRun, "atomic": &opts.Atomic} {
+		s := r.URL.Query().Get(name)
+		if s == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			err := errors.Errorf("%s must be true or false: %q", name, s)
+			return web.NewRequestError(err, http.StatusBadRequest)
+		}
+		*dst = b
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		for f, t := range formatTypes {
+			if mt, _, _ := mime.ParseMediaType(t); mt == ct {
+				format = f
+			}
+		}
+	}
+
+	if r.ContentLength > maxImportSize {
+		err := errors.Errorf("import is larger than %d bytes", maxImportSize)
+		return web.NewRequestError(err, http.StatusRequestEntityTooLarge)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	rows, err := product.DecodeProducts(r.Body, format)
+	if err != nil {
+		switch errors.Cause(err) {
+		case product.ErrInvalidImport:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "decoding import")
+		}
+	}
+
+	res, err := p.products.Import(ctx, claims, rows, opts, v.Now)
+	if err != nil {
+		return errors.Wrapf(err, "importing %d products", len(rows))
+	}
+
+	status := http.StatusOK
+	if res.Atomic && res.Failed > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	return web.Respond(ctx, w, res, status)
+}
+
+// Export sends products in the CSV or NDJSON format accepted by Import. The
+// format query parameter defaults to CSV and the products are filtered like
+// the ones of List.
+func (p *Product) Export(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Export")
+	defer span.End()
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = product.FormatCSV
+	}
+	contentType, ok := formatTypes[format]
+	if !ok {
+		err := errors.Errorf("format must be csv or ndjson: %q", format)
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	include, err := includeDeleted(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	f := product.Filter{
+		IncludeDeleted: include,
+		Category:       r.URL.Query().Get("category"),
+		Tag:            r.URL.Query().Get("tag"),
+	}
+
+	products, err := p.products.List(ctx, f)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "listing products: %+v", f)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := product.EncodeProducts(&buf, format, products); err != nil {
+		return errors.Wrap(err, "encoding products")
+	}
+
+	return web.RespondStream(ctx, w, &buf, contentType, http.StatusOK)
+}
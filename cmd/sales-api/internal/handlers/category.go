@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Categories returns every product category.
+func (p *Product) Categories(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Categories")
+	defer span.End()
+
+	categories, err := p.products.ListCategories(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing categories")
+	}
+
+	return web.Respond(ctx, w, categories, http.StatusOK)
+}
+
+// CreateCategory decodes the body of a request to create a new category.
+func (p *Product) CreateCategory(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.CreateCategory")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nc product.NewCategory
+	if err := web.Decode(r, &nc); err != nil {
+		return errors.Wrap(err, "decoding category")
+	}
+
+	c, err := p.products.CreateCategory(ctx, nc, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidCategory, product.ErrCategoryNotFound:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "creating category: %+v", nc)
+		}
+	}
+
+	return web.Respond(ctx, w, c, http.StatusCreated)
+}
+
+// RetrieveCategory returns the category identified in the request URL.
+func (p *Product) RetrieveCategory(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.RetrieveCategory")
+	defer span.End()
+
+	c, err := p.products.RetrieveCategory(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrCategoryNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, c, http.StatusOK)
+}
+
+// UpdateCategory decodes the body of a request to update the category
+// identified in the request URL.
+func (p *Product) UpdateCategory(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.UpdateCategory")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var uc product.UpdateCategory
+	if err := web.Decode(r, &uc); err != nil {
+		return errors.Wrap(err, "decoding category")
+	}
+
+	if err := p.products.UpdateCategory(ctx, params["id"], uc, v.Now); err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidCategory:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrCategoryNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInvalidAttributes:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "updating category %q: %+v", params["id"], uc)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// DeleteCategory removes the category identified in the request URL.
+func (p *Product) DeleteCategory(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.DeleteCategory")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := p.products.DeleteCategory(ctx, params["id"], v.Now); err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrCategoryNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrCategoryInUse:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "deleting category %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
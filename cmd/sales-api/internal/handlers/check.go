@@ -26,7 +26,12 @@ func (c *Check) Health(ctx context.Context, w http.ResponseWriter, r *http.Reque
 		Status string `json:"status"`
 	}
 
-	// Check if the database is ready.
+	// Check if the database is ready. There is nothing to check when the
+	// service runs without a database.
+	if c.db == nil {
+		health.Status = "ok"
+		return web.Respond(ctx, w, health, http.StatusOK)
+	}
 	if err := database.StatusCheck(ctx, c.db); err != nil {
 
 		// If the database is not ready we will tell the client and use a 500
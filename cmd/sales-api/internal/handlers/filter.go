@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/pkg/errors"
+)
+
+// includeDeleted reports if the request asked for deleted records with the
+// include_deleted query parameter. Only admins may see deleted records.
+func includeDeleted(ctx context.Context, r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, nil
+	}
+
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		err := errors.Errorf("include_deleted must be true or false: %q", v)
+		return false, web.NewRequestError(err, http.StatusBadRequest)
+	}
+	if !include {
+		return false, nil
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return false, web.NewShutdownError("claims missing from context")
+	}
+
+	if !claims.HasRole(auth.RoleAdmin) {
+		err := errors.New("Only admins may include deleted records")
+		return false, web.NewRequestError(err, http.StatusForbidden)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// History returns every version of a product, oldest first.
+func (p *Product) History(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.History")
+	defer span.End()
+
+	versions, err := p.products.History(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "listing versions of product %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, versions, http.StatusOK)
+}
+
+// retrieveVersion responds with the version of a product current at the
+// RFC 3339 time asOf.
+func (p *Product) retrieveVersion(ctx context.Context, w http.ResponseWriter, id, asOf string) error {
+	t, err := time.Parse(time.RFC3339, asOf)
+	if err != nil {
+		err := errors.Errorf("as_of must be an RFC 3339 time: %q", asOf)
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	v, err := p.products.RetrieveVersion(ctx, id, t)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "retrieving product %q as of %s", id, asOf)
+		}
+	}
+
+	return web.Respond(ctx, w, v, http.StatusOK)
+}
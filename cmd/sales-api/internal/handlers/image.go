@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ardanlabs/service/internal/media"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// multipartOverhead is allowed on top of the largest image for the headers
+// and boundaries of a multipart upload.
+const multipartOverhead = 64 << 10
+
+// Image represents the product image API method handler set.
+type Image struct {
+	images media.Store
+}
+
+// List returns the images of the product identified in the request URL.
+func (i *Image) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Image.List")
+	defer span.End()
+
+	images, err := i.images.List(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "listing images of product %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, images, http.StatusOK)
+}
+
+// Upload reads the image in the "image" field of a multipart form and adds it
+// to the product identified in the request URL.
+func (i *Image) Upload(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Image.Upload")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	const limit = media.MaxSize + multipartOverhead
+	if r.ContentLength > limit {
+		return web.NewRequestError(media.ErrTooLarge, http.StatusRequestEntityTooLarge)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	f, fh, err := r.FormFile("image")
+	if err != nil {
+		err := errors.Wrap(err, "reading the image field of the form")
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return errors.Wrap(err, "reading image")
+	}
+
+	img, err := i.images.Add(ctx, claims, params["id"], media.NewImage{Name: fh.Filename, Data: data}, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case media.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case media.ErrTooLarge:
+			return web.NewRequestError(err, http.StatusRequestEntityTooLarge)
+		case media.ErrUnsupportedType:
+			return web.NewRequestError(err, http.StatusUnsupportedMediaType)
+		default:
+			return errors.Wrapf(err, "adding image to product %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, img, http.StatusCreated)
+}
+
+// Download sends the content of the image identified in the request URL.
+func (i *Image) Download(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Image.Download")
+	defer span.End()
+
+	return i.send(ctx, w, params, false)
+}
+
+// Thumbnail sends the thumbnail of the image identified in the request URL.
+func (i *Image) Thumbnail(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Image.Thumbnail")
+	defer span.End()
+
+	return i.send(ctx, w, params, true)
+}
+
+// Delete removes the image identified in the request URL.
+func (i *Image) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Image.Delete")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := i.images.Delete(ctx, claims, params["id"], params["image_id"], v.Now); err != nil {
+		switch err {
+		case product.ErrInvalidID, media.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound, media.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case media.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "deleting image %q", params["image_id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// send streams an image or its thumbnail to the client.
+func (i *Image) send(ctx context.Context, w http.ResponseWriter, params map[string]string, thumbnail bool) error {
+	img, rc, err := i.images.Open(ctx, params["id"], params["image_id"], thumbnail)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, media.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound, media.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "opening image %q", params["image_id"])
+		}
+	}
+	defer rc.Close()
+
+	return web.RespondStream(ctx, w, rc, img.ContentType, http.StatusOK)
+}
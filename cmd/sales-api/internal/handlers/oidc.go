@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/oidc"
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+const (
+	oidcCookie   = "oidc_login"     // Keeps a login until the provider sends the browser back.
+	oidcLoginTTL = 10 * time.Minute // How long someone has to log in at the provider.
+	oidcPath     = "/v1/users/oidc" // Where the cookie is sent to.
+)
+
+// LoginOIDC starts a login with the external identity provider. The browser
+// is sent to the provider with a PKCE challenge and a cookie that keeps the
+// state, nonce and verifier of the login for CallbackOIDC.
+func (u *User) LoginOIDC(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.LoginOIDC")
+	defer span.End()
+
+	state, err := oidc.NewState()
+	if err != nil {
+		return err
+	}
+	nonce, err := oidc.NewState()
+	if err != nil {
+		return err
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    strings.Join([]string{state, nonce, verifier}, "."),
+		Path:     oidcPath,
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return web.Redirect(ctx, w, r, u.provider.AuthCodeURL(state, nonce, oidc.Challenge(verifier)), http.StatusFound)
+}
+
+// CallbackOIDC completes a login started with LoginOIDC. The code the provider
+// sent the browser back with is exchanged for an ID token of the person, who
+// is logged in as the user linked to them. It responds with a JWT, or an
+// mfa_token for users with two-factor authentication enabled, like Token.
+func (u *User) CallbackOIDC(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.CallbackOIDC")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		err := errors.Errorf("identity provider: %s", e)
+		return web.NewRequestError(err, http.StatusUnauthorized)
+	}
+
+	// The login is only completed in the browser that started it.
+	var login []string
+	if c, err := r.Cookie(oidcCookie); err == nil {
+		login = strings.Split(c.Value, ".")
+	}
+	if len(login) != 3 || subtle.ConstantTimeCompare([]byte(login[0]), []byte(q.Get("state"))) != 1 {
+		err := errors.New("login state does not match")
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: oidcPath, MaxAge: -1})
+	nonce, verifier := login[1], login[2]
+
+	idToken, err := u.provider.Exchange(ctx, q.Get("code"), verifier)
+	if err != nil {
+		switch errors.Cause(err) {
+		case oidc.ErrInvalidToken:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "exchanging code")
+		}
+	}
+
+	id, err := u.provider.Verify(ctx, idToken, v.Now)
+	if err != nil {
+		switch errors.Cause(err) {
+		case oidc.ErrInvalidToken:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "verifying id token")
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(id.Nonce), []byte(nonce)) != 1 {
+		return web.NewRequestError(oidc.ErrInvalidToken, http.StatusUnauthorized)
+	}
+
+	claims, err := u.users.AuthenticateExternal(ctx, v.Now, user.NewExternal(id), web.SourceAddr(r))
+	if err != nil {
+		switch err {
+		case user.ErrAuthenticationFailure:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		case user.ErrDisabled:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrLastAdmin:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrap(err, "authenticating")
+		}
+	}
+
+	signed, err := u.authenticator.GenerateToken(claims)
+	if err != nil {
+		return errors.Wrap(err, "generating token")
+	}
+
+	var tkn struct {
+		Token    string `json:"token,omitempty"`
+		MFAToken string `json:"mfa_token,omitempty"`
+	}
+	if claims.Audience == user.ChallengeAudience {
+		tkn.MFAToken = signed
+	} else {
+		tkn.Token = signed
+	}
+
+	return web.Respond(ctx, w, tkn, http.StatusOK)
+}
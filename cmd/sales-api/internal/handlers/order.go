@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ardanlabs/service/internal/order"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Order represents the Order API method handler set.
+type Order struct {
+	orders order.Store
+}
+
+// List gets the orders visible to the caller. Admins see every order.
+func (o *Order) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.List")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	orders, err := o.orders.List(ctx, claims)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, orders, http.StatusOK)
+}
+
+// Retrieve returns the specified order from the system.
+func (o *Order) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.Retrieve")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	ord, err := o.orders.Retrieve(ctx, claims, params["id"])
+	if err != nil {
+		switch err {
+		case order.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case order.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case order.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, ord, http.StatusOK)
+}
+
+// Create starts an empty cart for the caller. The order is sent back in the
+// response and its ID is used to add lines.
+func (o *Order) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.Create")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	ord, err := o.orders.Create(ctx, claims, v.Now)
+	if err != nil {
+		return errors.Wrap(err, "creating new order")
+	}
+
+	return web.Respond(ctx, w, ord, http.StatusCreated)
+}
+
+// AddLine decodes the body of a request to add a product to a cart. The
+// updated order is sent back in the response.
+func (o *Order) AddLine(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.AddLine")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nl order.NewLine
+	if err := web.Decode(r, &nl); err != nil {
+		return errors.Wrap(err, "decoding order line")
+	}
+
+	ord, err := o.orders.AddLine(ctx, claims, params["id"], nl, v.Now)
+	if err != nil {
+		switch err {
+		case order.ErrInvalidID, order.ErrInvalidLine, product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case order.ErrNotFound, product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case order.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case order.ErrNotCart, product.ErrNoRate:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "adding line to order %q: %+v", params["id"], nl)
+		}
+	}
+
+	return web.Respond(ctx, w, ord, http.StatusOK)
+}
+
+// RemoveLine takes the line identified in the request URL out of a cart. The
+// updated order is sent back in the response.
+func (o *Order) RemoveLine(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.RemoveLine")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	ord, err := o.orders.RemoveLine(ctx, claims, params["id"], params["line_id"], v.Now)
+	if err != nil {
+		switch err {
+		case order.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case order.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case order.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case order.ErrNotCart:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "removing line %q of order %q", params["line_id"], params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, ord, http.StatusOK)
+}
+
+// Checkout records the sales of a cart and makes the order pending. It fails
+// without selling anything if a product does not have enough stock.
+func (o *Order) Checkout(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.Checkout")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	ord, err := o.orders.Checkout(ctx, claims, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case order.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case order.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case order.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case order.ErrNotCart, order.ErrEmptyCart, product.ErrNotFound, product.ErrInsufficientStock, product.ErrNoRate:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "checking out order %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, ord, http.StatusOK)
+}
+
+// Status decodes the body of a request to move an order to another state. The
+// updated order is sent back in the response.
+func (o *Order) Status(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.Status")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var sc order.StatusChange
+	if err := web.Decode(r, &sc); err != nil {
+		return errors.Wrap(err, "decoding status change")
+	}
+
+	ord, err := o.orders.Transition(ctx, claims, params["id"], sc.Status, v.Now)
+	if err != nil {
+		switch err {
+		case order.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case order.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case order.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case order.ErrInvalidTransition:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "moving order %q to %q", params["id"], sc.Status)
+		}
+	}
+
+	return web.Respond(ctx, w, ord, http.StatusOK)
+}
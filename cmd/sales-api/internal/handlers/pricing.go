@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// AddSale records a sale of the product identified in the request URL made by
+// the authenticated user. The sale with its price and the pricing rules that
+// were applied is sent back in the response.
+func (p *Product) AddSale(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.AddSale")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var ns product.NewSale
+	if err := web.Decode(r, &ns); err != nil {
+		return errors.Wrap(err, "decoding sale")
+	}
+
+	sale, err := p.products.AddSale(ctx, claims, params["id"], ns, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidCoupon, money.ErrInvalidCurrency:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrPriceTooLow:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrInsufficientStock, product.ErrNoRate:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "adding sale of product %q: %+v", params["id"], ns)
+		}
+	}
+
+	return web.Respond(ctx, w, sale, http.StatusCreated)
+}
+
+// Sales returns the sales of the product identified in the request URL.
+func (p *Product) Sales(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Sales")
+	defer span.End()
+
+	sales, err := p.products.ListSales(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "listing sales of product %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, sales, http.StatusOK)
+}
+
+// Quote returns the price the authenticated user would pay for a quantity of
+// the product identified in the request URL.
+func (p *Product) Quote(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Quote")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nq product.NewQuote
+	if err := web.Decode(r, &nq); err != nil {
+		return errors.Wrap(err, "decoding quote")
+	}
+
+	q, err := p.products.Quote(ctx, claims, params["id"], nq, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidQuantity, product.ErrInvalidCoupon:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrNoRate:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "quoting product %q: %+v", params["id"], nq)
+		}
+	}
+
+	return web.Respond(ctx, w, q, http.StatusOK)
+}
+
+// Tiers returns the quantity breaks of the product identified in the request
+// URL.
+func (p *Product) Tiers(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Tiers")
+	defer span.End()
+
+	tiers, err := p.products.ListTiers(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "listing tiers of product %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, tiers, http.StatusOK)
+}
+
+// SetTiers replaces the quantity breaks of the product identified in the
+// request URL.
+func (p *Product) SetTiers(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.SetTiers")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nt product.NewTiers
+	if err := web.Decode(r, &nt); err != nil {
+		return errors.Wrap(err, "decoding tiers")
+	}
+
+	tiers, err := p.products.SetTiers(ctx, claims, params["id"], nt.Tiers, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidTier:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "setting tiers of product %q: %+v", params["id"], nt)
+		}
+	}
+
+	return web.Respond(ctx, w, tiers, http.StatusOK)
+}
+
+// Coupons returns every coupon.
+func (p *Product) Coupons(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Coupons")
+	defer span.End()
+
+	coupons, err := p.products.ListCoupons(ctx)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, coupons, http.StatusOK)
+}
+
+// CreateCoupon decodes the body of a request to create a new coupon.
+func (p *Product) CreateCoupon(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.CreateCoupon")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nc product.NewCoupon
+	if err := web.Decode(r, &nc); err != nil {
+		return errors.Wrap(err, "decoding coupon")
+	}
+
+	c, err := p.products.CreateCoupon(ctx, nc, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidCoupon, money.ErrInvalidCurrency:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrCouponExists:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "creating coupon: %+v", nc)
+		}
+	}
+
+	return web.Respond(ctx, w, c, http.StatusCreated)
+}
+
+// DeleteCoupon removes the coupon identified by the code in the request URL.
+func (p *Product) DeleteCoupon(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.DeleteCoupon")
+	defer span.End()
+
+	if err := p.products.DeleteCoupon(ctx, params["code"]); err != nil {
+		switch err {
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "deleting coupon %q", params["code"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// SetDiscount sets the discount of the user identified in the request URL.
+func (p *Product) SetDiscount(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.SetDiscount")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nd product.NewDiscount
+	if err := web.Decode(r, &nd); err != nil {
+		return errors.Wrap(err, "decoding discount")
+	}
+
+	if err := p.products.SetDiscount(ctx, params["user_id"], nd, v.Now); err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidDiscount:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "setting discount of user %q: %+v", params["user_id"], nd)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
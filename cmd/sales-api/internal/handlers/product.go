@@ -4,40 +4,65 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/ardanlabs/service/internal/money"
 	"github.com/ardanlabs/service/internal/platform/auth"
 	"github.com/ardanlabs/service/internal/platform/web"
 	"github.com/ardanlabs/service/internal/product"
-	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
 
 // Product represents the Product API method handler set.
 type Product struct {
-	db *sqlx.DB
+	products product.Store
 
 	// ADD OTHER STATE LIKE THE LOGGER IF NEEDED.
 }
 
-// List gets all existing products in the system.
+// List gets all existing products in the system. Admins may include deleted
+// products with the include_deleted query parameter. The category and tag
+// query parameters narrow the list to a category with its subcategories or to
+// a tag.
 func (p *Product) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Product.List")
 	defer span.End()
 
-	products, err := product.List(ctx, p.db)
+	include, err := includeDeleted(ctx, r)
 	if err != nil {
 		return err
 	}
 
+	f := product.Filter{
+		IncludeDeleted: include,
+		Category:       r.URL.Query().Get("category"),
+		Tag:            r.URL.Query().Get("tag"),
+	}
+
+	products, err := p.products.List(ctx, f)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "listing products: %+v", f)
+		}
+	}
+
 	return web.Respond(ctx, w, products, http.StatusOK)
 }
 
-// Retrieve returns the specified product from the system.
+// Retrieve returns the specified product from the system. With the as_of
+// query parameter the version of the product current at that time is
+// returned instead.
 func (p *Product) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Product.Retrieve")
 	defer span.End()
 
-	prod, err := product.Retrieve(ctx, p.db, params["id"])
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		return p.retrieveVersion(ctx, w, params["id"], asOf)
+	}
+
+	prod, err := p.products.Retrieve(ctx, params["id"])
 	if err != nil {
 		switch err {
 		case product.ErrInvalidID:
@@ -73,9 +98,14 @@ func (p *Product) Create(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return errors.Wrap(err, "decoding new product")
 	}
 
-	prod, err := product.Create(ctx, p.db, claims, np, v.Now)
+	prod, err := p.products.Create(ctx, claims, np, v.Now)
 	if err != nil {
-		return errors.Wrapf(err, "creating new product: %+v", np)
+		switch err {
+		case money.ErrInvalidCurrency, product.ErrCategoryNotFound, product.ErrInvalidAttributes:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "creating new product: %+v", np)
+		}
 	}
 
 	return web.Respond(ctx, w, prod, http.StatusCreated)
@@ -102,14 +132,16 @@ func (p *Product) Update(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return errors.Wrap(err, "")
 	}
 
-	if err := product.Update(ctx, p.db, claims, params["id"], up, v.Now); err != nil {
+	if err := p.products.Update(ctx, claims, params["id"], up, v.Now); err != nil {
 		switch err {
-		case product.ErrInvalidID:
+		case product.ErrInvalidID, product.ErrCategoryNotFound, product.ErrInvalidAttributes:
 			return web.NewRequestError(err, http.StatusBadRequest)
 		case product.ErrNotFound:
 			return web.NewRequestError(err, http.StatusNotFound)
 		case product.ErrForbidden:
 			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrInsufficientStock:
+			return web.NewRequestError(err, http.StatusConflict)
 		default:
 			return errors.Wrapf(err, "updating product %q: %+v", params["id"], up)
 		}
@@ -123,7 +155,12 @@ func (p *Product) Delete(ctx context.Context, w http.ResponseWriter, r *http.Req
 	ctx, span := trace.StartSpan(ctx, "handlers.Product.Delete")
 	defer span.End()
 
-	if err := product.Delete(ctx, p.db, params["id"]); err != nil {
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := p.products.Delete(ctx, params["id"], v.Now); err != nil {
 		switch err {
 		case product.ErrInvalidID:
 			return web.NewRequestError(err, http.StatusBadRequest)
@@ -134,3 +171,239 @@ func (p *Product) Delete(ctx context.Context, w http.ResponseWriter, r *http.Req
 
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
+
+// Restore returns a deleted product identified by an ID in the request URL to
+// the active set.
+func (p *Product) Restore(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Restore")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := p.products.Restore(ctx, params["id"], v.Now); err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Movements returns the inventory ledger of the product identified by an ID
+// in the request URL.
+func (p *Product) Movements(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Movements")
+	defer span.End()
+
+	movements, err := p.products.ListMovements(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, movements, http.StatusOK)
+}
+
+// Adjust decodes the body of a request to change the stock of a product by
+// hand. The recorded movement is sent back in the response.
+func (p *Product) Adjust(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Adjust")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var na product.NewAdjustment
+	if err := web.Decode(r, &na); err != nil {
+		return errors.Wrap(err, "decoding adjustment")
+	}
+
+	m, err := p.products.Adjust(ctx, claims, params["id"], na, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidMovement:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrInsufficientStock:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "adjusting product %q: %+v", params["id"], na)
+		}
+	}
+
+	return web.Respond(ctx, w, m, http.StatusCreated)
+}
+
+// Reserve decodes the body of a request to hold stock of a product. The
+// reservation is sent back in the response and its ID is used to release it.
+func (p *Product) Reserve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Reserve")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nr product.NewReservation
+	if err := web.Decode(r, &nr); err != nil {
+		return errors.Wrap(err, "decoding reservation")
+	}
+
+	m, err := p.products.Reserve(ctx, claims, params["id"], nr, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidMovement:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInsufficientStock:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "reserving product %q: %+v", params["id"], nr)
+		}
+	}
+
+	return web.Respond(ctx, w, m, http.StatusCreated)
+}
+
+// Release returns the stock held by a reservation identified in the request
+// URL.
+func (p *Product) Release(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Release")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := p.products.Release(ctx, claims, params["id"], params["reservation_id"], v.Now); err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "releasing %q of product %q", params["reservation_id"], params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Refund decodes the body of a request to refund a sale of a product. The
+// product and sale are identified in the request URL.
+func (p *Product) Refund(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Refund")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("claims missing from context")
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nr product.NewRefund
+	if err := web.Decode(r, &nr); err != nil {
+		return errors.Wrap(err, "decoding refund")
+	}
+
+	ref, err := p.products.Refund(ctx, claims, params["id"], params["sale_id"], nr, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidRefund:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "refunding sale %q of product %q: %+v", params["sale_id"], params["id"], nr)
+		}
+	}
+
+	return web.Respond(ctx, w, ref, http.StatusCreated)
+}
+
+// Refunds gives the refunds of every sale of a product.
+func (p *Product) Refunds(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Refunds")
+	defer span.End()
+
+	refunds, err := p.products.ListRefunds(ctx, params["id"])
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "listing refunds of product %q", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, refunds, http.StatusOK)
+}
+
+// Revenue reports the revenue of all products per currency, net of refunds.
+func (p *Product) Revenue(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Revenue")
+	defer span.End()
+
+	revenue, err := p.products.Revenue(ctx)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, revenue, http.StatusOK)
+}
+
+// Rates returns the stored exchange rates.
+func (p *Product) Rates(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Rates")
+	defer span.End()
+
+	rates, err := p.products.ListRates(ctx)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, rates, http.StatusOK)
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/report"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// defaultReportDays is the length of the range reported on when the request
+// does not give its start.
+const defaultReportDays = 30
+
+// Report has handler methods for sales reports. Every report is sent as JSON
+// or as CSV when the format query parameter is csv.
+type Report struct {
+	reports report.Store
+}
+
+// Sales gives the units sold and revenue of every day, week or month of the
+// range according to the interval query parameter.
+func (rp *Report) Sales(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Report.Sales")
+	defer span.End()
+
+	q, err := reportQuery(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	buckets, err := rp.reports.Series(ctx, q)
+	if err != nil {
+		switch err {
+		case report.ErrInvalidQuery:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "reporting sales: %+v", q)
+		}
+	}
+
+	records := [][]string{{"start", "currency", "units", "revenue"}}
+	for _, b := range buckets {
+		records = append(records, []string{
+			b.Start.Format(time.RFC3339), b.Currency, strconv.Itoa(b.Units), strconv.Itoa(b.Revenue),
+		})
+	}
+
+	return respondReport(ctx, w, r, buckets, records)
+}
+
+// TopProducts gives the Products that sold the most. The by query parameter
+// ranks them by units or revenue and limit sets how many are given.
+func (rp *Report) TopProducts(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Report.TopProducts")
+	defer span.End()
+
+	q, err := reportQuery(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	products, err := rp.reports.TopProducts(ctx, q)
+	if err != nil {
+		switch err {
+		case report.ErrInvalidQuery:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "reporting top products: %+v", q)
+		}
+	}
+
+	records := [][]string{{"product_id", "name", "currency", "units", "revenue"}}
+	for _, p := range products {
+		records = append(records, []string{
+			p.ProductID, p.Name, p.Currency, strconv.Itoa(p.Units), strconv.Itoa(p.Revenue),
+		})
+	}
+
+	return respondReport(ctx, w, r, products, records)
+}
+
+// Owners gives the units sold and revenue of the Products of every user.
+func (rp *Report) Owners(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Report.Owners")
+	defer span.End()
+
+	q, err := reportQuery(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	users, err := rp.reports.Owners(ctx, q)
+	if err != nil {
+		switch err {
+		case report.ErrInvalidQuery:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "reporting owners: %+v", q)
+		}
+	}
+
+	records := [][]string{{"user_id", "currency", "products", "units", "revenue"}}
+	for _, u := range users {
+		records = append(records, []string{
+			u.UserID, u.Currency, strconv.Itoa(u.Products), strconv.Itoa(u.Units), strconv.Itoa(u.Revenue),
+		})
+	}
+
+	return respondReport(ctx, w, r, users, records)
+}
+
+// Prices gives the average selling price of every Product next to its list
+// Cost.
+func (rp *Report) Prices(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Report.Prices")
+	defer span.End()
+
+	q, err := reportQuery(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	prices, err := rp.reports.Prices(ctx, q)
+	if err != nil {
+		switch err {
+		case report.ErrInvalidQuery:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "reporting prices: %+v", q)
+		}
+	}
+
+	records := [][]string{{"product_id", "name", "currency", "cost", "units", "revenue", "average_price", "difference"}}
+	for _, p := range prices {
+		records = append(records, []string{
+			p.ProductID, p.Name, p.Currency, strconv.Itoa(p.Cost), strconv.Itoa(p.Units),
+			strconv.Itoa(p.Revenue), strconv.Itoa(p.AveragePrice), strconv.Itoa(p.Difference),
+		})
+	}
+
+	return respondReport(ctx, w, r, prices, records)
+}
+
+// reportQuery reads the query parameters shared by the reports. The tz
+// parameter names the time zone, from and to bound the range as RFC 3339
+// times or dates in that time zone. A date given for to includes that whole
+// day. The range defaults to the last 30 days up to the end of the current
+// hour. Sales are rolled up by the hour so time zones that are not a whole
+// number of hours off UTC and times inside an hour are rejected by the
+// reports with a 400.
+func reportQuery(ctx context.Context, r *http.Request) (report.Query, error) {
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return report.Query{}, web.NewShutdownError("web value missing from context")
+	}
+
+	query := r.URL.Query()
+	q := report.Query{
+		Location: time.UTC,
+		Interval: query.Get("interval"),
+		By:       query.Get("by"),
+	}
+
+	if tz := query.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			err := errors.Errorf("tz must be a time zone name: %q", tz)
+			return report.Query{}, web.NewRequestError(err, http.StatusBadRequest)
+		}
+		q.Location = loc
+	}
+
+	if lim := query.Get("limit"); lim != "" {
+		n, err := strconv.Atoi(lim)
+		if err != nil {
+			err := errors.Errorf("limit must be a number: %q", lim)
+			return report.Query{}, web.NewRequestError(err, http.StatusBadRequest)
+		}
+		q.Limit = n
+	}
+
+	q.To = v.Now.Truncate(time.Hour)
+	if !q.To.Equal(v.Now) {
+		q.To = q.To.Add(time.Hour)
+	}
+	if to := query.Get("to"); to != "" {
+		t, date, err := parseReportTime(to, q.Location)
+		if err != nil {
+			return report.Query{}, err
+		}
+		if date {
+			t = t.AddDate(0, 0, 1)
+		}
+		q.To = t
+	}
+
+	q.From = q.To.AddDate(0, 0, -defaultReportDays)
+	if from := query.Get("from"); from != "" {
+		t, _, err := parseReportTime(from, q.Location)
+		if err != nil {
+			return report.Query{}, err
+		}
+		q.From = t
+	}
+
+	return q, nil
+}
+
+// parseReportTime parses an RFC 3339 time or a date in loc. It reports
+// whether a date was given.
+func parseReportTime(s string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		err := errors.Errorf("time must be a date or RFC 3339 time: %q", s)
+		return time.Time{}, false, web.NewRequestError(err, http.StatusBadRequest)
+	}
+	return t, false, nil
+}
+
+// respondReport sends the report as CSV records when the format query
+// parameter asks for it and as JSON otherwise. The first record is the header.
+func respondReport(ctx context.Context, w http.ResponseWriter, r *http.Request, data interface{}, records [][]string) error {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		return web.Respond(ctx, w, data, http.StatusOK)
+	case "csv":
+	default:
+		err := errors.Errorf("format must be json or csv: %q", format)
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if err := cw.WriteAll(records); err != nil {
+		return errors.Wrap(err, "encoding csv")
+	}
+
+	return web.RespondStream(ctx, w, &buf, "text/csv; charset=utf-8", http.StatusOK)
+}
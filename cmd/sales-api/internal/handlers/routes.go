@@ -5,14 +5,28 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/ardanlabs/service/internal/media"
 	"github.com/ardanlabs/service/internal/mid"
+	"github.com/ardanlabs/service/internal/order"
 	"github.com/ardanlabs/service/internal/platform/auth" // Import is removed in final PR
+	"github.com/ardanlabs/service/internal/platform/notify"
+	"github.com/ardanlabs/service/internal/platform/oidc"
 	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/report"
+	"github.com/ardanlabs/service/internal/user"
 	"github.com/jmoiron/sqlx"
 )
 
-// API constructs an http.Handler with all application routes defined.
-func API(shutdown chan os.Signal, log *log.Logger, db *sqlx.DB, authenticator *auth.Authenticator) http.Handler {
+// API constructs an http.Handler with all application routes defined. The
+// stores provide persistence for the handlers. The db is only used for health
+// checks and may be nil when the stores do not use a database. The notifier
+// sends password reset and email verification tokens to users. The signups
+// limiter throttles the requests that sign up or send verification tokens and
+// the resets limiter those that reset passwords.
+// People can also log in with the external identity provider, and use its ID
+// tokens, unless it is nil.
+func API(shutdown chan os.Signal, log *log.Logger, db *sqlx.DB, authenticator *auth.Authenticator, products product.Store, users user.Store, orders order.Store, images media.Store, reports report.Store, notifier notify.Notifier, signups, resets *mid.Limiter, provider *oidc.Provider) http.Handler {
 
 	// Construct the web.App which holds all routes as well as common Middleware.
 	app := web.NewApp(shutdown, log, mid.Logger(log), mid.Errors(log), mid.Metrics(), mid.Panics(log))
@@ -25,27 +39,114 @@ func API(shutdown chan os.Signal, log *log.Logger, db *sqlx.DB, authenticator *a
 
 	// Register user management and authentication endpoints.
 	u := User{
-		db:            db,
+		users:         users,
+		products:      products,
 		authenticator: authenticator,
+		notifier:      notifier,
+		provider:      provider,
+		log:           log,
 	}
-	app.Handle("GET", "/v1/users", u.List, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
-	app.Handle("POST", "/v1/users", u.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
-	app.Handle("GET", "/v1/users/:id", u.Retrieve, mid.Authenticate(authenticator))
-	app.Handle("PUT", "/v1/users/:id", u.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
-	app.Handle("DELETE", "/v1/users/:id", u.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/users", u.List, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users", u.Create, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/users/me", u.Me, mid.Authenticate(authenticator, users, provider))
+	app.Handle("PUT", "/v1/users/me", u.UpdateMe, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/users/:id", u.Retrieve, mid.Authenticate(authenticator, users, provider))
+	app.Handle("PUT", "/v1/users/:id", u.Update, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/users/:id", u.Delete, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users/:id/restore", u.Restore, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users/:id/unlock", u.Unlock, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users/:id/disable", u.Disable, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users/:id/enable", u.Enable, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/users/:id/sessions", u.ListSessions, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/users/:id/sessions/:session_id", u.RevokeSession, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users/:id/transfer", u.Transfer, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/users/:id/mfa", u.EnrollMFA, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/users/:id/mfa/confirm", u.ConfirmMFA, mid.Authenticate(authenticator, users, provider))
+	app.Handle("DELETE", "/v1/users/:id/mfa", u.DisableMFA, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/users/:id/keys", u.ListAPIKeys, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/users/:id/keys", u.CreateAPIKey, mid.Authenticate(authenticator, users, provider))
+	app.Handle("DELETE", "/v1/users/:id/keys/:key_id", u.RevokeAPIKey, mid.Authenticate(authenticator, users, provider))
 
-	// This route is not authenticated
+	// These routes are not authenticated
 	app.Handle("GET", "/v1/users/token", u.Token)
+	app.Handle("POST", "/v1/users/token/mfa", u.VerifyMFA, mid.Challenge(authenticator))
+	app.Handle("POST", "/v1/users/password-reset", u.RequestReset, mid.RateLimit(resets))
+	app.Handle("POST", "/v1/users/password-reset/confirm", u.ConfirmReset, mid.RateLimit(resets))
+	app.Handle("POST", "/v1/users/signup", u.Register, mid.RateLimit(signups))
+	app.Handle("POST", "/v1/users/verify", u.Verify)
+	app.Handle("POST", "/v1/users/verify/resend", u.RequestVerification, mid.RateLimit(signups))
+	if provider != nil {
+		app.Handle("GET", "/v1/users/oidc/login", u.LoginOIDC)
+		app.Handle("GET", "/v1/users/oidc/callback", u.CallbackOIDC)
+	}
 
 	// Register product and sale endpoints.
 	p := Product{
-		db: db,
+		products: products,
+	}
+	app.Handle("GET", "/v1/products", p.List, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products", p.Create, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/search", p.Search, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/import", p.Import, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/export", p.Export, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/:id", p.Retrieve, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/:id/history", p.History, mid.Authenticate(authenticator, users, provider))
+	app.Handle("PUT", "/v1/products/:id", p.Update, mid.Authenticate(authenticator, users, provider))
+	app.Handle("DELETE", "/v1/products/:id", p.Delete, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/:id/restore", p.Restore, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/products/:id/inventory", p.Movements, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/:id/inventory", p.Adjust, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/:id/reservations", p.Reserve, mid.Authenticate(authenticator, users, provider))
+	app.Handle("DELETE", "/v1/products/:id/reservations/:reservation_id", p.Release, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/:id/refunds", p.Refunds, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/:id/sales/:sale_id/refunds", p.Refund, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/:id/sales", p.Sales, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/:id/sales", p.AddSale, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/:id/quote", p.Quote, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/:id/tiers", p.Tiers, mid.Authenticate(authenticator, users, provider))
+	app.Handle("PUT", "/v1/products/:id/tiers", p.SetTiers, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/coupons", p.Coupons, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/coupons", p.CreateCoupon, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/coupons/:code", p.DeleteCoupon, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("PUT", "/v1/discounts/:user_id", p.SetDiscount, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/revenue", p.Revenue, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/rates", p.Rates, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/categories", p.Categories, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/categories", p.CreateCategory, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/categories/:id", p.RetrieveCategory, mid.Authenticate(authenticator, users, provider))
+	app.Handle("PUT", "/v1/categories/:id", p.UpdateCategory, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/categories/:id", p.DeleteCategory, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+
+	// Register product image endpoints.
+	i := Image{
+		images: images,
+	}
+	app.Handle("GET", "/v1/products/:id/images", i.List, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/products/:id/images", i.Upload, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/:id/images/:image_id", i.Download, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/products/:id/images/:image_id/thumbnail", i.Thumbnail, mid.Authenticate(authenticator, users, provider))
+	app.Handle("DELETE", "/v1/products/:id/images/:image_id", i.Delete, mid.Authenticate(authenticator, users, provider))
+
+	// Register sales report endpoints.
+	rp := Report{
+		reports: reports,
+	}
+	app.Handle("GET", "/v1/reports/sales", rp.Sales, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/reports/top-products", rp.TopProducts, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/reports/owners", rp.Owners, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/reports/prices", rp.Prices, mid.Authenticate(authenticator, users, provider), mid.HasRole(auth.RoleAdmin))
+
+	// Register order endpoints.
+	o := Order{
+		orders: orders,
 	}
-	app.Handle("GET", "/v1/products", p.List, mid.Authenticate(authenticator))
-	app.Handle("POST", "/v1/products", p.Create, mid.Authenticate(authenticator))
-	app.Handle("GET", "/v1/products/:id", p.Retrieve, mid.Authenticate(authenticator))
-	app.Handle("PUT", "/v1/products/:id", p.Update, mid.Authenticate(authenticator))
-	app.Handle("DELETE", "/v1/products/:id", p.Delete, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/orders", o.List, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/orders", o.Create, mid.Authenticate(authenticator, users, provider))
+	app.Handle("GET", "/v1/orders/:id", o.Retrieve, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/orders/:id/lines", o.AddLine, mid.Authenticate(authenticator, users, provider))
+	app.Handle("DELETE", "/v1/orders/:id/lines/:line_id", o.RemoveLine, mid.Authenticate(authenticator, users, provider))
+	app.Handle("POST", "/v1/orders/:id/checkout", o.Checkout, mid.Authenticate(authenticator, users, provider))
+	app.Handle("PUT", "/v1/orders/:id/status", o.Status, mid.Authenticate(authenticator, users, provider))
 
 	return app
 }
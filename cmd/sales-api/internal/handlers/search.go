@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Search finds products by the words of the q query parameter. The category
+// and band query parameters narrow the hits and limit and offset page
+// through them.
+func (p *Product) Search(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Search")
+	defer span.End()
+
+	query := r.URL.Query()
+	sq := product.SearchQuery{
+		Text:     query.Get("q"),
+		Category: query.Get("category"),
+		Band:     query.Get("band"),
+	}
+
+	for name, dst := range map[string]*int{"limit": &sq.Limit, "offset": &sq.Offset} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			err := errors.Errorf("%s must be a number: %q", name, v)
+			return web.NewRequestError(err, http.StatusBadRequest)
+		}
+		*dst = n
+	}
+
+	res, err := p.products.Search(ctx, sq)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidQuery:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "searching products: %+v", sq)
+		}
+	}
+
+	return web.Respond(ctx, w, res, http.StatusOK)
+}
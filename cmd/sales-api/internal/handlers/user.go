@@ -2,30 +2,50 @@ package handlers
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/notify"
+	"github.com/ardanlabs/service/internal/platform/oidc"
 	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
 	"github.com/ardanlabs/service/internal/user"
-	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
 
+const (
+	resetTTL  = time.Hour      // How long a password reset token can be used.
+	verifyTTL = 24 * time.Hour // How long an email verification token can be used.
+)
+
 // User represents the User API method handler set.
 type User struct {
-	db            *sqlx.DB
+	users         user.Store
+	products      product.Store
 	authenticator *auth.Authenticator
+	notifier      notify.Notifier
+	provider      *oidc.Provider
+	log           *log.Logger
 
 	// ADD OTHER STATE LIKE THE LOGGER AND CONFIG HERE.
 }
 
-// List returns all the existing users in the system.
+// List returns all the existing users in the system. Deleted users are
+// included when asked for with the include_deleted query parameter.
 func (u *User) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.List")
 	defer span.End()
 
-	usrs, err := user.List(ctx, u.db)
+	include, err := includeDeleted(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	usrs, err := u.users.List(ctx, user.Filter{IncludeDeleted: include})
 	if err != nil {
 		return err
 	}
@@ -43,7 +63,7 @@ func (u *User) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		return errors.New("claims missing from context")
 	}
 
-	usr, err := user.Retrieve(ctx, claims, u.db, params["id"])
+	usr, err := u.users.Retrieve(ctx, claims, params["id"])
 	if err != nil {
 		switch err {
 		case user.ErrInvalidID:
@@ -70,14 +90,32 @@ func (u *User) Create(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
 	var nu user.NewUser
 	if err := web.Decode(r, &nu); err != nil {
 		return errors.Wrap(err, "")
 	}
 
-	usr, err := user.Create(ctx, u.db, nu, v.Now)
+	usr, err := u.users.Create(ctx, claims, nu, v.Now)
 	if err != nil {
-		return errors.Wrapf(err, "User: %+v", &usr)
+		switch err {
+		case user.ErrPasswordTooShort, user.ErrPasswordTooSimple, user.ErrPasswordBreached:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrInvalidRole:
+			return web.NewFieldError(err, http.StatusBadRequest, "roles")
+		case user.ErrRoleNotHeld:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrInvalidEmail:
+			return web.NewFieldError(err, http.StatusBadRequest, "email")
+		case user.ErrEmailTaken:
+			return web.NewFieldError(err, http.StatusConflict, "email")
+		default:
+			return errors.Wrapf(err, "User: %+v", &usr)
+		}
 	}
 
 	return web.Respond(ctx, w, usr, http.StatusCreated)
@@ -103,15 +141,23 @@ func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		return errors.Wrap(err, "")
 	}
 
-	err := user.Update(ctx, claims, u.db, params["id"], upd, v.Now)
+	err := u.users.Update(ctx, claims, params["id"], upd, v.Now)
 	if err != nil {
 		switch err {
-		case user.ErrInvalidID:
+		case user.ErrInvalidID, user.ErrPasswordTooShort, user.ErrPasswordTooSimple, user.ErrPasswordBreached:
 			return web.NewRequestError(err, http.StatusBadRequest)
 		case user.ErrNotFound:
 			return web.NewRequestError(err, http.StatusNotFound)
-		case user.ErrForbidden:
+		case user.ErrForbidden, user.ErrRoleNotHeld:
 			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrInvalidRole:
+			return web.NewFieldError(err, http.StatusBadRequest, "roles")
+		case user.ErrInvalidEmail:
+			return web.NewFieldError(err, http.StatusBadRequest, "email")
+		case user.ErrEmailTaken:
+			return web.NewFieldError(err, http.StatusConflict, "email")
+		case user.ErrLastAdmin:
+			return web.NewRequestError(err, http.StatusConflict)
 		default:
 			return errors.Wrapf(err, "ID: %s  User: %+v", params["id"], &upd)
 		}
@@ -120,12 +166,85 @@ func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
+// Me returns the user of the token.
+func (u *User) Me(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Me")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	usr, err := u.users.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s", claims.Subject)
+		}
+	}
+
+	return web.Respond(ctx, w, usr, http.StatusOK)
+}
+
+// UpdateMe updates the profile of the user of the token. Changing their email
+// or password needs their current password, and changing the password logs
+// them out everywhere but here.
+func (u *User) UpdateMe(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.UpdateMe")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var upd user.UpdateProfile
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	err := u.users.UpdateProfile(ctx, claims, upd, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID, user.ErrPasswordTooShort, user.ErrPasswordTooSimple, user.ErrPasswordBreached:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrWrongPassword:
+			return web.NewFieldError(err, http.StatusBadRequest, "current_password")
+		case user.ErrInvalidEmail:
+			return web.NewFieldError(err, http.StatusBadRequest, "email")
+		case user.ErrEmailTaken:
+			return web.NewFieldError(err, http.StatusConflict, "email")
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s", claims.Subject)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
 // Delete removes the specified user from the system.
 func (u *User) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Delete")
 	defer span.End()
 
-	err := user.Delete(ctx, u.db, params["id"])
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	err := u.users.Delete(ctx, params["id"], v.Now)
 	if err != nil {
 		switch err {
 		case user.ErrInvalidID:
@@ -134,16 +253,231 @@ func (u *User) Delete(ctx context.Context, w http.ResponseWriter, r *http.Reques
 			return web.NewRequestError(err, http.StatusNotFound)
 		case user.ErrForbidden:
 			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrLastAdmin:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Restore returns the specified deleted user to the active set.
+func (u *User) Restore(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Restore")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	err := u.users.Restore(ctx, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Unlock lets the specified user log in again right away after too many
+// failed attempts.
+func (u *User) Unlock(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Unlock")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	err := u.users.Unlock(ctx, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Disable keeps the specified user from logging in and ends their sessions
+// without deleting them.
+func (u *User) Disable(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Disable")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var d user.Disable
+	if err := web.Decode(r, &d); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	err := u.users.Disable(ctx, params["id"], d.Reason, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrLastAdmin:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Enable lets the specified user log in again after they were disabled.
+func (u *User) Enable(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Enable")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	err := u.users.Enable(ctx, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// ListSessions returns the active sessions of the specified user.
+func (u *User) ListSessions(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.ListSessions")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	sessions, err := u.users.ListSessions(ctx, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
 		default:
 			return errors.Wrapf(err, "Id: %s", params["id"])
 		}
 	}
 
+	return web.Respond(ctx, w, sessions, http.StatusOK)
+}
+
+// RevokeSession ends the specified session of a user. Its token is no longer
+// accepted.
+func (u *User) RevokeSession(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.RevokeSession")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	err := u.users.RevokeSession(ctx, params["id"], params["session_id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrSessionNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "Id: %s  Session: %s", params["id"], params["session_id"])
+		}
+	}
+
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
+// Transfer hands every product of the specified user to the active user given
+// in the request, so their products are kept when they are deleted. It
+// responds with how many products were transferred.
+func (u *User) Transfer(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Transfer")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var t user.Transfer
+	if err := web.Decode(r, &t); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	// The products go to a user who can still log in to manage them.
+	to, err := u.users.Retrieve(ctx, claims, t.UserID)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID, user.ErrNotFound:
+			return web.NewRequestError(errors.Wrap(err, "new owner"), http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "Id: %s", t.UserID)
+		}
+	}
+	if to.DisabledAt != nil {
+		return web.NewRequestError(errors.Wrap(user.ErrDisabled, "new owner"), http.StatusBadRequest)
+	}
+
+	n, err := u.products.Transfer(ctx, params["id"], to.ID, v.Now)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "From: %s  To: %s", params["id"], to.ID)
+		}
+	}
+
+	resp := struct {
+		Transferred int `json:"transferred"`
+	}{n}
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
 // Token handles a request to authenticate a user. It expects a request using
-// Basic Auth with a user's email and password. It responds with a JWT.
+// Basic Auth with a user's email and password. It responds with a JWT. Users
+// with two-factor authentication enabled get a short lived mfa_token instead,
+// which VerifyMFA exchanges for a JWT. Failed attempts are counted against
+// the address the request came from.
 func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Token")
 	defer span.End()
@@ -159,23 +493,455 @@ func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request
 		return web.NewRequestError(err, http.StatusUnauthorized)
 	}
 
-	claims, err := user.Authenticate(ctx, u.db, v.Now, email, pass)
+	claims, err := u.users.Authenticate(ctx, v.Now, email, pass, web.SourceAddr(r))
 	if err != nil {
 		switch err {
 		case user.ErrAuthenticationFailure:
 			return web.NewRequestError(err, http.StatusUnauthorized)
+		case user.ErrUnverified, user.ErrDisabled:
+			return web.NewRequestError(err, http.StatusForbidden)
 		default:
 			return errors.Wrap(err, "authenticating")
 		}
 	}
 
-	var tkn struct {
-		Token string `json:"token"`
-	}
-	tkn.Token, err = u.authenticator.GenerateToken(claims)
+	signed, err := u.authenticator.GenerateToken(claims)
 	if err != nil {
 		return errors.Wrap(err, "generating token")
 	}
 
+	var tkn struct {
+		Token    string `json:"token,omitempty"`
+		MFAToken string `json:"mfa_token,omitempty"`
+	}
+	if claims.Audience == user.ChallengeAudience {
+		tkn.MFAToken = signed
+	} else {
+		tkn.Token = signed
+	}
+
 	return web.Respond(ctx, w, tkn, http.StatusOK)
 }
+
+// VerifyMFA completes a login with the mfa_token given by Token and a code
+// from the authenticator app of the user or one of their recovery codes. It
+// responds with a JWT.
+func (u *User) VerifyMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.VerifyMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var mc user.MFACode
+	if err := web.Decode(r, &mc); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	claims, err := u.users.VerifyMFA(ctx, v.Now, claims, mc.Code, web.SourceAddr(r))
+	if err != nil {
+		switch err {
+		case user.ErrAuthenticationFailure:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "verifying two-factor code")
+		}
+	}
+
+	var tkn struct {
+		Token string `json:"token"`
+	}
+	tkn.Token, err = u.authenticator.GenerateToken(claims)
+	if err != nil {
+		return errors.Wrap(err, "generating token")
+	}
+
+	return web.Respond(ctx, w, tkn, http.StatusOK)
+}
+
+// EnrollMFA starts enrolling the specified user in two-factor authentication.
+// It responds with the secret to add to their authenticator app. Users can
+// only enroll themselves.
+func (u *User) EnrollMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.EnrollMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	e, err := u.users.EnrollMFA(ctx, claims, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrMFAEnabled:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, e, http.StatusOK)
+}
+
+// ConfirmMFA enables two-factor authentication for the specified user given a
+// code from their authenticator app. It responds with their recovery codes.
+func (u *User) ConfirmMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.ConfirmMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var mc user.MFACode
+	if err := web.Decode(r, &mc); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	codes, err := u.users.ConfirmMFA(ctx, claims, params["id"], mc.Code, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID, user.ErrMFANotEnrolled, user.ErrInvalidMFACode:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrMFAEnabled:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, user.RecoveryCodes{Codes: codes}, http.StatusOK)
+}
+
+// DisableMFA turns off two-factor authentication for the specified user.
+func (u *User) DisableMFA(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.DisableMFA")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	err := u.users.DisableMFA(ctx, claims, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// RequestReset sends a password reset token to the user with the email of the
+// request. It responds the same way whether or not the email belongs to a
+// user so the endpoint can not be used to find out which emails are in the
+// system. For the same reason failing to send the token is only logged, and
+// the notifier should send it in the background so the response takes as long
+// either way.
+func (u *User) RequestReset(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.RequestReset")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var rr user.RequestReset
+	if err := web.Decode(r, &rr); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	pr, err := u.users.RequestReset(ctx, rr.Email, resetTTL, v.Now)
+	switch err {
+	case nil:
+		m := notify.Message{
+			To:      pr.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hello %s,\n\nUse this token to set a new password before %s:\n\n%s\n\nIf you did not ask to reset your password you can ignore this message.",
+				pr.Name, pr.ExpiresAt.Format(time.RFC1123), pr.Token),
+		}
+		if err := u.notifier.Notify(ctx, m); err != nil {
+			u.log.Printf("%s : ERROR : sending password reset to user %s : %v", v.TraceID, pr.UserID, err)
+		}
+	case user.ErrNotFound:
+	default:
+		return errors.Wrap(err, "requesting password reset")
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// ConfirmReset sets a new password with a token sent by RequestReset. The
+// tokens issued to the user before are no longer accepted.
+func (u *User) ConfirmReset(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.ConfirmReset")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var cr user.ConfirmReset
+	if err := web.Decode(r, &cr); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	if err := u.users.ConfirmReset(ctx, cr.Token, cr.Password, v.Now); err != nil {
+		switch err {
+		case user.ErrInvalidResetToken, user.ErrPasswordTooShort, user.ErrPasswordTooSimple, user.ErrPasswordBreached:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "confirming password reset")
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Register signs someone up as a user with the USER role and sends them a
+// token to verify their email. They can not get a token before that.
+func (u *User) Register(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Register")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nr user.NewRegistration
+	if err := web.Decode(r, &nr); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	ver, err := u.users.Register(ctx, nr, verifyTTL, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrPasswordTooShort, user.ErrPasswordTooSimple, user.ErrPasswordBreached:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrDomainNotAllowed:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrInvalidEmail:
+			return web.NewFieldError(err, http.StatusBadRequest, "email")
+		case user.ErrEmailTaken:
+			return web.NewFieldError(err, http.StatusConflict, "email")
+		default:
+			return errors.Wrapf(err, "Email: %s", nr.Email)
+		}
+	}
+
+	u.sendVerification(ctx, v, ver)
+
+	return web.Respond(ctx, w, ver, http.StatusCreated)
+}
+
+// RequestVerification sends a new verification token to the unverified user
+// with the email of the request. Like RequestReset it responds the same way
+// whether or not there is such a user.
+func (u *User) RequestVerification(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.RequestVerification")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var rv user.RequestVerification
+	if err := web.Decode(r, &rv); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	ver, err := u.users.RequestVerification(ctx, rv.Email, verifyTTL, v.Now)
+	switch err {
+	case nil:
+		u.sendVerification(ctx, v, ver)
+	case user.ErrNotFound:
+	default:
+		return errors.Wrap(err, "requesting verification")
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Verify verifies the email of a user with a token sent by Register or
+// RequestVerification.
+func (u *User) Verify(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Verify")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var ve user.VerifyEmail
+	if err := web.Decode(r, &ve); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	if err := u.users.Verify(ctx, ve.Token, v.Now); err != nil {
+		switch err {
+		case user.ErrInvalidVerificationToken:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "verifying email")
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// sendVerification sends the token of ver to its user. Failing to send it is
+// only logged since the user can ask for another one.
+func (u *User) sendVerification(ctx context.Context, v *web.Values, ver *user.Verification) {
+	m := notify.Message{
+		To:      ver.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hello %s,\n\nUse this token to verify your email before %s:\n\n%s\n\nIf you did not sign up you can ignore this message.",
+			ver.Name, ver.ExpiresAt.Format(time.RFC1123), ver.Token),
+	}
+	if err := u.notifier.Notify(ctx, m); err != nil {
+		u.log.Printf("%s : ERROR : sending verification to user %s : %v", v.TraceID, ver.UserID, err)
+	}
+}
+
+// CreateAPIKey creates an API key for the specified user. The response is the
+// only time the full key is shown.
+func (u *User) CreateAPIKey(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.CreateAPIKey")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var nk user.NewAPIKey
+	if err := web.Decode(r, &nk); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	k, err := u.users.CreateAPIKey(ctx, claims, params["id"], nk, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID, user.ErrInvalidScope:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, k, http.StatusCreated)
+}
+
+// ListAPIKeys returns the API keys of the specified user without their
+// secrets.
+func (u *User) ListAPIKeys(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.ListAPIKeys")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	keys, err := u.users.ListAPIKeys(ctx, claims, params["id"])
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, keys, http.StatusOK)
+}
+
+// RevokeAPIKey stops the specified API key from being used.
+func (u *User) RevokeAPIKey(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.RevokeAPIKey")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	err := u.users.RevokeAPIKey(ctx, claims, params["id"], params["key_id"], v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrAPIKeyNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "Id: %s  Key: %s", params["id"], params["key_id"])
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
@@ -11,14 +11,25 @@ import (
 	_ "net/http/pprof" // Register the pprof handlers
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/zipkin"
 	"github.com/ardanlabs/service/cmd/sales-api/internal/handlers"
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/media"
+	"github.com/ardanlabs/service/internal/mid"
+	"github.com/ardanlabs/service/internal/order"
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/blob"
 	"github.com/ardanlabs/service/internal/platform/conf"
 	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/ardanlabs/service/internal/platform/notify"
+	"github.com/ardanlabs/service/internal/platform/oidc"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/report"
+	"github.com/ardanlabs/service/internal/user"
 	jwt "github.com/dgrijalva/jwt-go"
 	openzipkin "github.com/openzipkin/zipkin-go"
 	zipkinHTTP "github.com/openzipkin/zipkin-go/reporter/http"
@@ -68,6 +79,7 @@ func run() error {
 			ShutdownTimeout time.Duration `conf:"default:5s"`
 		}
 		DB struct {
+			Driver     string `conf:"default:postgres"`
 			User       string `conf:"default:postgres"`
 			Password   string `conf:"default:postgres,noprint"`
 			Host       string `conf:"default:0.0.0.0"`
@@ -78,6 +90,64 @@ func run() error {
 			KeyID          string `conf:"default:1"`
 			PrivateKeyFile string `conf:"default:/app/private.pem"`
 			Algorithm      string `conf:"default:RS256"`
+			AdminMFA       bool   `conf:"default:false,help:only give the ADMIN role to admins using two-factor authentication"`
+		}
+		Lockout struct {
+			MaxFailures       int           `conf:"default:5,help:failed logins of a user before it is locked"`
+			MaxSourceFailures int           `conf:"default:50,help:failed logins from an address before it is locked"`
+			LockDuration      time.Duration `conf:"default:15m"`
+			BaseDelay         time.Duration `conf:"default:1s,help:wait after the first failed login, doubled by every failure after"`
+			MaxDelay          time.Duration `conf:"default:1m"`
+		}
+		Password struct {
+			MinLength  int    `conf:"default:8"`
+			MinClasses int    `conf:"default:1,help:character classes out of lower, upper, digits and symbols a password uses"`
+			Breached   string `conf:"help:file of breached passwords that can not be used, one per line"`
+			Hasher     string `conf:"default:bcrypt,help:bcrypt|argon2id"`
+			Cost       int    `conf:"default:0,help:bcrypt cost or argon2id passes, the default of the hasher when 0"`
+		}
+		Signup struct {
+			Domains []string      `conf:"help:email domains allowed to sign up with separated by commas, any when empty"`
+			Limit   int           `conf:"default:5,help:signups and verification requests from an address per window"`
+			Window  time.Duration `conf:"default:1h"`
+		}
+		Reset struct {
+			Limit  int           `conf:"default:5,help:password reset requests from an address per window"`
+			Window time.Duration `conf:"default:1h"`
+		}
+		Email struct {
+			StripPlusTags bool `conf:"default:false,help:treat emails that only differ in their +tag as the same user; set when installing"`
+		}
+		OIDC struct {
+			Issuer       string   `conf:"help:URL of the OpenID Connect provider people can log in with, none when empty"`
+			ClientID     string   `conf:"default:sales-api"`
+			ClientSecret string   `conf:"noprint,help:empty for a public client"`
+			RedirectURL  string   `conf:"help:public URL of /v1/users/oidc/callback"`
+			Scopes       string   `conf:"default:email profile,help:scopes requested besides openid separated by spaces"`
+			GroupsClaim  string   `conf:"default:groups"`
+			GroupRoles   []string `conf:"help:group:ROLE pairs separated by commas"`
+			DefaultRoles []string `conf:"default:USER,help:roles of people in none of the groups"`
+		}
+		Events struct {
+			Sink         string        `conf:"default:stdout,help:none|stdout|file|webhook|notify"`
+			Target       string        `conf:"help:file path|webhook URL|notify channel"`
+			PollInterval time.Duration `conf:"default:1s"`
+			MaxAttempts  int           `conf:"default:0"`
+		}
+		Blobs struct {
+			Dir string `conf:"default:/var/lib/sales/blobs"`
+		}
+		Notify struct {
+			Sink      string `conf:"default:stdout,help:stdout|file"`
+			Target    string `conf:"help:file path"`
+			QueueSize int    `conf:"default:100,help:messages waiting to be sent"`
+		}
+		Inventory struct {
+			ExpireInterval time.Duration `conf:"default:1m"`
+		}
+		Reports struct {
+			RefreshInterval time.Duration `conf:"default:5m"`
+			RefreshWindow   time.Duration `conf:"default:72h,help:age of the sales rolled up again on every refresh"`
 		}
 		Zipkin struct {
 			LocalEndpoint string  `conf:"default:0.0.0.0:3000"`
@@ -140,6 +210,7 @@ func run() error {
 	log.Println("main : Started : Initializing database support")
 
 	db, err := database.Open(database.Config{
+		Driver:     cfg.DB.Driver,
 		User:       cfg.DB.User,
 		Password:   cfg.DB.Password,
 		Host:       cfg.DB.Host,
@@ -154,6 +225,171 @@ func run() error {
 		db.Close()
 	}()
 
+	// =========================================================================
+	// Start Event Relay
+
+	log.Println("main : Started : Initializing event relay")
+
+	var sink event.Sink
+	switch cfg.Events.Sink {
+	case "none":
+	case "stdout":
+		sink = event.NewWriterSink(os.Stdout)
+	case "file":
+		fs, err := event.OpenFileSink(cfg.Events.Target)
+		if err != nil {
+			return errors.Wrap(err, "opening event sink")
+		}
+		defer fs.Close()
+		sink = fs
+	case "webhook":
+		sink = event.NewWebhookSink(cfg.Events.Target, &http.Client{Timeout: 10 * time.Second})
+	case "notify":
+		sink = event.NewNotifySink(db, cfg.Events.Target)
+	default:
+		return errors.Errorf("unknown event sink %q", cfg.Events.Sink)
+	}
+
+	if sink != nil {
+		relay := event.NewRelay(db, sink, log, event.RelayConfig{
+			PollInterval: cfg.Events.PollInterval,
+			MaxAttempts:  cfg.Events.MaxAttempts,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			relay.Run(ctx)
+			close(done)
+		}()
+
+		defer func() {
+			log.Printf("main : Event Relay Stopping : %s", cfg.Events.Sink)
+			cancel()
+			<-done
+		}()
+	}
+
+	// =========================================================================
+	// Start Reservation Expiry
+
+	log.Println("main : Started : Initializing reservation expiry")
+
+	products := product.NewDB(db)
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			ticker := time.NewTicker(cfg.Inventory.ExpireInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				n, err := products.ExpireReservations(ctx, time.Now())
+				if err != nil {
+					log.Printf("main : ERROR : expiring reservations : %v", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("main : Expired %d reservations", n)
+				}
+			}
+		}()
+
+		defer func() {
+			log.Println("main : Reservation Expiry Stopping")
+			cancel()
+			<-done
+		}()
+	}
+
+	// =========================================================================
+	// Start Report Refresh
+
+	log.Println("main : Started : Initializing report refresh")
+
+	reports := report.NewDB(db)
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			ticker := time.NewTicker(cfg.Reports.RefreshInterval)
+			defer ticker.Stop()
+
+			// Every rollup is rebuilt at startup. Later refreshes only rebuild
+			// the recent hours where sales are still added, cancelled and
+			// refunded.
+			full := true
+			for {
+				since := time.Now().Add(-cfg.Reports.RefreshWindow)
+				if full {
+					since = time.Time{}
+				}
+				if err := reports.Refresh(ctx, since); err != nil {
+					log.Printf("main : ERROR : refreshing reports : %v", err)
+				} else {
+					full = false
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+
+		defer func() {
+			log.Println("main : Report Refresh Stopping")
+			cancel()
+			<-done
+		}()
+	}
+
+	// =========================================================================
+	// Start Blob Storage
+
+	log.Println("main : Started : Initializing blob storage")
+
+	blobs, err := blob.NewLocal(cfg.Blobs.Dir)
+	if err != nil {
+		return errors.Wrap(err, "opening blob storage")
+	}
+
+	// =========================================================================
+	// Start Notifications
+
+	log.Println("main : Started : Initializing notifications")
+
+	var notifier notify.Notifier
+	switch cfg.Notify.Sink {
+	case "stdout":
+		notifier = notify.NewWriter(os.Stdout)
+	case "file":
+		nf, err := notify.OpenFile(cfg.Notify.Target)
+		if err != nil {
+			return errors.Wrap(err, "opening notification file")
+		}
+		defer nf.Close()
+		notifier = nf
+	default:
+		return errors.Errorf("unknown notification sink %q", cfg.Notify.Sink)
+	}
+
+	// Messages are sent in the background so requests that send them take as
+	// long as those that do not.
+	queue := notify.NewQueue(notifier, log, cfg.Notify.QueueSize)
+	defer queue.Close()
+
 	// =========================================================================
 	// Start Tracing Support
 
@@ -202,9 +438,70 @@ func run() error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	hasher, err := user.NewHasher(cfg.Password.Hasher, cfg.Password.Cost)
+	if err != nil {
+		return errors.Wrap(err, "configuring password hasher")
+	}
+	var breached []string
+	if cfg.Password.Breached != "" {
+		if breached, err = user.ReadBreached(cfg.Password.Breached); err != nil {
+			return err
+		}
+	}
+
+	users := user.NewDB(db, user.Config{
+		Lockout: user.LockoutConfig{
+			MaxFailures:       cfg.Lockout.MaxFailures,
+			MaxSourceFailures: cfg.Lockout.MaxSourceFailures,
+			LockDuration:      cfg.Lockout.LockDuration,
+			BaseDelay:         cfg.Lockout.BaseDelay,
+			MaxDelay:          cfg.Lockout.MaxDelay,
+		},
+		AdminMFA:      cfg.Auth.AdminMFA,
+		SignupDomains: cfg.Signup.Domains,
+		Password: user.PasswordPolicy{
+			MinLength:  cfg.Password.MinLength,
+			MinClasses: cfg.Password.MinClasses,
+			Breached:   breached,
+		},
+		Hasher:        hasher,
+		StripPlusTags: cfg.Email.StripPlusTags,
+	})
+	if err := users.CheckEmails(context.Background()); err != nil {
+		return errors.Wrap(err, "checking user emails")
+	}
+
+	var provider *oidc.Provider
+	if cfg.OIDC.Issuer != "" {
+		log.Println("main : Started : Discovering identity provider")
+
+		groupRoles := make(map[string]string)
+		for _, gr := range cfg.OIDC.GroupRoles {
+			i := strings.LastIndex(gr, ":")
+			if i < 0 {
+				return errors.Errorf("group role %q is not of the form group:ROLE", gr)
+			}
+			groupRoles[gr[:i]] = gr[i+1:]
+		}
+
+		provider, err = oidc.Discover(context.Background(), oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+			Scopes:       strings.Fields(cfg.OIDC.Scopes),
+			GroupsClaim:  cfg.OIDC.GroupsClaim,
+			GroupRoles:   groupRoles,
+			DefaultRoles: cfg.OIDC.DefaultRoles,
+		})
+		if err != nil {
+			return errors.Wrap(err, "configuring identity provider")
+		}
+	}
+
 	api := http.Server{
 		Addr:         cfg.Web.APIHost,
-		Handler:      handlers.API(shutdown, log, db, authenticator),
+		Handler:      handlers.API(shutdown, log, db, authenticator, products, users, order.NewDB(db), media.NewDB(db, products, blobs), reports, queue, mid.NewLimiter(cfg.Signup.Limit, cfg.Signup.Window), mid.NewLimiter(cfg.Reset.Limit, cfg.Reset.Window), provider),
 		ReadTimeout:  cfg.Web.ReadTimeout,
 		WriteTimeout: cfg.Web.WriteTimeout,
 	}
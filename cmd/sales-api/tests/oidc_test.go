@@ -0,0 +1,270 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/cmd/sales-api/internal/handlers"
+	"github.com/ardanlabs/service/internal/mid"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/oidc"
+	"github.com/ardanlabs/service/internal/platform/oidc/oidctest"
+	"github.com/ardanlabs/service/internal/tests"
+)
+
+// TestOIDC is the entry point for testing logins with an external identity
+// provider.
+func TestOIDC(t *testing.T) {
+	test := tests.NewIntegration(t)
+	defer test.Teardown()
+
+	runOIDCTests(t, test)
+}
+
+// TestOIDCMemory runs the same subtests as TestOIDC against the in-memory
+// stores so they do not require a database.
+func TestOIDCMemory(t *testing.T) {
+	test := tests.NewMemory(t)
+	defer test.Teardown()
+
+	runOIDCTests(t, test)
+}
+
+// runOIDCTests registers the identity provider subtests for the application
+// built from the provided test state and a stub provider.
+func runOIDCTests(t *testing.T, test *tests.Test) {
+	stub := oidctest.Start(t, "sales-api")
+	defer stub.Close()
+
+	provider, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:       stub.Issuer,
+		ClientID:     "sales-api",
+		RedirectURL:  "http://sales.example.com/v1/users/oidc/callback",
+		GroupRoles:   map[string]string{"sales-admins": auth.RoleAdmin},
+		DefaultRoles: []string{auth.RoleUser},
+	})
+	if err != nil {
+		t.Fatalf("discovering provider: %v", err)
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	tests := OIDCTests{
+		app:           handlers.API(shutdown, test.Log, test.DB, test.Authenticator, test.Products, test.Users, test.Orders, test.Images, test.Reports, test.Notifier, mid.NewLimiter(100, time.Hour), mid.NewLimiter(100, time.Hour), provider),
+		adminToken:    test.Token("admin@example.com", "gophers"),
+		authenticator: test.Authenticator,
+		stub:          stub,
+	}
+
+	t.Run("codeFlow", tests.codeFlow)
+	t.Run("idTokens", tests.idTokens)
+}
+
+// OIDCTests holds methods for each identity provider subtest. This type allows
+// passing dependencies for tests while still providing a convenient syntax
+// when subtests are registered.
+type OIDCTests struct {
+	app           http.Handler
+	adminToken    string
+	authenticator *auth.Authenticator
+	stub          *oidctest.Provider
+}
+
+// codeFlow validates logging in through the provider with the authorization
+// code flow.
+func (ot *OIDCTests) codeFlow(t *testing.T) {
+	ot.stub.Login(map[string]interface{}{
+		"sub":            "jo",
+		"email":          "jo@example.com",
+		"email_verified": true,
+		"name":           "Jo Gopher",
+		"groups":         []string{"sales-admins"},
+	})
+
+	// login starts a login and gives the cookie of the login and where the
+	// provider sends the browser back to.
+	login := func() (*http.Cookie, *url.URL) {
+		r := httptest.NewRequest("GET", "/v1/users/oidc/login", nil)
+		w := httptest.NewRecorder()
+		ot.app.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("\t%s\tShould be sent to the provider : %v", tests.Failed, w.Code)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("\t%s\tShould get a cookie for the login : got %v", tests.Failed, cookies)
+		}
+
+		client := http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to log in at the provider : %v", tests.Failed, err)
+		}
+		resp.Body.Close()
+		back, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || resp.StatusCode != http.StatusFound {
+			t.Fatalf("\t%s\tShould be sent back by the provider : %d %v", tests.Failed, resp.StatusCode, err)
+		}
+		return cookies[0], back
+	}
+	callback := func(cookie *http.Cookie, back *url.URL) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", back.RequestURI(), nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		ot.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to log in with an external identity provider.")
+	{
+		t.Log("\tTest 0:\tWhen the provider sends the browser back.")
+		{
+			cookie, back := login()
+			w := callback(cookie, back)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			var tkn struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&tkn); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			claims, err := ot.authenticator.ParseClaims(tkn.Token)
+			if err != nil {
+				t.Fatalf("\t%s\tShould get a token : %v", tests.Failed, err)
+			}
+			if !claims.HasRole(auth.RoleAdmin) {
+				t.Fatalf("\t%s\tShould get the roles of the groups : got %v", tests.Failed, claims.Roles)
+			}
+			t.Logf("\t%s\tShould receive a token with the roles of the groups.", tests.Success)
+
+			r := httptest.NewRequest("GET", "/v1/users/"+claims.Subject, nil)
+			r.Header.Set("Authorization", "Bearer "+tkn.Token)
+			w = httptest.NewRecorder()
+			ot.app.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould be able to use the token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould be able to use the token.", tests.Success)
+
+			if w := callback(cookie, back); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 using the code again : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 using the code again.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen the login was not started by the browser.")
+		{
+			_, back := login()
+			if w := callback(nil, back); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 without the cookie : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 without the cookie.", tests.Success)
+
+			other, _ := login()
+			if w := callback(other, back); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 with the cookie of another login : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 with the cookie of another login.", tests.Success)
+		}
+	}
+}
+
+// idTokens validates ID tokens of the provider are accepted instead of tokens
+// of the service.
+func (ot *OIDCTests) idTokens(t *testing.T) {
+	send := func(method, url, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		ot.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to accept the ID tokens of an external identity provider.")
+	{
+		t.Log("\tTest 0:\tWhen using an ID token.")
+		{
+			admin := ot.stub.IDToken(t, map[string]interface{}{
+				"sub":            "max",
+				"email":          "max@example.com",
+				"email_verified": true,
+				"groups":         []string{"sales-admins"},
+			})
+			if w := send("GET", "/v1/users", admin); w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 with the role of the group : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 with the role of the group.", tests.Success)
+
+			plain := ot.stub.IDToken(t, map[string]interface{}{
+				"sub":            "max",
+				"email":          "max@example.com",
+				"email_verified": true,
+			})
+			if w := send("GET", "/v1/users", plain); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 once out of the group : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 once out of the group.", tests.Success)
+
+			other := ot.stub.IDToken(t, map[string]interface{}{"sub": "max", "aud": "someone"})
+			if w := send("GET", "/v1/users", other); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 for another client : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 for another client.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen the user of the ID token is disabled.")
+		{
+			tkn := ot.stub.IDToken(t, map[string]interface{}{
+				"sub":            "lou",
+				"email":          "lou@example.com",
+				"email_verified": true,
+			})
+			w := send("GET", "/v1/products", tkn)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould be able to use the ID token : %v", tests.Failed, w.Code)
+			}
+
+			var users []struct {
+				ID    string `json:"id"`
+				Email string `json:"email"`
+			}
+			if err := json.NewDecoder(send("GET", "/v1/users", ot.adminToken).Body).Decode(&users); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			var id string
+			for _, u := range users {
+				if u.Email == "lou@example.com" {
+					id = u.ID
+				}
+			}
+			if id == "" {
+				t.Fatalf("\t%s\tShould list the provisioned user.", tests.Failed)
+			}
+
+			r := httptest.NewRequest("POST", "/v1/users/"+id+"/disable", strings.NewReader(`{"reason": "left"}`))
+			r.Header.Set("Authorization", "Bearer "+ot.adminToken)
+			w = httptest.NewRecorder()
+			ot.app.ServeHTTP(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould be able to disable the user : %v", tests.Failed, w.Code)
+			}
+
+			if w := send("GET", "/v1/users/"+id, tkn); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/cmd/sales-api/internal/handlers"
+	"github.com/ardanlabs/service/internal/mid"
+	"github.com/ardanlabs/service/internal/order"
+	"github.com/ardanlabs/service/internal/tests"
+)
+
+// TestOrders runs a series of tests to exercise Order behavior from the API
+// level against the database.
+func TestOrders(t *testing.T) {
+	test := tests.NewIntegration(t)
+	defer test.Teardown()
+
+	runOrderTests(t, test)
+}
+
+// TestOrdersMemory runs the same subtests as TestOrders against the in-memory
+// stores so they do not require a database.
+func TestOrdersMemory(t *testing.T) {
+	test := tests.NewMemory(t)
+	defer test.Teardown()
+
+	runOrderTests(t, test)
+}
+
+// runOrderTests registers the order subtests for the application built from
+// the provided test state.
+func runOrderTests(t *testing.T, test *tests.Test) {
+	shutdown := make(chan os.Signal, 1)
+	tests := OrderTests{
+		app:        handlers.API(shutdown, test.Log, test.DB, test.Authenticator, test.Products, test.Users, test.Orders, test.Images, test.Reports, test.Notifier, mid.NewLimiter(100, time.Hour), mid.NewLimiter(100, time.Hour), nil),
+		adminToken: test.Token("admin@example.com", "gophers"),
+		userToken:  test.Token("user@example.com", "gophers"),
+	}
+
+	t.Run("getOrder404", tests.getOrder404)
+	t.Run("checkoutOrder", tests.checkoutOrder)
+}
+
+// OrderTests holds methods for each order subtest. This type allows passing
+// dependencies for tests while still providing a convenient syntax when
+// subtests are registered.
+type OrderTests struct {
+	app        http.Handler
+	adminToken string
+	userToken  string
+}
+
+// send makes a request to the application as the holder of the token.
+func (ot *OrderTests) send(token, method, url, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	ot.app.ServeHTTP(w, r)
+	return w
+}
+
+// getOrder404 validates an order request for an order that does not exist
+// with the endpoint.
+func (ot *OrderTests) getOrder404(t *testing.T) {
+	id := "a224a8d6-3f9e-4b11-9900-e81a25d80702"
+
+	w := ot.send(ot.adminToken, "GET", "/v1/orders/"+id, "")
+
+	t.Log("Given the need to validate getting an order with an unknown id.")
+	{
+		t.Logf("\tTest 0:\tWhen using the new order %s.", id)
+		{
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("\t%s\tShould receive a status code of 404 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 404 for the response.", tests.Success)
+		}
+	}
+}
+
+// checkoutOrder validates a cart can be built, checked out and paid for.
+func (ot *OrderTests) checkoutOrder(t *testing.T) {
+	const toys = "72f8b983-3eb4-48db-9ed0-e45cc6bd716b"
+
+	t.Log("Given the need to buy products with an order.")
+	{
+		t.Log("\tTest 0:\tWhen a user buys two toys.")
+		{
+			w := ot.send(ot.userToken, "POST", "/v1/orders", "")
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the new order : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for the new order.", tests.Success)
+
+			var o order.Order
+			if err := json.NewDecoder(w.Body).Decode(&o); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+
+			w = ot.send(ot.userToken, "POST", "/v1/orders/"+o.ID+"/lines", `{"product_id": "`+toys+`", "quantity": 0}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for an empty line : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for an empty line.", tests.Success)
+
+			w = ot.send(ot.userToken, "POST", "/v1/orders/"+o.ID+"/lines", `{"product_id": "`+toys+`", "quantity": 2}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the new line : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&o); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if o.Total != 150 {
+				t.Fatalf("\t%s\tShould total 150 cents : got %d", tests.Failed, o.Total)
+			}
+			t.Logf("\t%s\tShould total the lines at the cost of the product.", tests.Success)
+
+			w = ot.send(ot.userToken, "POST", "/v1/orders/"+o.ID+"/checkout", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the checkout : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&o); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if o.Status != order.StatusPending {
+				t.Fatalf("\t%s\tShould be pending : got %q", tests.Failed, o.Status)
+			}
+			t.Logf("\t%s\tShould be pending after the checkout.", tests.Success)
+
+			w = ot.send(ot.userToken, "POST", "/v1/orders/"+o.ID+"/checkout", "")
+			if w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould receive a status code of 409 for a second checkout : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 409 for a second checkout.", tests.Success)
+
+			w = ot.send(ot.userToken, "PUT", "/v1/orders/"+o.ID+"/status", `{"status": "paid"}`)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 when the owner marks it paid : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 when the owner marks it paid.", tests.Success)
+
+			w = ot.send(ot.adminToken, "PUT", "/v1/orders/"+o.ID+"/status", `{"status": "pending"}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for an unknown status : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for an unknown status.", tests.Success)
+
+			w = ot.send(ot.adminToken, "PUT", "/v1/orders/"+o.ID+"/status", `{"status": "paid"}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 when an admin marks it paid : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 when an admin marks it paid.", tests.Success)
+
+			w = ot.send(ot.userToken, "GET", "/v1/orders", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the list : %v", tests.Failed, w.Code)
+			}
+			var list []order.Order
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(list) != 1 || list[0].Status != order.StatusPaid || len(list[0].Lines) != 1 {
+				t.Fatalf("\t%s\tShould list the paid order with its line : %+v", tests.Failed, list)
+			}
+			t.Logf("\t%s\tShould list the paid order with its line.", tests.Success)
+		}
+	}
+}
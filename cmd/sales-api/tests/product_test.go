@@ -2,16 +2,25 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ardanlabs/service/cmd/sales-api/internal/handlers"
+	"github.com/ardanlabs/service/internal/media"
+	"github.com/ardanlabs/service/internal/mid"
+	"github.com/ardanlabs/service/internal/money"
 	"github.com/ardanlabs/service/internal/platform/web"
 	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/report"
 	"github.com/ardanlabs/service/internal/tests"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -27,10 +36,27 @@ func TestProducts(t *testing.T) {
 	test := tests.NewIntegration(t)
 	defer test.Teardown()
 
+	runProductTests(t, test)
+}
+
+// TestProductsMemory runs the same subtests as TestProducts against the
+// in-memory stores so they do not require a database.
+func TestProductsMemory(t *testing.T) {
+	test := tests.NewMemory(t)
+	defer test.Teardown()
+
+	runProductTests(t, test)
+}
+
+// runProductTests registers the product subtests for the application built
+// from the provided test state.
+func runProductTests(t *testing.T, test *tests.Test) {
 	shutdown := make(chan os.Signal, 1)
 	tests := ProductTests{
-		app:       handlers.API(shutdown, test.Log, test.DB, test.Authenticator),
+		app:       handlers.API(shutdown, test.Log, test.DB, test.Authenticator, test.Products, test.Users, test.Orders, test.Images, test.Reports, test.Notifier, mid.NewLimiter(100, time.Hour), mid.NewLimiter(100, time.Hour), nil),
 		userToken: test.Token("admin@example.com", "gophers"),
+		userOnly:  test.Token("user@example.com", "gophers"),
+		reports:   test.Reports,
 	}
 
 	t.Run("postProduct400", tests.postProduct400)
@@ -40,6 +66,17 @@ func TestProducts(t *testing.T) {
 	t.Run("deleteProductNotFound", tests.deleteProductNotFound)
 	t.Run("putProduct404", tests.putProduct404)
 	t.Run("crudProducts", tests.crudProduct)
+	t.Run("restoreProduct", tests.restoreProduct)
+	t.Run("inventoryProduct", tests.inventoryProduct)
+	t.Run("refundProduct", tests.refundProduct)
+	t.Run("revenueProduct", tests.revenueProduct)
+	t.Run("saleProduct", tests.saleProduct)
+	t.Run("categoryProduct", tests.categoryProduct)
+	t.Run("searchProduct", tests.searchProduct)
+	t.Run("imageProduct", tests.imageProduct)
+	t.Run("bulkProduct", tests.bulkProduct)
+	t.Run("reportProduct", tests.reportProduct)
+	t.Run("historyProduct", tests.historyProduct)
 }
 
 // ProductTests holds methods for each product subtest. This type allows
@@ -48,6 +85,8 @@ func TestProducts(t *testing.T) {
 type ProductTests struct {
 	app       http.Handler
 	userToken string
+	userOnly  string
+	reports   report.Store
 }
 
 // postProduct400 validates a product can't be created with the endpoint
@@ -426,3 +465,817 @@ func (pt *ProductTests) putProduct204(t *testing.T, id string) {
 		}
 	}
 }
+
+// restoreProduct validates a deleted product is hidden until an admin
+// restores it.
+func (pt *ProductTests) restoreProduct(t *testing.T) {
+	p := pt.postProduct201(t)
+	pt.deleteProduct204(t, p.ID)
+	defer pt.deleteProduct204(t, p.ID)
+
+	listed := func(query, token string) (int, bool) {
+		r := httptest.NewRequest("GET", "/v1/products"+query, nil)
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		pt.app.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			return w.Code, false
+		}
+
+		var list []product.Product
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+		}
+		for _, lp := range list {
+			if lp.ID == p.ID {
+				return w.Code, true
+			}
+		}
+		return w.Code, false
+	}
+
+	t.Log("Given the need to restore a deleted product.")
+	{
+		t.Logf("\tTest 0:\tWhen using the deleted product %s.", p.ID)
+		{
+			if _, found := listed("", pt.userToken); found {
+				t.Fatalf("\t%s\tShould NOT list the deleted product.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould NOT list the deleted product.", tests.Success)
+
+			if _, found := listed("?include_deleted=true", pt.userToken); !found {
+				t.Fatalf("\t%s\tShould list the deleted product for an admin asking for it.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould list the deleted product for an admin asking for it.", tests.Success)
+
+			if code, _ := listed("?include_deleted=true", pt.userOnly); code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for a regular user : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for a regular user.", tests.Success)
+
+			r := httptest.NewRequest("POST", "/v1/products/"+p.ID+"/restore", nil)
+			w := httptest.NewRecorder()
+			r.Header.Set("Authorization", "Bearer "+pt.userOnly)
+			pt.app.ServeHTTP(w, r)
+
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould NOT allow a regular user to restore : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould NOT allow a regular user to restore.", tests.Success)
+
+			r = httptest.NewRequest("POST", "/v1/products/"+p.ID+"/restore", nil)
+			w = httptest.NewRecorder()
+			r.Header.Set("Authorization", "Bearer "+pt.userToken)
+			pt.app.ServeHTTP(w, r)
+
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the restore : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the restore.", tests.Success)
+
+			pt.getProduct200(t, p.ID)
+		}
+	}
+}
+
+// inventoryProduct validates stock can be adjusted and reserved through the
+// api without overselling.
+func (pt *ProductTests) inventoryProduct(t *testing.T) {
+	p := pt.postProduct201(t)
+	defer pt.deleteProduct204(t, p.ID)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+pt.userToken)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to manage the stock of a product.")
+	{
+		t.Logf("\tTest 0:\tWhen using the new product %s.", p.ID)
+		{
+			w := send("POST", "/v1/products/"+p.ID+"/inventory", `{"kind": "receive", "quantity": 10, "reason": "Delivery"}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the adjustment : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for the adjustment.", tests.Success)
+
+			w = send("POST", "/v1/products/"+p.ID+"/inventory", `{"kind": "sale", "quantity": 1, "reason": "Sold"}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for an unknown kind : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for an unknown kind.", tests.Success)
+
+			w = send("POST", "/v1/products/"+p.ID+"/reservations", `{"quantity": 70}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the reservation : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for the reservation.", tests.Success)
+
+			var r product.Movement
+			if err := json.NewDecoder(w.Body).Decode(&r); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+
+			w = send("POST", "/v1/products/"+p.ID+"/reservations", `{"quantity": 1}`)
+			if w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould receive a status code of 409 when stock runs out : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 409 when stock runs out.", tests.Success)
+
+			w = send("PUT", "/v1/products/"+p.ID, `{"quantity": 10}`)
+			if w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould receive a status code of 409 for a quantity below the reserved stock : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 409 for a quantity below the reserved stock.", tests.Success)
+
+			w = send("DELETE", "/v1/products/"+p.ID+"/reservations/"+r.ID, "")
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the release : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the release.", tests.Success)
+
+			w = send("GET", "/v1/products/"+p.ID+"/inventory", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the ledger : %v", tests.Failed, w.Code)
+			}
+
+			var ms []product.Movement
+			if err := json.NewDecoder(w.Body).Decode(&ms); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(ms) != 4 {
+				t.Fatalf("\t%s\tShould get back every movement : got %d.", tests.Failed, len(ms))
+			}
+			t.Logf("\t%s\tShould get back every movement.", tests.Success)
+		}
+	}
+}
+
+// refundProduct validates a seeded sale can be refunded by an admin and the
+// refund is netted out of the product aggregates.
+func (pt *ProductTests) refundProduct(t *testing.T) {
+	const (
+		productID = "a2b0639f-2cc6-44b8-b97b-15d69dbb511e"
+		saleID    = "98b6d4b8-f04b-4c79-8c2e-a0aef46854b7"
+	)
+
+	send := func(token, method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to refund a sale.")
+	{
+		t.Logf("\tTest 0:\tWhen refunding the sale %s.", saleID)
+		{
+			url := "/v1/products/" + productID + "/sales/" + saleID + "/refunds"
+
+			w := send(pt.userOnly, "POST", url, `{"quantity": 1, "amount": 50, "restock": true, "reason": "Damaged"}`)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for someone else's product : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for someone else's product.", tests.Success)
+
+			w = send(pt.userToken, "POST", url, `{"quantity": 3, "amount": 50, "reason": "Damaged"}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for refunding too much : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for refunding too much.", tests.Success)
+
+			w = send(pt.userToken, "POST", url, `{"quantity": 1, "amount": 50, "restock": true, "reason": "Damaged"}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the refund : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for the refund.", tests.Success)
+
+			w = send(pt.userToken, "GET", "/v1/products/"+productID, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the product : %v", tests.Failed, w.Code)
+			}
+
+			var p product.Product
+			if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if p.Sold != 6 || p.Revenue != 300 {
+				t.Fatalf("\t%s\tShould net out the refund : got %d sold for %d", tests.Failed, p.Sold, p.Revenue)
+			}
+			t.Logf("\t%s\tShould net out the refund.", tests.Success)
+
+			w = send(pt.userToken, "GET", "/v1/products/"+productID+"/refunds", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the refunds : %v", tests.Failed, w.Code)
+			}
+
+			var rs []product.Refund
+			if err := json.NewDecoder(w.Body).Decode(&rs); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(rs) != 1 || rs[0].SaleID != saleID {
+				t.Fatalf("\t%s\tShould get back the refund : %+v", tests.Failed, rs)
+			}
+			t.Logf("\t%s\tShould get back the refund.", tests.Success)
+		}
+	}
+}
+
+// revenueProduct validates products are priced in a supported currency and
+// revenue is reported per currency to admins.
+func (pt *ProductTests) revenueProduct(t *testing.T) {
+	send := func(token, method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to report revenue per currency.")
+	{
+		t.Log("\tTest 0:\tWhen creating a product in an unknown currency.")
+		{
+			w := send(pt.userToken, "POST", "/v1/products", `{"name": "clogs", "cost": 100, "quantity": 5, "currency": "XXX"}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen fetching the revenue.")
+		{
+			w := send(pt.userOnly, "GET", "/v1/revenue", "")
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for a non-admin : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for a non-admin.", tests.Success)
+
+			w = send(pt.userToken, "GET", "/v1/revenue", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var revenue []money.Money
+			if err := json.NewDecoder(w.Body).Decode(&revenue); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(revenue) != 1 || revenue[0].Currency != "USD" || revenue[0].Amount <= 0 {
+				t.Fatalf("\t%s\tShould report the seeded sales in USD : got %+v", tests.Failed, revenue)
+			}
+			t.Logf("\t%s\tShould report the seeded sales in USD.", tests.Success)
+		}
+	}
+}
+
+// saleProduct validates sales are priced by the server and paying less needs
+// permission.
+func (pt *ProductTests) saleProduct(t *testing.T) {
+	const productID = "72f8b983-3eb4-48db-9ed0-e45cc6bd716b"
+
+	send := func(token, method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to sell a product at its price.")
+	{
+		t.Logf("\tTest 0:\tWhen quoting the product %s.", productID)
+		{
+			w := send(pt.userOnly, "POST", "/v1/products/"+productID+"/quote", `{"quantity": 2}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+
+			var q product.Quote
+			if err := json.NewDecoder(w.Body).Decode(&q); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if q.Price != 150 {
+				t.Fatalf("\t%s\tShould quote 2 items at 150 : got %d", tests.Failed, q.Price)
+			}
+			t.Logf("\t%s\tShould quote the price of the product.", tests.Success)
+		}
+
+		t.Logf("\tTest 1:\tWhen selling the product %s.", productID)
+		{
+			url := "/v1/products/" + productID + "/sales"
+
+			w := send(pt.userOnly, "POST", url, `{"quantity": 1, "paid": 10}`)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for paying below the price : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for paying below the price.", tests.Success)
+
+			w = send(pt.userOnly, "POST", url, `{"quantity": 1, "paid": 75}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for paying the price : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for paying the price.", tests.Success)
+
+			w = send(pt.userToken, "POST", url, `{"quantity": 1, "paid": 10}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for an admin override : %v", tests.Failed, w.Code)
+			}
+
+			var sale product.Sale
+			if err := json.NewDecoder(w.Body).Decode(&sale); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(sale.Rules) != 1 || sale.Rules[0].Rule != product.RuleOverride || sale.Rules[0].Amount != 65 {
+				t.Fatalf("\t%s\tShould record the override : %+v", tests.Failed, sale.Rules)
+			}
+			t.Logf("\t%s\tShould let an admin override the price.", tests.Success)
+		}
+	}
+}
+
+// categoryProduct validates admins manage categories and products can be
+// listed by category and tag.
+func (pt *ProductTests) categoryProduct(t *testing.T) {
+	send := func(token, method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to organize products in categories.")
+	{
+		var c product.Category
+
+		t.Log("\tTest 0:\tWhen creating a category.")
+		{
+			body := `{"name": "Bikes", "schema": [{"name": "gears", "type": "number", "required": true}]}`
+
+			w := send(pt.userOnly, "POST", "/v1/categories", body)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for a non-admin : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for a non-admin.", tests.Success)
+
+			w = send(pt.userToken, "POST", "/v1/categories", body)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the response : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for the response.", tests.Success)
+		}
+
+		t.Logf("\tTest 1:\tWhen creating a product in the category %s.", c.ID)
+		{
+			w := send(pt.userOnly, "POST", "/v1/products", `{"name": "bmx", "cost": 200, "quantity": 2, "category_id": "`+c.ID+`", "attributes": {"gears": "one"}}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for invalid attributes : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for invalid attributes.", tests.Success)
+
+			w = send(pt.userOnly, "POST", "/v1/products", `{"name": "bmx", "cost": 200, "quantity": 2, "category_id": "`+c.ID+`", "attributes": {"gears": 1}, "tags": ["Kids"]}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for the response.", tests.Success)
+		}
+
+		t.Logf("\tTest 2:\tWhen listing the products of the category %s.", c.ID)
+		{
+			w := send(pt.userOnly, "GET", "/v1/products?category="+c.ID+"&tag=kids", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+
+			var list []product.Product
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(list) != 1 || list[0].Name != "bmx" || list[0].Attributes["gears"] != 1.0 {
+				t.Fatalf("\t%s\tShould list the product of the category : got %+v", tests.Failed, list)
+			}
+			t.Logf("\t%s\tShould list the product of the category.", tests.Success)
+		}
+
+		t.Logf("\tTest 3:\tWhen deleting the category %s.", c.ID)
+		{
+			w := send(pt.userToken, "DELETE", "/v1/categories/"+c.ID, "")
+			if w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould receive a status code of 409 for a category in use : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 409 for a category in use.", tests.Success)
+		}
+	}
+}
+
+// searchProduct validates products can be searched by the words of their
+// names.
+func (pt *ProductTests) searchProduct(t *testing.T) {
+	send := func(url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+pt.userOnly)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to search products.")
+	{
+		t.Log("\tTest 0:\tWhen searching without words.")
+		{
+			w := send("/v1/products/search?q=")
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen searching for the start of a word.")
+		{
+			w := send("/v1/products/search?q=comi")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var res product.SearchResult
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if res.Total != 1 || res.Hits[0].Product.Name != "Comic Books" || res.Hits[0].Snippet != "<b>Comic</b> Books" {
+				t.Fatalf("\t%s\tShould find the seeded comic books : got %+v", tests.Failed, res)
+			}
+			t.Logf("\t%s\tShould find the seeded comic books.", tests.Success)
+		}
+	}
+}
+
+// imageProduct validates images can be uploaded to a product, downloaded and
+// deleted.
+func (pt *ProductTests) imageProduct(t *testing.T) {
+	const productID = "a2b0639f-2cc6-44b8-b97b-15d69dbb511e"
+	url := "/v1/products/" + productID + "/images"
+
+	upload := func(name string, data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("image", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+		mw.Close()
+
+		r := httptest.NewRequest("POST", url, &body)
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", "Bearer "+pt.userToken)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	send := func(method, url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+pt.userToken)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to keep images of products.")
+	{
+		var img media.Image
+
+		t.Logf("\tTest 0:\tWhen uploading to the product %s.", productID)
+		{
+			w := upload("notes.txt", []byte("not an image"))
+			if w.Code != http.StatusUnsupportedMediaType {
+				t.Fatalf("\t%s\tShould receive a status code of 415 for text : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 415 for text.", tests.Success)
+
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 300, 300))); err != nil {
+				t.Fatal(err)
+			}
+
+			w = upload("comics.png", buf.Bytes())
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the response : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&img); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if img.Name != "comics.png" || img.ContentType != "image/png" || img.Width != 300 {
+				t.Fatalf("\t%s\tShould describe the uploaded image : %+v", tests.Failed, img)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 for the response.", tests.Success)
+		}
+
+		t.Logf("\tTest 1:\tWhen downloading the image %s.", img.ID)
+		{
+			w := send("GET", url+"/"+img.ID+"/thumbnail")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			cfg, err := png.DecodeConfig(w.Body)
+			if err != nil || w.Header().Get("Content-Type") != "image/png" || cfg.Width != media.ThumbnailMax {
+				t.Fatalf("\t%s\tShould receive the thumbnail : %+v : %v", tests.Failed, cfg, err)
+			}
+			t.Logf("\t%s\tShould receive the thumbnail.", tests.Success)
+		}
+
+		t.Logf("\tTest 2:\tWhen deleting the image %s.", img.ID)
+		{
+			if w := send("DELETE", url+"/"+img.ID); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			if w := send("GET", url+"/"+img.ID); w.Code != http.StatusNotFound {
+				t.Fatalf("\t%s\tShould receive a status code of 404 after deleting : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 404 after deleting.", tests.Success)
+		}
+	}
+}
+
+// bulkProduct validates products can be imported from CSV and NDJSON and
+// exported again.
+func (pt *ProductTests) bulkProduct(t *testing.T) {
+	send := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+pt.userToken)
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	const data = "name,cost,quantity,tags\n" +
+		"Bulk Kettles,1500,10,bulk\n" +
+		"Bulk Toasters,abc,1,bulk\n"
+
+	t.Log("Given the need to import and export products in bulk.")
+	{
+		t.Log("\tTest 0:\tWhen importing a file with unknown columns.")
+		{
+			w := send("POST", "/v1/products/import", "text/csv", "name,price\nKettles,10\n")
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen importing a file with an invalid row atomically.")
+		{
+			w := send("POST", "/v1/products/import?atomic=true", "text/csv", data)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("\t%s\tShould receive a status code of 422 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 422 for the response.", tests.Success)
+
+			var res product.ImportResult
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if res.Created != 0 || res.Failed != 1 || res.Rows[1].Error == "" {
+				t.Fatalf("\t%s\tShould report the invalid row and keep nothing : got %+v", tests.Failed, res)
+			}
+			t.Logf("\t%s\tShould report the invalid row and keep nothing.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen importing NDJSON on a best-effort basis.")
+		{
+			body := `{"name":"Bulk Kettles","cost":1500,"quantity":10,"tags":["bulk"]}` + "\n" +
+				`{"name":"Bulk Toasters","cost":-1,"quantity":1}` + "\n"
+			w := send("POST", "/v1/products/import?format=ndjson", "", body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var res product.ImportResult
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if res.Created != 1 || res.Failed != 1 || res.Rows[0].ID == "" {
+				t.Fatalf("\t%s\tShould keep the valid row : got %+v", tests.Failed, res)
+			}
+			t.Logf("\t%s\tShould keep the valid row.", tests.Success)
+		}
+
+		t.Log("\tTest 3:\tWhen exporting the imported products.")
+		{
+			w := send("GET", "/v1/products/export?tag=bulk", "", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			want := "name,cost,currency,quantity,category_id,tags,attributes\n" +
+				"Bulk Kettles,1500,USD,10,,bulk,\n"
+			if got := w.Body.String(); got != want {
+				t.Fatalf("\t%s\tShould export the products as CSV : got %q", tests.Failed, got)
+			}
+			t.Logf("\t%s\tShould export the products as CSV.", tests.Success)
+
+			if w := send("GET", "/v1/products/export?format=xml", "", ""); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for an unknown format : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for an unknown format.", tests.Success)
+		}
+	}
+}
+
+// reportProduct validates admins can report on the sales recorded by the
+// other subtests as JSON or CSV.
+func (pt *ProductTests) reportProduct(t *testing.T) {
+	send := func(url, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to report on sales.")
+	{
+		if err := pt.reports.Refresh(context.Background(), time.Time{}); err != nil {
+			t.Fatalf("\t%s\tShould be able to refresh the reports : %v", tests.Failed, err)
+		}
+
+		t.Log("\tTest 0:\tWhen a user who is not an admin asks for a report.")
+		{
+			w := send("/v1/reports/sales", pt.userOnly)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for the response.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen asking for a report with bad parameters.")
+		{
+			for _, url := range []string{
+				"/v1/reports/sales?tz=Nowhere/Special",
+				"/v1/reports/sales?tz=Asia/Kolkata",
+				"/v1/reports/sales?from=2019-01-01T10:30:00Z&to=2019-01-02T00:00:00Z",
+				"/v1/reports/sales?from=2019-02-01&to=2019-01-01",
+				"/v1/reports/sales?interval=year",
+				"/v1/reports/top-products?limit=many",
+				"/v1/reports/prices?format=xml",
+			} {
+				if w := send(url, pt.userToken); w.Code != http.StatusBadRequest {
+					t.Fatalf("\t%s\tShould receive a status code of 400 for %s : %v", tests.Failed, url, w.Code)
+				}
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for the responses.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen asking for the top products.")
+		{
+			w := send("/v1/reports/top-products?tz=America/New_York&by=revenue", pt.userToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var top []report.ProductTotal
+			if err := json.NewDecoder(w.Body).Decode(&top); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(top) == 0 || top[0].Units == 0 {
+				t.Fatalf("\t%s\tShould include the recent sales : got %+v", tests.Failed, top)
+			}
+			t.Logf("\t%s\tShould include the recent sales.", tests.Success)
+		}
+
+		t.Log("\tTest 3:\tWhen exporting a report as CSV.")
+		{
+			w := send("/v1/reports/owners?format=csv", pt.userToken)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+				t.Fatalf("\t%s\tShould receive CSV : got %q", tests.Failed, ct)
+			}
+			lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			if lines[0] != "user_id,currency,products,units,revenue" || len(lines) < 2 {
+				t.Fatalf("\t%s\tShould receive a header and the owners : got %q", tests.Failed, lines)
+			}
+			t.Logf("\t%s\tShould receive a header and the owners.", tests.Success)
+		}
+	}
+}
+
+// historyProduct validates every change of a product is kept and the product
+// can be retrieved as it was at a time.
+func (pt *ProductTests) historyProduct(t *testing.T) {
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+pt.userToken)
+
+		pt.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to know the past values of a product.")
+	{
+		w := send("POST", "/v1/products", `{"name": "Puzzles", "cost": 30, "quantity": 5}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("\t%s\tShould receive a status code of 201 for the response : %v", tests.Failed, w.Code)
+		}
+		var p product.Product
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+		}
+
+		if w := send("PUT", "/v1/products/"+p.ID, `{"cost": 45}`); w.Code != http.StatusNoContent {
+			t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+		}
+
+		t.Logf("\tTest 0:\tWhen listing the history of product %s.", p.ID)
+		{
+			w := send("GET", "/v1/products/"+p.ID+"/history", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var versions []product.Version
+			if err := json.NewDecoder(w.Body).Decode(&versions); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(versions) != 2 || versions[0].Cost != 30 || versions[1].Cost != 45 {
+				t.Fatalf("\t%s\tShould get a version for every change : got %+v", tests.Failed, versions)
+			}
+			t.Logf("\t%s\tShould get a version for every change.", tests.Success)
+		}
+
+		t.Logf("\tTest 1:\tWhen retrieving product %s as of its creation.", p.ID)
+		{
+			w := send("GET", "/v1/products/"+p.ID+"?as_of="+p.DateCreated.Format(time.RFC3339Nano), "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			var v product.Version
+			if err := json.NewDecoder(w.Body).Decode(&v); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if v.Version != 1 || v.Cost != 30 {
+				t.Fatalf("\t%s\tShould get the first version : got %+v", tests.Failed, v)
+			}
+			t.Logf("\t%s\tShould get the first version.", tests.Success)
+		}
+
+		t.Logf("\tTest 2:\tWhen retrieving product %s as of a bad time.", p.ID)
+		{
+			if w := send("GET", "/v1/products/"+p.ID+"?as_of=yesterday", ""); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for the response.", tests.Success)
+
+			if w := send("GET", "/v1/products/"+p.ID+"?as_of=2000-01-01T00:00:00Z", ""); w.Code != http.StatusNotFound {
+				t.Fatalf("\t%s\tShould receive a status code of 404 before the product existed : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 404 before the product existed.", tests.Success)
+		}
+	}
+}
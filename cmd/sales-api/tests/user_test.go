@@ -8,9 +8,13 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ardanlabs/service/cmd/sales-api/internal/handlers"
+	"github.com/ardanlabs/service/internal/mid"
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/notify"
+	"github.com/ardanlabs/service/internal/platform/totp"
 	"github.com/ardanlabs/service/internal/platform/web"
 	"github.com/ardanlabs/service/internal/tests"
 	"github.com/ardanlabs/service/internal/user"
@@ -23,11 +27,32 @@ func TestUsers(t *testing.T) {
 	test := tests.NewIntegration(t)
 	defer test.Teardown()
 
+	runUserTests(t, test)
+}
+
+// TestUsersMemory runs the same subtests as TestUsers against the in-memory
+// stores so they do not require a database.
+func TestUsersMemory(t *testing.T) {
+	test := tests.NewMemory(t)
+	defer test.Teardown()
+
+	runUserTests(t, test)
+}
+
+// signupLimit is how many signups and verification requests the user tests
+// can make from their address.
+const signupLimit = 3
+
+// runUserTests registers the user subtests for the application built from the
+// provided test state.
+func runUserTests(t *testing.T, test *tests.Test) {
 	shutdown := make(chan os.Signal, 1)
 	tests := UserTests{
-		app:        handlers.API(shutdown, test.Log, test.DB, test.Authenticator),
-		userToken:  test.Token("user@example.com", "gophers"),
-		adminToken: test.Token("admin@example.com", "gophers"),
+		app:           handlers.API(shutdown, test.Log, test.DB, test.Authenticator, test.Products, test.Users, test.Orders, test.Images, test.Reports, test.Notifier, mid.NewLimiter(signupLimit, time.Hour), mid.NewLimiter(100, time.Hour), nil),
+		userToken:     test.Token("user@example.com", "gophers"),
+		adminToken:    test.Token("admin@example.com", "gophers"),
+		authenticator: test.Authenticator,
+		notifier:      test.Notifier,
 	}
 
 	t.Run("getToken401", tests.getToken401)
@@ -35,21 +60,32 @@ func TestUsers(t *testing.T) {
 	t.Run("postUser400", tests.postUser400)
 	t.Run("postUser401", tests.postUser401)
 	t.Run("postUser403", tests.postUser403)
+	t.Run("postUser409", tests.postUser409)
 	t.Run("getUser400", tests.getUser400)
 	t.Run("getUser403", tests.getUser403)
 	t.Run("getUser404", tests.getUser404)
 	t.Run("deleteUserNotFound", tests.deleteUserNotFound)
 	t.Run("putUser404", tests.putUser404)
 	t.Run("crudUsers", tests.crudUser)
+	t.Run("resetPassword", tests.resetPassword)
+	t.Run("unlockUser", tests.unlockUser)
+	t.Run("mfaLogin", tests.mfaLogin)
+	t.Run("signup", tests.signup)
+	t.Run("apiKeys", tests.apiKeys)
+	t.Run("disableUser", tests.disableUser)
+	t.Run("me", tests.me)
+	t.Run("roleSafeguards", tests.roleSafeguards)
 }
 
 // UserTests holds methods for each user subtest. This type allows passing
 // dependencies for tests while still providing a convenient syntax when
 // subtests are registered.
 type UserTests struct {
-	app        http.Handler
-	userToken  string
-	adminToken string
+	app           http.Handler
+	userToken     string
+	adminToken    string
+	authenticator *auth.Authenticator
+	notifier      *notify.Memory
 }
 
 // getToken401 ensures an unknown user can't generate a token.
@@ -215,6 +251,55 @@ func (ut *UserTests) postUser403(t *testing.T) {
 	}
 }
 
+// postUser409 validates a user can't be created with the email of another
+// user, whatever its case.
+func (ut *UserTests) postUser409(t *testing.T) {
+	body, err := json.Marshal(&user.NewUser{
+		Name:            "Admin Again",
+		Email:           " Admin@Example.com",
+		Roles:           []string{auth.RoleUser},
+		Password:        "gophers",
+		PasswordConfirm: "gophers",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/v1/users", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	r.Header.Set("Authorization", "Bearer "+ut.adminToken)
+
+	ut.app.ServeHTTP(w, r)
+
+	t.Log("Given the need to validate a new user can't take the email of another user.")
+	{
+		t.Log("\tTest 0:\tWhen using the email of the admin in another case.")
+		{
+			if w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould receive a status code of 409 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 409 for the response.", tests.Success)
+
+			var got web.ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response to an error type : %v", tests.Failed, err)
+			}
+
+			want := web.ErrorResponse{
+				Error: user.ErrEmailTaken.Error(),
+				Fields: []web.FieldError{
+					{Field: "email", Error: user.ErrEmailTaken.Error()},
+				},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("\t%s\tShould get the error for the email field. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould get the error for the email field.", tests.Success)
+		}
+	}
+}
+
 // getUser400 validates a user request for a malformed userid.
 func (ut *UserTests) getUser400(t *testing.T) {
 	id := "12345"
@@ -585,3 +670,766 @@ func (ut *UserTests) putUser403(t *testing.T, id string) {
 		}
 	}
 }
+
+// resetPassword validates a user can replace a forgotten password with a
+// token sent to them and that doing so revokes their older tokens.
+func (ut *UserTests) resetPassword(t *testing.T) {
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	body := `{"name": "Rob Gopher", "email": "rob@example.com", "roles": ["USER"], "password": "gophers", "password_confirm": "gophers"}`
+	w := send("POST", "/v1/users", ut.adminToken, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("\t%s\tShould be able to create a user : %v", tests.Failed, w.Code)
+	}
+	var u user.User
+	if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+		t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+	}
+	defer ut.deleteUser204(t, u.ID)
+
+	// Tokens only record the second they were issued in so this one is made
+	// well before the reset.
+	old, err := ut.authenticator.GenerateToken(auth.NewClaims(u.ID, u.Roles, time.Now().Add(-time.Minute), time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("Given the need to reset a forgotten password.")
+	{
+		t.Log("\tTest 0:\tWhen requesting a reset.")
+		{
+			sent := len(ut.notifier.Messages())
+
+			w := send("POST", "/v1/users/password-reset", "", `{"email": "nobody@example.com"}`)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for an unknown email : %v", tests.Failed, w.Code)
+			}
+			if len(ut.notifier.Messages()) != sent {
+				t.Fatalf("\t%s\tShould send nothing for an unknown email.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould respond the same way for an unknown email and send nothing.", tests.Success)
+
+			w = send("POST", "/v1/users/password-reset", "", `{"email": "rob@example.com"}`)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			msgs := ut.notifier.Messages()
+			if len(msgs) != sent+1 || msgs[sent].To != "rob@example.com" {
+				t.Fatalf("\t%s\tShould send a token to the user : got %+v", tests.Failed, msgs)
+			}
+			t.Logf("\t%s\tShould send a token to the user.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen confirming a reset.")
+		{
+			msgs := ut.notifier.Messages()
+			parts := strings.Split(msgs[len(msgs)-1].Body, "\n\n")
+			if len(parts) < 3 {
+				t.Fatalf("\t%s\tShould find the token in the message : %q", tests.Failed, msgs[len(msgs)-1].Body)
+			}
+			token := parts[2]
+
+			w := send("POST", "/v1/users/password-reset/confirm", "", `{"token": "unknown", "password": "channels", "password_confirm": "channels"}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for an unknown token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for an unknown token.", tests.Success)
+
+			body := `{"token": "` + token + `", "password": "channels", "password_confirm": "channels"}`
+			if w := send("POST", "/v1/users/password-reset/confirm", "", body); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if w := send("POST", "/v1/users/password-reset/confirm", "", body); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for a used token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for a used token.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen using tokens after the reset.")
+		{
+			if w := send("GET", "/v1/users/"+u.ID, old, ""); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 for a token issued before the reset : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 for a token issued before the reset.", tests.Success)
+
+			r := httptest.NewRequest("GET", "/v1/users/token", nil)
+			r.SetBasicAuth("rob@example.com", "channels")
+			w := httptest.NewRecorder()
+			ut.app.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould get a token with the new password : %v", tests.Failed, w.Code)
+			}
+			var got struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if w := send("GET", "/v1/users/"+u.ID, got.Token, ""); w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for a new token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould accept a token issued after the reset.", tests.Success)
+		}
+	}
+}
+
+// unlockUser validates failed logins delay the next attempt and that admins
+// can unlock the user.
+func (ut *UserTests) unlockUser(t *testing.T) {
+	login := func(password string) int {
+		r := httptest.NewRequest("GET", "/v1/users/token", nil)
+		r.SetBasicAuth("ken@example.com", password)
+		w := httptest.NewRecorder()
+		ut.app.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	body := `{"name": "Ken Gopher", "email": "ken@example.com", "roles": ["USER"], "password": "gophers", "password_confirm": "gophers"}`
+	w := send("POST", "/v1/users", ut.adminToken, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("\t%s\tShould be able to create a user : %v", tests.Failed, w.Code)
+	}
+	var u user.User
+	if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+		t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+	}
+	defer ut.deleteUser204(t, u.ID)
+
+	t.Log("Given the need to slow down password guessing.")
+	{
+		t.Log("\tTest 0:\tWhen logging in right after a wrong password.")
+		{
+			if code := login("wrong"); code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 for a wrong password : %v", tests.Failed, code)
+			}
+			if code := login("gophers"); code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 until the delay passed : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 until the delay passed.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen an admin unlocks the user.")
+		{
+			if w := send("POST", "/v1/users/"+u.ID+"/unlock", ut.userToken, ""); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for a user who is not an admin : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for a user who is not an admin.", tests.Success)
+
+			if w := send("POST", "/v1/users/"+u.ID+"/unlock", ut.adminToken, ""); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if code := login("gophers"); code != http.StatusOK {
+				t.Fatalf("\t%s\tShould be able to log in right away : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould be able to log in right away.", tests.Success)
+
+			w := send("GET", "/v1/users/"+u.ID, ut.adminToken, "")
+			var got user.User
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if got.LastLogin == nil {
+				t.Fatalf("\t%s\tShould record the last login.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould record the last login.", tests.Success)
+		}
+	}
+}
+
+// mfaLogin validates a user can enroll in two-factor authentication and then
+// needs a code to get a token.
+func (ut *UserTests) mfaLogin(t *testing.T) {
+	login := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/v1/users/token", nil)
+		r.SetBasicAuth("grace@example.com", "gophers")
+		w := httptest.NewRecorder()
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	var tkn struct {
+		Token    string `json:"token"`
+		MFAToken string `json:"mfa_token"`
+	}
+
+	body := `{"name": "Grace Gopher", "email": "grace@example.com", "roles": ["USER"], "password": "gophers", "password_confirm": "gophers"}`
+	w := send("POST", "/v1/users", ut.adminToken, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("\t%s\tShould be able to create a user : %v", tests.Failed, w.Code)
+	}
+	var u user.User
+	if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+		t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+	}
+	defer ut.deleteUser204(t, u.ID)
+
+	if err := json.NewDecoder(login().Body).Decode(&tkn); err != nil || tkn.Token == "" {
+		t.Fatalf("\t%s\tShould be able to log in : %v", tests.Failed, err)
+	}
+	token := tkn.Token
+
+	t.Log("Given the need to require a second factor to log in.")
+	{
+		var codes user.RecoveryCodes
+		t.Log("\tTest 0:\tWhen enrolling.")
+		{
+			if w := send("POST", "/v1/users/"+u.ID+"/mfa", ut.adminToken, ""); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for someone else : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for someone else.", tests.Success)
+
+			w := send("POST", "/v1/users/"+u.ID+"/mfa", token, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			var e user.MFAEnrollment
+			if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 for the response.", tests.Success)
+
+			if w := send("POST", "/v1/users/"+u.ID+"/mfa/confirm", token, `{"code": "abc"}`); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for a wrong code : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for a wrong code.", tests.Success)
+
+			code, err := totp.Code(e.Secret, totp.Step(time.Now()))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to generate a code : %v", tests.Failed, err)
+			}
+			w = send("POST", "/v1/users/"+u.ID+"/mfa/confirm", token, `{"code": "`+code+`"}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&codes); err != nil || len(codes.Codes) == 0 {
+				t.Fatalf("\t%s\tShould receive recovery codes : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould receive recovery codes.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen logging in.")
+		{
+			w := login()
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			tkn.Token, tkn.MFAToken = "", ""
+			if err := json.NewDecoder(w.Body).Decode(&tkn); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if tkn.Token != "" || tkn.MFAToken == "" {
+				t.Fatalf("\t%s\tShould only receive an mfa_token : %+v", tests.Failed, tkn)
+			}
+			t.Logf("\t%s\tShould only receive an mfa_token.", tests.Success)
+
+			if w := send("GET", "/v1/users/"+u.ID, tkn.MFAToken, ""); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 using the mfa_token elsewhere : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 using the mfa_token elsewhere.", tests.Success)
+
+			if w := send("POST", "/v1/users/token/mfa", token, `{"code": "`+codes.Codes[0]+`"}`); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 without an mfa_token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 without an mfa_token.", tests.Success)
+
+			w = send("POST", "/v1/users/token/mfa", tkn.MFAToken, `{"code": "`+codes.Codes[0]+`"}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for a recovery code : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&tkn); err != nil || tkn.Token == "" {
+				t.Fatalf("\t%s\tShould receive a token : %v", tests.Failed, err)
+			}
+			if w := send("GET", "/v1/users/"+u.ID, tkn.Token, ""); w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould be able to use the token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a token for a recovery code.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen disabling.")
+		{
+			if w := send("DELETE", "/v1/users/"+u.ID+"/mfa", tkn.Token, ""); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+		}
+	}
+}
+
+// signup validates people can sign up themselves and log in once they
+// verified their email.
+func (ut *UserTests) signup(t *testing.T) {
+	login := func() int {
+		r := httptest.NewRequest("GET", "/v1/users/token", nil)
+		r.SetBasicAuth("ada@example.com", "gophers")
+		w := httptest.NewRecorder()
+		ut.app.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	post := func(url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to let people sign up themselves.")
+	{
+		var v user.Verification
+		t.Log("\tTest 0:\tWhen signing up.")
+		{
+			body := `{"name": "Ada Gopher", "email": "ada@example.com", "password": "gophers", "password_confirm": "gophers"}`
+			w := post("/v1/users/signup", body)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the response : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&v); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			defer ut.deleteUser204(t, v.UserID)
+			t.Logf("\t%s\tShould receive a status code of 201 for the response.", tests.Success)
+
+			if code := login(); code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 logging in before verifying : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 logging in before verifying.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen verifying the email.")
+		{
+			if w := post("/v1/users/verify/resend", `{"email": "ada@example.com"}`); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 asking for another token : %v", tests.Failed, w.Code)
+			}
+			msgs := ut.notifier.Messages()
+			if len(msgs) < 2 || msgs[len(msgs)-1].To != "ada@example.com" || msgs[len(msgs)-2].To != "ada@example.com" {
+				t.Fatalf("\t%s\tShould send a token for the signup and the request : %+v", tests.Failed, msgs)
+			}
+			t.Logf("\t%s\tShould send a token for the signup and the request.", tests.Success)
+
+			if w := post("/v1/users/verify", `{"token": "unknown"}`); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for an unknown token : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for an unknown token.", tests.Success)
+
+			parts := strings.Split(msgs[len(msgs)-1].Body, "\n\n")
+			if len(parts) < 3 {
+				t.Fatalf("\t%s\tShould send the token : %q", tests.Failed, msgs[len(msgs)-1].Body)
+			}
+			if w := post("/v1/users/verify", `{"token": "`+parts[2]+`"}`); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if code := login(); code != http.StatusOK {
+				t.Fatalf("\t%s\tShould be able to log in once verified : %v", tests.Failed, code)
+			}
+			t.Logf("\t%s\tShould be able to log in once verified.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen signing up too often.")
+		{
+			for i := 2; i < signupLimit; i++ {
+				if w := post("/v1/users/verify/resend", `{"email": "nobody@example.com"}`); w.Code != http.StatusNoContent {
+					t.Fatalf("\t%s\tShould receive a status code of 204 within the limit : %v", tests.Failed, w.Code)
+				}
+			}
+			w := post("/v1/users/signup", `{"name": "Eve", "email": "eve@example.com", "password": "gophers", "password_confirm": "gophers"}`)
+			if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+				t.Fatalf("\t%s\tShould receive a status code of 429 with Retry-After : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 429 with Retry-After.", tests.Success)
+		}
+	}
+}
+
+// apiKeys validates a user can create an API key and use it in place of a
+// token until it is revoked.
+func (ut *UserTests) apiKeys(t *testing.T) {
+	send := func(method, url, scheme, credential, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", scheme+" "+credential)
+
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	body := `{"name": "Lee Gopher", "email": "lee@example.com", "roles": ["USER"], "password": "gophers", "password_confirm": "gophers"}`
+	w := send("POST", "/v1/users", "Bearer", ut.adminToken, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("\t%s\tShould be able to create a user : %v", tests.Failed, w.Code)
+	}
+	var u user.User
+	if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+		t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+	}
+	defer ut.deleteUser204(t, u.ID)
+
+	r := httptest.NewRequest("GET", "/v1/users/token", nil)
+	r.SetBasicAuth("lee@example.com", "gophers")
+	w = httptest.NewRecorder()
+	ut.app.ServeHTTP(w, r)
+	var tkn struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&tkn); err != nil {
+		t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+	}
+
+	t.Log("Given the need to authenticate machine clients with API keys.")
+	{
+		var k user.APIKey
+		t.Log("\tTest 0:\tWhen creating a key.")
+		{
+			if w := send("POST", "/v1/users/"+u.ID+"/keys", "Bearer", tkn.Token, `{"name": "ci", "scopes": ["ADMIN"]}`); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for a scope the user lacks : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for a scope the user lacks.", tests.Success)
+
+			if w := send("POST", "/v1/users/"+u.ID+"/keys", "Bearer", ut.userToken, `{"name": "ci", "scopes": ["USER"]}`); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for someone else : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for someone else.", tests.Success)
+
+			w := send("POST", "/v1/users/"+u.ID+"/keys", "Bearer", tkn.Token, `{"name": "ci", "scopes": ["USER"]}`)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould receive a status code of 201 for the response : %v", tests.Failed, w.Code)
+			}
+			if err := json.NewDecoder(w.Body).Decode(&k); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if k.Key == "" {
+				t.Fatalf("\t%s\tShould get the full key.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould receive a status code of 201 with the full key.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen using the key.")
+		{
+			if w := send("GET", "/v1/users/"+u.ID, "ApiKey", k.Key, ""); w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 with the key : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 200 with the key.", tests.Success)
+
+			if w := send("POST", "/v1/users/"+u.ID+"/keys", "ApiKey", k.Key, `{"name": "more", "scopes": ["USER"]}`); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 creating a key with a key : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 creating a key with a key.", tests.Success)
+
+			w := send("GET", "/v1/users/"+u.ID+"/keys", "Bearer", tkn.Token, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 listing keys : %v", tests.Failed, w.Code)
+			}
+			var keys []user.APIKey
+			if err := json.NewDecoder(w.Body).Decode(&keys); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(keys) != 1 || keys[0].ID != k.ID || keys[0].Key != "" || keys[0].LastUsed == nil {
+				t.Fatalf("\t%s\tShould list the key without its secret : got %+v", tests.Failed, keys)
+			}
+			t.Logf("\t%s\tShould list the key without its secret.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen revoking the key.")
+		{
+			if w := send("DELETE", "/v1/users/"+u.ID+"/keys/"+k.ID, "Bearer", tkn.Token, ""); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if w := send("GET", "/v1/users/"+u.ID, "ApiKey", k.Key, ""); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 with a revoked key : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 with a revoked key.", tests.Success)
+		}
+	}
+}
+
+// disableUser validates admins can cut off a user, end their sessions and
+// hand their products to someone else.
+func (ut *UserTests) disableUser(t *testing.T) {
+	send := func(method, url, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+	login := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/v1/users/token", nil)
+		r.SetBasicAuth("kai@example.com", "gophers")
+		w := httptest.NewRecorder()
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	body := `{"name": "Kai Gopher", "email": "kai@example.com", "roles": ["USER"], "password": "gophers", "password_confirm": "gophers"}`
+	w := send("POST", "/v1/users", ut.adminToken, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("\t%s\tShould be able to create a user : %v", tests.Failed, w.Code)
+	}
+	var u user.User
+	if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+		t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+	}
+	defer ut.deleteUser204(t, u.ID)
+
+	var tkn struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(login().Body).Decode(&tkn); err != nil {
+		t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+	}
+
+	if w := send("POST", "/v1/products", tkn.Token, `{"name": "Comic Books", "cost": 25, "quantity": 60}`); w.Code != http.StatusCreated {
+		t.Fatalf("\t%s\tShould be able to create a product : %v", tests.Failed, w.Code)
+	}
+
+	t.Log("Given the need to cut off a user without deleting them.")
+	{
+		t.Log("\tTest 0:\tWhen listing the sessions of the user.")
+		{
+			if w := send("GET", "/v1/users/"+u.ID+"/sessions", ut.userToken, ""); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for a non admin : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for a non admin.", tests.Success)
+
+			w := send("GET", "/v1/users/"+u.ID+"/sessions", ut.adminToken, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			var sessions []user.Session
+			if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if len(sessions) != 1 {
+				t.Fatalf("\t%s\tShould list the session of the login : got %+v", tests.Failed, sessions)
+			}
+			t.Logf("\t%s\tShould list the session of the login.", tests.Success)
+
+			if w := send("DELETE", "/v1/users/"+u.ID+"/sessions/"+sessions[0].ID, ut.adminToken, ""); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 revoking the session : %v", tests.Failed, w.Code)
+			}
+			if w := send("GET", "/v1/users/"+u.ID, tkn.Token, ""); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 with the token of a revoked session : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 with the token of a revoked session.", tests.Success)
+
+			if w := send("DELETE", "/v1/users/"+u.ID+"/sessions/"+u.ID, ut.adminToken, ""); w.Code != http.StatusNotFound {
+				t.Fatalf("\t%s\tShould receive a status code of 404 for an unknown session : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 404 for an unknown session.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen disabling the user.")
+		{
+			if err := json.NewDecoder(login().Body).Decode(&tkn); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+
+			if w := send("POST", "/v1/users/"+u.ID+"/disable", ut.adminToken, `{}`); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 without a reason : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 without a reason.", tests.Success)
+
+			if w := send("POST", "/v1/users/"+u.ID+"/disable", ut.adminToken, `{"reason": "left the company"}`); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			if w := send("GET", "/v1/users/"+u.ID, tkn.Token, ""); w.Code != http.StatusUnauthorized {
+				t.Fatalf("\t%s\tShould receive a status code of 401 with the token of the user : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 401 with the token of the user.", tests.Success)
+
+			if w := login(); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 logging in : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 logging in.", tests.Success)
+		}
+
+		t.Log("\tTest 2:\tWhen transferring the products of the user.")
+		{
+			if w := send("POST", "/v1/users/"+u.ID+"/transfer", ut.adminToken, `{"user_id": "`+u.ID+`"}`); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for a disabled owner : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for a disabled owner.", tests.Success)
+
+			body := `{"name": "Noa Gopher", "email": "noa@example.com", "roles": ["USER"], "password": "gophers", "password_confirm": "gophers"}`
+			w := send("POST", "/v1/users", ut.adminToken, body)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("\t%s\tShould be able to create a user : %v", tests.Failed, w.Code)
+			}
+			var to user.User
+			if err := json.NewDecoder(w.Body).Decode(&to); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			defer ut.deleteUser204(t, to.ID)
+
+			w = send("POST", "/v1/users/"+u.ID+"/transfer", ut.adminToken, `{"user_id": "`+to.ID+`"}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			var got struct {
+				Transferred int `json:"transferred"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if got.Transferred != 1 {
+				t.Fatalf("\t%s\tShould transfer the product of the user : got %d", tests.Failed, got.Transferred)
+			}
+			t.Logf("\t%s\tShould transfer the product of the user.", tests.Success)
+		}
+	}
+}
+
+// me validates users can see and change their own profile without knowing
+// their ID.
+func (ut *UserTests) me(t *testing.T) {
+	send := func(method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/users/me", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+ut.userToken)
+
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need for users to manage their own profile.")
+	{
+		t.Log("\tTest 0:\tWhen changing their name.")
+		{
+			if w := send("PUT", `{"name": "Regular Gopher"}`); w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tShould receive a status code of 204 for the response : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 204 for the response.", tests.Success)
+
+			w := send("GET", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("\t%s\tShould receive a status code of 200 for the response : %v", tests.Failed, w.Code)
+			}
+			var got user.User
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response : %v", tests.Failed, err)
+			}
+			if got.ID != tests.UserID || got.Name != "Regular Gopher" {
+				t.Fatalf("\t%s\tShould get themselves with the new name : got %s %q", tests.Failed, got.ID, got.Name)
+			}
+			t.Logf("\t%s\tShould get themselves with the new name.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen changing their password or roles.")
+		{
+			w := send("PUT", `{"password": "generics", "password_confirm": "generics", "current_password": "wrong"}`)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 with the wrong current password : %v", tests.Failed, w.Code)
+			}
+			var got web.ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response to an error type : %v", tests.Failed, err)
+			}
+			if len(got.Fields) != 1 || got.Fields[0].Field != "current_password" {
+				t.Fatalf("\t%s\tShould get an error for the current password : got %+v", tests.Failed, got)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 with the wrong current password.", tests.Success)
+
+			if w := send("PUT", `{"roles": ["ADMIN"]}`); w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 changing their roles : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 changing their roles.", tests.Success)
+		}
+	}
+}
+
+// roleSafeguards validates admins only give known roles they have themselves
+// and can not remove the last admin. The seeded admin is the only one left
+// when it runs.
+func (ut *UserTests) roleSafeguards(t *testing.T) {
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		r.Header.Set("Authorization", "Bearer "+ut.adminToken)
+
+		ut.app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Log("Given the need to safeguard the roles of users.")
+	{
+		t.Log("\tTest 0:\tWhen creating users with roles.")
+		{
+			body := `{"name": "Rae Gopher", "email": "rae@example.com", "roles": ["SUPERUSER"], "password": "gophers", "password_confirm": "gophers"}`
+			w := send("POST", "/v1/users", body)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("\t%s\tShould receive a status code of 400 for an unknown role : %v", tests.Failed, w.Code)
+			}
+			var got web.ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the response to an error type : %v", tests.Failed, err)
+			}
+			if len(got.Fields) != 1 || got.Fields[0].Field != "roles" {
+				t.Fatalf("\t%s\tShould get an error for the roles : got %+v", tests.Failed, got)
+			}
+			t.Logf("\t%s\tShould receive a status code of 400 for an unknown role.", tests.Success)
+
+			body = `{"name": "Rae Gopher", "email": "rae@example.com", "roles": ["PRICE_OVERRIDE"], "password": "gophers", "password_confirm": "gophers"}`
+			if w := send("POST", "/v1/users", body); w.Code != http.StatusForbidden {
+				t.Fatalf("\t%s\tShould receive a status code of 403 for a role the admin does not have : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 403 for a role the admin does not have.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen removing the last admin.")
+		{
+			if w := send("PUT", "/v1/users/"+tests.AdminID, `{"roles": ["USER"]}`); w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould receive a status code of 409 removing the ADMIN role : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 409 removing the ADMIN role.", tests.Success)
+
+			if w := send("DELETE", "/v1/users/"+tests.AdminID, ""); w.Code != http.StatusConflict {
+				t.Fatalf("\t%s\tShould receive a status code of 409 deleting the admin : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould receive a status code of 409 deleting the admin.", tests.Success)
+		}
+	}
+}
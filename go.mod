@@ -13,6 +13,7 @@ require (
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/leodido/go-urn v1.1.0 // indirect
 	github.com/lib/pq v1.1.1
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/openzipkin/zipkin-go v0.1.6
 	github.com/pkg/errors v0.8.0
 	github.com/stretchr/testify v1.3.0 // indirect
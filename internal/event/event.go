@@ -0,0 +1,213 @@
+// Package event records domain events in a transactional outbox and relays
+// them to other systems.
+//
+// Events are written to the outbox table in the same transaction as the
+// change they describe so an event exists if and only if the change was
+// committed. A Relay later delivers them, in the order they were recorded, to
+// a Sink such as a file or a webhook.
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// These are the types of domain events recorded by the system.
+const (
+	ProductCreated     = "ProductCreated"
+	ProductUpdated     = "ProductUpdated"
+	ProductDeleted     = "ProductDeleted"
+	ProductRestored    = "ProductRestored"
+	ProductTransferred = "ProductTransferred"
+	SaleRecorded       = "SaleRecorded"
+	SaleCancelled      = "SaleCancelled"
+	SaleRefunded       = "SaleRefunded"
+	InventoryMoved     = "InventoryMoved"
+	OrderCreated       = "OrderCreated"
+	OrderUpdated       = "OrderUpdated"
+	OrderStatusChanged = "OrderStatusChanged"
+	UserCreated        = "UserCreated"
+	UserUpdated        = "UserUpdated"
+	UserDeleted        = "UserDeleted"
+	UserRestored       = "UserRestored"
+	UserPasswordReset  = "UserPasswordReset"
+	UserUnlocked       = "UserUnlocked"
+	UserMFAEnabled     = "UserMFAEnabled"
+	UserMFADisabled    = "UserMFADisabled"
+	UserVerified       = "UserVerified"
+	APIKeyCreated      = "APIKeyCreated"
+	APIKeyRevoked      = "APIKeyRevoked"
+	UserDisabled       = "UserDisabled"
+	UserEnabled        = "UserEnabled"
+	SessionRevoked     = "SessionRevoked"
+	IdentityLinked     = "IdentityLinked"
+	CategoryCreated    = "CategoryCreated"
+	CategoryUpdated    = "CategoryUpdated"
+	CategoryDeleted    = "CategoryDeleted"
+	ImageAdded         = "ImageAdded"
+	ImageDeleted       = "ImageDeleted"
+)
+
+// These are the delivery states of an Event.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// ErrNotFound is used when a specific Event is requested but does not exist.
+var ErrNotFound = errors.New("Event not found")
+
+// Event is something that happened in the system which other systems may need
+// to know about.
+type Event struct {
+	Seq           int64           `db:"seq" json:"seq"`                         // Position of the event in the outbox.
+	ID            string          `db:"event_id" json:"id"`                     // Unique identifier.
+	Type          string          `db:"type" json:"type"`                       // What happened, e.g. ProductCreated.
+	AggregateID   string          `db:"aggregate_id" json:"aggregate_id"`       // ID of the record the event is about.
+	Payload       json.RawMessage `db:"payload" json:"payload"`                 // State of the record after the change.
+	Status        string          `db:"status" json:"status"`                   // Delivery state of the event.
+	Attempts      int             `db:"attempts" json:"attempts"`               // Number of failed delivery attempts.
+	LastError     string          `db:"last_error" json:"last_error,omitempty"` // Error from the last failed attempt.
+	NextAttempt   time.Time       `db:"next_attempt" json:"next_attempt"`       // Earliest time of the next attempt.
+	DateCreated   time.Time       `db:"date_created" json:"date_created"`       // When the event was recorded.
+	DateDelivered *time.Time      `db:"date_delivered" json:"date_delivered"`   // When the event was delivered.
+}
+
+// WithTx runs f inside a transaction that records events. The outbox is
+// locked before f runs so such transactions commit one after the other and
+// the Relay never sees an event before the events numbered ahead of it. Taking
+// the lock first keeps it from being waited on while other rows are held.
+func WithTx(ctx context.Context, db *sqlx.DB, f func(tx *sqlx.Tx) error) error {
+	return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		if err := lock(ctx, tx); err != nil {
+			return err
+		}
+		return f(tx)
+	})
+}
+
+// lock holds the outbox lock until the transaction ends. Writers that run at
+// the same time are given their outbox sequence numbers in commit order.
+func lock(ctx context.Context, tx sqlx.ExecerContext) error {
+	const q = `UPDATE outbox_lock SET id = id`
+	if _, err := tx.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "locking outbox")
+	}
+	return nil
+}
+
+// Record adds an Event to the outbox. It should be called with the
+// transaction that makes the change described by the event so both are
+// committed or rolled back together. The transaction should be started with
+// WithTx. The data is stored as the event payload.
+func Record(ctx context.Context, tx sqlx.ExecerContext, typ, aggregateID string, data interface{}, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Record")
+	defer span.End()
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s payload", typ)
+	}
+
+	// The lock is already held in a transaction started with WithTx.
+	if err := lock(ctx, tx); err != nil {
+		return err
+	}
+
+	const q = `INSERT INTO outbox
+		(event_id, type, aggregate_id, payload, status, attempts, last_error, next_attempt, date_created)
+		VALUES ($1, $2, $3, $4, $5, 0, '', $6, $6)`
+
+	_, err = tx.ExecContext(ctx, q,
+		uuid.New().String(), typ, aggregateID,
+		payload, StatusPending, now.UTC(),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "inserting %s event", typ)
+	}
+
+	return nil
+}
+
+// List retrieves events from the outbox in the order they were recorded. If
+// status is not blank only events with that status are returned. At most
+// limit events are returned.
+func List(ctx context.Context, db *sqlx.DB, status string, limit int) ([]Event, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.event.List")
+	defer span.End()
+
+	events := []Event{}
+	const q = `SELECT * FROM outbox
+		WHERE $1 = '' OR status = $1
+		ORDER BY seq
+		LIMIT $2`
+
+	if err := db.SelectContext(ctx, &events, q, status, limit); err != nil {
+		return nil, errors.Wrap(err, "selecting events")
+	}
+
+	return events, nil
+}
+
+// Counts reports the number of events in the outbox for each status.
+func Counts(ctx context.Context, db *sqlx.DB) (map[string]int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Counts")
+	defer span.End()
+
+	var rows []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}
+	const q = `SELECT status, COUNT(*) AS count FROM outbox GROUP BY status`
+
+	if err := db.SelectContext(ctx, &rows, q); err != nil {
+		return nil, errors.Wrap(err, "counting events")
+	}
+
+	counts := map[string]int{
+		StatusPending:   0,
+		StatusDelivered: 0,
+		StatusFailed:    0,
+	}
+	for _, r := range rows {
+		counts[r.Status] = r.Count
+	}
+
+	return counts, nil
+}
+
+// Requeue returns a failed event to the pending state so the Relay attempts
+// to deliver it again.
+func Requeue(ctx context.Context, db *sqlx.DB, seq int64, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Requeue")
+	defer span.End()
+
+	const q = `UPDATE outbox SET
+		status = $2,
+		attempts = 0,
+		next_attempt = $3
+		WHERE seq = $1 AND status = $4`
+
+	res, err := db.ExecContext(ctx, q, seq, StatusPending, now.UTC(), StatusFailed)
+	if err != nil {
+		return errors.Wrapf(err, "requeueing event %d", seq)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "requeueing event %d", seq)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
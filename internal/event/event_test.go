@@ -0,0 +1,225 @@
+package event_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/tests"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// sink records delivered events and fails while err is set.
+type sink struct {
+	events []event.Event
+	err    error
+}
+
+func (s *sink) Deliver(ctx context.Context, e event.Event) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+// TestRelay validates events recorded by the stores are delivered in order
+// and that failed deliveries are retried.
+func TestRelay(t *testing.T) {
+	db, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	log := log.New(os.Stdout, "TEST : ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	t.Log("Given the need to relay domain events.")
+	{
+		t.Log("\tWhen products are changed.")
+		{
+			ctx := context.Background()
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+			claims := auth.NewClaims(
+				"718ffbea-f4a1-4667-8ae3-b349da52675e", // This is just some random UUID.
+				[]string{auth.RoleAdmin, auth.RoleUser},
+				now, time.Hour,
+			)
+
+			products := product.NewDB(db)
+			p, err := products.Create(ctx, claims, product.NewProduct{Name: "Comic Books", Cost: 10, Quantity: 55}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			if _, err := products.AddSale(ctx, claims, p.ID, product.NewSale{Quantity: 2, Paid: 20}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+			}
+			if err := products.Delete(ctx, p.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete the product : %s.", tests.Failed, err)
+			}
+
+			pending, err := event.List(ctx, db, event.StatusPending, 10)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list pending events : %s.", tests.Failed, err)
+			}
+			if len(pending) != 5 {
+				t.Fatalf("\t%s\tShould have recorded 5 events : got %d.", tests.Failed, len(pending))
+			}
+			t.Logf("\t%s\tShould have recorded 5 events.", tests.Success)
+
+			s := sink{err: errors.New("receiver unavailable")}
+			relay := event.NewRelay(db, &s, log, event.RelayConfig{
+				MinBackoff:  time.Second,
+				MaxBackoff:  time.Minute,
+				MaxAttempts: 3,
+			})
+
+			n, err := relay.Process(ctx, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to process the outbox : %s.", tests.Failed, err)
+			}
+			if n != 0 {
+				t.Fatalf("\t%s\tShould not deliver while the sink fails : got %d.", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould not deliver while the sink fails.", tests.Success)
+
+			s.err = nil
+			if n, _ := relay.Process(ctx, now); n != 0 {
+				t.Fatalf("\t%s\tShould wait out the backoff before retrying : got %d.", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould wait out the backoff before retrying.", tests.Success)
+
+			n, err = relay.Process(ctx, now.Add(time.Second))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to process the outbox : %s.", tests.Failed, err)
+			}
+			if n != 5 {
+				t.Fatalf("\t%s\tShould deliver all events after the backoff : got %d.", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould deliver all events after the backoff.", tests.Success)
+
+			want := []string{
+				event.ProductCreated, event.InventoryMoved,
+				event.InventoryMoved, event.SaleRecorded,
+				event.ProductDeleted,
+			}
+			for i, e := range s.events {
+				if e.Type != want[i] {
+					t.Fatalf("\t%s\tShould deliver events in order : got %s at %d, want %s.", tests.Failed, e.Type, i, want[i])
+				}
+			}
+			t.Logf("\t%s\tShould deliver events in order.", tests.Success)
+		}
+
+		t.Log("\tWhen delivery keeps failing.")
+		{
+			ctx := context.Background()
+			now := time.Date(2019, time.January, 2, 0, 0, 0, 0, time.UTC)
+
+			if err := event.Record(ctx, db, event.UserCreated, "5cf37266-3473-4006-984f-9325122678b7", nil, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to record an event : %s.", tests.Failed, err)
+			}
+
+			s := sink{err: errors.New("receiver unavailable")}
+			relay := event.NewRelay(db, &s, log, event.RelayConfig{
+				MinBackoff:  time.Second,
+				MaxBackoff:  time.Minute,
+				MaxAttempts: 2,
+			})
+
+			relay.Process(ctx, now)
+			relay.Process(ctx, now.Add(time.Hour))
+
+			failed, err := event.List(ctx, db, event.StatusFailed, 10)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list failed events : %s.", tests.Failed, err)
+			}
+			if len(failed) != 1 || failed[0].Attempts != 2 || failed[0].LastError != "receiver unavailable" {
+				t.Fatalf("\t%s\tShould fail the event after the max attempts : %+v.", tests.Failed, failed)
+			}
+			t.Logf("\t%s\tShould fail the event after the max attempts.", tests.Success)
+
+			if err := event.Requeue(ctx, db, failed[0].Seq, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to requeue the event : %s.", tests.Failed, err)
+			}
+
+			s.err = nil
+			if n, err := relay.Process(ctx, now); err != nil || n != 1 {
+				t.Fatalf("\t%s\tShould deliver the requeued event : %d %v.", tests.Failed, n, err)
+			}
+			t.Logf("\t%s\tShould deliver the requeued event.", tests.Success)
+
+			if err := event.Requeue(ctx, db, failed[0].Seq, now); err != event.ErrNotFound {
+				t.Fatalf("\t%s\tShould not requeue a delivered event : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould not requeue a delivered event.", tests.Success)
+		}
+
+		t.Log("\tWhen two transactions record events at the same time.")
+		{
+			ctx := context.Background()
+			now := time.Date(2019, time.January, 3, 0, 0, 0, 0, time.UTC)
+
+			first := "d2b9e3a4-41d2-4a3c-9a5c-7d1b8f0e6c11"
+			second := "6f0c7d55-8c0e-4b8e-9f4e-2e6a3b1d9a72"
+
+			recorded := make(chan struct{})
+			commit := make(chan struct{})
+			firstDone := make(chan error, 1)
+			go func() {
+				firstDone <- event.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+					if err := event.Record(ctx, tx, event.UserCreated, first, nil, now); err != nil {
+						return err
+					}
+					close(recorded)
+					<-commit
+					return nil
+				})
+			}()
+			<-recorded
+
+			secondDone := make(chan error, 1)
+			go func() {
+				secondDone <- event.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+					return event.Record(ctx, tx, event.UserCreated, second, nil, now)
+				})
+			}()
+
+			select {
+			case err := <-secondDone:
+				close(commit)
+				t.Fatalf("\t%s\tShould wait for the first transaction to commit : %v.", tests.Failed, err)
+			case <-time.After(200 * time.Millisecond):
+			}
+			t.Logf("\t%s\tShould wait for the first transaction to commit.", tests.Success)
+
+			var s sink
+			relay := event.NewRelay(db, &s, log, event.RelayConfig{})
+			if n, err := relay.Process(ctx, now); err != nil || n != 0 {
+				close(commit)
+				t.Fatalf("\t%s\tShould not deliver uncommitted events : %d %v.", tests.Failed, n, err)
+			}
+			t.Logf("\t%s\tShould not deliver uncommitted events.", tests.Success)
+
+			close(commit)
+			if err := <-firstDone; err != nil {
+				t.Fatalf("\t%s\tShould be able to commit the first transaction : %s.", tests.Failed, err)
+			}
+			if err := <-secondDone; err != nil {
+				t.Fatalf("\t%s\tShould be able to commit the second transaction : %s.", tests.Failed, err)
+			}
+
+			if n, err := relay.Process(ctx, now); err != nil || n != 2 {
+				t.Fatalf("\t%s\tShould deliver both events : %d %v.", tests.Failed, n, err)
+			}
+			if s.events[0].AggregateID != first || s.events[1].AggregateID != second {
+				t.Fatalf("\t%s\tShould deliver events in commit order : got %s then %s.", tests.Failed, s.events[0].AggregateID, s.events[1].AggregateID)
+			}
+			t.Logf("\t%s\tShould deliver events in commit order.", tests.Success)
+		}
+	}
+}
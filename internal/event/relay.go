@@ -0,0 +1,170 @@
+package event
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Sink is the destination of relayed events. Deliver must return nil only
+// once the event has been accepted. An event may be delivered more than once
+// so receivers should use the event ID to discard duplicates.
+type Sink interface {
+	Deliver(ctx context.Context, e Event) error
+}
+
+// RelayConfig controls how a Relay delivers events.
+type RelayConfig struct {
+	PollInterval time.Duration // How long to wait between checks of the outbox.
+	BatchSize    int           // Max number of events read from the outbox at once.
+	MinBackoff   time.Duration // Wait after the first failed attempt.
+	MaxBackoff   time.Duration // Upper bound of the wait between attempts.
+	MaxAttempts  int           // Attempts before an event is failed. Zero retries forever.
+}
+
+// Relay delivers events from the outbox to a Sink. Events are delivered one at
+// a time in the order they were recorded. When a delivery fails the Relay
+// waits with an exponential backoff before trying the same event again and
+// does not move on to later events, so consumers never see events out of
+// order. Transactions started with WithTx commit in the order of their
+// events, so an event never becomes visible after the ones following it. Only
+// a single Relay should run against a database.
+type Relay struct {
+	db   *sqlx.DB
+	sink Sink
+	log  *log.Logger
+	cfg  RelayConfig
+}
+
+// NewRelay constructs a Relay for the outbox in db. Zero values in cfg are
+// replaced with reasonable defaults.
+func NewRelay(db *sqlx.DB, sink Sink, log *log.Logger, cfg RelayConfig) *Relay {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = time.Minute
+	}
+
+	return &Relay{
+		db:   db,
+		sink: sink,
+		log:  log,
+		cfg:  cfg,
+	}
+}
+
+// Run delivers events until the context is canceled.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Process(ctx, time.Now()); err != nil {
+			r.log.Printf("relay : ERROR : %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Process makes a single pass over the outbox delivering pending events that
+// are due at the provided time. It returns the number of events delivered.
+func (r *Relay) Process(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Relay.Process")
+	defer span.End()
+
+	var delivered int
+	for {
+		events := []Event{}
+		const q = `SELECT * FROM outbox WHERE status = $1 ORDER BY seq LIMIT $2`
+
+		if err := r.db.SelectContext(ctx, &events, q, StatusPending, r.cfg.BatchSize); err != nil {
+			return delivered, errors.Wrap(err, "selecting pending events")
+		}
+
+		for _, e := range events {
+
+			// The oldest pending event is waiting out a backoff. Later events
+			// must wait behind it to preserve the order of delivery.
+			if e.NextAttempt.After(now) {
+				return delivered, nil
+			}
+
+			if err := r.sink.Deliver(ctx, e); err != nil {
+				if err := r.fail(ctx, e, err, now); err != nil {
+					return delivered, err
+				}
+
+				// A failed event no longer blocks the events after it.
+				if r.cfg.MaxAttempts > 0 && e.Attempts+1 >= r.cfg.MaxAttempts {
+					continue
+				}
+				return delivered, nil
+			}
+
+			const q = `UPDATE outbox SET status = $2, date_delivered = $3 WHERE seq = $1`
+			if _, err := r.db.ExecContext(ctx, q, e.Seq, StatusDelivered, now.UTC()); err != nil {
+				return delivered, errors.Wrapf(err, "marking event %d delivered", e.Seq)
+			}
+			delivered++
+		}
+
+		if len(events) < r.cfg.BatchSize {
+			return delivered, nil
+		}
+	}
+}
+
+// fail records a failed delivery attempt and schedules the next one.
+func (r *Relay) fail(ctx context.Context, e Event, deliverErr error, now time.Time) error {
+	attempts := e.Attempts + 1
+
+	status := StatusPending
+	if r.cfg.MaxAttempts > 0 && attempts >= r.cfg.MaxAttempts {
+		status = StatusFailed
+	}
+
+	r.log.Printf("relay : delivering event %d %s attempt %d : %v", e.Seq, e.Type, attempts, deliverErr)
+
+	const q = `UPDATE outbox SET
+		status = $2,
+		attempts = $3,
+		last_error = $4,
+		next_attempt = $5
+		WHERE seq = $1`
+
+	next := now.Add(r.backoff(attempts)).UTC()
+	if _, err := r.db.ExecContext(ctx, q, e.Seq, status, attempts, deliverErr.Error(), next); err != nil {
+		return errors.Wrapf(err, "recording failure of event %d", e.Seq)
+	}
+
+	return nil
+}
+
+// backoff returns how long to wait after the given number of failed attempts.
+// The wait doubles with each attempt up to the configured maximum.
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.cfg.MinBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= r.cfg.MaxBackoff {
+			return r.cfg.MaxBackoff
+		}
+	}
+	return d
+}
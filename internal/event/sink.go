@@ -0,0 +1,147 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// WriterSink writes each event as a line of JSON. It can be used with
+// os.Stdout for local development.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink constructs a Sink that writes events to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Deliver implements the Sink interface.
+func (s *WriterSink) Deliver(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "encoding event")
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(data); err != nil {
+		return errors.Wrap(err, "writing event")
+	}
+
+	return nil
+}
+
+// FileSink appends each event as a line of JSON to a file.
+type FileSink struct {
+	*WriterSink
+	f *os.File
+}
+
+// OpenFileSink opens the file at path for appending, creating it if needed.
+func OpenFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening event file")
+	}
+
+	return &FileSink{WriterSink: NewWriterSink(f), f: f}, nil
+}
+
+// Deliver implements the Sink interface. The file is synced so an event is
+// only reported as delivered once it is on disk.
+func (s *FileSink) Deliver(ctx context.Context, e Event) error {
+	if err := s.WriterSink.Deliver(ctx, e); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// WebhookSink POSTs each event as JSON to a URL. Any response other than a
+// 2xx status is treated as a failed delivery.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink constructs a Sink that sends events to url using client. If
+// client is nil http.DefaultClient is used.
+func NewWebhookSink(url string, client *http.Client) *WebhookSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebhookSink{url: url, client: client}
+}
+
+// Deliver implements the Sink interface.
+func (s *WebhookSink) Deliver(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "encoding event")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", e.ID)
+	req.Header.Set("X-Event-Type", e.Type)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "sending event")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// NotifySink publishes each event on a Postgres LISTEN/NOTIFY channel. The
+// notification payload is the event encoded as JSON, which Postgres limits to
+// 8000 bytes.
+type NotifySink struct {
+	db      *sqlx.DB
+	channel string
+}
+
+// NewNotifySink constructs a Sink that notifies listeners of channel.
+func NewNotifySink(db *sqlx.DB, channel string) *NotifySink {
+	return &NotifySink{db: db, channel: channel}
+}
+
+// Deliver implements the Sink interface.
+func (s *NotifySink) Deliver(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "encoding event")
+	}
+
+	const q = `SELECT pg_notify($1, $2)`
+	if _, err := s.db.ExecContext(ctx, q, s.channel, string(data)); err != nil {
+		return errors.Wrap(err, "notifying channel")
+	}
+
+	return nil
+}
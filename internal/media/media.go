@@ -0,0 +1,307 @@
+// Package media keeps the images of Products. Image records live in the
+// database while their content lives in a blob.Store.
+package media
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/blob"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Predefined errors identify expected failure conditions.
+var (
+	// ErrNotFound is used when a specific Image is requested but does not exist.
+	ErrNotFound = errors.New("Image not found")
+
+	// ErrInvalidID is used when an invalid UUID is provided.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrForbidden occurs when a user changes the images of a Product they do
+	// not own.
+	ErrForbidden = errors.New("Attempted action is not allowed")
+
+	// ErrTooLarge occurs when an image has more bytes or pixels than allowed.
+	ErrTooLarge = errors.New("Image is too large")
+
+	// ErrUnsupportedType occurs when an upload is not a GIF, JPEG or PNG image.
+	ErrUnsupportedType = errors.New("Image type is not supported")
+)
+
+// Store defines the set of behaviors required to keep the Images of
+// Products. Every implementation must honor the same semantics for ownership
+// and the predefined errors.
+//
+// Only admins and the owner of a Product may add or delete its Images. The
+// Images of a deleted Product are kept so it can be restored. Purge removes
+// the Images and blobs of Products that were purged.
+type Store interface {
+	List(ctx context.Context, productID string) ([]Image, error)
+	Add(ctx context.Context, user auth.Claims, productID string, ni NewImage, now time.Time) (*Image, error)
+	Open(ctx context.Context, productID, imageID string, thumbnail bool) (*Image, io.ReadCloser, error)
+	Delete(ctx context.Context, user auth.Claims, productID, imageID string, now time.Time) error
+	Purge(ctx context.Context) (int, error)
+}
+
+// DB is a Store that keeps Image records in a database and their content in
+// a blob.Store.
+type DB struct {
+	db       *sqlx.DB
+	products product.Store
+	blobs    blob.Store
+}
+
+// NewDB constructs a Store for the Images of the Products in the provided
+// product.Store.
+func NewDB(db *sqlx.DB, products product.Store, blobs blob.Store) *DB {
+	return &DB{db: db, products: products, blobs: blobs}
+}
+
+// List gives the Images of a Product in the order they were added.
+func (s *DB) List(ctx context.Context, productID string) ([]Image, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.List")
+	defer span.End()
+
+	if _, err := s.products.Retrieve(ctx, productID); err != nil {
+		return nil, err
+	}
+
+	images := []Image{}
+	const q = `SELECT * FROM images WHERE product_id = $1 ORDER BY date_created, image_id`
+	if err := s.db.SelectContext(ctx, &images, q, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting images")
+	}
+
+	return images, nil
+}
+
+// Add checks and stores an image of a Product with its thumbnail.
+func (s *DB) Add(ctx context.Context, user auth.Claims, productID string, ni NewImage, now time.Time) (*Image, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Add")
+	defer span.End()
+
+	img, thumb, err := newImage(ctx, s.products, user, productID, ni, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// The blobs are stored first so a record never points at missing content.
+	if err := putBlobs(ctx, s.blobs, img, ni.Data, thumb); err != nil {
+		return nil, err
+	}
+
+	const q = `INSERT INTO images
+		(image_id, product_id, name, content_type, size, width, height, user_id, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, q,
+			img.ID, img.ProductID, img.Name, img.ContentType,
+			img.Size, img.Width, img.Height, img.UserID, img.DateCreated)
+		if err != nil {
+			return errors.Wrap(err, "inserting image")
+		}
+
+		return event.Record(ctx, tx, event.ImageAdded, img.ID, img, now)
+	})
+	if err != nil {
+		deleteBlobs(ctx, s.blobs, img)
+		return nil, err
+	}
+
+	return &img, nil
+}
+
+// Open gives an Image of an active Product with a reader over its content or
+// its thumbnail. The caller must close the reader.
+func (s *DB) Open(ctx context.Context, productID, imageID string, thumbnail bool) (*Image, io.ReadCloser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Open")
+	defer span.End()
+
+	if _, err := s.products.Retrieve(ctx, productID); err != nil {
+		return nil, nil, err
+	}
+
+	img, err := s.retrieve(ctx, productID, imageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openBlob(ctx, s.blobs, img, thumbnail)
+}
+
+// Delete removes an Image and its blobs.
+func (s *DB) Delete(ctx context.Context, user auth.Claims, productID, imageID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Delete")
+	defer span.End()
+
+	if err := checkOwner(ctx, s.products, user, productID); err != nil {
+		return err
+	}
+
+	img, err := s.retrieve(ctx, productID, imageID)
+	if err != nil {
+		return err
+	}
+
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		const q = `DELETE FROM images WHERE image_id = $1`
+		if _, err := tx.ExecContext(ctx, q, img.ID); err != nil {
+			return errors.Wrapf(err, "deleting image %s", img.ID)
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{img.ID}
+		return event.Record(ctx, tx, event.ImageDeleted, img.ID, data, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	return deleteBlobs(ctx, s.blobs, *img)
+}
+
+// Purge removes the Images of Products that no longer exist along with their
+// blobs. It returns the number of Images removed.
+func (s *DB) Purge(ctx context.Context) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Purge")
+	defer span.End()
+
+	var images []Image
+	const q = `SELECT * FROM images WHERE product_id NOT IN (SELECT product_id FROM products)`
+	if err := s.db.SelectContext(ctx, &images, q); err != nil {
+		return 0, errors.Wrap(err, "selecting orphaned images")
+	}
+
+	// The blobs go first so an interrupted purge can be run again.
+	for _, img := range images {
+		if err := deleteBlobs(ctx, s.blobs, img); err != nil {
+			return 0, err
+		}
+
+		const del = `DELETE FROM images WHERE image_id = $1`
+		if _, err := s.db.ExecContext(ctx, del, img.ID); err != nil {
+			return 0, errors.Wrapf(err, "deleting image %s", img.ID)
+		}
+	}
+
+	return len(images), nil
+}
+
+// retrieve finds an Image of a Product.
+func (s *DB) retrieve(ctx context.Context, productID, imageID string) (*Image, error) {
+	if _, err := uuid.Parse(imageID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	var img Image
+	const q = `SELECT * FROM images WHERE image_id = $1 AND product_id = $2`
+	if err := s.db.GetContext(ctx, &img, q, imageID, productID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting image %s", imageID)
+	}
+
+	return &img, nil
+}
+
+// checkOwner makes sure the user may change the Images of an active Product.
+func checkOwner(ctx context.Context, products product.Store, user auth.Claims, productID string) error {
+	p, err := products.Retrieve(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// newImage checks the user may add an image to the Product and that the
+// image is acceptable. It gives the Image with its thumbnail.
+func newImage(ctx context.Context, products product.Store, user auth.Claims, productID string, ni NewImage, now time.Time) (Image, []byte, error) {
+	if err := checkOwner(ctx, products, user, productID); err != nil {
+		return Image{}, nil, err
+	}
+
+	pr, err := process(ni.Data)
+	if err != nil {
+		return Image{}, nil, err
+	}
+
+	img := Image{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		Name:        ni.Name,
+		ContentType: pr.contentType,
+		Size:        len(ni.Data),
+		Width:       pr.width,
+		Height:      pr.height,
+		UserID:      user.Subject,
+		DateCreated: now.UTC(),
+	}
+
+	return img, pr.thumbnail, nil
+}
+
+// blobKey gives the key of the content of an Image or of its thumbnail.
+func blobKey(img Image, thumbnail bool) string {
+	key := "products/" + img.ProductID + "/images/" + img.ID
+	if thumbnail {
+		key += ".thumbnail"
+	}
+	return key
+}
+
+// putBlobs stores the content and thumbnail of an Image.
+func putBlobs(ctx context.Context, blobs blob.Store, img Image, data, thumb []byte) error {
+	if err := blobs.Put(ctx, blobKey(img, false), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := blobs.Put(ctx, blobKey(img, true), bytes.NewReader(thumb)); err != nil {
+		deleteBlobs(ctx, blobs, img)
+		return err
+	}
+	return nil
+}
+
+// deleteBlobs removes the content and thumbnail of an Image.
+func deleteBlobs(ctx context.Context, blobs blob.Store, img Image) error {
+	for _, thumbnail := range []bool{false, true} {
+		if err := blobs.Delete(ctx, blobKey(img, thumbnail)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openBlob opens the content or thumbnail of an Image. The content type of
+// the returned Image is the one of the blob that was opened.
+func openBlob(ctx context.Context, blobs blob.Store, img *Image, thumbnail bool) (*Image, io.ReadCloser, error) {
+	r, err := blobs.Get(ctx, blobKey(*img, thumbnail))
+	if err != nil {
+		if err == blob.ErrNotFound {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	if thumbnail {
+		img.ContentType = ThumbnailType
+	}
+	return img, r, nil
+}
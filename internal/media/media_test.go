@@ -0,0 +1,196 @@
+package media_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/internal/media"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/blob"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/tests"
+	"github.com/pkg/errors"
+)
+
+// TestMedia validates the Store backed by the database.
+func TestMedia(t *testing.T) {
+	db, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	products := product.NewDB(db)
+	blobs := blob.NewMemory()
+	testStore(t, media.NewDB(db, products, blobs), products, blobs)
+}
+
+// TestMediaMemory validates the in-memory Store against the same suite used
+// for the database so both implementations behave identically.
+func TestMediaMemory(t *testing.T) {
+	products := product.NewMemory()
+	blobs := blob.NewMemory()
+	testStore(t, media.NewMemory(products, blobs), products, blobs)
+}
+
+// testStore is the conformance suite every media.Store must pass. The blobs
+// must be the ones the Store keeps images in.
+func testStore(t *testing.T, s media.Store, products product.Store, blobs *blob.Memory) {
+	t.Run("images", func(t *testing.T) { images(t, s, products) })
+	t.Run("purge", func(t *testing.T) { purge(t, s, products, blobs) })
+}
+
+var (
+	now   = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	owner = auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+	other = auth.NewClaims("45b5fbd3-755f-4379-8f07-a58d4a30fa2f", []string{auth.RoleUser}, now, time.Hour)
+)
+
+// pngImage encodes a PNG image of the given size.
+func pngImage(t *testing.T, w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.NRGBA{R: 0xff, A: 0xff})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// images validates images are checked, thumbnailed and only changed by the
+// owner of their Product.
+func images(t *testing.T, s media.Store, products product.Store) {
+	t.Log("Given the need to keep images of Products.")
+	{
+		ctx := context.Background()
+
+		p, err := products.Create(ctx, owner, product.NewProduct{Name: "Lamps", Cost: 500, Quantity: 3}, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen uploading an image.")
+		{
+			data := pngImage(t, 800, 400)
+
+			if _, err := s.Add(ctx, other, p.ID, media.NewImage{Name: "lamp.png", Data: data}, now); errors.Cause(err) != media.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT allow another user to upload : %v.", tests.Failed, err)
+			}
+			if _, err := s.Add(ctx, owner, p.ID, media.NewImage{Name: "lamp.png", Data: []byte("%PDF-1.4")}, now); errors.Cause(err) != media.ErrUnsupportedType {
+				t.Fatalf("\t%s\tShould NOT allow content that is not an image : %v.", tests.Failed, err)
+			}
+			big := make([]byte, media.MaxSize+1)
+			copy(big, data)
+			if _, err := s.Add(ctx, owner, p.ID, media.NewImage{Name: "lamp.png", Data: big}, now); errors.Cause(err) != media.ErrTooLarge {
+				t.Fatalf("\t%s\tShould NOT allow images over the size limit : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow invalid uploads.", tests.Success)
+
+			img, err := s.Add(ctx, owner, p.ID, media.NewImage{Name: "lamp.png", Data: data}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to upload an image : %s.", tests.Failed, err)
+			}
+			if img.ContentType != "image/png" || img.Width != 800 || img.Height != 400 || img.Size != len(data) {
+				t.Fatalf("\t%s\tShould describe the image : %+v.", tests.Failed, img)
+			}
+			t.Logf("\t%s\tShould describe the image.", tests.Success)
+
+			list, err := s.List(ctx, p.ID)
+			if err != nil || len(list) != 1 || list[0].ID != img.ID {
+				t.Fatalf("\t%s\tShould list the image : %+v : %v.", tests.Failed, list, err)
+			}
+			t.Logf("\t%s\tShould list the image.", tests.Success)
+
+			_, r, err := s.Open(ctx, p.ID, img.ID, false)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to open the image : %s.", tests.Failed, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("\t%s\tShould read back the uploaded image : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould read back the uploaded image.", tests.Success)
+
+			thumb, r, err := s.Open(ctx, p.ID, img.ID, true)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to open the thumbnail : %s.", tests.Failed, err)
+			}
+			cfg, err := png.DecodeConfig(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to decode the thumbnail : %s.", tests.Failed, err)
+			}
+			if thumb.ContentType != media.ThumbnailType || cfg.Width != media.ThumbnailMax || cfg.Height != media.ThumbnailMax/2 {
+				t.Fatalf("\t%s\tShould scale the thumbnail keeping its aspect : %dx%d.", tests.Failed, cfg.Width, cfg.Height)
+			}
+			t.Logf("\t%s\tShould scale the thumbnail keeping its aspect.", tests.Success)
+		}
+
+		t.Log("\tWhen deleting an image.")
+		{
+			img, err := s.Add(ctx, owner, p.ID, media.NewImage{Name: "shade.png", Data: pngImage(t, 10, 10)}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to upload an image : %s.", tests.Failed, err)
+			}
+
+			if err := s.Delete(ctx, other, p.ID, img.ID, now); errors.Cause(err) != media.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT allow another user to delete : %v.", tests.Failed, err)
+			}
+			if err := s.Delete(ctx, owner, p.ID, img.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete the image : %s.", tests.Failed, err)
+			}
+			if _, _, err := s.Open(ctx, p.ID, img.ID, false); errors.Cause(err) != media.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT find a deleted image : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould only let the owner delete images.", tests.Success)
+		}
+	}
+}
+
+// purge validates the images of purged Products are removed with their
+// blobs while deleted Products keep theirs.
+func purge(t *testing.T, s media.Store, products product.Store, blobs *blob.Memory) {
+	t.Log("Given the need to clean up the images of deleted Products.")
+	{
+		t.Log("\tWhen purging a Product with images.")
+		{
+			ctx := context.Background()
+
+			p, err := products.Create(ctx, owner, product.NewProduct{Name: "Rugs", Cost: 900, Quantity: 1}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			if _, err := s.Add(ctx, owner, p.ID, media.NewImage{Name: "rug.png", Data: pngImage(t, 20, 20)}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to upload an image : %s.", tests.Failed, err)
+			}
+			before := len(blobs.Keys())
+
+			if err := products.Delete(ctx, p.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete the product : %s.", tests.Failed, err)
+			}
+			if n, err := s.Purge(ctx); err != nil || n != 0 {
+				t.Fatalf("\t%s\tShould keep the images of a deleted product : %d : %v.", tests.Failed, n, err)
+			}
+			t.Logf("\t%s\tShould keep the images of a deleted product.", tests.Success)
+
+			if _, err := products.Purge(ctx, now.Add(time.Second)); err != nil {
+				t.Fatalf("\t%s\tShould be able to purge the product : %s.", tests.Failed, err)
+			}
+			n, err := s.Purge(ctx)
+			if err != nil || n != 1 {
+				t.Fatalf("\t%s\tShould purge the image of the product : %d : %v.", tests.Failed, n, err)
+			}
+			if after := len(blobs.Keys()); after != before-2 {
+				t.Fatalf("\t%s\tShould delete the image and thumbnail blobs : %d left of %d.", tests.Failed, after, before)
+			}
+			t.Logf("\t%s\tShould purge the images and blobs of a purged product.", tests.Success)
+		}
+	}
+}
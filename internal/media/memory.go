@@ -0,0 +1,174 @@
+package media
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/blob"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/google/uuid"
+	"go.opencensus.io/trace"
+)
+
+// Memory is a Store that keeps Image records in memory and their content in a
+// blob.Store. It is safe for concurrent use and is intended for tests and
+// local development where running a database is not practical.
+type Memory struct {
+	mu       sync.Mutex
+	images   map[string]Image
+	products product.Store
+	blobs    blob.Store
+}
+
+// NewMemory constructs an empty in-memory Store for the Images of the
+// Products in the provided product.Store.
+func NewMemory(products product.Store, blobs blob.Store) *Memory {
+	return &Memory{
+		images:   make(map[string]Image),
+		products: products,
+		blobs:    blobs,
+	}
+}
+
+// List gives the Images of a Product in the order they were added.
+func (m *Memory) List(ctx context.Context, productID string) ([]Image, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Memory.List")
+	defer span.End()
+
+	if _, err := m.products.Retrieve(ctx, productID); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	images := []Image{}
+	for _, img := range m.images {
+		if img.ProductID == productID {
+			images = append(images, img)
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if !images[i].DateCreated.Equal(images[j].DateCreated) {
+			return images[i].DateCreated.Before(images[j].DateCreated)
+		}
+		return images[i].ID < images[j].ID
+	})
+
+	return images, nil
+}
+
+// Add checks and stores an image of a Product with its thumbnail.
+func (m *Memory) Add(ctx context.Context, user auth.Claims, productID string, ni NewImage, now time.Time) (*Image, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Memory.Add")
+	defer span.End()
+
+	img, thumb, err := newImage(ctx, m.products, user, productID, ni, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := putBlobs(ctx, m.blobs, img, ni.Data, thumb); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.images[img.ID] = img
+
+	return &img, nil
+}
+
+// Open gives an Image of an active Product with a reader over its content or
+// its thumbnail. The caller must close the reader.
+func (m *Memory) Open(ctx context.Context, productID, imageID string, thumbnail bool) (*Image, io.ReadCloser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Memory.Open")
+	defer span.End()
+
+	if _, err := m.products.Retrieve(ctx, productID); err != nil {
+		return nil, nil, err
+	}
+
+	img, err := m.retrieve(productID, imageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openBlob(ctx, m.blobs, &img, thumbnail)
+}
+
+// Delete removes an Image and its blobs.
+func (m *Memory) Delete(ctx context.Context, user auth.Claims, productID, imageID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Memory.Delete")
+	defer span.End()
+
+	if err := checkOwner(ctx, m.products, user, productID); err != nil {
+		return err
+	}
+
+	img, err := m.retrieve(productID, imageID)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.images, img.ID)
+	m.mu.Unlock()
+
+	return deleteBlobs(ctx, m.blobs, img)
+}
+
+// Purge removes the Images of Products that no longer exist along with their
+// blobs. It returns the number of Images removed.
+func (m *Memory) Purge(ctx context.Context) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.media.Memory.Purge")
+	defer span.End()
+
+	products, err := m.products.List(ctx, product.Filter{IncludeDeleted: true})
+	if err != nil {
+		return 0, err
+	}
+	exists := make(map[string]bool, len(products))
+	for _, p := range products {
+		exists[p.ID] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for id, img := range m.images {
+		if exists[img.ProductID] {
+			continue
+		}
+		if err := deleteBlobs(ctx, m.blobs, img); err != nil {
+			return n, err
+		}
+		delete(m.images, id)
+		n++
+	}
+
+	return n, nil
+}
+
+// retrieve finds an Image of a Product.
+func (m *Memory) retrieve(productID, imageID string) (Image, error) {
+	if _, err := uuid.Parse(imageID); err != nil {
+		return Image{}, ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	img, ok := m.images[imageID]
+	if !ok || img.ProductID != productID {
+		return Image{}, ErrNotFound
+	}
+	return img, nil
+}
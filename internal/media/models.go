@@ -0,0 +1,33 @@
+package media
+
+import "time"
+
+// These are the limits on uploaded images.
+const (
+	MaxSize      = 5 << 20  // Largest image in bytes.
+	MaxPixels    = 25000000 // Largest image in pixels so decoding can not exhaust memory.
+	ThumbnailMax = 200      // Longest side of a thumbnail in pixels.
+)
+
+// ThumbnailType is the content type of every thumbnail.
+const ThumbnailType = "image/png"
+
+// Image is a picture of a Product. The image and its thumbnail are kept in
+// blob storage.
+type Image struct {
+	ID          string    `db:"image_id" json:"id"`
+	ProductID   string    `db:"product_id" json:"product_id"`
+	Name        string    `db:"name" json:"name"`                 // File name given when uploading.
+	ContentType string    `db:"content_type" json:"content_type"` // Sniffed from the content.
+	Size        int       `db:"size" json:"size"`                 // Size of the image in bytes.
+	Width       int       `db:"width" json:"width"`
+	Height      int       `db:"height" json:"height"`
+	UserID      string    `db:"user_id" json:"user_id"` // ID of the user who uploaded the image.
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+}
+
+// NewImage is what we require from clients when uploading an Image.
+type NewImage struct {
+	Name string
+	Data []byte
+}
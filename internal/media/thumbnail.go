@@ -0,0 +1,118 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"  // Register the GIF decoder.
+	_ "image/jpeg" // Register the JPEG decoder.
+	"image/png"
+	"net/http"
+)
+
+// decoders lists the content types we accept. The types are sniffed from the
+// content rather than trusted from the client.
+var decoders = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// processed is an uploaded image that was checked and thumbnailed.
+type processed struct {
+	contentType string
+	width       int
+	height      int
+	thumbnail   []byte
+}
+
+// process sniffs the type of an uploaded image, checks its size and makes
+// its thumbnail.
+func process(data []byte) (processed, error) {
+	if len(data) > MaxSize {
+		return processed{}, ErrTooLarge
+	}
+
+	ct := http.DetectContentType(data)
+	if !decoders[ct] {
+		return processed{}, ErrUnsupportedType
+	}
+
+	// Check the dimensions before decoding the pixels.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return processed{}, ErrUnsupportedType
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return processed{}, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return processed{}, ErrUnsupportedType
+	}
+
+	var thumb bytes.Buffer
+	if err := png.Encode(&thumb, thumbnail(img, ThumbnailMax)); err != nil {
+		return processed{}, err
+	}
+
+	return processed{
+		contentType: ct,
+		width:       cfg.Width,
+		height:      cfg.Height,
+		thumbnail:   thumb.Bytes(),
+	}, nil
+}
+
+// thumbnail scales img down to fit a square of max pixels keeping its aspect
+// ratio. Each pixel of the thumbnail averages the pixels it covers. Images
+// that already fit are copied as they are.
+func thumbnail(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > max || h > max {
+		if w >= h {
+			tw, th = max, h*max/w
+		} else {
+			tw, th = w*max/h, max
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+
+			// Colors are premultiplied by alpha so undo it for NRGBA.
+			i := dst.PixOffset(x, y)
+			if a > 0 {
+				dst.Pix[i+0] = uint8(r * 0xff / a)
+				dst.Pix[i+1] = uint8(g * 0xff / a)
+				dst.Pix[i+2] = uint8(bl * 0xff / a)
+			}
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
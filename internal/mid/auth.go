@@ -4,9 +4,12 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/oidc"
 	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/user"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
@@ -18,8 +21,13 @@ var ErrForbidden = web.NewRequestError(
 	http.StatusForbidden,
 )
 
-// Authenticate validates a JWT from the `Authorization` header.
-func Authenticate(authenticator *auth.Authenticator) web.Middleware {
+// Authenticate validates a JWT or an API key from the `Authorization` header,
+// given as `Bearer <token>` or `ApiKey <key>`. Tokens the users store reports
+// as revoked are rejected, as are challenges that still need a two-factor
+// code. API keys give the claims of their user. When there is a provider, its
+// ID tokens are accepted as well and give the claims of the user provisioned
+// for the person until the ID token expires.
+func Authenticate(authenticator *auth.Authenticator, users user.Store, provider *oidc.Provider) web.Middleware {
 
 	// This is the actual middleware function to be executed.
 	f := func(after web.Handler) web.Handler {
@@ -29,16 +37,93 @@ func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 			ctx, span := trace.StartSpan(ctx, "internal.mid.Authenticate")
 			defer span.End()
 
-			// Parse the authorization header. Expected header is of
-			// the format `Bearer <token>`.
-			parts := strings.Split(r.Header.Get("Authorization"), " ")
-			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-				err := errors.New("expected authorization header format: Bearer <token>")
-				return web.NewRequestError(err, http.StatusUnauthorized)
+			if parts := strings.Split(r.Header.Get("Authorization"), " "); len(parts) == 2 && strings.ToLower(parts[0]) == "apikey" {
+				v, ok := ctx.Value(web.KeyValues).(*web.Values)
+				if !ok {
+					return web.NewShutdownError("web value missing from context")
+				}
+
+				claims, err := users.AuthenticateAPIKey(ctx, v.Now, parts[1])
+				if err != nil {
+					switch err {
+					case user.ErrAuthenticationFailure:
+						return web.NewRequestError(err, http.StatusUnauthorized)
+					default:
+						return errors.Wrap(err, "authenticating api key")
+					}
+				}
+
+				// Add claims to the context so they can be retrieved later.
+				ctx = context.WithValue(ctx, auth.Key, claims)
+
+				return after(ctx, w, r, params)
+			}
+
+			if parts := strings.Split(r.Header.Get("Authorization"), " "); provider != nil && len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" && provider.Issued(parts[1]) {
+				v, ok := ctx.Value(web.KeyValues).(*web.Values)
+				if !ok {
+					return web.NewShutdownError("web value missing from context")
+				}
+
+				claims, err := idTokenClaims(ctx, provider, users, parts[1], v.Now)
+				if err != nil {
+					return err
+				}
+
+				// Add claims to the context so they can be retrieved later.
+				ctx = context.WithValue(ctx, auth.Key, claims)
+
+				return after(ctx, w, r, params)
 			}
 
-			claims, err := authenticator.ParseClaims(parts[1])
+			claims, err := parseBearer(authenticator, r)
 			if err != nil {
+				return err
+			}
+			if claims.Audience == user.ChallengeAudience {
+				return web.NewRequestError(user.ErrMFARequired, http.StatusUnauthorized)
+			}
+
+			if err := users.CheckClaims(ctx, claims); err != nil {
+				switch err {
+				case user.ErrTokenRevoked, user.ErrDisabled:
+					return web.NewRequestError(err, http.StatusUnauthorized)
+				default:
+					return errors.Wrap(err, "checking claims")
+				}
+			}
+
+			// Add claims to the context so they can be retrieved later.
+			ctx = context.WithValue(ctx, auth.Key, claims)
+
+			return after(ctx, w, r, params)
+		}
+
+		return h
+	}
+
+	return f
+}
+
+// Challenge validates a JWT from the `Authorization` header that is a
+// challenge to complete a login with a two-factor code. Whether the challenge
+// is still in force is left to the users store.
+func Challenge(authenticator *auth.Authenticator) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		// Wrap this handler around the next one provided.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+			ctx, span := trace.StartSpan(ctx, "internal.mid.Challenge")
+			defer span.End()
+
+			claims, err := parseBearer(authenticator, r)
+			if err != nil {
+				return err
+			}
+			if claims.Audience != user.ChallengeAudience {
+				err := errors.New("expected a two-factor challenge token")
 				return web.NewRequestError(err, http.StatusUnauthorized)
 			}
 
@@ -54,6 +139,52 @@ func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 	return f
 }
 
+// parseBearer gives the claims of the token in the authorization header,
+// which is expected to be of the format `Bearer <token>`.
+func parseBearer(authenticator *auth.Authenticator, r *http.Request) (auth.Claims, error) {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		err := errors.New("expected authorization header format: Bearer <token> or ApiKey <key>")
+		return auth.Claims{}, web.NewRequestError(err, http.StatusUnauthorized)
+	}
+
+	claims, err := authenticator.ParseClaims(parts[1])
+	if err != nil {
+		return auth.Claims{}, web.NewRequestError(err, http.StatusUnauthorized)
+	}
+
+	return claims, nil
+}
+
+// idTokenClaims verifies an ID token of the provider and gives the claims of
+// the user provisioned for the person it vouches for. Users who need a
+// two-factor code can not use ID tokens.
+func idTokenClaims(ctx context.Context, provider *oidc.Provider, users user.Store, token string, now time.Time) (auth.Claims, error) {
+	id, err := provider.Verify(ctx, token, now)
+	if err != nil {
+		switch errors.Cause(err) {
+		case oidc.ErrInvalidToken:
+			return auth.Claims{}, web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return auth.Claims{}, errors.Wrap(err, "verifying id token")
+		}
+	}
+
+	claims, err := users.AuthenticateIDToken(ctx, now, user.NewExternal(id), id.ExpiresAt)
+	if err != nil {
+		switch err {
+		case user.ErrAuthenticationFailure, user.ErrDisabled, user.ErrMFARequired:
+			return auth.Claims{}, web.NewRequestError(err, http.StatusUnauthorized)
+		case user.ErrLastAdmin:
+			return auth.Claims{}, web.NewRequestError(err, http.StatusConflict)
+		default:
+			return auth.Claims{}, errors.Wrap(err, "authenticating id token")
+		}
+	}
+
+	return claims, nil
+}
+
 // HasRole validates that an authenticated user has at least one role from a
 // specified list. This method constructs the actual function that is used.
 func HasRole(roles ...string) web.Middleware {
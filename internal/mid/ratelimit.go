@@ -0,0 +1,108 @@
+package mid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// ErrTooManyRequests is returned when a source address made more requests
+// than a Limiter allows.
+var ErrTooManyRequests = web.NewRequestError(
+	errors.New("too many requests, try again later"),
+	http.StatusTooManyRequests,
+)
+
+// Limiter counts the requests from every source address in fixed windows of
+// time. It is safe for concurrent use. Counts are only kept in memory so
+// every instance of the service limits on its own.
+type Limiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	swept   time.Time
+	sources map[string]*requests
+}
+
+// requests are the requests from a source address in the window that started
+// at start.
+type requests struct {
+	start time.Time
+	n     int
+}
+
+// NewLimiter constructs a Limiter that allows limit requests from a source
+// address per window.
+func NewLimiter(limit int, window time.Duration) *Limiter {
+	return &Limiter{
+		limit:   limit,
+		window:  window,
+		sources: make(map[string]*requests),
+	}
+}
+
+// Allow counts a request from source at now and reports whether it is within
+// the limit. When it is not it gives how long until the next window starts.
+func (l *Limiter) Allow(source string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget the sources whose window ended so the map does not keep growing.
+	if !now.Before(l.swept.Add(l.window)) {
+		for s, r := range l.sources {
+			if !now.Before(r.start.Add(l.window)) {
+				delete(l.sources, s)
+			}
+		}
+		l.swept = now
+	}
+
+	r, ok := l.sources[source]
+	if !ok || !now.Before(r.start.Add(l.window)) {
+		r = &requests{start: now}
+		l.sources[source] = r
+	}
+	if r.n >= l.limit {
+		return r.start.Add(l.window).Sub(now), false
+	}
+	r.n++
+
+	return 0, true
+}
+
+// RateLimit rejects requests from source addresses that made more requests
+// than the limiter allows. The Retry-After header tells clients when to try
+// again.
+func RateLimit(l *Limiter) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+			ctx, span := trace.StartSpan(ctx, "internal.mid.RateLimit")
+			defer span.End()
+
+			v, ok := ctx.Value(web.KeyValues).(*web.Values)
+			if !ok {
+				return web.NewShutdownError("web value missing from context")
+			}
+
+			if wait, ok := l.Allow(web.SourceAddr(r), v.Now); !ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int((wait+time.Second-1)/time.Second)))
+				return ErrTooManyRequests
+			}
+
+			return after(ctx, w, r, params)
+		}
+
+		return h
+	}
+
+	return f
+}
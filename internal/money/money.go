@@ -0,0 +1,119 @@
+// Package money represents amounts of money in the minor unit of an ISO 4217
+// currency and converts them using exchange rates.
+package money
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCurrency is used for records created before currencies were tracked
+// and for new records that do not name a currency.
+const DefaultCurrency = "USD"
+
+var (
+	// ErrInvalidCurrency occurs when a currency code is not a supported ISO
+	// 4217 code.
+	ErrInvalidCurrency = errors.New("Currency is not supported")
+
+	// ErrInvalidRate occurs when an exchange rate is not a positive number.
+	ErrInvalidRate = errors.New("Exchange rate is not valid")
+)
+
+// minorUnits maps the supported ISO 4217 codes to the number of digits after
+// the decimal point of their minor unit.
+var minorUnits = map[string]int{
+	"AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2, "CZK": 2,
+	"DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2,
+	"INR": 2, "ISK": 0, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "MYR": 2,
+	"NOK": 2, "NZD": 2, "PHP": 2, "PLN": 2, "SEK": 2, "SGD": 2, "THB": 2,
+	"TRY": 2, "USD": 2, "ZAR": 2,
+}
+
+// Money is an amount in the minor unit of a currency such as cents for USD.
+type Money struct {
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Rate is the number of units of the To currency one unit of the From
+// currency buys.
+type Rate struct {
+	From        string    `db:"from_currency" json:"from"`
+	To          string    `db:"to_currency" json:"to"`
+	Rate        float64   `db:"rate" json:"rate"`
+	DateUpdated time.Time `db:"date_updated" json:"date_updated"`
+}
+
+// Valid reports if code is a supported ISO 4217 currency code.
+func Valid(code string) bool {
+	_, ok := minorUnits[code]
+	return ok
+}
+
+// Convert applies r to m. The result is rounded to the nearest minor unit of
+// the To currency.
+func (r Rate) Convert(m Money) (Money, error) {
+	if m.Currency != r.From || !Valid(r.To) {
+		return Money{}, ErrInvalidCurrency
+	}
+	if r.Rate <= 0 {
+		return Money{}, ErrInvalidRate
+	}
+
+	scale := math.Pow10(minorUnits[r.To] - minorUnits[r.From])
+	amount := math.Round(float64(m.Amount) * r.Rate * scale)
+
+	return Money{Amount: int(amount), Currency: r.To}, nil
+}
+
+// Inverse gives the Rate converting back from the To currency.
+func (r Rate) Inverse() Rate {
+	return Rate{From: r.To, To: r.From, Rate: 1 / r.Rate, DateUpdated: r.DateUpdated}
+}
+
+// ParseRates reads exchange rates from CSV with the columns from, to and
+// rate. A first line naming the columns is skipped.
+func ParseRates(r io.Reader) ([]Rate, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	var rates []Rate
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading rates")
+		}
+
+		if line == 1 && strings.EqualFold(rec[0], "from") {
+			continue
+		}
+
+		rate := Rate{
+			From: strings.ToUpper(strings.TrimSpace(rec[0])),
+			To:   strings.ToUpper(strings.TrimSpace(rec[1])),
+		}
+		if !Valid(rate.From) || !Valid(rate.To) {
+			return nil, errors.Wrapf(ErrInvalidCurrency, "line %d", line)
+		}
+
+		rate.Rate, err = strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+		if err != nil || rate.Rate <= 0 {
+			return nil, errors.Wrapf(ErrInvalidRate, "line %d", line)
+		}
+
+		rates = append(rates, rate)
+	}
+
+	return rates, nil
+}
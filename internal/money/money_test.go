@@ -0,0 +1,73 @@
+package money_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/tests"
+	"github.com/pkg/errors"
+)
+
+// TestConvert validates amounts are converted between minor units.
+func TestConvert(t *testing.T) {
+	t.Log("Given the need to convert money between currencies.")
+	{
+		t.Log("\tWhen converting with a known rate.")
+		{
+			tt := []struct {
+				name string
+				rate money.Rate
+				in   money.Money
+				want money.Money
+			}{
+				{"EUR to USD", money.Rate{From: "EUR", To: "USD", Rate: 1.1}, money.Money{Amount: 1000, Currency: "EUR"}, money.Money{Amount: 1100, Currency: "USD"}},
+				{"USD to JPY", money.Rate{From: "USD", To: "JPY", Rate: 150}, money.Money{Amount: 199, Currency: "USD"}, money.Money{Amount: 299, Currency: "JPY"}},
+				{"JPY to USD", money.Rate{From: "USD", To: "JPY", Rate: 150}.Inverse(), money.Money{Amount: 300, Currency: "JPY"}, money.Money{Amount: 200, Currency: "USD"}},
+			}
+
+			for _, tc := range tt {
+				got, err := tc.rate.Convert(tc.in)
+				if err != nil {
+					t.Fatalf("\t%s\t%s : Should be able to convert : %s.", tests.Failed, tc.name, err)
+				}
+				if got != tc.want {
+					t.Fatalf("\t%s\t%s : Should get %+v : got %+v.", tests.Failed, tc.name, tc.want, got)
+				}
+				t.Logf("\t%s\t%s : Should convert to the minor unit of the target.", tests.Success, tc.name)
+			}
+
+			r := money.Rate{From: "EUR", To: "USD", Rate: 1.1}
+			if _, err := r.Convert(money.Money{Amount: 1, Currency: "GBP"}); errors.Cause(err) != money.ErrInvalidCurrency {
+				t.Fatalf("\t%s\tShould NOT convert another currency : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT convert another currency.", tests.Success)
+		}
+	}
+}
+
+// TestParseRates validates exchange rates are read from CSV.
+func TestParseRates(t *testing.T) {
+	t.Log("Given the need to load exchange rates from a file.")
+	{
+		t.Log("\tWhen reading CSV.")
+		{
+			rates, err := money.ParseRates(strings.NewReader("from,to,rate\nEUR, USD, 1.08\ngbp,usd,1.27\n"))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to parse rates : %s.", tests.Failed, err)
+			}
+			if len(rates) != 2 || rates[1].From != "GBP" || rates[1].Rate != 1.27 {
+				t.Fatalf("\t%s\tShould get back every rate : %+v.", tests.Failed, rates)
+			}
+			t.Logf("\t%s\tShould be able to parse rates.", tests.Success)
+
+			if _, err := money.ParseRates(strings.NewReader("EUR,XXX,1\n")); errors.Cause(err) != money.ErrInvalidCurrency {
+				t.Fatalf("\t%s\tShould reject unknown currencies : %v.", tests.Failed, err)
+			}
+			if _, err := money.ParseRates(strings.NewReader("EUR,USD,-1\n")); errors.Cause(err) != money.ErrInvalidRate {
+				t.Fatalf("\t%s\tShould reject negative rates : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reject invalid rates.", tests.Success)
+		}
+	}
+}
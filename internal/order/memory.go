@@ -0,0 +1,346 @@
+package order
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/google/uuid"
+	"go.opencensus.io/trace"
+)
+
+// Memory is a Store that keeps Orders in memory. It is safe for concurrent use
+// and is intended for tests and local development where running a database is
+// not practical. Stock and prices come from the provided product.Store.
+type Memory struct {
+	mu       sync.Mutex
+	orders   map[string]Order
+	products product.Store
+}
+
+// NewMemory constructs an empty in-memory Store that sells the Products of
+// the provided product.Store.
+func NewMemory(products product.Store) *Memory {
+	return &Memory{
+		orders:   make(map[string]Order),
+		products: products,
+	}
+}
+
+// List gets the Orders visible to the user with their lines.
+func (m *Memory) List(ctx context.Context, user auth.Claims) ([]Order, error) {
+	_, span := trace.StartSpan(ctx, "internal.order.Memory.List")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	orders := []Order{}
+	for _, o := range m.orders {
+		if user.HasRole(auth.RoleAdmin) || o.UserID == user.Subject {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].DateCreated.Before(orders[j].DateCreated)
+	})
+
+	return orders, nil
+}
+
+// Create starts an empty cart for the user.
+func (m *Memory) Create(ctx context.Context, user auth.Claims, now time.Time) (*Order, error) {
+	_, span := trace.StartSpan(ctx, "internal.order.Memory.Create")
+	defer span.End()
+
+	o := Order{
+		ID:          uuid.New().String(),
+		UserID:      user.Subject,
+		Status:      StatusCart,
+		Currency:    money.DefaultCurrency,
+		Lines:       []OrderLine{},
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.orders[o.ID] = o
+
+	c := copyOrder(o)
+	return &c, nil
+}
+
+// Retrieve finds the Order identified by a given ID. Only admins and the owner
+// of the Order may see it.
+func (m *Memory) Retrieve(ctx context.Context, user auth.Claims, id string) (*Order, error) {
+	_, span := trace.StartSpan(ctx, "internal.order.Memory.Retrieve")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, err := m.find(user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := copyOrder(o)
+	return &c, nil
+}
+
+// AddLine adds a Product to a cart at its current cost. Adding a Product that
+// is already in the cart increases the quantity of its line.
+func (m *Memory) AddLine(ctx context.Context, user auth.Claims, id string, nl NewLine, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.Memory.AddLine")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if _, err := uuid.Parse(nl.ProductID); err != nil {
+		return nil, product.ErrInvalidID
+	}
+	if nl.Quantity <= 0 {
+		return nil, ErrInvalidLine
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, err := m.findCart(user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := m.products.Retrieve(ctx, nl.ProductID)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty cart takes the currency of the first product added to it.
+	if len(o.Lines) == 0 {
+		o.Currency = p.Currency
+	}
+
+	price, err := m.products.Convert(ctx, money.Money{Amount: p.Cost, Currency: p.Currency}, o.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged bool
+	for i := range o.Lines {
+		if o.Lines[i].ProductID == nl.ProductID {
+			o.Lines[i].Quantity += nl.Quantity
+			o.Lines[i].UnitPrice = price.Amount
+			merged = true
+		}
+	}
+	if !merged {
+		o.Lines = append(o.Lines, OrderLine{
+			ID:          uuid.New().String(),
+			OrderID:     id,
+			ProductID:   nl.ProductID,
+			Quantity:    nl.Quantity,
+			UnitPrice:   price.Amount,
+			DateCreated: now.UTC(),
+		})
+	}
+	o.DateUpdated = now.UTC()
+	m.orders[id] = o
+
+	c := copyOrder(o)
+	return &c, nil
+}
+
+// RemoveLine takes a line out of a cart.
+func (m *Memory) RemoveLine(ctx context.Context, user auth.Claims, id, lineID string, now time.Time) (*Order, error) {
+	_, span := trace.StartSpan(ctx, "internal.order.Memory.RemoveLine")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if _, err := uuid.Parse(lineID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, err := m.findCart(user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]OrderLine, 0, len(o.Lines))
+	for _, l := range o.Lines {
+		if l.ID != lineID {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == len(o.Lines) {
+		return nil, ErrNotFound
+	}
+	o.Lines = lines
+	o.DateUpdated = now.UTC()
+	m.orders[id] = o
+
+	c := copyOrder(o)
+	return &c, nil
+}
+
+// Checkout records a Sale for every line of a cart at the price the pricing
+// rules give the user for its Product and makes the Order pending. Nothing
+// changes if any Product does not have enough stock.
+func (m *Memory) Checkout(ctx context.Context, user auth.Claims, id string, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.Memory.Checkout")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, err := m.findCart(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.Lines) == 0 {
+		return nil, ErrEmptyCart
+	}
+
+	sl := make([]product.SaleLine, len(o.Lines))
+	for i, l := range o.Lines {
+		p, err := m.products.Retrieve(ctx, l.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		price, err := m.products.Convert(ctx, money.Money{Amount: p.Cost, Currency: p.Currency}, o.Currency)
+		if err != nil {
+			return nil, err
+		}
+
+		qt, err := m.products.Quote(ctx, user, l.ProductID, product.NewQuote{Quantity: l.Quantity}, now)
+		if err != nil {
+			return nil, err
+		}
+		paid, err := m.products.Convert(ctx, money.Money{Amount: qt.Price, Currency: qt.Currency}, o.Currency)
+		if err != nil {
+			return nil, err
+		}
+
+		o.Lines[i].UnitPrice = price.Amount
+		o.Lines[i].Discount = l.Quantity*price.Amount - paid.Amount
+		sl[i] = product.SaleLine{
+			ProductID: l.ProductID,
+			NewSale:   product.NewSale{Quantity: l.Quantity, Paid: paid.Amount, Currency: o.Currency},
+		}
+	}
+
+	sales, err := m.products.AddSales(ctx, user, sl, now)
+	if err != nil {
+		return nil, err
+	}
+	for i := range o.Lines {
+		o.Lines[i].SaleID = &sales[i].ID
+	}
+
+	o.Status = StatusPending
+	o.DateUpdated = now.UTC()
+	m.orders[id] = o
+
+	c := copyOrder(o)
+	return &c, nil
+}
+
+// Transition moves an Order to another state. The owner of an Order may cancel
+// it but only admins may mark it paid, shipped or refunded. Cancelling a
+// pending Order cancels its Sales and refunding an Order refunds them. Either
+// way the items return to stock.
+func (m *Memory) Transition(ctx context.Context, user auth.Claims, id, status string, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.Memory.Transition")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if status != StatusCancelled && !user.HasRole(auth.RoleAdmin) {
+		return nil, ErrForbidden
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, err := m.find(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if !canMove(o.Status, status) {
+		return nil, ErrInvalidTransition
+	}
+
+	switch {
+	case o.Status == StatusPending && status == StatusCancelled:
+		if err := m.products.CancelSales(ctx, user, saleIDs(o.Lines), now); err != nil {
+			return nil, err
+		}
+	case status == StatusRefunded:
+		if err := m.products.RefundSales(ctx, user, saleIDs(o.Lines), "Order refunded", now); err != nil {
+			return nil, err
+		}
+	}
+
+	o.Status = status
+	o.DateUpdated = now.UTC()
+	m.orders[id] = o
+
+	c := copyOrder(o)
+	return &c, nil
+}
+
+// find gets an Order the user may see. The caller must hold the lock.
+func (m *Memory) find(user auth.Claims, id string) (Order, error) {
+	o, ok := m.orders[id]
+	if !ok {
+		return Order{}, ErrNotFound
+	}
+	if !user.HasRole(auth.RoleAdmin) && o.UserID != user.Subject {
+		return Order{}, ErrForbidden
+	}
+	return copyOrder(o), nil
+}
+
+// findCart gets an Order whose lines are about to change. The caller must
+// hold the lock.
+func (m *Memory) findCart(user auth.Claims, id string) (Order, error) {
+	o, err := m.find(user, id)
+	if err != nil {
+		return Order{}, err
+	}
+	if o.Status != StatusCart {
+		return Order{}, ErrNotCart
+	}
+	return o, nil
+}
+
+// copyOrder returns a deep copy of o with its total computed so callers can
+// not modify the stored value.
+func copyOrder(o Order) Order {
+	lines := make([]OrderLine, len(o.Lines))
+	copy(lines, o.Lines)
+	setLines(&o, lines)
+	return o
+}
@@ -0,0 +1,80 @@
+package order
+
+import "time"
+
+// These are the states of an Order. An Order starts as a cart and becomes
+// pending when it is checked out.
+const (
+	StatusCart      = "cart"
+	StatusPending   = "pending"
+	StatusPaid      = "paid"
+	StatusShipped   = "shipped"
+	StatusCancelled = "cancelled"
+	StatusRefunded  = "refunded"
+)
+
+// transitions lists the states an Order may move to from each state. A cart
+// only becomes pending by checking it out.
+var transitions = map[string][]string{
+	StatusCart:    {StatusCancelled},
+	StatusPending: {StatusPaid, StatusCancelled},
+	StatusPaid:    {StatusShipped, StatusRefunded},
+	StatusShipped: {StatusRefunded},
+}
+
+// Order groups the items a customer buys in one transaction. An Order takes the
+// currency of the Product on its first line and the prices of other Products
+// are converted into it.
+type Order struct {
+	ID          string      `db:"order_id" json:"id"`
+	UserID      string      `db:"user_id" json:"user_id"`
+	Status      string      `db:"status" json:"status"`
+	Currency    string      `db:"currency" json:"currency"` // ISO 4217 code of the prices of the lines.
+	Total       int         `db:"-" json:"total"`           // Sum of the line totals in the minor unit of Currency.
+	Lines       []OrderLine `db:"-" json:"lines"`
+	DateCreated time.Time   `db:"date_created" json:"date_created"`
+	DateUpdated time.Time   `db:"date_updated" json:"date_updated"`
+}
+
+// OrderLine is a quantity of one Product in an Order.
+type OrderLine struct {
+	ID          string    `db:"line_id" json:"id"`
+	OrderID     string    `db:"order_id" json:"order_id"`
+	ProductID   string    `db:"product_id" json:"product_id"`
+	Quantity    int       `db:"quantity" json:"quantity"`
+	UnitPrice   int       `db:"unit_price" json:"unit_price"` // Cost of the Product in the currency of the Order.
+	Discount    int       `db:"discount" json:"discount"`     // Taken off the line by the pricing rules at checkout.
+	SaleID      *string   `db:"sale_id" json:"sale_id,omitempty"`
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+}
+
+// NewLine is what we require from clients when adding a Product to a cart.
+type NewLine struct {
+	ProductID string `json:"product_id" validate:"required"`
+	Quantity  int    `json:"quantity" validate:"gte=1"`
+}
+
+// StatusChange is what we require from clients when moving an Order to
+// another state.
+type StatusChange struct {
+	Status string `json:"status" validate:"required,oneof=paid shipped cancelled refunded"`
+}
+
+// total computes the total of an Order from its lines.
+func total(lines []OrderLine) int {
+	var t int
+	for _, l := range lines {
+		t += l.Quantity*l.UnitPrice - l.Discount
+	}
+	return t
+}
+
+// canMove reports if an Order in state from may move to state to.
+func canMove(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,508 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Predefined errors identify expected failure conditions.
+var (
+	// ErrNotFound is used when a specific Order is requested but does not exist.
+	ErrNotFound = errors.New("Order not found")
+
+	// ErrInvalidID is used when an invalid UUID is provided.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrForbidden occurs when a user tries to do something that is forbidden to
+	// them according to our access control policies.
+	ErrForbidden = errors.New("Attempted action is not allowed")
+
+	// ErrNotCart occurs when the lines of an Order are changed after it was
+	// checked out.
+	ErrNotCart = errors.New("Order can only be changed while it is a cart")
+
+	// ErrInvalidLine occurs when a line does not have a positive quantity.
+	ErrInvalidLine = errors.New("Order line is not valid")
+
+	// ErrEmptyCart occurs when checking out an Order without lines.
+	ErrEmptyCart = errors.New("Order has no lines")
+
+	// ErrInvalidTransition occurs when an Order can not move to the requested
+	// state from its current state.
+	ErrInvalidTransition = errors.New("Order can not move to that status")
+)
+
+// Store defines the set of behaviors required to persist and retrieve Orders.
+// Every implementation must honor the same semantics for access control, state
+// transitions and the predefined errors.
+//
+// Users only see their own Orders while admins see every Order. Checking out
+// records a Sale for every line, all at once, or fails without changing stock.
+type Store interface {
+	List(ctx context.Context, user auth.Claims) ([]Order, error)
+	Create(ctx context.Context, user auth.Claims, now time.Time) (*Order, error)
+	Retrieve(ctx context.Context, user auth.Claims, id string) (*Order, error)
+	AddLine(ctx context.Context, user auth.Claims, id string, nl NewLine, now time.Time) (*Order, error)
+	RemoveLine(ctx context.Context, user auth.Claims, id, lineID string, now time.Time) (*Order, error)
+	Checkout(ctx context.Context, user auth.Claims, id string, now time.Time) (*Order, error)
+	Transition(ctx context.Context, user auth.Claims, id, status string, now time.Time) (*Order, error)
+}
+
+// DB is a Store backed by a Postgres database. Every change is committed
+// together with a domain event in the outbox.
+type DB struct {
+	db *sqlx.DB
+}
+
+// NewDB constructs a Store that persists Orders using the provided database.
+func NewDB(db *sqlx.DB) *DB {
+	return &DB{db: db}
+}
+
+// List gets the Orders visible to the user with their lines.
+func (s *DB) List(ctx context.Context, user auth.Claims) ([]Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.List")
+	defer span.End()
+
+	all := user.HasRole(auth.RoleAdmin)
+
+	orders := []Order{}
+	const q = `SELECT * FROM orders WHERE $1 OR user_id = $2 ORDER BY date_created`
+	if err := s.db.SelectContext(ctx, &orders, q, all, user.Subject); err != nil {
+		return nil, errors.Wrap(err, "selecting orders")
+	}
+
+	lines := []OrderLine{}
+	const ql = `SELECT l.* FROM order_lines AS l
+		JOIN orders AS o ON o.order_id = l.order_id
+		WHERE $1 OR o.user_id = $2
+		ORDER BY l.date_created`
+	if err := s.db.SelectContext(ctx, &lines, ql, all, user.Subject); err != nil {
+		return nil, errors.Wrap(err, "selecting order lines")
+	}
+
+	byOrder := make(map[string][]OrderLine)
+	for _, l := range lines {
+		byOrder[l.OrderID] = append(byOrder[l.OrderID], l)
+	}
+	for i := range orders {
+		setLines(&orders[i], byOrder[orders[i].ID])
+	}
+
+	return orders, nil
+}
+
+// Create starts an empty cart for the user.
+func (s *DB) Create(ctx context.Context, user auth.Claims, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.Create")
+	defer span.End()
+
+	o := Order{
+		ID:          uuid.New().String(),
+		UserID:      user.Subject,
+		Status:      StatusCart,
+		Currency:    money.DefaultCurrency,
+		Lines:       []OrderLine{},
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+
+	const q = `INSERT INTO orders
+		(order_id, user_id, status, currency, date_created, date_updated)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, q, o.ID, o.UserID, o.Status, o.Currency, o.DateCreated, o.DateUpdated)
+		if err != nil {
+			return errors.Wrap(err, "inserting order")
+		}
+
+		return event.Record(ctx, tx, event.OrderCreated, o.ID, o, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// Retrieve finds the Order identified by a given ID. Only admins and the owner
+// of the Order may see it.
+func (s *DB) Retrieve(ctx context.Context, user auth.Claims, id string) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.Retrieve")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	return retrieve(ctx, s.db, user, id)
+}
+
+// AddLine adds a Product to a cart at its current cost. Adding a Product that
+// is already in the cart increases the quantity of its line.
+func (s *DB) AddLine(ctx context.Context, user auth.Claims, id string, nl NewLine, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.AddLine")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if _, err := uuid.Parse(nl.ProductID); err != nil {
+		return nil, product.ErrInvalidID
+	}
+	if nl.Quantity <= 0 {
+		return nil, ErrInvalidLine
+	}
+
+	var o *Order
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var err error
+		if o, err = lockCart(ctx, tx, user, id); err != nil {
+			return err
+		}
+
+		// An empty cart takes the currency of the first product added to it.
+		if len(o.Lines) == 0 {
+			cur, err := productCurrency(ctx, tx, nl.ProductID)
+			if err != nil {
+				return err
+			}
+			const qc = `UPDATE orders SET currency = $2 WHERE order_id = $1`
+			if _, err := tx.ExecContext(ctx, qc, id, cur); err != nil {
+				return errors.Wrapf(err, "updating currency of order %q", id)
+			}
+			o.Currency = cur
+		}
+
+		price, err := unitPrice(ctx, tx, nl.ProductID, o.Currency)
+		if err != nil {
+			return err
+		}
+
+		l := OrderLine{
+			ID:          uuid.New().String(),
+			OrderID:     id,
+			ProductID:   nl.ProductID,
+			Quantity:    nl.Quantity,
+			UnitPrice:   price,
+			DateCreated: now.UTC(),
+		}
+		for _, cur := range o.Lines {
+			if cur.ProductID == nl.ProductID {
+				l = cur
+				l.Quantity += nl.Quantity
+				l.UnitPrice = price
+			}
+		}
+
+		const q = `INSERT INTO order_lines
+			(line_id, order_id, product_id, quantity, unit_price, date_created)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (line_id) DO UPDATE SET quantity = $4, unit_price = $5`
+		_, err = tx.ExecContext(ctx, q, l.ID, l.OrderID, l.ProductID, l.Quantity, l.UnitPrice, l.DateCreated)
+		if err != nil {
+			return errors.Wrap(err, "inserting order line")
+		}
+
+		if o, err = touch(ctx, tx, user, id, now); err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, event.OrderUpdated, o.ID, o, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// RemoveLine takes a line out of a cart.
+func (s *DB) RemoveLine(ctx context.Context, user auth.Claims, id, lineID string, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.RemoveLine")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if _, err := uuid.Parse(lineID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	var o *Order
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if _, err := lockCart(ctx, tx, user, id); err != nil {
+			return err
+		}
+
+		const q = `DELETE FROM order_lines WHERE line_id = $1 AND order_id = $2`
+		res, err := tx.ExecContext(ctx, q, lineID, id)
+		if err != nil {
+			return errors.Wrap(err, "deleting order line")
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return errors.Wrap(err, "counting deleted order lines")
+		} else if n == 0 {
+			return ErrNotFound
+		}
+
+		if o, err = touch(ctx, tx, user, id, now); err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, event.OrderUpdated, o.ID, o, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Checkout records a Sale for every line of a cart at the price the pricing
+// rules give the user for its Product and makes the Order pending. Nothing
+// changes if any Product does not have enough stock.
+func (s *DB) Checkout(ctx context.Context, user auth.Claims, id string, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.Checkout")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	var o *Order
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var err error
+		if o, err = lockCart(ctx, tx, user, id); err != nil {
+			return err
+		}
+		if len(o.Lines) == 0 {
+			return ErrEmptyCart
+		}
+
+		sl := make([]product.SaleLine, len(o.Lines))
+		for i, l := range o.Lines {
+			price, err := unitPrice(ctx, tx, l.ProductID, o.Currency)
+			if err != nil {
+				return err
+			}
+
+			qt, err := product.QuoteTx(ctx, tx, user, l.ProductID, product.NewQuote{Quantity: l.Quantity}, now)
+			if err != nil {
+				return err
+			}
+			paid, err := product.ConvertTx(ctx, tx, money.Money{Amount: qt.Price, Currency: qt.Currency}, o.Currency)
+			if err != nil {
+				return err
+			}
+
+			o.Lines[i].UnitPrice = price
+			o.Lines[i].Discount = l.Quantity*price - paid.Amount
+			sl[i] = product.SaleLine{
+				ProductID: l.ProductID,
+				NewSale:   product.NewSale{Quantity: l.Quantity, Paid: paid.Amount, Currency: o.Currency},
+			}
+		}
+
+		sales, err := product.AddSalesTx(ctx, tx, user, sl, now)
+		if err != nil {
+			return err
+		}
+
+		const q = `UPDATE order_lines SET unit_price = $2, discount = $3, sale_id = $4 WHERE line_id = $1`
+		for i, l := range o.Lines {
+			if _, err := tx.ExecContext(ctx, q, l.ID, l.UnitPrice, l.Discount, sales[i].ID); err != nil {
+				return errors.Wrap(err, "updating order line")
+			}
+			o.Lines[i].SaleID = &sales[i].ID
+		}
+
+		return setStatus(ctx, tx, o, StatusPending, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Transition moves an Order to another state. The owner of an Order may cancel
+// it but only admins may mark it paid, shipped or refunded. Cancelling a
+// pending Order cancels its Sales and refunding an Order refunds them. Either
+// way the items return to stock.
+func (s *DB) Transition(ctx context.Context, user auth.Claims, id, status string, now time.Time) (*Order, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.order.Transition")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if status != StatusCancelled && !user.HasRole(auth.RoleAdmin) {
+		return nil, ErrForbidden
+	}
+
+	var o *Order
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var err error
+		if o, err = lock(ctx, tx, user, id); err != nil {
+			return err
+		}
+		if !canMove(o.Status, status) {
+			return ErrInvalidTransition
+		}
+
+		switch {
+		case o.Status == StatusPending && status == StatusCancelled:
+			if err := product.CancelSalesTx(ctx, tx, user, saleIDs(o.Lines), now); err != nil {
+				return err
+			}
+		case status == StatusRefunded:
+			if err := product.RefundSalesTx(ctx, tx, user, saleIDs(o.Lines), "Order refunded", now); err != nil {
+				return err
+			}
+		}
+
+		return setStatus(ctx, tx, o, status, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// retrieve reads an Order with its lines using the database or a transaction.
+func retrieve(ctx context.Context, db sqlx.QueryerContext, user auth.Claims, id string) (*Order, error) {
+	var o Order
+	const q = `SELECT * FROM orders WHERE order_id = $1`
+	if err := sqlx.GetContext(ctx, db, &o, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting order %q", id)
+	}
+
+	if !user.HasRole(auth.RoleAdmin) && o.UserID != user.Subject {
+		return nil, ErrForbidden
+	}
+
+	lines := []OrderLine{}
+	const ql = `SELECT * FROM order_lines WHERE order_id = $1 ORDER BY date_created`
+	if err := sqlx.SelectContext(ctx, db, &lines, ql, id); err != nil {
+		return nil, errors.Wrapf(err, "selecting lines of order %q", id)
+	}
+	setLines(&o, lines)
+
+	return &o, nil
+}
+
+// lock locks the row of an Order for the rest of the transaction and reads
+// it. Touching the row with an UPDATE takes the lock on both Postgres and
+// SQLite.
+func lock(ctx context.Context, tx *sqlx.Tx, user auth.Claims, id string) (*Order, error) {
+	const q = `UPDATE orders SET order_id = order_id WHERE order_id = $1`
+	if _, err := tx.ExecContext(ctx, q, id); err != nil {
+		return nil, errors.Wrapf(err, "locking order %q", id)
+	}
+
+	return retrieve(ctx, tx, user, id)
+}
+
+// lockCart locks an Order whose lines are about to change.
+func lockCart(ctx context.Context, tx *sqlx.Tx, user auth.Claims, id string) (*Order, error) {
+	o, err := lock(ctx, tx, user, id)
+	if err != nil {
+		return nil, err
+	}
+	if o.Status != StatusCart {
+		return nil, ErrNotCart
+	}
+	return o, nil
+}
+
+// touch updates the modification time of an Order and reads it back.
+func touch(ctx context.Context, tx *sqlx.Tx, user auth.Claims, id string, now time.Time) (*Order, error) {
+	const q = `UPDATE orders SET date_updated = $2 WHERE order_id = $1`
+	if _, err := tx.ExecContext(ctx, q, id, now.UTC()); err != nil {
+		return nil, errors.Wrapf(err, "updating order %q", id)
+	}
+
+	return retrieve(ctx, tx, user, id)
+}
+
+// setStatus moves o to status and records the change.
+func setStatus(ctx context.Context, tx *sqlx.Tx, o *Order, status string, now time.Time) error {
+	const q = `UPDATE orders SET status = $2, date_updated = $3 WHERE order_id = $1`
+	if _, err := tx.ExecContext(ctx, q, o.ID, status, now.UTC()); err != nil {
+		return errors.Wrapf(err, "updating order %q", o.ID)
+	}
+
+	o.Status = status
+	o.DateUpdated = now.UTC()
+	o.Total = total(o.Lines)
+
+	return event.Record(ctx, tx, event.OrderStatusChanged, o.ID, o, now)
+}
+
+// unitPrice reads the current cost of an active Product in the provided
+// currency.
+func unitPrice(ctx context.Context, tx *sqlx.Tx, productID, currency string) (int, error) {
+	var cost money.Money
+	const q = `SELECT cost AS amount, currency FROM products WHERE product_id = $1 AND deleted_at IS NULL`
+	if err := tx.GetContext(ctx, &cost, q, productID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, product.ErrNotFound
+		}
+		return 0, errors.Wrapf(err, "selecting cost of product %q", productID)
+	}
+
+	price, err := product.ConvertTx(ctx, tx, cost, currency)
+	if err != nil {
+		return 0, err
+	}
+	return price.Amount, nil
+}
+
+// productCurrency reads the currency of an active Product.
+func productCurrency(ctx context.Context, tx *sqlx.Tx, productID string) (string, error) {
+	var currency string
+	const q = `SELECT currency FROM products WHERE product_id = $1 AND deleted_at IS NULL`
+	if err := tx.GetContext(ctx, &currency, q, productID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", product.ErrNotFound
+		}
+		return "", errors.Wrapf(err, "selecting currency of product %q", productID)
+	}
+	return currency, nil
+}
+
+// setLines attaches lines to o and computes its total.
+func setLines(o *Order, lines []OrderLine) {
+	if lines == nil {
+		lines = []OrderLine{}
+	}
+	o.Lines = lines
+	o.Total = total(lines)
+}
+
+// saleIDs gives the Sales recorded for lines at checkout.
+func saleIDs(lines []OrderLine) []string {
+	var ids []string
+	for _, l := range lines {
+		if l.SaleID != nil {
+			ids = append(ids, *l.SaleID)
+		}
+	}
+	return ids
+}
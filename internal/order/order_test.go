@@ -0,0 +1,349 @@
+package order_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/internal/order"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/tests"
+	"github.com/pkg/errors"
+)
+
+// TestOrder validates the Store backed by the database.
+func TestOrder(t *testing.T) {
+	db, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	testStore(t, order.NewDB(db), product.NewDB(db))
+}
+
+// TestOrderMemory validates the in-memory Store against the same suite used
+// for the database so both implementations behave identically.
+func TestOrderMemory(t *testing.T) {
+	products := product.NewMemory()
+	testStore(t, order.NewMemory(products), products)
+}
+
+// testStore is the conformance suite every order.Store must pass. The
+// products Store must share stock with the Orders.
+func testStore(t *testing.T, s order.Store, products product.Store) {
+	t.Run("checkout", func(t *testing.T) { checkout(t, s, products) })
+	t.Run("discounts", func(t *testing.T) { discounts(t, s, products) })
+	t.Run("transitions", func(t *testing.T) { transitions(t, s, products) })
+	t.Run("access", func(t *testing.T) { access(t, s) })
+}
+
+var (
+	now   = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	admin = auth.NewClaims("5cf37266-3473-4006-984f-9325122678b7", []string{auth.RoleAdmin, auth.RoleUser}, now, time.Hour)
+	buyer = auth.NewClaims("45b5fbd3-755f-4379-8f07-a58d4a30fa2f", []string{auth.RoleUser}, now, time.Hour)
+	other = auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+)
+
+// checkout validates a cart is built line by line and checked out into Sales.
+func checkout(t *testing.T, s order.Store, products product.Store) {
+	t.Log("Given the need to buy several Products in one Order.")
+	{
+		t.Log("\tWhen building a cart and checking it out.")
+		{
+			ctx := context.Background()
+
+			kites, err := products.Create(ctx, admin, product.NewProduct{Name: "Kites", Cost: 1500, Quantity: 4}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			yoyos, err := products.Create(ctx, admin, product.NewProduct{Name: "Yoyos", Cost: 250, Quantity: 10}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+
+			o, err := s.Create(ctx, buyer, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create an order : %s.", tests.Failed, err)
+			}
+			if o.Status != order.StatusCart {
+				t.Fatalf("\t%s\tShould start as a cart : got %q.", tests.Failed, o.Status)
+			}
+			t.Logf("\t%s\tShould be able to create an order.", tests.Success)
+
+			if _, err := s.Checkout(ctx, buyer, o.ID, now); errors.Cause(err) != order.ErrEmptyCart {
+				t.Fatalf("\t%s\tShould NOT be able to check out an empty cart : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to check out an empty cart.", tests.Success)
+
+			if _, err := s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: kites.ID, Quantity: 1}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+			if _, err := s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: yoyos.ID, Quantity: 3}, now.Add(time.Second)); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+			o, err = s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: kites.ID, Quantity: 1}, now.Add(2*time.Second))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+			if len(o.Lines) != 2 || o.Lines[0].Quantity != 2 || o.Total != 3750 {
+				t.Fatalf("\t%s\tShould merge lines of the same product and total 3750 : %+v.", tests.Failed, o)
+			}
+			t.Logf("\t%s\tShould merge lines of the same product and compute the total.", tests.Success)
+
+			o, err = s.RemoveLine(ctx, buyer, o.ID, o.Lines[1].ID, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to remove a line : %s.", tests.Failed, err)
+			}
+			if len(o.Lines) != 1 || o.Total != 3000 {
+				t.Fatalf("\t%s\tShould have one line totalling 3000 : %+v.", tests.Failed, o)
+			}
+			t.Logf("\t%s\tShould be able to remove a line.", tests.Success)
+
+			o, err = s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: yoyos.ID, Quantity: 11}, now.Add(3*time.Second))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+			if _, err := s.Checkout(ctx, buyer, o.ID, now); errors.Cause(err) != product.ErrInsufficientStock {
+				t.Fatalf("\t%s\tShould NOT be able to check out more than is in stock : %v.", tests.Failed, err)
+			}
+			p, err := products.Retrieve(ctx, kites.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product : %s.", tests.Failed, err)
+			}
+			if p.Sold != 0 || p.Available != 4 {
+				t.Fatalf("\t%s\tShould sell nothing when a line fails : got %d sold and %d available.", tests.Failed, p.Sold, p.Available)
+			}
+			t.Logf("\t%s\tShould sell nothing when a line is out of stock.", tests.Success)
+
+			o, err = s.RemoveLine(ctx, buyer, o.ID, o.Lines[1].ID, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to remove a line : %s.", tests.Failed, err)
+			}
+			if _, err := s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: yoyos.ID, Quantity: 2}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+
+			price := 2000
+			if err := products.Update(ctx, admin, kites.ID, product.UpdateProduct{Cost: &price}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to update product : %s.", tests.Failed, err)
+			}
+
+			o, err = s.Checkout(ctx, buyer, o.ID, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to check out : %s.", tests.Failed, err)
+			}
+			if o.Status != order.StatusPending || o.Total != 4500 {
+				t.Fatalf("\t%s\tShould be pending at the current prices totalling 4500 : %+v.", tests.Failed, o)
+			}
+			for _, l := range o.Lines {
+				if l.SaleID == nil {
+					t.Fatalf("\t%s\tShould record a sale for every line : %+v.", tests.Failed, l)
+				}
+			}
+			t.Logf("\t%s\tShould be able to check out at the current prices.", tests.Success)
+
+			p, err = products.Retrieve(ctx, kites.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product : %s.", tests.Failed, err)
+			}
+			if p.Sold != 2 || p.Revenue != 4000 || p.Available != 2 {
+				t.Fatalf("\t%s\tShould record the sale : got %d sold for %d and %d available.", tests.Failed, p.Sold, p.Revenue, p.Available)
+			}
+			t.Logf("\t%s\tShould record the sales of the lines.", tests.Success)
+
+			if _, err := s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: yoyos.ID, Quantity: 1}, now); errors.Cause(err) != order.ErrNotCart {
+				t.Fatalf("\t%s\tShould NOT be able to change a checked out order : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to change a checked out order.", tests.Success)
+		}
+	}
+}
+
+// discounts validates checkout charges the price the pricing rules give the
+// buyer.
+func discounts(t *testing.T, s order.Store, products product.Store) {
+	t.Log("Given the need to charge the pricing rules at checkout.")
+	{
+		t.Log("\tWhen checking out a cart eligible for discounts.")
+		{
+			ctx := context.Background()
+
+			drums, err := products.Create(ctx, admin, product.NewProduct{Name: "Drums", Cost: 1000, Quantity: 10}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			if _, err := products.SetTiers(ctx, admin, drums.ID, []product.NewPriceTier{{MinQuantity: 2, UnitPrice: 900}}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to set tiers : %s.", tests.Failed, err)
+			}
+			if err := products.SetDiscount(ctx, other.Subject, product.NewDiscount{Percent: 10}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to set a discount : %s.", tests.Failed, err)
+			}
+
+			o, err := s.Create(ctx, other, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create an order : %s.", tests.Failed, err)
+			}
+			o, err = s.AddLine(ctx, other, o.ID, order.NewLine{ProductID: drums.ID, Quantity: 2}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+			if o.Total != 2000 {
+				t.Fatalf("\t%s\tShould price the cart at cost : got %d.", tests.Failed, o.Total)
+			}
+			t.Logf("\t%s\tShould price the cart at cost.", tests.Success)
+
+			o, err = s.Checkout(ctx, other, o.ID, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to check out : %s.", tests.Failed, err)
+			}
+			if o.Total != 1620 || o.Lines[0].Discount != 380 {
+				t.Fatalf("\t%s\tShould charge 1620 after the tier and the discount : %+v.", tests.Failed, o)
+			}
+			t.Logf("\t%s\tShould charge the price of the pricing rules.", tests.Success)
+
+			p, err := products.Retrieve(ctx, drums.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product : %s.", tests.Failed, err)
+			}
+			if p.Sold != 2 || p.Revenue != 1620 {
+				t.Fatalf("\t%s\tShould record the sale at the charged price : got %d sold for %d.", tests.Failed, p.Sold, p.Revenue)
+			}
+			t.Logf("\t%s\tShould record the sale at the charged price.", tests.Success)
+		}
+	}
+}
+
+// transitions validates Orders only move between allowed states.
+func transitions(t *testing.T, s order.Store, products product.Store) {
+	t.Log("Given the need to track the state of an Order.")
+	{
+		t.Log("\tWhen moving an Order through its states.")
+		{
+			ctx := context.Background()
+
+			p, err := products.Create(ctx, admin, product.NewProduct{Name: "Marbles", Cost: 100, Quantity: 5}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+
+			o, err := s.Create(ctx, buyer, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create an order : %s.", tests.Failed, err)
+			}
+			if _, err := s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: p.ID, Quantity: 3}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+
+			if _, err := s.Transition(ctx, admin, o.ID, order.StatusPaid, now); errors.Cause(err) != order.ErrInvalidTransition {
+				t.Fatalf("\t%s\tShould NOT be able to pay for a cart : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to pay for a cart.", tests.Success)
+
+			if _, err := s.Checkout(ctx, buyer, o.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to check out : %s.", tests.Failed, err)
+			}
+
+			if _, err := s.Transition(ctx, buyer, o.ID, order.StatusPaid, now); errors.Cause(err) != order.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT be able to mark an order paid as its owner : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to mark an order paid as its owner.", tests.Success)
+
+			o, err = s.Transition(ctx, buyer, o.ID, order.StatusCancelled, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to cancel a pending order : %s.", tests.Failed, err)
+			}
+			if o.Status != order.StatusCancelled {
+				t.Fatalf("\t%s\tShould be cancelled : got %q.", tests.Failed, o.Status)
+			}
+			saved, err := products.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product : %s.", tests.Failed, err)
+			}
+			if saved.Sold != 0 || saved.Available != 5 {
+				t.Fatalf("\t%s\tShould return the items to stock : got %d sold and %d available.", tests.Failed, saved.Sold, saved.Available)
+			}
+			t.Logf("\t%s\tShould return the items to stock when a pending order is cancelled.", tests.Success)
+
+			if _, err := s.Transition(ctx, admin, o.ID, order.StatusPaid, now); errors.Cause(err) != order.ErrInvalidTransition {
+				t.Fatalf("\t%s\tShould NOT be able to pay for a cancelled order : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to pay for a cancelled order.", tests.Success)
+
+			o, err = s.Create(ctx, buyer, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create an order : %s.", tests.Failed, err)
+			}
+			if _, err := s.AddLine(ctx, buyer, o.ID, order.NewLine{ProductID: p.ID, Quantity: 1}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a line : %s.", tests.Failed, err)
+			}
+			if _, err := s.Checkout(ctx, buyer, o.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to check out : %s.", tests.Failed, err)
+			}
+			for _, status := range []string{order.StatusPaid, order.StatusShipped, order.StatusRefunded} {
+				o, err = s.Transition(ctx, admin, o.ID, status, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to move the order to %s : %s.", tests.Failed, status, err)
+				}
+				if o.Status != status {
+					t.Fatalf("\t%s\tShould be %s : got %q.", tests.Failed, status, o.Status)
+				}
+			}
+			t.Logf("\t%s\tShould be able to pay for, ship and refund an order.", tests.Success)
+
+			saved, err = products.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product : %s.", tests.Failed, err)
+			}
+			if saved.Sold != 0 || saved.Revenue != 0 || saved.Available != 5 {
+				t.Fatalf("\t%s\tShould refund the sales and restock : got %d sold for %d and %d available.", tests.Failed, saved.Sold, saved.Revenue, saved.Available)
+			}
+			sales, err := products.ListSales(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list sales : %s.", tests.Failed, err)
+			}
+			if len(sales) != 2 {
+				t.Fatalf("\t%s\tShould keep the sales of the orders : got %d.", tests.Failed, len(sales))
+			}
+			t.Logf("\t%s\tShould refund the sales of a refunded order and restock them.", tests.Success)
+		}
+	}
+}
+
+// access validates users only see their own Orders.
+func access(t *testing.T, s order.Store) {
+	t.Log("Given the need to keep Orders private.")
+	{
+		t.Log("\tWhen another user asks for an Order.")
+		{
+			ctx := context.Background()
+
+			o, err := s.Create(ctx, other, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create an order : %s.", tests.Failed, err)
+			}
+
+			if _, err := s.Retrieve(ctx, buyer, o.ID); errors.Cause(err) != order.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT be able to see the order of someone else : %v.", tests.Failed, err)
+			}
+			if _, err := s.Retrieve(ctx, admin, o.ID); err != nil {
+				t.Fatalf("\t%s\tShould be able to see any order as an admin : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould only see the orders of others as an admin.", tests.Success)
+
+			list, err := s.List(ctx, buyer)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list orders : %s.", tests.Failed, err)
+			}
+			for _, lo := range list {
+				if lo.UserID != buyer.Subject {
+					t.Fatalf("\t%s\tShould only list own orders : got one of %s.", tests.Failed, lo.UserID)
+				}
+			}
+			t.Logf("\t%s\tShould only list own orders.", tests.Success)
+
+			if _, err := s.Retrieve(ctx, admin, "bad-id"); errors.Cause(err) != order.ErrInvalidID {
+				t.Fatalf("\t%s\tShould reject an invalid ID : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reject an invalid ID.", tests.Success)
+		}
+	}
+}
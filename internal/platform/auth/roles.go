@@ -12,6 +12,9 @@ import (
 const (
 	RoleAdmin = "ADMIN"
 	RoleUser  = "USER"
+
+	// RolePriceOverride allows recording sales paid below the computed price.
+	RolePriceOverride = "PRICE_OVERRIDE"
 )
 
 // ctxKey represents the type of value for the context key.
@@ -45,9 +48,7 @@ func NewClaims(subject string, roles []string, now time.Time, expires time.Durat
 // Valid is called during the parsing of a token.
 func (c Claims) Valid() error {
 	for _, r := range c.Roles {
-		switch r {
-		case RoleAdmin, RoleUser: // Role is valid.
-		default:
+		if !ValidRole(r) {
 			return fmt.Errorf("invalid role %q", r)
 		}
 	}
@@ -57,6 +58,16 @@ func (c Claims) Valid() error {
 	return nil
 }
 
+// ValidRole reports whether role is one of the expected values for
+// Claims.Roles.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleUser, RolePriceOverride:
+		return true
+	}
+	return false
+}
+
 // HasRole returns true if the claims has at least one of the provided roles.
 func (c Claims) HasRole(roles ...string) bool {
 	for _, has := range c.Roles {
@@ -0,0 +1,211 @@
+// Package blob stores opaque binary objects by key. Keys are slash separated
+// relative paths like "products/<id>/images/<id>".
+package blob
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Predefined errors identify expected failure conditions.
+var (
+	// ErrNotFound is used when a blob is requested but does not exist.
+	ErrNotFound = errors.New("Blob not found")
+
+	// ErrInvalidKey is used when a key is not a clean relative path.
+	ErrInvalidKey = errors.New("Blob key is not valid")
+)
+
+// Store defines the behaviors required to keep blobs. Putting a blob replaces
+// any blob with the same key. Deleting a blob that does not exist is not an
+// error so cleanup can be retried.
+//
+// Local keeps blobs on the filesystem. Stores for S3 compatible services can
+// implement the same interface.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// checkKey makes sure a key can not escape the root of a Store.
+func checkKey(key string) error {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// Local is a Store that keeps every blob in a file under a root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal constructs a Store keeping blobs under root. The directory is
+// created if it does not exist.
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating blob directory")
+	}
+	return &Local{root: root}, nil
+}
+
+// Put writes the blob to a temporary file and moves it into place so readers
+// never see a partial blob.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) error {
+	_, span := trace.StartSpan(ctx, "internal.platform.blob.Local.Put")
+	defer span.End()
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	name := filepath.Join(l.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return errors.Wrapf(err, "creating directory of blob %s", key)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(name), ".blob-")
+	if err != nil {
+		return errors.Wrapf(err, "creating blob %s", key)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "writing blob %s", key)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "writing blob %s", key)
+	}
+
+	return errors.Wrapf(os.Rename(f.Name(), name), "storing blob %s", key)
+}
+
+// Get opens the blob for reading. The caller must close it.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	_, span := trace.StartSpan(ctx, "internal.platform.blob.Local.Get")
+	defer span.End()
+
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(l.root, filepath.FromSlash(key)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "opening blob %s", key)
+	}
+
+	return f, nil
+}
+
+// Delete removes the blob.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	_, span := trace.StartSpan(ctx, "internal.platform.blob.Local.Delete")
+	defer span.End()
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(l.root, filepath.FromSlash(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "deleting blob %s", key)
+	}
+
+	return nil
+}
+
+// Memory is a Store that keeps blobs in memory. It is safe for concurrent use
+// and is intended for tests.
+type Memory struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewMemory constructs an empty in-memory Store.
+func NewMemory() *Memory {
+	return &Memory{blobs: make(map[string][]byte)}
+}
+
+// Put keeps a copy of the blob.
+func (m *Memory) Put(ctx context.Context, key string, r io.Reader) error {
+	_, span := trace.StartSpan(ctx, "internal.platform.blob.Memory.Put")
+	defer span.End()
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "reading blob %s", key)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.blobs[key] = b
+	return nil
+}
+
+// Get gives a reader over the blob.
+func (m *Memory) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	_, span := trace.StartSpan(ctx, "internal.platform.blob.Memory.Get")
+	defer span.End()
+
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.blobs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Delete removes the blob.
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	_, span := trace.StartSpan(ctx, "internal.platform.blob.Memory.Delete")
+	defer span.End()
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.blobs, key)
+	return nil
+}
+
+// Keys gives the keys of every blob. It lets tests check blobs were cleaned
+// up.
+func (m *Memory) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.blobs))
+	for k := range m.blobs {
+		keys = append(keys, k)
+	}
+	return keys
+}
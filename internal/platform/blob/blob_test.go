@@ -0,0 +1,88 @@
+package blob_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ardanlabs/service/internal/platform/blob"
+	"github.com/ardanlabs/service/internal/tests"
+	"github.com/pkg/errors"
+)
+
+// TestLocal runs the Store tests against the filesystem.
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := blob.NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+// TestMemory runs the Store tests against the in-memory implementation.
+func TestMemory(t *testing.T) {
+	testStore(t, blob.NewMemory())
+}
+
+// testStore validates a Store keeps, replaces and deletes blobs.
+func testStore(t *testing.T, s blob.Store) {
+	t.Log("Given the need to keep blobs.")
+	{
+		ctx := context.Background()
+		const key = "products/1/images/2"
+
+		t.Log("\tWhen putting a blob.")
+		{
+			for _, body := range []string{"first", "second"} {
+				if err := s.Put(ctx, key, strings.NewReader(body)); err != nil {
+					t.Fatalf("\t%s\tShould be able to put a blob : %s.", tests.Failed, err)
+				}
+			}
+
+			r, err := s.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get the blob : %s.", tests.Failed, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to read the blob : %s.", tests.Failed, err)
+			}
+			if string(b) != "second" {
+				t.Fatalf("\t%s\tShould get the last blob put : got %q.", tests.Failed, b)
+			}
+			t.Logf("\t%s\tShould get the last blob put.", tests.Success)
+		}
+
+		t.Log("\tWhen deleting a blob.")
+		{
+			for i := 0; i < 2; i++ {
+				if err := s.Delete(ctx, key); err != nil {
+					t.Fatalf("\t%s\tShould be able to delete a blob more than once : %s.", tests.Failed, err)
+				}
+			}
+			if _, err := s.Get(ctx, key); errors.Cause(err) != blob.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT find a deleted blob : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT find a deleted blob.", tests.Success)
+		}
+
+		t.Log("\tWhen using a key outside of the store.")
+		{
+			for _, key := range []string{"", "/etc/passwd", "../x", "a/../../x", "a//b"} {
+				if err := s.Put(ctx, key, strings.NewReader("x")); errors.Cause(err) != blob.ErrInvalidKey {
+					t.Fatalf("\t%s\tShould NOT allow the key %q : %v.", tests.Failed, key, err)
+				}
+			}
+			t.Logf("\t%s\tShould NOT allow keys outside of the store.", tests.Success)
+		}
+	}
+}
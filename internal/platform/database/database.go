@@ -5,12 +5,21 @@ import (
 	"net/url"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // The database driver in use.
+	"github.com/lib/pq" // The Postgres driver.
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
 
+// These are the supported values for Config.Driver.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
 // Config is the required properties to use the database.
 type Config struct {
+	Driver     string
 	User       string
 	Password   string
 	Host       string
@@ -19,7 +28,22 @@ type Config struct {
 }
 
 // Open knows how to open a database connection based on the configuration.
+// An empty Driver defaults to Postgres. When the Driver is SQLite the Name is
+// the path of the database file or ":memory:" for a private in-memory database
+// and the remaining fields are ignored.
 func Open(cfg Config) (*sqlx.DB, error) {
+	switch cfg.Driver {
+	case "", DriverPostgres:
+		return openPostgres(cfg)
+	case DriverSQLite:
+		return openSQLite(cfg)
+	default:
+		return nil, errors.Errorf("unknown database driver %q", cfg.Driver)
+	}
+}
+
+// openPostgres opens a connection to a Postgres server.
+func openPostgres(cfg Config) (*sqlx.DB, error) {
 
 	// Define SSL mode.
 	sslMode := "require"
@@ -41,7 +65,7 @@ func Open(cfg Config) (*sqlx.DB, error) {
 		RawQuery: q.Encode(),
 	}
 
-	return sqlx.Open("postgres", u.String())
+	return sqlx.Open(DriverPostgres, u.String())
 }
 
 // StatusCheck returns nil if it can successfully talk to the database. It
@@ -58,3 +82,40 @@ func StatusCheck(ctx context.Context, db *sqlx.DB) error {
 	var tmp bool
 	return db.QueryRowContext(ctx, q).Scan(&tmp)
 }
+
+// WithTx runs f inside a transaction. The transaction is committed when f
+// returns nil and rolled back otherwise. The error from f is returned as-is so
+// callers can still compare it against their predefined errors.
+func WithTx(ctx context.Context, db *sqlx.DB, f func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+
+	if err := f(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return errors.Wrapf(err, "rolling back transaction: %v", rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return nil
+}
+
+// IsDuplicate reports whether err was caused by a row that violates a unique
+// constraint or index, so callers can tell conflicting values apart from
+// other failures of the database.
+func IsDuplicate(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case *pq.Error:
+		return err.Code == "23505" // unique_violation
+	case sqlite3.Error:
+		return err.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			err.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
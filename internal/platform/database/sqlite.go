@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register(DriverSQLite, &sqliteDriver{})
+}
+
+// openSQLite opens a SQLite database file. Foreign keys are enforced so
+// cascading deletes behave like they do in Postgres.
+func openSQLite(cfg Config) (*sqlx.DB, error) {
+	q := make(url.Values)
+	q.Set("_foreign_keys", "1")
+	q.Set("_busy_timeout", "5000")
+	q.Set("_loc", "UTC")
+
+	name := cfg.Name
+	memory := name == "" || name == ":memory:"
+	if memory {
+		name = ":memory:"
+	} else {
+		q.Set("_journal_mode", "WAL")
+	}
+
+	db, err := sqlx.Open(DriverSQLite, "file:"+name+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// Every connection to ":memory:" is a new, empty database so all work must
+	// share a single connection.
+	if memory {
+		db.SetMaxOpenConns(1)
+	}
+
+	return db, nil
+}
+
+// sqliteDriver wraps the SQLite driver so queries written for Postgres can be
+// used unchanged. Postgres numbers its placeholders as $1, $2 ... while SQLite
+// assigns indexes to $-style parameters in the order they first appear. The
+// wrapper rewrites them to the equivalent ?1, ?2 ... form.
+type sqliteDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+// Open returns a new connection to the database.
+func (d *sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{c}, nil
+}
+
+// sqliteConn rewrites the placeholders of every query before handing it to
+// the wrapped connection.
+type sqliteConn struct {
+	driver.Conn
+}
+
+// Prepare implements driver.Conn.
+func (c *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+// PrepareContext implements driver.ConnPrepareContext.
+func (c *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, rebind(query))
+	}
+	return c.Conn.Prepare(rebind(query))
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *sqliteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *sqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+// rebind converts Postgres style $N placeholders to SQLite ?N placeholders.
+// Text inside quotes is copied as-is so literals containing a $ such as
+// password hashes are not altered.
+func rebind(query string) string {
+	if !strings.Contains(query, "$") {
+		return query
+	}
+
+	var (
+		b     strings.Builder
+		quote byte
+	)
+	b.Grow(len(query))
+
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			ch = '?'
+		}
+		b.WriteByte(ch)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// TestRebind validates Postgres placeholders are rewritten for SQLite while
+// quoted text is left alone.
+func TestRebind(t *testing.T) {
+	tt := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"none", `SELECT * FROM users`, `SELECT * FROM users`},
+		{"ordered", `SELECT * FROM users WHERE user_id = $1 AND email = $2`, `SELECT * FROM users WHERE user_id = ?1 AND email = ?2`},
+		{"unordered", `UPDATE products SET "name" = $2 WHERE product_id = $1`, `UPDATE products SET "name" = ?2 WHERE product_id = ?1`},
+		{"literal", `INSERT INTO users (password_hash) VALUES ('$2a$10$abc'), ($1)`, `INSERT INTO users (password_hash) VALUES ('$2a$10$abc'), (?1)`},
+		{"identifier", `SELECT "$1" FROM t WHERE a = $1`, `SELECT "$1" FROM t WHERE a = ?1`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rebind(tc.query); got != tc.want {
+				t.Fatalf("got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestIsDuplicate validates violations of unique indexes are recognized.
+func TestIsDuplicate(t *testing.T) {
+	db, err := Open(Config{Driver: DriverSQLite})
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+
+	const schema = `CREATE TABLE t (a TEXT PRIMARY KEY, b TEXT);
+		CREATE UNIQUE INDEX t_b_idx ON t (LOWER(b));
+		INSERT INTO t (a, b) VALUES ('1', 'x');`
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatalf("creating table: %v", err)
+	}
+
+	tt := []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{"primary key", `INSERT INTO t (a, b) VALUES ('1', 'y')`, true},
+		{"unique index", `INSERT INTO t (a, b) VALUES ('2', 'X')`, true},
+		{"other", `INSERT INTO missing (a) VALUES ('1')`, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := db.Exec(tc.query)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := IsDuplicate(errors.Wrap(err, "inserting")); got != tc.want {
+				t.Fatalf("got %v want %v for %v", got, tc.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Package notify sends messages to people, like the tokens they need to reset
+// their password.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// ErrQueueFull is returned by a Queue that holds as many messages as it can.
+var ErrQueueFull = errors.New("notification queue is full")
+
+// Message is something to tell a person.
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier defines the behavior required to deliver Messages. A Message is
+// only reported as sent once it was handed off for delivery.
+//
+// Writer and File keep messages where a developer can read them and Memory
+// keeps them for tests. Queue delivers them with another Notifier in the
+// background. Notifiers for email or SMS services can implement the
+// same interface.
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+// Writer writes each Message as a line of JSON. It can be used with os.Stdout
+// for local development.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter constructs a Notifier that writes messages to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Notify implements the Notifier interface.
+func (n *Writer) Notify(ctx context.Context, m Message) error {
+	_, span := trace.StartSpan(ctx, "internal.platform.notify.Writer.Notify")
+	defer span.End()
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "encoding message")
+	}
+	data = append(data, '\n')
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, err := n.w.Write(data); err != nil {
+		return errors.Wrap(err, "writing message")
+	}
+
+	return nil
+}
+
+// File appends each Message as a line of JSON to a file.
+type File struct {
+	*Writer
+	f *os.File
+}
+
+// OpenFile opens the file at path for appending, creating it if needed. The
+// file is only readable by its owner since messages can hold secrets.
+func OpenFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening message file")
+	}
+
+	return &File{Writer: NewWriter(f), f: f}, nil
+}
+
+// Notify implements the Notifier interface. The file is synced so a message
+// is only reported as sent once it is on disk.
+func (n *File) Notify(ctx context.Context, m Message) error {
+	if err := n.Writer.Notify(ctx, m); err != nil {
+		return err
+	}
+	return n.f.Sync()
+}
+
+// Close closes the underlying file.
+func (n *File) Close() error {
+	return n.f.Close()
+}
+
+// Memory is a Notifier that keeps every Message in memory. It is intended for
+// tests.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemory constructs a Notifier that keeps messages in memory.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Notify implements the Notifier interface.
+func (n *Memory) Notify(ctx context.Context, m Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.messages = append(n.messages, m)
+	return nil
+}
+
+// Messages gives the messages sent so far, oldest first.
+func (n *Memory) Messages() []Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]Message(nil), n.messages...)
+}
+
+// Queue hands Messages to another Notifier in the background so callers do
+// not wait for delivery. Callers can then not tell from how long a request
+// takes whether a Message was sent. Failed deliveries are logged.
+type Queue struct {
+	n    Notifier
+	log  *log.Logger
+	ch   chan Message
+	done chan struct{}
+}
+
+// NewQueue constructs a Notifier that queues up to size messages for
+// delivery by n. Close must be called to deliver the queued messages.
+func NewQueue(n Notifier, log *log.Logger, size int) *Queue {
+	q := Queue{
+		n:    n,
+		log:  log,
+		ch:   make(chan Message, size),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return &q
+}
+
+// Notify implements the Notifier interface. The Message is reported as sent
+// once it is queued.
+func (q *Queue) Notify(ctx context.Context, m Message) error {
+	select {
+	case q.ch <- m:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close delivers the queued messages and stops the Queue. It must not be
+// used after it is closed.
+func (q *Queue) Close() {
+	close(q.ch)
+	<-q.done
+}
+
+// run delivers the queued messages until the Queue is closed.
+func (q *Queue) run() {
+	defer close(q.done)
+
+	for m := range q.ch {
+		if err := q.n.Notify(context.Background(), m); err != nil {
+			q.log.Printf("notify : ERROR : delivering %q : %v", m.Subject, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ardanlabs/service/internal/platform/notify"
+	"github.com/ardanlabs/service/internal/tests"
+)
+
+// TestFile validates messages are appended to a file as lines of JSON.
+func TestFile(t *testing.T) {
+	t.Log("Given the need to read messages sent during development.")
+	{
+		dir, err := ioutil.TempDir("", "notify")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "messages.log")
+
+		t.Log("\tWhen sending messages to a file.")
+		{
+			n, err := notify.OpenFile(path)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to open the file : %s.", tests.Failed, err)
+			}
+
+			sent := []notify.Message{
+				{To: "admin@example.com", Subject: "First", Body: "one"},
+				{To: "user@example.com", Subject: "Second", Body: "two\nlines"},
+			}
+			for _, m := range sent {
+				if err := n.Notify(context.Background(), m); err != nil {
+					t.Fatalf("\t%s\tShould be able to send a message : %s.", tests.Failed, err)
+				}
+			}
+			if err := n.Close(); err != nil {
+				t.Fatalf("\t%s\tShould be able to close the file : %s.", tests.Failed, err)
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to read the file : %s.", tests.Failed, err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) != len(sent) {
+				t.Fatalf("\t%s\tShould write a line for every message : got %d.", tests.Failed, len(lines))
+			}
+			for i, line := range lines {
+				var m notify.Message
+				if err := json.Unmarshal([]byte(line), &m); err != nil {
+					t.Fatalf("\t%s\tShould write every message as JSON : %s.", tests.Failed, err)
+				}
+				if m != sent[i] {
+					t.Fatalf("\t%s\tShould write the messages in order : got %+v.", tests.Failed, m)
+				}
+			}
+			t.Logf("\t%s\tShould write every message as a line of JSON.", tests.Success)
+		}
+	}
+}
+
+// TestQueue validates queued messages are delivered in the background.
+func TestQueue(t *testing.T) {
+	t.Log("Given the need to send messages without waiting for delivery.")
+	{
+		t.Log("\tWhen queueing messages.")
+		{
+			m := notify.NewMemory()
+			q := notify.NewQueue(m, log.New(ioutil.Discard, "", 0), 1)
+
+			if err := q.Notify(context.Background(), notify.Message{Subject: "First"}); err != nil {
+				t.Fatalf("\t%s\tShould be able to queue a message : %s.", tests.Failed, err)
+			}
+			q.Close()
+
+			if got := m.Messages(); len(got) != 1 || got[0].Subject != "First" {
+				t.Fatalf("\t%s\tShould deliver the queued messages : got %+v.", tests.Failed, got)
+			}
+			t.Logf("\t%s\tShould deliver the queued messages.", tests.Success)
+		}
+	}
+}
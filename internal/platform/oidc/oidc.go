@@ -0,0 +1,499 @@
+// Package oidc lets people log in with an external OpenID Connect provider.
+// It implements the authorization code flow with PKCE for a relying party and
+// verifies the ID tokens of the provider against the keys it publishes.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// ErrInvalidToken occurs when an ID token was not issued by the provider for
+// this client or is no longer valid.
+var ErrInvalidToken = errors.New("ID token is not valid")
+
+// Config describes the provider and how this service is registered with it.
+type Config struct {
+	Issuer       string   // URL the provider is discovered at and issues tokens as.
+	ClientID     string   // ID of this service at the provider.
+	ClientSecret string   // Secret of confidential clients, empty for public ones.
+	RedirectURL  string   // Where the provider sends people back to with a code.
+	Scopes       []string // Scopes requested in addition to openid.
+
+	// GroupsClaim names the claim of an ID token that lists the groups of
+	// its subject. It is "groups" when empty.
+	GroupsClaim string
+
+	// GroupRoles gives the role of every member of a group. People in none
+	// of the groups get the DefaultRoles.
+	GroupRoles   map[string]string
+	DefaultRoles []string
+
+	// Client makes the requests to the provider. It is http.DefaultClient
+	// when nil.
+	Client *http.Client
+}
+
+// Identity is someone the provider vouched for with an ID token.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Nonce         string
+	Roles         []string // Mapped from the groups of the subject.
+	ExpiresAt     time.Time
+}
+
+// Provider is an OpenID Connect provider found by discovery. Its signing keys
+// are fetched when a token uses a key that is not known yet, at most once
+// every keyRefresh.
+type Provider struct {
+	cfg      Config
+	client   *http.Client
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time // When the keys were last fetched, or tried to be.
+}
+
+// keyRefresh is how long the keys of the provider are kept before a token with
+// an unknown key has them fetched again. Tokens with made up key ids can not
+// make every request wait on the provider.
+const keyRefresh = time.Minute
+
+// Discover reads the configuration the issuer of cfg publishes and constructs
+// a Provider from it. It will error if the issuer it reports is another one
+// or the config maps groups onto unknown roles.
+func Discover(ctx context.Context, cfg Config) (*Provider, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.oidc.Discover")
+	defer span.End()
+
+	if cfg.ClientID == "" {
+		return nil, errors.New("client id cannot be blank")
+	}
+	for _, r := range cfg.GroupRoles {
+		if err := checkRole(r); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range cfg.DefaultRoles {
+		if err := checkRole(r); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	p := Provider{
+		cfg:    cfg,
+		client: cfg.Client,
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+	if p.client == nil {
+		p.client = http.DefaultClient
+	}
+
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.get(ctx, wellKnown, &doc); err != nil {
+		return nil, errors.Wrap(err, "discovering provider")
+	}
+	if doc.Issuer != cfg.Issuer {
+		return nil, errors.Errorf("provider reports issuer %q instead of %q", doc.Issuer, cfg.Issuer)
+	}
+	if doc.AuthURL == "" || doc.TokenURL == "" || doc.JWKSURL == "" {
+		return nil, errors.New("provider configuration is missing endpoints")
+	}
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthURL, doc.TokenURL, doc.JWKSURL
+
+	return &p, nil
+}
+
+// checkRole reports roles the service does not know.
+func checkRole(role string) error {
+	if !auth.ValidRole(role) {
+		return errors.Errorf("invalid role %q", role)
+	}
+	return nil
+}
+
+// Issuer gives the issuer of the tokens of the provider.
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// AuthCodeURL gives the URL of the provider to send someone to so they log
+// in. The provider sends them back to the redirect URL with the state and a
+// code that only the verifier the challenge was made from can exchange. The
+// nonce is put into the ID token.
+func (p *Provider) AuthCodeURL(state, nonce, challenge string) string {
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	return p.authURL + sep + v.Encode()
+}
+
+// Exchange trades the code the provider sent someone back with for their ID
+// token. The verifier must be the one the challenge of the code was made from.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.oidc.Exchange")
+	defer span.End()
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "creating token request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	var tkn struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := p.do(req, &tkn); err != nil {
+		if tkn.Error != "" {
+			return "", errors.Wrapf(ErrInvalidToken, "exchanging code: %s", tkn.Error)
+		}
+		return "", errors.Wrap(err, "exchanging code")
+	}
+	if tkn.IDToken == "" {
+		return "", errors.New("exchanging code: no id token in response")
+	}
+
+	return tkn.IDToken, nil
+}
+
+// Issued reports whether the token claims to be issued by the provider. It
+// does not verify the token.
+func (p *Provider) Issued(token string) bool {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return false
+	}
+	return claims.VerifyIssuer(p.cfg.Issuer, true)
+}
+
+// idClaims are the claims of an ID token this package looks at. The audience
+// can be a single string or a list.
+type idClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	NotBefore     int64    `json:"nbf"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience is the aud claim of an ID token.
+type audience []string
+
+// UnmarshalJSON accepts a single audience as well as a list.
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// leeway is how far the clocks of the provider and this service can be apart.
+const leeway = time.Minute
+
+// Verify checks that the ID token was signed by the provider for this client
+// and is valid at now, and gives the Identity it vouches for. Every failure is
+// ErrInvalidToken except when the keys of the provider can not be fetched.
+func (p *Provider) Verify(ctx context.Context, token string, now time.Time) (Identity, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.oidc.Verify")
+	defer span.End()
+
+	var fetchErr error
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := p.key(ctx, kid, now)
+		if err != nil {
+			fetchErr = err
+		}
+		return key, err
+	}
+
+	// Only RS256 is accepted so a token can not pick how it is checked. The
+	// claims are checked below against now instead of the clock.
+	parser := jwt.Parser{ValidMethods: []string{"RS256"}, SkipClaimsValidation: true}
+	tkn, err := parser.ParseWithClaims(token, jwt.MapClaims{}, keyFunc)
+	if err != nil {
+		if fetchErr != nil && errors.Cause(fetchErr) != ErrInvalidToken {
+			return Identity{}, fetchErr
+		}
+		return Identity{}, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	raw := tkn.Claims.(jwt.MapClaims)
+	var claims idClaims
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "encoding claims")
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return Identity{}, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	switch {
+	case claims.Issuer != p.cfg.Issuer:
+		return Identity{}, errors.Wrap(ErrInvalidToken, "issued by another provider")
+	case !claims.Audience.has(p.cfg.ClientID):
+		return Identity{}, errors.Wrap(ErrInvalidToken, "issued for another client")
+	case claims.Subject == "":
+		return Identity{}, errors.Wrap(ErrInvalidToken, "no subject")
+	case claims.ExpiresAt == 0 || !now.Before(time.Unix(claims.ExpiresAt, 0).Add(leeway)):
+		return Identity{}, errors.Wrap(ErrInvalidToken, "expired")
+	case claims.IssuedAt != 0 && now.Add(leeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return Identity{}, errors.Wrap(ErrInvalidToken, "issued in the future")
+	case claims.NotBefore != 0 && now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)):
+		return Identity{}, errors.Wrap(ErrInvalidToken, "not valid yet")
+	}
+
+	id := Identity{
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+		Nonce:         claims.Nonce,
+		Roles:         p.roles(groups(raw[p.cfg.GroupsClaim])),
+		ExpiresAt:     time.Unix(claims.ExpiresAt, 0).UTC(),
+	}
+	return id, nil
+}
+
+// has reports whether the audience includes the client.
+func (a audience) has(client string) bool {
+	for _, c := range a {
+		if c == client {
+			return true
+		}
+	}
+	return false
+}
+
+// groups gives the group names of a groups claim, which is a list of strings
+// or a single one.
+func groups(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var gs []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				gs = append(gs, s)
+			}
+		}
+		return gs
+	default:
+		return nil
+	}
+}
+
+// roles maps groups onto the roles of their members, each role once.
+func (p *Provider) roles(groups []string) []string {
+	var roles []string
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		if r, ok := p.cfg.GroupRoles[g]; ok && !seen[r] {
+			seen[r] = true
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == 0 {
+		roles = append(roles, p.cfg.DefaultRoles...)
+	}
+	return roles
+}
+
+// key gives the public key with the kid. The keys of the provider are fetched
+// again when it is not known, which picks up rotated keys. Until keyRefresh
+// has passed since the last fetch unknown keys fail right away. The lock is
+// not held while fetching so known keys keep working in the meantime.
+func (p *Provider) key(ctx context.Context, kid string, now time.Time) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	fetch := !ok && !now.Before(p.fetched.Add(keyRefresh))
+	if fetch {
+		p.fetched = now
+	}
+	p.mu.Unlock()
+
+	switch {
+	case ok:
+		return key, nil
+	case !fetch:
+		return nil, errors.Wrapf(ErrInvalidToken, "unrecognized key id %q", kid)
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, errors.Wrapf(ErrInvalidToken, "unrecognized key id %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys gets the RSA signing keys of the provider by their kid.
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.get(ctx, p.jwksURL, &set); err != nil {
+		return nil, errors.Wrap(err, "fetching provider keys")
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding modulus of key %q", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding exponent of key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// get decodes the JSON document at url into v.
+func (p *Provider) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	return p.do(req.WithContext(ctx), v)
+}
+
+// do sends the request and decodes the JSON response into v. Responses other
+// than 200 are decoded as well before they are reported.
+func (p *Provider) do(req *http.Request, v interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return errors.Wrap(err, "reading response")
+	}
+	if err := json.Unmarshal(data, v); err != nil && resp.StatusCode == http.StatusOK {
+		return errors.Wrap(err, "decoding response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s %s: status %d", req.Method, req.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// NewVerifier gives a random PKCE code verifier. Only its holder can exchange
+// a code requested with its Challenge.
+func NewVerifier() (string, error) {
+	return random()
+}
+
+// Challenge gives the S256 PKCE challenge of the verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewState gives a random value to use as the state or nonce of a login.
+func NewState() (string, error) {
+	return random()
+}
+
+// random gives 32 random bytes encoded for use in a URL.
+func random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generating random value")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,215 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/oidc"
+	"github.com/ardanlabs/service/internal/platform/oidc/oidctest"
+	"github.com/ardanlabs/service/internal/tests"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+)
+
+// clientID is the ID the tests are registered with at the stub provider.
+const clientID = "sales-api"
+
+// discover finds the stub provider with groups mapped onto roles.
+func discover(t *testing.T, stub *oidctest.Provider) *oidc.Provider {
+	t.Helper()
+
+	p, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:       stub.Issuer,
+		ClientID:     clientID,
+		RedirectURL:  "http://sales.example.com/v1/users/oidc/callback",
+		Scopes:       []string{"email", "profile"},
+		GroupRoles:   map[string]string{"sales-admins": auth.RoleAdmin, "sales": auth.RoleUser},
+		DefaultRoles: []string{auth.RoleUser},
+	})
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to discover the provider : %s.", tests.Failed, err)
+	}
+	return p
+}
+
+// TestCodeFlow validates logging in with the authorization code flow and PKCE.
+func TestCodeFlow(t *testing.T) {
+	stub := oidctest.Start(t, clientID)
+	defer stub.Close()
+
+	stub.Login(map[string]interface{}{
+		"sub":            "jane",
+		"email":          "jane@example.com",
+		"email_verified": true,
+		"name":           "Jane Gopher",
+		"groups":         []string{"sales-admins", "sales", "other"},
+	})
+
+	p := discover(t, stub)
+
+	// The client does not follow redirects so the code can be read from where
+	// the provider sends the browser.
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	login := func(challenge string) url.Values {
+		resp, err := client.Get(p.AuthCodeURL("the-state", "the-nonce", challenge))
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to log in at the provider : %s.", tests.Failed, err)
+		}
+		resp.Body.Close()
+		back, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || resp.StatusCode != http.StatusFound {
+			t.Fatalf("\t%s\tShould be sent back with a code : %d %v.", tests.Failed, resp.StatusCode, err)
+		}
+		return back.Query()
+	}
+
+	t.Log("Given the need to log people in with an external provider.")
+	{
+		ctx := context.Background()
+
+		verifier, err := oidc.NewVerifier()
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create a verifier : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tTest 0:\tWhen exchanging the code with its verifier.")
+		{
+			back := login(oidc.Challenge(verifier))
+			if back.Get("state") != "the-state" {
+				t.Fatalf("\t%s\tShould get the state back : got %q.", tests.Failed, back.Get("state"))
+			}
+			t.Logf("\t%s\tShould get the state back.", tests.Success)
+
+			tkn, err := p.Exchange(ctx, back.Get("code"), verifier)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to exchange the code : %s.", tests.Failed, err)
+			}
+			id, err := p.Verify(ctx, tkn, time.Now())
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to verify the id token : %s.", tests.Failed, err)
+			}
+
+			want := oidc.Identity{
+				Issuer:        stub.Issuer,
+				Subject:       "jane",
+				Email:         "jane@example.com",
+				EmailVerified: true,
+				Name:          "Jane Gopher",
+				Nonce:         "the-nonce",
+				Roles:         []string{auth.RoleAdmin, auth.RoleUser},
+				ExpiresAt:     id.ExpiresAt,
+			}
+			if diff := cmp.Diff(want, id); diff != "" {
+				t.Fatalf("\t%s\tShould get the identity with roles for its groups. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould get the identity with roles for its groups.", tests.Success)
+
+			if _, err := p.Exchange(ctx, back.Get("code"), verifier); errors.Cause(err) != oidc.ErrInvalidToken {
+				t.Fatalf("\t%s\tShould NOT exchange a code twice : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT exchange a code twice.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen exchanging the code with another verifier.")
+		{
+			back := login(oidc.Challenge(verifier))
+
+			other, err := oidc.NewVerifier()
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a verifier : %s.", tests.Failed, err)
+			}
+			if _, err := p.Exchange(ctx, back.Get("code"), other); errors.Cause(err) != oidc.ErrInvalidToken {
+				t.Fatalf("\t%s\tShould NOT exchange the code : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT exchange the code.", tests.Success)
+		}
+	}
+}
+
+// TestVerify validates only ID tokens of the provider for this client are
+// accepted.
+func TestVerify(t *testing.T) {
+	stub := oidctest.Start(t, clientID)
+	defer stub.Close()
+	other := oidctest.Start(t, clientID)
+	defer other.Close()
+
+	p := discover(t, stub)
+	now := time.Now()
+
+	t.Log("Given the need to accept the ID tokens of a provider.")
+	{
+		ctx := context.Background()
+
+		t.Log("\tTest 0:\tWhen verifying valid tokens.")
+		{
+			id, err := p.Verify(ctx, stub.IDToken(t, map[string]interface{}{"sub": "kim"}), now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould accept the token : %s.", tests.Failed, err)
+			}
+			if id.Subject != "kim" || !cmp.Equal(id.Roles, []string{auth.RoleUser}) {
+				t.Fatalf("\t%s\tShould get the default roles without groups : got %+v.", tests.Failed, id)
+			}
+			t.Logf("\t%s\tShould get the default roles without groups.", tests.Success)
+
+			tkn := stub.IDToken(t, map[string]interface{}{"sub": "kim", "aud": []string{"someone", clientID}})
+			if _, err := p.Verify(ctx, tkn, now); err != nil {
+				t.Fatalf("\t%s\tShould accept a list of audiences : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould accept a list of audiences.", tests.Success)
+
+			if !p.Issued(tkn) {
+				t.Fatalf("\t%s\tShould recognize the tokens of the provider.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould recognize the tokens of the provider.", tests.Success)
+
+			stub.RotateKey(t)
+			rotated := stub.IDToken(t, map[string]interface{}{"sub": "kim"})
+			fetches := stub.KeyFetches()
+			if _, err := p.Verify(ctx, rotated, now); errors.Cause(err) != oidc.ErrInvalidToken {
+				t.Fatalf("\t%s\tShould NOT fetch the keys again right away : %v.", tests.Failed, err)
+			}
+			if n := stub.KeyFetches(); n != fetches {
+				t.Fatalf("\t%s\tShould NOT fetch the keys again right away : fetched %d times.", tests.Failed, n-fetches)
+			}
+			t.Logf("\t%s\tShould NOT fetch the keys again right away.", tests.Success)
+
+			if _, err := p.Verify(ctx, rotated, now.Add(time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould accept tokens signed with a rotated key : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould accept tokens signed with a rotated key.", tests.Success)
+		}
+
+		t.Log("\tTest 1:\tWhen verifying invalid tokens.")
+		{
+			invalid := []struct {
+				name string
+				tkn  string
+			}{
+				{"expired", stub.IDToken(t, map[string]interface{}{"sub": "kim", "exp": now.Add(-time.Hour).Unix()})},
+				{"for another client", stub.IDToken(t, map[string]interface{}{"sub": "kim", "aud": "someone"})},
+				{"of another issuer", stub.IDToken(t, map[string]interface{}{"sub": "kim", "iss": "https://evil.example.com"})},
+				{"without a subject", stub.IDToken(t, map[string]interface{}{})},
+				{"signed by someone else", other.IDToken(t, map[string]interface{}{"sub": "kim", "iss": stub.Issuer})},
+				{"malformed", "not-a-token"},
+			}
+			for _, tt := range invalid {
+				if _, err := p.Verify(ctx, tt.tkn, now); errors.Cause(err) != oidc.ErrInvalidToken {
+					t.Fatalf("\t%s\tShould reject a token %s : %v.", tests.Failed, tt.name, err)
+				}
+				t.Logf("\t%s\tShould reject a token %s.", tests.Success, tt.name)
+			}
+
+			if p.Issued(other.IDToken(t, map[string]interface{}{"sub": "kim"})) {
+				t.Fatalf("\t%s\tShould NOT recognize the tokens of another provider.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould NOT recognize the tokens of another provider.", tests.Success)
+		}
+	}
+}
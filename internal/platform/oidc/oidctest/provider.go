@@ -0,0 +1,249 @@
+// Package oidctest runs a stub OpenID Connect provider for tests.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Provider is a stub provider serving discovery, its keys, and the
+// authorization and token endpoints of the authorization code flow. Everyone
+// sent to it is logged in right away as the subject of the claims set with
+// Login.
+type Provider struct {
+	Issuer   string
+	ClientID string
+
+	server *httptest.Server
+
+	mu      sync.Mutex
+	kid     string
+	key     *rsa.PrivateKey
+	login   jwt.MapClaims
+	grants  map[string]grant
+	fetches int
+}
+
+// grant is a code given out by the authorization endpoint.
+type grant struct {
+	challenge   string
+	redirectURI string
+	claims      jwt.MapClaims
+}
+
+// Start runs a Provider for the client with the ID. Call Close when the test
+// is done with it.
+func Start(t *testing.T, clientID string) *Provider {
+	t.Helper()
+
+	p := Provider{
+		ClientID: clientID,
+		grants:   make(map[string]grant),
+	}
+	p.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/keys", p.keys)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+
+	p.server = httptest.NewServer(mux)
+	p.Issuer = p.server.URL
+
+	return &p
+}
+
+// Close stops the Provider.
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+// RotateKey replaces the signing key with a new one under another kid.
+func (p *Provider) RotateKey(t *testing.T) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.key = key
+	p.kid = random()
+}
+
+// KeyFetches gives how many times the keys of the Provider were fetched.
+func (p *Provider) KeyFetches() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fetches
+}
+
+// Login sets the claims of the ID token given to the next people to log in.
+// The issuer, audience and times are filled in.
+func (p *Provider) Login(claims map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.login = jwt.MapClaims(claims)
+}
+
+// IDToken signs an ID token with the claims. The issuer, audience and times
+// are filled in unless the claims set them; the token expires in an hour.
+func (p *Provider) IDToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	tkn, err := p.sign(claims)
+	if err != nil {
+		t.Fatalf("signing id token: %v", err)
+	}
+	return tkn
+}
+
+// sign signs an ID token with the claims and the current key.
+func (p *Provider) sign(claims map[string]interface{}) (string, error) {
+	now := time.Now()
+	c := jwt.MapClaims{
+		"iss": p.Issuer,
+		"aud": p.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+
+	p.mu.Lock()
+	key, kid := p.key, p.kid
+	p.mu.Unlock()
+
+	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	tkn.Header["kid"] = kid
+	return tkn.SignedString(key)
+}
+
+// discovery serves the configuration of the provider.
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.Issuer,
+		"authorization_endpoint": p.Issuer + "/authorize",
+		"token_endpoint":         p.Issuer + "/token",
+		"jwks_uri":               p.Issuer + "/keys",
+	})
+}
+
+// keys serves the public key of the current signing key.
+func (p *Provider) keys(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	pub, kid := p.key.PublicKey, p.kid
+	p.fetches++
+	p.mu.Unlock()
+
+	key := map[string]string{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []interface{}{key}})
+}
+
+// authorize logs in right away and sends the browser back with a code. Only
+// S256 challenges are supported.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	claims := jwt.MapClaims{"nonce": q.Get("nonce")}
+	for k, v := range p.login {
+		claims[k] = v
+	}
+	code := random()
+	p.grants[code] = grant{
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+		claims:      claims,
+	}
+	p.mu.Unlock()
+
+	back, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect", http.StatusBadRequest)
+		return
+	}
+	v := back.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	back.RawQuery = v.Encode()
+
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token once, given the verifier of its
+// challenge.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	p.mu.Lock()
+	g, ok := p.grants[r.PostForm.Get("code")]
+	delete(p.grants, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok,
+		r.PostForm.Get("grant_type") != "authorization_code",
+		r.PostForm.Get("client_id") != p.ClientID,
+		r.PostForm.Get("redirect_uri") != g.redirectURI,
+		base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	tkn, err := p.sign(g.claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": "stub",
+		"token_type":   "Bearer",
+		"id_token":     tkn,
+	})
+}
+
+// writeJSON responds with v as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// random gives a random value encoded for use in a URL.
+func random() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
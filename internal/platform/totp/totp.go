@@ -0,0 +1,107 @@
+// Package totp implements the time-based one-time passwords of RFC 6238 as
+// generated by authenticator apps. Codes have six digits, change every thirty
+// seconds and are derived with HMAC-SHA1 from a secret shared with the app.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Digits is the length of a code.
+	Digits = 6
+
+	// Period is how long a code is current.
+	Period = 30 * time.Second
+
+	// Skew is the number of periods before and after the current one whose
+	// codes are also accepted to allow for clock drift.
+	Skew = 1
+)
+
+// encoding is how secrets are shared with authenticator apps.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret generates a random secret in the base32 form apps expect.
+func NewSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generating secret")
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Step gives the number of the period t is in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code gives the code of the secret for the period numbered step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", errors.Wrap(err, "decoding secret")
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation as defined by RFC 4226.
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, v%1000000), nil
+}
+
+// Validate checks code against the codes of the secret around now. Only
+// periods after the one numbered last are considered so a code can not be
+// used twice. It returns the number of the period the code belongs to.
+func Validate(secret, code string, now time.Time, last int64) (int64, bool, error) {
+	cur := Step(now)
+	for step := cur - Skew; step <= cur+Skew; step++ {
+		if step <= last {
+			continue
+		}
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// URI gives the otpauth URI apps read, usually from a QR code, to add the
+// secret of account at issuer.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
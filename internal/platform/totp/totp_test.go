@@ -0,0 +1,110 @@
+package totp_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/totp"
+	"github.com/ardanlabs/service/internal/tests"
+)
+
+// secret is the key of the RFC 6238 test vectors, "12345678901234567890", in
+// base32.
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCode validates codes against the SHA1 test vectors of RFC 6238, which
+// have eight digits of which the last six are used here.
+func TestCode(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	t.Log("Given the need to generate the codes of authenticator apps.")
+	{
+		for i, v := range vectors {
+			t.Logf("\tTest %d:\tWhen generating the code at %d.", i, v.unix)
+			{
+				code, err := totp.Code(secret, totp.Step(time.Unix(v.unix, 0)))
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to generate a code : %s.", tests.Failed, err)
+				}
+				if code != v.code {
+					t.Fatalf("\t%s\tShould get %s : got %s.", tests.Failed, v.code, code)
+				}
+				t.Logf("\t%s\tShould get %s.", tests.Success, v.code)
+			}
+		}
+	}
+}
+
+// TestValidate validates codes are accepted within the allowed skew and only
+// once.
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	cur := totp.Step(now)
+
+	t.Log("Given the need to check codes entered by users.")
+	{
+		t.Log("\tWhen checking codes around the current period.")
+		{
+			for _, step := range []int64{cur - 1, cur, cur + 1} {
+				code, err := totp.Code(secret, step)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to generate a code : %s.", tests.Failed, err)
+				}
+				got, ok, err := totp.Validate(secret, code, now, 0)
+				if err != nil || !ok || got != step {
+					t.Fatalf("\t%s\tShould accept the code of period %d : got %d %v %v.", tests.Failed, step, got, ok, err)
+				}
+			}
+			t.Logf("\t%s\tShould accept the codes of adjacent periods.", tests.Success)
+
+			code, err := totp.Code(secret, cur-2)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to generate a code : %s.", tests.Failed, err)
+			}
+			if _, ok, _ := totp.Validate(secret, code, now, 0); ok {
+				t.Fatalf("\t%s\tShould reject an old code.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould reject an old code.", tests.Success)
+
+			code, err = totp.Code(secret, cur)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to generate a code : %s.", tests.Failed, err)
+			}
+			if _, ok, _ := totp.Validate(secret, code, now, cur); ok {
+				t.Fatalf("\t%s\tShould reject a code of a period already used.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould reject a code of a period already used.", tests.Success)
+		}
+
+		t.Log("\tWhen sharing a new secret.")
+		{
+			s, err := totp.NewSecret()
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to generate a secret : %s.", tests.Failed, err)
+			}
+			if _, err := totp.Code(s, cur); err != nil {
+				t.Fatalf("\t%s\tShould generate a usable secret : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould generate a usable secret.", tests.Success)
+
+			u, err := url.Parse(totp.URI("Garage Sale", "admin@example.com", s))
+			if err != nil {
+				t.Fatalf("\t%s\tShould give a valid URI : %s.", tests.Failed, err)
+			}
+			if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Garage Sale:admin@example.com" || u.Query().Get("secret") != s {
+				t.Fatalf("\t%s\tShould give an otpauth URI of the secret : got %s.", tests.Failed, u)
+			}
+			t.Logf("\t%s\tShould give an otpauth URI of the secret.", tests.Success)
+		}
+	}
+}
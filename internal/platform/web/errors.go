@@ -30,6 +30,12 @@ func NewRequestError(err error, status int) error {
 	return &Error{err, status, nil}
 }
 
+// NewFieldError wraps a provided error with an HTTP status code and reports
+// it for the request field it is about.
+func NewFieldError(err error, status int, field string) error {
+	return &Error{err, status, []FieldError{{Field: field, Error: err.Error()}}}
+}
+
 // Error implements the error interface. It uses the default message of the
 // wrapped error. This is what will be shown in the services' logs.
 func (err *Error) Error() string {
@@ -3,6 +3,7 @@ package web
 import (
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"reflect"
 	"strings"
@@ -83,3 +84,14 @@ func Decode(r *http.Request, val interface{}) error {
 
 	return nil
 }
+
+// SourceAddr gives the address a request came from without its port. The
+// service is expected to be reached directly so forwarding headers, which
+// clients can set to anything, are not trusted.
+func SourceAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
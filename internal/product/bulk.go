@@ -0,0 +1,437 @@
+package product
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// These are the formats Products are imported from and exported to. CSV
+// files start with a header naming the columns of csvColumns in any order.
+// Tags are separated by semicolons and attributes are a JSON object. NDJSON
+// files hold one NewProduct document per line.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// MaxImportRows is the largest number of rows a single import may hold.
+const MaxImportRows = 10000
+
+// csvColumns are the columns of a CSV file. They are the fields of NewProduct.
+var csvColumns = []string{"name", "cost", "currency", "quantity", "category_id", "tags", "attributes"}
+
+// validate checks NewProduct values read from import files against the same
+// rules applied to requests.
+var validate = func() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(fld reflect.StructField) string {
+		name := strings.SplitN(fld.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}()
+
+// DecodeProducts reads the rows of an import file. Rows that can not be read
+// or are not valid are given with their Err set so every problem of a file is
+// reported at once. An error is only returned when the file as a whole can
+// not be read.
+func DecodeProducts(r io.Reader, format string) ([]ImportRow, error) {
+	var rows []ImportRow
+	var err error
+	switch format {
+	case FormatCSV:
+		rows, err = decodeCSV(r)
+	case FormatNDJSON:
+		rows, err = decodeNDJSON(r)
+	default:
+		return nil, errors.Wrapf(ErrInvalidImport, "unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.Wrap(ErrInvalidImport, "no rows")
+	}
+
+	for i := range rows {
+		if rows[i].Err == nil {
+			rows[i].Err = checkRow(rows[i].Product)
+		}
+	}
+
+	return rows, nil
+}
+
+// decodeCSV reads the rows of a CSV file.
+func decodeCSV(r io.Reader) ([]ImportRow, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.Wrap(ErrInvalidImport, "no header")
+		}
+		return nil, errors.Wrapf(ErrInvalidImport, "reading header: %v", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !knownColumn(name) {
+			return nil, errors.Wrapf(ErrInvalidImport, "unknown column %q", name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, errors.Wrapf(ErrInvalidImport, "duplicate column %q", name)
+		}
+		columns[name] = i
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if len(rows) == MaxImportRows {
+			return nil, errors.Wrapf(ErrInvalidImport, "more than %d rows", MaxImportRows)
+		}
+
+		row := ImportRow{Row: len(rows) + 1}
+		perr, _ := err.(*csv.ParseError)
+		switch {
+		case err == nil:
+			row.Product, row.Err = csvProduct(record, columns)
+		case perr != nil && perr.Err == csv.ErrFieldCount:
+			row.Err = errors.Errorf("row has %d fields instead of %d", len(record), len(header))
+		default:
+			return nil, errors.Wrapf(ErrInvalidImport, "reading row %d: %v", row.Row, err)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// knownColumn reports whether name is one of the CSV columns.
+func knownColumn(name string) bool {
+	for _, c := range csvColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// csvProduct converts a CSV record to a NewProduct. Empty cells leave their
+// field unset.
+func csvProduct(record []string, columns map[string]int) (NewProduct, error) {
+	cell := func(name string) string {
+		i, ok := columns[name]
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	np := NewProduct{
+		Name:     cell("name"),
+		Currency: cell("currency"),
+	}
+
+	for name, dst := range map[string]*int{"cost": &np.Cost, "quantity": &np.Quantity} {
+		v := cell(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return NewProduct{}, errors.Errorf("%s must be a number: %q", name, v)
+		}
+		*dst = n
+	}
+
+	if id := cell("category_id"); id != "" {
+		np.CategoryID = &id
+	}
+
+	if tags := cell("tags"); tags != "" {
+		for _, t := range strings.Split(tags, ";") {
+			if t = strings.TrimSpace(t); t != "" {
+				np.Tags = append(np.Tags, t)
+			}
+		}
+	}
+
+	if attrs := cell("attributes"); attrs != "" {
+		if err := json.Unmarshal([]byte(attrs), &np.Attributes); err != nil {
+			return NewProduct{}, errors.Errorf("attributes must be a JSON object: %v", err)
+		}
+	}
+
+	return np, nil
+}
+
+// decodeNDJSON reads the rows of an NDJSON file. Blank lines are skipped.
+func decodeNDJSON(r io.Reader) ([]ImportRow, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+
+	var rows []ImportRow
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(rows) == MaxImportRows {
+			return nil, errors.Wrapf(ErrInvalidImport, "more than %d rows", MaxImportRows)
+		}
+
+		row := ImportRow{Row: len(rows) + 1}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row.Product); err != nil {
+			row.Product, row.Err = NewProduct{}, errors.Errorf("invalid JSON: %v", err)
+		}
+		rows = append(rows, row)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrapf(ErrInvalidImport, "reading row %d: %v", len(rows)+1, err)
+	}
+
+	return rows, nil
+}
+
+// checkRow validates a NewProduct with its validate tags. Every failed field
+// is named in the error.
+func checkRow(np NewProduct) error {
+	err := validate.Struct(np)
+	if err == nil {
+		return nil
+	}
+
+	verrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
+
+	msgs := make([]string, len(verrors))
+	for i, fe := range verrors {
+		rule := fe.Tag()
+		if fe.Param() != "" {
+			rule += "=" + fe.Param()
+		}
+		msgs[i] = fmt.Sprintf("%s must satisfy %s", fe.Field(), rule)
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// EncodeProducts writes Products in an import format so exported files can be
+// imported again. Quantity is written as the original stock of the Product.
+func EncodeProducts(w io.Writer, format string, products []Product) error {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return errors.Wrap(err, "writing header")
+		}
+		for _, p := range products {
+			var category, attrs string
+			if p.CategoryID != nil {
+				category = *p.CategoryID
+			}
+			if len(p.Attributes) > 0 {
+				data, err := json.Marshal(p.Attributes)
+				if err != nil {
+					return errors.Wrapf(err, "encoding attributes of %s", p.ID)
+				}
+				attrs = string(data)
+			}
+
+			record := []string{
+				p.Name, strconv.Itoa(p.Cost), p.Currency, strconv.Itoa(p.Quantity),
+				category, strings.Join(p.Tags, ";"), attrs,
+			}
+			if err := cw.Write(record); err != nil {
+				return errors.Wrapf(err, "writing product %s", p.ID)
+			}
+		}
+		cw.Flush()
+		return errors.Wrap(cw.Error(), "writing csv")
+
+	case FormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, p := range products {
+			np := NewProduct{
+				Name:       p.Name,
+				Cost:       p.Cost,
+				Currency:   p.Currency,
+				Quantity:   p.Quantity,
+				CategoryID: p.CategoryID,
+				Tags:       p.Tags,
+				Attributes: p.Attributes,
+			}
+			if err := enc.Encode(np); err != nil {
+				return errors.Wrapf(err, "writing product %s", p.ID)
+			}
+		}
+		return nil
+	}
+
+	return errors.Wrapf(ErrInvalidImport, "unknown format %q", format)
+}
+
+// errRollback discards the changes of an import that must not be kept.
+var errRollback = errors.New("rollback")
+
+// Import creates a Product for every valid row in a single transaction. The
+// transaction is rolled back for a dry run and for an atomic import with
+// invalid rows.
+func (s *DB) Import(ctx context.Context, user auth.Claims, rows []ImportRow, opts ImportOptions, now time.Time) (*ImportResult, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Import")
+	defer span.End()
+
+	res := newImportResult(rows, opts)
+	ids := make([]string, len(rows))
+
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		for i, row := range rows {
+			if row.Err != nil {
+				res.reject(i, row.Err)
+				continue
+			}
+
+			p, err := create(ctx, tx, user, row.Product, now)
+			if err != nil {
+				if !isRowError(err) {
+					return errors.Wrapf(err, "importing row %d", row.Row)
+				}
+				res.reject(i, err)
+				continue
+			}
+			ids[i] = p.ID
+			res.Valid++
+		}
+
+		if !res.keep() {
+			return errRollback
+		}
+		return nil
+	})
+	if err != nil && err != errRollback {
+		return nil, err
+	}
+
+	if err == nil {
+		res.created(ids)
+	}
+	return res, nil
+}
+
+// Import creates a Product for every valid row. Nothing is kept for a dry run
+// or for an atomic import with invalid rows.
+func (m *Memory) Import(ctx context.Context, user auth.Claims, rows []ImportRow, opts ImportOptions, now time.Time) (*ImportResult, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Import")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := newImportResult(rows, opts)
+	products := make([]Product, len(rows))
+	for i, row := range rows {
+		if row.Err != nil {
+			res.reject(i, row.Err)
+			continue
+		}
+
+		p, err := m.newProduct(user, row.Product, now)
+		if err != nil {
+			if !isRowError(err) {
+				return nil, errors.Wrapf(err, "importing row %d", row.Row)
+			}
+			res.reject(i, err)
+			continue
+		}
+		products[i] = p
+		res.Valid++
+	}
+
+	if !res.keep() {
+		return res, nil
+	}
+
+	ids := make([]string, len(rows))
+	for i, p := range products {
+		if p.ID != "" {
+			m.insert(p)
+			ids[i] = p.ID
+		}
+	}
+	res.created(ids)
+
+	return res, nil
+}
+
+// isRowError reports whether err is caused by the values of an imported row
+// rather than a failure of the store.
+func isRowError(err error) bool {
+	switch errors.Cause(err) {
+	case money.ErrInvalidCurrency, ErrCategoryNotFound, ErrInvalidAttributes:
+		return true
+	}
+	return false
+}
+
+// newImportResult gives the result of an import before any row is handled.
+func newImportResult(rows []ImportRow, opts ImportOptions) *ImportResult {
+	res := ImportResult{
+		DryRun: opts.DryRun,
+		Atomic: opts.Atomic,
+		Rows:   make([]ImportedRow, len(rows)),
+	}
+	for i, row := range rows {
+		res.Rows[i].Row = row.Row
+	}
+	return &res
+}
+
+// reject records why the i-th row was not imported.
+func (res *ImportResult) reject(i int, err error) {
+	res.Rows[i].Error = err.Error()
+	res.Failed++
+}
+
+// keep reports whether the Products of the valid rows are to be kept.
+func (res *ImportResult) keep() bool {
+	return !res.DryRun && !(res.Atomic && res.Failed > 0)
+}
+
+// created records the IDs of the Products that were kept.
+func (res *ImportResult) created(ids []string) {
+	for i, id := range ids {
+		if id != "" {
+			res.Rows[i].ID = id
+			res.Created++
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Attributes are the custom attributes of a Product keyed by name. Numbers are
+// kept as float64 like they are after decoding JSON. They are stored as JSON.
+type Attributes map[string]interface{}
+
+// Value stores the attributes as JSON.
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding attributes")
+	}
+	return string(b), nil
+}
+
+// Scan reads attributes stored as JSON.
+func (a *Attributes) Scan(src interface{}) error {
+	*a = Attributes{}
+	return scanJSON(src, a)
+}
+
+// Schema lists the custom attributes of the Products of a Category. It is
+// stored as JSON.
+type Schema []AttributeDef
+
+// Value stores the schema as JSON.
+func (s Schema) Value() (driver.Value, error) {
+	if s == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding schema")
+	}
+	return string(b), nil
+}
+
+// Scan reads a schema stored as JSON.
+func (s *Schema) Scan(src interface{}) error {
+	*s = Schema{}
+	return scanJSON(src, s)
+}
+
+// scanJSON decodes a JSON column into dst. NULL leaves dst untouched.
+func scanJSON(src interface{}, dst interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.Errorf("unsupported type %T for a JSON column", src)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(b, dst), "decoding JSON column")
+}
+
+// ListCategories gives every Category ordered by name.
+func (s *DB) ListCategories(ctx context.Context) ([]Category, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ListCategories")
+	defer span.End()
+
+	categories := []Category{}
+	const q = `SELECT * FROM categories ORDER BY name, category_id`
+
+	if err := s.db.SelectContext(ctx, &categories, q); err != nil {
+		return nil, errors.Wrap(err, "selecting categories")
+	}
+
+	return categories, nil
+}
+
+// CreateCategory adds a Category under an optional parent.
+func (s *DB) CreateCategory(ctx context.Context, nc NewCategory, now time.Time) (*Category, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.CreateCategory")
+	defer span.End()
+
+	c := Category{
+		ID:          uuid.New().String(),
+		Name:        nc.Name,
+		Schema:      nc.Schema,
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+	if c.Schema == nil {
+		c.Schema = Schema{}
+	}
+	if nc.ParentID != nil && *nc.ParentID != "" {
+		c.ParentID = nc.ParentID
+	}
+	if err := validSchema(c.Schema); err != nil {
+		return nil, err
+	}
+
+	const q = `INSERT INTO categories
+		(category_id, parent_id, name, schema, date_created, date_updated)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if c.ParentID != nil {
+			if _, err := retrieveCategory(ctx, tx, *c.ParentID); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.ExecContext(ctx, q, c.ID, c.ParentID, c.Name, c.Schema, c.DateCreated, c.DateUpdated)
+		if err != nil {
+			return errors.Wrap(err, "inserting category")
+		}
+
+		return event.Record(ctx, tx, event.CategoryCreated, c.ID, c, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// RetrieveCategory finds the Category identified by a given ID.
+func (s *DB) RetrieveCategory(ctx context.Context, id string) (*Category, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.RetrieveCategory")
+	defer span.End()
+
+	return retrieveCategory(ctx, s.db, id)
+}
+
+// UpdateCategory modifies a Category. It will error if the Category would
+// become its own ancestor or if the new schema does not describe the
+// attributes of its Products.
+func (s *DB) UpdateCategory(ctx context.Context, id string, uc UpdateCategory, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.UpdateCategory")
+	defer span.End()
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		const lock = `UPDATE categories SET category_id = category_id WHERE category_id = $1`
+		if _, err := tx.ExecContext(ctx, lock, id); err != nil {
+			return errors.Wrapf(err, "locking category %s", id)
+		}
+
+		c, err := retrieveCategory(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		if uc.Name != nil {
+			c.Name = *uc.Name
+		}
+		if uc.ParentID != nil {
+			c.ParentID = nil
+			if *uc.ParentID != "" {
+				c.ParentID = uc.ParentID
+				if err := checkAncestors(ctx, tx, id, *uc.ParentID); err != nil {
+					return err
+				}
+			}
+		}
+		if uc.Schema != nil {
+			if err := validSchema(*uc.Schema); err != nil {
+				return err
+			}
+			c.Schema = *uc.Schema
+
+			var attrs []Attributes
+			const qa = `SELECT attributes FROM products WHERE category_id = $1`
+			if err := tx.SelectContext(ctx, &attrs, qa, id); err != nil {
+				return errors.Wrapf(err, "selecting products of category %s", id)
+			}
+			for _, a := range attrs {
+				if _, err := checkAttributes(c.Schema, a); err != nil {
+					return err
+				}
+			}
+		}
+		c.DateUpdated = now.UTC()
+
+		const q = `UPDATE categories SET
+			parent_id = $2,
+			name = $3,
+			schema = $4,
+			date_updated = $5
+			WHERE category_id = $1`
+		if _, err := tx.ExecContext(ctx, q, id, c.ParentID, c.Name, c.Schema, c.DateUpdated); err != nil {
+			return errors.Wrap(err, "updating category")
+		}
+
+		return event.Record(ctx, tx, event.CategoryUpdated, c.ID, c, now)
+	})
+}
+
+// DeleteCategory removes a Category that has no subcategories and no active
+// Products. Deleted Products in the Category lose their Category.
+func (s *DB) DeleteCategory(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.DeleteCategory")
+	defer span.End()
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if _, err := retrieveCategory(ctx, tx, id); err != nil {
+			return err
+		}
+
+		var used int
+		const qu = `SELECT
+			(SELECT COUNT(*) FROM categories WHERE parent_id = $1) +
+			(SELECT COUNT(*) FROM products WHERE category_id = $1 AND deleted_at IS NULL)`
+		if err := tx.GetContext(ctx, &used, qu, id); err != nil {
+			return errors.Wrapf(err, "counting uses of category %s", id)
+		}
+		if used > 0 {
+			return ErrCategoryInUse
+		}
+
+		const q = `DELETE FROM categories WHERE category_id = $1`
+		if _, err := tx.ExecContext(ctx, q, id); err != nil {
+			return errors.Wrapf(err, "deleting category %s", id)
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.CategoryDeleted, id, data, now)
+	})
+}
+
+// retrieveCategory reads a Category through db.
+func retrieveCategory(ctx context.Context, db sqlx.QueryerContext, id string) (*Category, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	var c Category
+	const q = `SELECT * FROM categories WHERE category_id = $1`
+	if err := sqlx.GetContext(ctx, db, &c, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrCategoryNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting category %s", id)
+	}
+
+	return &c, nil
+}
+
+// subcategoriesQuery selects the IDs of the Category given by the placeholder
+// $n and of all of its descendants.
+func subcategoriesQuery(n int) string {
+	return `WITH RECURSIVE sub(category_id) AS (
+			SELECT category_id FROM categories WHERE category_id = $` + strconv.Itoa(n) + `
+			UNION ALL
+			SELECT c.category_id FROM categories AS c JOIN sub ON c.parent_id = sub.category_id
+		)
+		SELECT category_id FROM sub`
+}
+
+// checkAncestors makes sure moving the Category id under parent does not
+// make it its own ancestor.
+func checkAncestors(ctx context.Context, tx *sqlx.Tx, id, parent string) error {
+	for cur := &parent; cur != nil; {
+		if *cur == id {
+			return ErrInvalidCategory
+		}
+		c, err := retrieveCategory(ctx, tx, *cur)
+		if err != nil {
+			return err
+		}
+		cur = c.ParentID
+	}
+	return nil
+}
+
+// categorize checks the Category and attributes of a Product and gives the
+// attributes to store. A Product without a Category has no attributes.
+func categorize(ctx context.Context, db sqlx.QueryerContext, categoryID *string, a Attributes) (*string, Attributes, error) {
+	if categoryID == nil || *categoryID == "" {
+		if len(a) > 0 {
+			return nil, nil, ErrInvalidAttributes
+		}
+		return nil, Attributes{}, nil
+	}
+
+	c, err := retrieveCategory(ctx, db, *categoryID)
+	if err != nil {
+		if err == ErrInvalidID {
+			return nil, nil, ErrCategoryNotFound
+		}
+		return nil, nil, err
+	}
+
+	a, err = checkAttributes(c.Schema, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := *categoryID
+	return &id, a, nil
+}
+
+// setTags replaces the tags of a Product.
+func setTags(ctx context.Context, tx *sqlx.Tx, productID string, tags []string) error {
+	const del = `DELETE FROM product_tags WHERE product_id = $1`
+	if _, err := tx.ExecContext(ctx, del, productID); err != nil {
+		return errors.Wrap(err, "deleting tags")
+	}
+
+	const ins = `INSERT INTO product_tags (product_id, tag) VALUES ($1, $2)`
+	for _, t := range tags {
+		if _, err := tx.ExecContext(ctx, ins, productID, t); err != nil {
+			return errors.Wrap(err, "inserting tag")
+		}
+	}
+
+	return nil
+}
+
+// loadTags reads the tags of the products into them.
+func loadTags(ctx context.Context, db sqlx.QueryerContext, products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	var rows []struct {
+		ProductID string `db:"product_id"`
+		Tag       string `db:"tag"`
+	}
+
+	q := `SELECT product_id, tag FROM product_tags WHERE product_id = $1 ORDER BY tag`
+	args := []interface{}{products[0].ID}
+	if len(products) > 1 {
+		q = `SELECT product_id, tag FROM product_tags ORDER BY tag`
+		args = nil
+	}
+	if err := sqlx.SelectContext(ctx, db, &rows, q, args...); err != nil {
+		return errors.Wrap(err, "selecting tags")
+	}
+
+	tags := make(map[string][]string)
+	for _, r := range rows {
+		tags[r.ProductID] = append(tags[r.ProductID], r.Tag)
+	}
+	for i := range products {
+		products[i].Tags = append([]string{}, tags[products[i].ID]...)
+	}
+
+	return nil
+}
+
+// checkAttributes validates attributes against the schema of a Category and
+// gives them back with numbers as float64.
+func checkAttributes(s Schema, a Attributes) (Attributes, error) {
+	out := Attributes{}
+	defs := make(map[string]AttributeDef, len(s))
+	for _, d := range s {
+		defs[d.Name] = d
+	}
+
+	for name, v := range a {
+		d, ok := defs[name]
+		if !ok {
+			return nil, ErrInvalidAttributes
+		}
+
+		switch d.Type {
+		case AttributeString:
+			if _, ok := v.(string); !ok {
+				return nil, ErrInvalidAttributes
+			}
+		case AttributeBoolean:
+			if _, ok := v.(bool); !ok {
+				return nil, ErrInvalidAttributes
+			}
+		case AttributeNumber:
+			switch n := v.(type) {
+			case float64:
+			case int:
+				v = float64(n)
+			default:
+				return nil, ErrInvalidAttributes
+			}
+		}
+		out[name] = v
+	}
+
+	for _, d := range s {
+		if _, ok := out[d.Name]; d.Required && !ok {
+			return nil, ErrInvalidAttributes
+		}
+	}
+
+	return out, nil
+}
+
+// validSchema checks attribute names are unique and types are known.
+func validSchema(s Schema) error {
+	seen := make(map[string]bool)
+	for _, d := range s {
+		if d.Name == "" || seen[d.Name] {
+			return ErrInvalidCategory
+		}
+		switch d.Type {
+		case AttributeString, AttributeNumber, AttributeBoolean:
+		default:
+			return ErrInvalidCategory
+		}
+		seen[d.Name] = true
+	}
+	return nil
+}
+
+// normalizeTags lower cases and trims tags, dropping empty and repeated ones.
+// The result is sorted.
+func normalizeTags(tags []string) []string {
+	out := []string{}
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
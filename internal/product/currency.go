@@ -0,0 +1,160 @@
+package product
+
+import (
+	"context"
+	"time"
+
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// SetRates stores exchange rates, replacing any earlier rate between the same
+// currencies.
+func (s *DB) SetRates(ctx context.Context, rates []money.Rate, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.SetRates")
+	defer span.End()
+
+	for _, r := range rates {
+		if !money.Valid(r.From) || !money.Valid(r.To) {
+			return money.ErrInvalidCurrency
+		}
+		if r.Rate <= 0 {
+			return money.ErrInvalidRate
+		}
+	}
+
+	const q = `INSERT INTO exchange_rates
+		(from_currency, to_currency, rate, date_updated)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (from_currency, to_currency) DO UPDATE SET rate = $3, date_updated = $4`
+
+	return database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		for _, r := range rates {
+			if _, err := tx.ExecContext(ctx, q, r.From, r.To, r.Rate, now.UTC()); err != nil {
+				return errors.Wrapf(err, "storing rate %s/%s", r.From, r.To)
+			}
+		}
+		return nil
+	})
+}
+
+// ListRates gives every stored exchange rate.
+func (s *DB) ListRates(ctx context.Context) ([]money.Rate, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ListRates")
+	defer span.End()
+
+	rates := []money.Rate{}
+	const q = `SELECT * FROM exchange_rates ORDER BY from_currency, to_currency`
+
+	if err := s.db.SelectContext(ctx, &rates, q); err != nil {
+		return nil, errors.Wrap(err, "selecting rates")
+	}
+
+	return rates, nil
+}
+
+// Convert changes m into the currency to using the stored exchange rates.
+func (s *DB) Convert(ctx context.Context, m money.Money, to string) (money.Money, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Convert")
+	defer span.End()
+
+	return convert(ctx, s.db, m, to)
+}
+
+// Revenue totals the revenue of every Product per currency, net of refunds.
+// Products that were deleted but not purged are included.
+func (s *DB) Revenue(ctx context.Context) ([]money.Money, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Revenue")
+	defer span.End()
+
+	revenue := []money.Money{}
+	const q = `SELECT currency, SUM(amount) AS amount FROM (
+			SELECT s.currency, s.paid AS amount FROM sales AS s
+			UNION ALL
+			SELECT s.currency, -r.amount AS amount FROM refunds AS r
+			JOIN sales AS s ON s.sale_id = r.sale_id
+		) AS t
+		GROUP BY currency
+		ORDER BY currency`
+
+	if err := s.db.SelectContext(ctx, &revenue, q); err != nil {
+		return nil, errors.Wrap(err, "selecting revenue")
+	}
+
+	return revenue, nil
+}
+
+// ConvertTx changes m into the currency to using the exchange rates visible
+// to the transaction tx.
+func ConvertTx(ctx context.Context, tx *sqlx.Tx, m money.Money, to string) (money.Money, error) {
+	return convert(ctx, tx, m, to)
+}
+
+// convert changes m into the currency to. The inverse of a stored rate is used
+// when only the opposite rate is known.
+func convert(ctx context.Context, db sqlx.QueryerContext, m money.Money, to string) (money.Money, error) {
+	if !money.Valid(m.Currency) || !money.Valid(to) {
+		return money.Money{}, money.ErrInvalidCurrency
+	}
+	if m.Currency == to {
+		return m, nil
+	}
+
+	rates := []money.Rate{}
+	const q = `SELECT * FROM exchange_rates
+		WHERE (from_currency = $1 AND to_currency = $2) OR (from_currency = $2 AND to_currency = $1)`
+	if err := sqlx.SelectContext(ctx, db, &rates, q, m.Currency, to); err != nil {
+		return money.Money{}, errors.Wrap(err, "selecting rate")
+	}
+
+	r, err := pickRate(rates, m.Currency, to)
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	return r.Convert(m)
+}
+
+// pickRate finds the rate from one currency to another, preferring a stored
+// rate over the inverse of the opposite rate.
+func pickRate(rates []money.Rate, from, to string) (money.Rate, error) {
+	for _, r := range rates {
+		if r.From == from && r.To == to {
+			return r, nil
+		}
+	}
+	for _, r := range rates {
+		if r.From == to && r.To == from {
+			return r.Inverse(), nil
+		}
+	}
+	return money.Rate{}, ErrNoRate
+}
+
+// salePaid gives the amount paid for ns in the currency of its Product. An
+// amount paid in another currency is changed with convert.
+func salePaid(ns NewSale, currency string, convert func(money.Money) (money.Money, error)) (int, error) {
+	if ns.Currency == "" || ns.Currency == currency {
+		return ns.Paid, nil
+	}
+
+	m, err := convert(money.Money{Amount: ns.Paid, Currency: ns.Currency})
+	if err != nil {
+		return 0, err
+	}
+	return m.Amount, nil
+}
+
+// newCurrency checks the currency of a new record and defaults it.
+func newCurrency(code string) (string, error) {
+	if code == "" {
+		return money.DefaultCurrency, nil
+	}
+	if !money.Valid(code) {
+		return "", money.ErrInvalidCurrency
+	}
+	return code, nil
+}
@@ -0,0 +1,200 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// TagList is the tags of a Version. It is stored as a JSON array.
+type TagList []string
+
+// Value encodes the tags as JSON for the database.
+func (t TagList) Value() (driver.Value, error) {
+	if t == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding tags")
+	}
+	return string(b), nil
+}
+
+// Scan decodes the tags from the database.
+func (t *TagList) Scan(src interface{}) error {
+	*t = TagList{}
+	return scanJSON(src, t)
+}
+
+// History gives every Version of an active Product, oldest first.
+func (s *DB) History(ctx context.Context, id string) ([]Version, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.History")
+	defer span.End()
+
+	if _, err := s.Retrieve(ctx, id); err != nil {
+		return nil, err
+	}
+
+	versions := []Version{}
+	const q = `SELECT * FROM product_versions WHERE product_id = $1 ORDER BY version`
+	if err := s.db.SelectContext(ctx, &versions, q, id); err != nil {
+		return nil, errors.Wrap(err, "selecting versions")
+	}
+
+	return versions, nil
+}
+
+// RetrieveVersion gives the Version of an active Product that was current at
+// the given time. ErrNotFound is returned for times before it was created.
+func (s *DB) RetrieveVersion(ctx context.Context, id string, asOf time.Time) (*Version, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.RetrieveVersion")
+	defer span.End()
+
+	if _, err := s.Retrieve(ctx, id); err != nil {
+		return nil, err
+	}
+
+	var v Version
+	const q = `SELECT * FROM product_versions
+		WHERE product_id = $1 AND date_created <= $2
+		ORDER BY version DESC LIMIT 1`
+	if err := s.db.GetContext(ctx, &v, q, id, asOf.UTC()); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting version of %q", id)
+	}
+
+	return &v, nil
+}
+
+// History gives every Version of an active Product, oldest first.
+func (m *Memory) History(ctx context.Context, id string) ([]Version, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.History")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if p, ok := m.products[id]; !ok || p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	versions := make([]Version, len(m.versions[id]))
+	for i, v := range m.versions[id] {
+		versions[i] = copyVersion(v)
+	}
+	return versions, nil
+}
+
+// RetrieveVersion gives the Version of an active Product that was current at
+// the given time. ErrNotFound is returned for times before it was created.
+func (m *Memory) RetrieveVersion(ctx context.Context, id string, asOf time.Time) (*Version, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.RetrieveVersion")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if p, ok := m.products[id]; !ok || p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	versions := m.versions[id]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].DateCreated.After(asOf) {
+			v := copyVersion(versions[i])
+			return &v, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// recordVersion keeps the state of a Product after a change as its next
+// Version. The Product must be locked or new so versions are numbered
+// without gaps.
+func recordVersion(ctx context.Context, tx *sqlx.Tx, p Product, changedBy string, now time.Time) error {
+	var n int
+	const last = `SELECT COALESCE(MAX(version), 0) FROM product_versions WHERE product_id = $1`
+	if err := tx.GetContext(ctx, &n, last, p.ID); err != nil {
+		return errors.Wrapf(err, "selecting last version of %q", p.ID)
+	}
+
+	v := newVersion(p, n+1, changedBy, now)
+	const q = `INSERT INTO product_versions
+		(product_id, version, name, cost, currency, quantity, category_id, tags, attributes, changed_by, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	_, err := tx.ExecContext(ctx, q,
+		v.ProductID, v.Version,
+		v.Name, v.Cost, v.Currency, v.Quantity,
+		v.CategoryID, v.Tags, v.Attributes,
+		v.ChangedBy, v.DateCreated)
+	if err != nil {
+		return errors.Wrap(err, "inserting version")
+	}
+
+	return nil
+}
+
+// recordVersion keeps the state of a Product after a change as its next
+// Version. The caller must hold the lock.
+func (m *Memory) recordVersion(p Product, changedBy string, now time.Time) {
+	v := newVersion(p, len(m.versions[p.ID])+1, changedBy, now)
+	m.versions[p.ID] = append(m.versions[p.ID], copyVersion(v))
+}
+
+// newVersion gives the numbered Version of the state of a Product.
+func newVersion(p Product, n int, changedBy string, now time.Time) Version {
+	v := Version{
+		ProductID:   p.ID,
+		Version:     n,
+		Name:        p.Name,
+		Cost:        p.Cost,
+		Currency:    p.Currency,
+		Quantity:    p.Quantity,
+		CategoryID:  p.CategoryID,
+		Tags:        TagList(p.Tags),
+		Attributes:  p.Attributes,
+		ChangedBy:   changedBy,
+		DateCreated: now.UTC(),
+	}
+	if v.Tags == nil {
+		v.Tags = TagList{}
+	}
+	if v.Attributes == nil {
+		v.Attributes = Attributes{}
+	}
+	return v
+}
+
+// copyVersion copies the slices, maps and pointers of a Version so stored
+// versions can not be changed through the returned one.
+func copyVersion(v Version) Version {
+	v.Tags = append(TagList{}, v.Tags...)
+	attrs := make(Attributes, len(v.Attributes))
+	for k, a := range v.Attributes {
+		attrs[k] = a
+	}
+	v.Attributes = attrs
+	if v.CategoryID != nil {
+		id := *v.CategoryID
+		v.CategoryID = &id
+	}
+	return v
+}
@@ -0,0 +1,352 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// stockColumns computes the stock aggregates of the product aliased as p from
+// the inventory ledger.
+const stockColumns = `(SELECT COALESCE(SUM(m.quantity), 0) FROM inventory_movements AS m
+				WHERE m.product_id = p.product_id AND m.kind NOT IN ('reservation', 'release')) AS on_hand,
+			(SELECT COALESCE(SUM(m.quantity), 0) FROM inventory_movements AS m
+				WHERE m.product_id = p.product_id) AS available`
+
+// Adjust records a change to the stock of a Product made by hand. Only admins
+// and the owner of the Product may adjust its stock.
+func (s *DB) Adjust(ctx context.Context, user auth.Claims, productID string, na NewAdjustment, now time.Time) (*Movement, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Adjust")
+	defer span.End()
+
+	if err := validAdjustment(na); err != nil {
+		return nil, err
+	}
+
+	p, err := s.Retrieve(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return nil, ErrForbidden
+	}
+
+	m := Movement{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		Kind:        na.Kind,
+		Quantity:    na.Quantity,
+		Reason:      na.Reason,
+		UserID:      &user.Subject,
+		DateCreated: now.UTC(),
+	}
+
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		return move(ctx, tx, m, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Reserve holds items of a Product so they can not be taken by anyone else.
+// The reservation is released automatically once it expires.
+func (s *DB) Reserve(ctx context.Context, user auth.Claims, productID string, nr NewReservation, now time.Time) (*Movement, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Reserve")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m, err := newReservation(user, productID, nr, now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		return move(ctx, tx, m, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Release returns the items held by a reservation to the available stock.
+// Releasing a reservation more than once does nothing. Only the user who made
+// the reservation, the owner of the product or an admin may release it.
+func (s *DB) Release(ctx context.Context, user auth.Claims, productID, reservationID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Release")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return ErrInvalidID
+	}
+	if _, err := uuid.Parse(reservationID); err != nil {
+		return ErrInvalidID
+	}
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		p, err := lockProduct(ctx, tx, productID)
+		if err != nil {
+			return err
+		}
+
+		var r Movement
+		const q = `SELECT * FROM inventory_movements
+			WHERE movement_id = $1 AND product_id = $2 AND kind = $3`
+		if err := tx.GetContext(ctx, &r, q, reservationID, productID, MovementReservation); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return errors.Wrapf(err, "selecting reservation %s", reservationID)
+		}
+
+		if !canRelease(user, *p, r) {
+			return ErrForbidden
+		}
+
+		return release(ctx, tx, r, "Released", now)
+	})
+}
+
+// ListMovements gives the inventory ledger of a Product in the order the
+// movements were made.
+func (s *DB) ListMovements(ctx context.Context, productID string) ([]Movement, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ListMovements")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	movements := []Movement{}
+	const q = `SELECT * FROM inventory_movements WHERE product_id = $1 ORDER BY date_created`
+
+	if err := s.db.SelectContext(ctx, &movements, q, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting movements")
+	}
+
+	return movements, nil
+}
+
+// ExpireReservations releases every reservation that has expired at the
+// provided time. It returns the number of reservations released.
+func (s *DB) ExpireReservations(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ExpireReservations")
+	defer span.End()
+
+	reservations := []Movement{}
+	const q = `SELECT r.* FROM inventory_movements AS r
+		WHERE r.kind = 'reservation' AND NOT EXISTS (
+			SELECT 1 FROM inventory_movements AS x
+			WHERE x.kind = 'release' AND x.reservation_id = r.movement_id
+		)`
+
+	if err := s.db.SelectContext(ctx, &reservations, q); err != nil {
+		return 0, errors.Wrap(err, "selecting reservations")
+	}
+
+	var n int
+	for _, r := range reservations {
+		if !expired(r, now) {
+			continue
+		}
+
+		err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+			if _, err := lockProduct(ctx, tx, r.ProductID); err != nil && err != ErrNotFound {
+				return err
+			}
+			return release(ctx, tx, r, "Expired", now)
+		})
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// lockProduct locks the row of a Product for the rest of the transaction and
+// returns it without aggregates. Touching the row with an UPDATE takes the
+// lock on both Postgres and SQLite. Deleted products are locked but reported
+// as not found.
+func lockProduct(ctx context.Context, tx *sqlx.Tx, id string) (*Product, error) {
+	const lock = `UPDATE products SET product_id = product_id WHERE product_id = $1`
+	if _, err := tx.ExecContext(ctx, lock, id); err != nil {
+		return nil, errors.Wrapf(err, "locking product %s", id)
+	}
+
+	var p Product
+	const q = `SELECT * FROM products WHERE product_id = $1`
+	if err := tx.GetContext(ctx, &p, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting product %s", id)
+	}
+
+	if p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	return &p, nil
+}
+
+// move adds a Movement to the ledger of an active Product. Expired
+// reservations of the Product are released first so they do not hold stock.
+// A movement that takes items fails if fewer items are available.
+func move(ctx context.Context, tx *sqlx.Tx, m Movement, now time.Time) error {
+	if _, err := lockProduct(ctx, tx, m.ProductID); err != nil {
+		return err
+	}
+
+	if m.Quantity < 0 {
+		reservations := []Movement{}
+		const q = `SELECT r.* FROM inventory_movements AS r
+			WHERE r.product_id = $1 AND r.kind = 'reservation' AND NOT EXISTS (
+				SELECT 1 FROM inventory_movements AS x
+				WHERE x.kind = 'release' AND x.reservation_id = r.movement_id
+			)`
+		if err := tx.SelectContext(ctx, &reservations, q, m.ProductID); err != nil {
+			return errors.Wrap(err, "selecting reservations")
+		}
+		for _, r := range reservations {
+			if expired(r, now) {
+				if err := release(ctx, tx, r, "Expired", now); err != nil {
+					return err
+				}
+			}
+		}
+
+		var available int
+		const avail = `SELECT COALESCE(SUM(quantity), 0) FROM inventory_movements WHERE product_id = $1`
+		if err := tx.GetContext(ctx, &available, avail, m.ProductID); err != nil {
+			return errors.Wrap(err, "selecting available stock")
+		}
+
+		if available+m.Quantity < 0 {
+			return ErrInsufficientStock
+		}
+	}
+
+	return insertMovement(ctx, tx, m, now)
+}
+
+// release adds the Movement that releases reservation r unless it was already
+// released. The caller must hold the lock on the Product.
+func release(ctx context.Context, tx *sqlx.Tx, r Movement, reason string, now time.Time) error {
+	var count int
+	const q = `SELECT COUNT(*) FROM inventory_movements WHERE reservation_id = $1 AND kind = $2`
+	if err := tx.GetContext(ctx, &count, q, r.ID, MovementRelease); err != nil {
+		return errors.Wrapf(err, "selecting release of %s", r.ID)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	m := Movement{
+		ID:            uuid.New().String(),
+		ProductID:     r.ProductID,
+		Kind:          MovementRelease,
+		Quantity:      -r.Quantity,
+		Reason:        reason,
+		ReservationID: &r.ID,
+		DateCreated:   now.UTC(),
+	}
+	return insertMovement(ctx, tx, m, now)
+}
+
+// insertMovement writes m to the ledger together with its event.
+func insertMovement(ctx context.Context, tx *sqlx.Tx, m Movement, now time.Time) error {
+	const q = `INSERT INTO inventory_movements
+		(movement_id, product_id, kind, quantity, reason, reservation_id, user_id, expires_at, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	var expires *time.Time
+	if m.ExpiresAt != nil {
+		t := m.ExpiresAt.UTC()
+		expires = &t
+	}
+
+	_, err := tx.ExecContext(ctx, q,
+		m.ID, m.ProductID, m.Kind, m.Quantity, m.Reason,
+		m.ReservationID, m.UserID, expires, m.DateCreated.UTC(),
+	)
+	if err != nil {
+		return errors.Wrap(err, "inserting movement")
+	}
+
+	return event.Record(ctx, tx, event.InventoryMoved, m.ProductID, m, now)
+}
+
+// validAdjustment checks the quantity of an adjustment suits its kind.
+func validAdjustment(na NewAdjustment) error {
+	switch na.Kind {
+	case MovementReceive, MovementReturn:
+		if na.Quantity <= 0 {
+			return ErrInvalidMovement
+		}
+	case MovementAdjust:
+		if na.Quantity == 0 {
+			return ErrInvalidMovement
+		}
+	default:
+		return ErrInvalidMovement
+	}
+	return nil
+}
+
+// newReservation builds the Movement that holds the requested items for the
+// user.
+func newReservation(user auth.Claims, productID string, nr NewReservation, now time.Time) (Movement, error) {
+	if nr.Quantity <= 0 || nr.TTL < 0 {
+		return Movement{}, ErrInvalidMovement
+	}
+
+	ttl := DefaultReservationTTL
+	if nr.TTL > 0 {
+		ttl = time.Duration(nr.TTL) * time.Second
+	}
+	expires := now.Add(ttl).UTC()
+
+	m := Movement{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		Kind:        MovementReservation,
+		Quantity:    -nr.Quantity,
+		UserID:      &user.Subject,
+		ExpiresAt:   &expires,
+		DateCreated: now.UTC(),
+	}
+	m.ReservationID = &m.ID
+
+	return m, nil
+}
+
+// canRelease reports if the user may release reservation r of product p. The
+// user who made the reservation, the owner of the product and admins can.
+func canRelease(user auth.Claims, p Product, r Movement) bool {
+	if user.HasRole(auth.RoleAdmin) || p.UserID == user.Subject {
+		return true
+	}
+	return r.UserID != nil && *r.UserID == user.Subject
+}
+
+// expired reports if reservation r no longer holds stock at the provided time.
+func expired(r Movement, now time.Time) bool {
+	return r.ExpiresAt != nil && !r.ExpiresAt.After(now)
+}
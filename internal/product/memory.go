@@ -0,0 +1,1505 @@
+package product
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/google/uuid"
+	"go.opencensus.io/trace"
+)
+
+// Memory is a Store that keeps Products and Sales in memory. It is safe for
+// concurrent use and is intended for tests and local development where
+// running a database is not practical.
+type Memory struct {
+	mu         sync.RWMutex
+	products   map[string]Product
+	sales      []Sale
+	refunds    []Refund
+	movements  []Movement
+	rates      []money.Rate
+	tiers      map[string][]PriceTier
+	coupons    map[string]Coupon
+	discounts  map[string]Discount
+	categories map[string]Category
+	versions   map[string][]Version
+}
+
+// NewMemory constructs an empty in-memory Store.
+func NewMemory() *Memory {
+	return &Memory{
+		products:   make(map[string]Product),
+		tiers:      make(map[string][]PriceTier),
+		coupons:    make(map[string]Coupon),
+		discounts:  make(map[string]Discount),
+		categories: make(map[string]Category),
+		versions:   make(map[string][]Version),
+	}
+}
+
+// Load adds existing Products and Sales to the store as-is. It is used to seed
+// the store with known records. The inventory ledger gets the same movements
+// the database migration creates for existing records. Records without a
+// currency get the default currency like they do in the database.
+func (m *Memory) Load(products []Product, sales []Sale) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range products {
+		p.Sold, p.Revenue, p.OnHand, p.Available = 0, 0, 0, 0
+		if p.Currency == "" {
+			p.Currency = money.DefaultCurrency
+		}
+		if p.Attributes == nil {
+			p.Attributes = Attributes{}
+		}
+		p.Tags = normalizeTags(p.Tags)
+		m.products[p.ID] = p
+		m.movements = append(m.movements, Movement{
+			ID:          p.ID,
+			ProductID:   p.ID,
+			Kind:        MovementReceive,
+			Quantity:    p.Quantity,
+			Reason:      "Initial stock",
+			DateCreated: p.DateCreated,
+		})
+		m.recordVersion(p, p.UserID, p.DateCreated)
+	}
+	for _, s := range sales {
+		if s.Currency == "" {
+			s.Currency = money.DefaultCurrency
+		}
+		if s.Rules == nil {
+			s.Rules = []AppliedRule{}
+		}
+		m.sales = append(m.sales, s)
+		m.movements = append(m.movements, Movement{
+			ID:          s.ID,
+			ProductID:   s.ProductID,
+			Kind:        MovementSale,
+			Quantity:    -s.Quantity,
+			DateCreated: s.DateCreated,
+		})
+	}
+}
+
+// List gets all Products from the store. Deleted Products are only included
+// when the filter asks for them.
+func (m *Memory) List(ctx context.Context, f Filter) ([]Product, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.List")
+	defer span.End()
+
+	if f.Category != "" {
+		if _, err := uuid.Parse(f.Category); err != nil {
+			return nil, ErrInvalidID
+		}
+	}
+	tag := strings.ToLower(strings.TrimSpace(f.Tag))
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var categories map[string]bool
+	if f.Category != "" {
+		categories = m.subcategories(f.Category)
+	}
+
+	products := make([]Product, 0, len(m.products))
+	for _, p := range m.products {
+		if p.DeletedAt != nil && !f.IncludeDeleted {
+			continue
+		}
+		if categories != nil && (p.CategoryID == nil || !categories[*p.CategoryID]) {
+			continue
+		}
+		if tag != "" && !hasTag(p.Tags, tag) {
+			continue
+		}
+		products = append(products, m.aggregate(p))
+	}
+
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].DateCreated.Before(products[j].DateCreated)
+	})
+
+	return products, nil
+}
+
+// Create adds a Product to the store. It returns the created Product with
+// fields like ID and DateCreated populated.
+func (m *Memory) Create(ctx context.Context, user auth.Claims, np NewProduct, now time.Time) (*Product, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Create")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.newProduct(user, np, now)
+	if err != nil {
+		return nil, err
+	}
+	m.insert(p)
+
+	p = m.aggregate(p)
+	return &p, nil
+}
+
+// newProduct checks a NewProduct and gives the Product it creates. The caller
+// must hold the lock.
+func (m *Memory) newProduct(user auth.Claims, np NewProduct, now time.Time) (Product, error) {
+	currency, err := newCurrency(np.Currency)
+	if err != nil {
+		return Product{}, err
+	}
+
+	p := Product{
+		ID:          uuid.New().String(),
+		Name:        np.Name,
+		Cost:        np.Cost,
+		Currency:    currency,
+		Quantity:    np.Quantity,
+		UserID:      user.Subject,
+		OnHand:      np.Quantity,
+		Available:   np.Quantity,
+		Tags:        normalizeTags(np.Tags),
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+
+	p.CategoryID, p.Attributes, err = m.categorize(np.CategoryID, np.Attributes)
+	if err != nil {
+		return Product{}, err
+	}
+
+	return p, nil
+}
+
+// insert keeps a new Product with its initial stock. The caller must hold
+// the lock.
+func (m *Memory) insert(p Product) {
+	m.products[p.ID] = p
+	m.recordVersion(p, p.UserID, p.DateCreated)
+	m.movements = append(m.movements, Movement{
+		ID:          p.ID,
+		ProductID:   p.ID,
+		Kind:        MovementReceive,
+		Quantity:    p.Quantity,
+		Reason:      "Initial stock",
+		UserID:      &p.UserID,
+		DateCreated: p.DateCreated,
+	})
+}
+
+// Retrieve finds the product identified by a given ID. Deleted products are
+// not found.
+func (m *Memory) Retrieve(ctx context.Context, id string) (*Product, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Retrieve")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.products[id]
+	if !ok || p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	p = m.aggregate(p)
+	return &p, nil
+}
+
+// Update modifies data about a Product. It will error if the specified ID is
+// invalid or does not reference an existing Product.
+func (m *Memory) Update(ctx context.Context, user auth.Claims, id string, update UpdateProduct, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Update")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[id]
+	if !ok || p.DeletedAt != nil {
+		return ErrNotFound
+	}
+
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return ErrForbidden
+	}
+
+	if update.Name != nil {
+		p.Name = *update.Name
+	}
+	if update.Cost != nil {
+		p.Cost = *update.Cost
+	}
+	if update.CategoryID != nil || update.Attributes != nil {
+		categoryID, attrs := p.CategoryID, p.Attributes
+		if update.CategoryID != nil {
+			categoryID = update.CategoryID
+			if *categoryID == "" {
+				attrs = nil
+			}
+		}
+		if update.Attributes != nil {
+			attrs = *update.Attributes
+		}
+		var err error
+		if p.CategoryID, p.Attributes, err = m.categorize(categoryID, attrs); err != nil {
+			return err
+		}
+	}
+	if update.Tags != nil {
+		p.Tags = normalizeTags(*update.Tags)
+	}
+	if update.Quantity != nil && *update.Quantity != p.Quantity {
+		mv := Movement{
+			ID:          uuid.New().String(),
+			ProductID:   id,
+			Kind:        MovementAdjust,
+			Quantity:    *update.Quantity - p.Quantity,
+			Reason:      "Quantity updated",
+			UserID:      &user.Subject,
+			DateCreated: now.UTC(),
+		}
+		if err := m.move(mv, now); err != nil {
+			return err
+		}
+		p.Quantity = *update.Quantity
+	}
+	p.DateUpdated = now.UTC()
+
+	m.products[id] = p
+	m.recordVersion(p, user.Subject, now)
+
+	return nil
+}
+
+// Delete marks the product identified by a given ID as deleted. Its Sales are
+// kept.
+func (m *Memory) Delete(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Delete")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[id]
+	if !ok || p.DeletedAt != nil {
+		return nil
+	}
+
+	deleted := now.UTC()
+	p.DeletedAt = &deleted
+	m.products[id] = p
+
+	return nil
+}
+
+// Restore returns a deleted product to the active set. Restoring a product
+// that is not deleted does nothing. It will error if the specified ID is
+// invalid or does not reference an existing Product.
+func (m *Memory) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if p.DeletedAt == nil {
+		return nil
+	}
+
+	p.DeletedAt = nil
+	p.DateUpdated = now.UTC()
+	m.products[id] = p
+
+	return nil
+}
+
+// Transfer gives every product owned by the user from, deleted or not, to
+// the user to. It returns the number of products transferred.
+func (m *Memory) Transfer(ctx context.Context, from, to string, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Transfer")
+	defer span.End()
+
+	if _, err := uuid.Parse(from); err != nil {
+		return 0, ErrInvalidID
+	}
+	if _, err := uuid.Parse(to); err != nil {
+		return 0, ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for id, p := range m.products {
+		if p.UserID == from {
+			p.UserID = to
+			p.DateUpdated = now.UTC()
+			m.products[id] = p
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Purge permanently removes products that were deleted before the provided
+// time along with their Sales. It returns the number of products removed.
+func (m *Memory) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Purge")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := make(map[string]bool)
+	for id, p := range m.products {
+		if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+			delete(m.products, id)
+			delete(m.tiers, id)
+			delete(m.versions, id)
+			purged[id] = true
+		}
+	}
+
+	sales := m.sales[:0]
+	for _, s := range m.sales {
+		if !purged[s.ProductID] {
+			sales = append(sales, s)
+		}
+	}
+	m.sales = sales
+
+	refunds := m.refunds[:0]
+	for _, r := range m.refunds {
+		if !purged[r.ProductID] {
+			refunds = append(refunds, r)
+		}
+	}
+	m.refunds = refunds
+
+	movements := m.movements[:0]
+	for _, mv := range m.movements {
+		if !purged[mv.ProductID] {
+			movements = append(movements, mv)
+		}
+	}
+	m.movements = movements
+
+	return len(purged), nil
+}
+
+// AddSale records a sales transaction for a single Product made by the user.
+// It will error if the specified ID is invalid or does not reference an
+// existing Product, if not enough items are available or if the user may not
+// agree to the amount paid.
+func (m *Memory) AddSale(ctx context.Context, user auth.Claims, productID string, ns NewSale, now time.Time) (*Sale, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.AddSale")
+	defer span.End()
+
+	sales, err := m.AddSales(ctx, user, []SaleLine{{ProductID: productID, NewSale: ns}}, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sales[0], nil
+}
+
+// AddSales records several sales transactions made by the user at once.
+// Either every Sale is recorded or none are.
+func (m *Memory) AddSales(ctx context.Context, user auth.Claims, lines []SaleLine, now time.Time) ([]Sale, error) {
+	_, span := trace.StartSpan(ctx, "internal.product.Memory.AddSales")
+	defer span.End()
+
+	for _, l := range lines {
+		if _, err := uuid.Parse(l.ProductID); err != nil {
+			return nil, ErrInvalidID
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nSales, nMovements := len(m.sales), len(m.movements)
+	var used []string
+
+	// rollback forgets the lines recorded so far.
+	rollback := func(err error) ([]Sale, error) {
+		m.sales, m.movements = m.sales[:nSales], m.movements[:nMovements]
+		for _, code := range used {
+			c := m.coupons[code]
+			c.Uses--
+			m.coupons[code] = c
+		}
+		return nil, err
+	}
+
+	sales := make([]Sale, len(lines))
+	for i, l := range lines {
+		p, ok := m.products[l.ProductID]
+		if !ok || p.DeletedAt != nil {
+			return rollback(ErrNotFound)
+		}
+
+		qt, err := m.quote(user, p, NewQuote{Quantity: l.Quantity, Coupon: l.Coupon}, now)
+		if err != nil {
+			return rollback(err)
+		}
+
+		paid, err := charge(user, l.NewSale, &qt, m.convert)
+		if err != nil {
+			return rollback(err)
+		}
+
+		s := Sale{
+			ID:          uuid.New().String(),
+			ProductID:   l.ProductID,
+			Quantity:    l.Quantity,
+			Paid:        paid,
+			Price:       qt.Price,
+			UnitPrice:   p.Cost,
+			Currency:    p.Currency,
+			Rules:       qt.Rules,
+			DateCreated: now.UTC(),
+		}
+
+		mv := Movement{
+			ID:          s.ID,
+			ProductID:   s.ProductID,
+			Kind:        MovementSale,
+			Quantity:    -s.Quantity,
+			DateCreated: s.DateCreated,
+		}
+		if err := m.move(mv, now); err != nil {
+			return rollback(err)
+		}
+		if l.Coupon != "" {
+			c := m.coupons[l.Coupon]
+			c.Uses++
+			m.coupons[l.Coupon] = c
+			used = append(used, l.Coupon)
+		}
+		m.sales = append(m.sales, s)
+		sales[i] = s
+	}
+
+	return sales, nil
+}
+
+// CancelSales reverses Sales that were never paid for and returns their items
+// to stock. Either every Sale is cancelled or none are.
+func (m *Memory) CancelSales(ctx context.Context, user auth.Claims, saleIDs []string, now time.Time) error {
+	_, span := trace.StartSpan(ctx, "internal.product.Memory.CancelSales")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sales, err := m.findSales(saleIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sales {
+		if !m.reverse(user, s, "Sale cancelled", now) {
+			continue
+		}
+
+		// Coupons used by the sale may be used again.
+		for _, r := range s.Rules {
+			if c, ok := m.coupons[r.Reference]; ok && r.Rule == RuleCoupon && c.Uses > 0 {
+				c.Uses--
+				m.coupons[r.Reference] = c
+			}
+		}
+	}
+
+	return nil
+}
+
+// RefundSales refunds whatever is left of Sales and returns their items to
+// stock. Only admins and the owners of the Products may refund their Sales.
+// Either every Sale is refunded or none are.
+func (m *Memory) RefundSales(ctx context.Context, user auth.Claims, saleIDs []string, reason string, now time.Time) error {
+	_, span := trace.StartSpan(ctx, "internal.product.Memory.RefundSales")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sales, err := m.findSales(saleIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sales {
+		if !user.HasRole(auth.RoleAdmin) && m.products[s.ProductID].UserID != user.Subject {
+			return ErrForbidden
+		}
+	}
+
+	for _, s := range sales {
+		m.reverse(user, s, reason, now)
+	}
+
+	return nil
+}
+
+// findSales gets the Sales with the ids. The caller must hold the lock.
+func (m *Memory) findSales(ids []string) ([]Sale, error) {
+	sales := make([]Sale, len(ids))
+	for i, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, ErrInvalidID
+		}
+
+		found := false
+		for _, s := range m.sales {
+			if s.ID == id {
+				sales[i] = s
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrNotFound
+		}
+	}
+	return sales, nil
+}
+
+// reverse refunds what is left of sale and returns those items to stock. It
+// reports if there was anything left to refund. The caller must hold the
+// lock.
+func (m *Memory) reverse(user auth.Claims, sale Sale, reason string, now time.Time) bool {
+	var done Refund
+	for _, r := range m.refunds {
+		if r.SaleID == sale.ID {
+			done.Quantity += r.Quantity
+			done.Amount += r.Amount
+		}
+	}
+
+	r := remainder(user, sale, done, reason, now)
+	if r.Quantity == 0 && r.Amount == 0 {
+		return false
+	}
+
+	m.addRefund(r)
+	return true
+}
+
+// addRefund records r and returns its items to stock when it restocks. The
+// caller must hold the lock.
+func (m *Memory) addRefund(r Refund) {
+	m.refunds = append(m.refunds, r)
+	if r.Restock && r.Quantity > 0 {
+		m.movements = append(m.movements, restockMovement(r))
+	}
+}
+
+// ListSales gives all Sales for a Product in the order they were recorded.
+func (m *Memory) ListSales(ctx context.Context, productID string) ([]Sale, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ListSales")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sales := []Sale{}
+	for _, s := range m.sales {
+		if s.ProductID == productID {
+			s.Rules = append([]AppliedRule{}, s.Rules...)
+			sales = append(sales, s)
+		}
+	}
+
+	sort.SliceStable(sales, func(i, j int) bool {
+		return sales[i].DateCreated.Before(sales[j].DateCreated)
+	})
+
+	return sales, nil
+}
+
+// Refund reverses all or part of a Sale of a Product. Only admins and the
+// owner of the Product may refund its Sales. The refunds of a Sale can never
+// add up to more items or money than the Sale recorded.
+func (m *Memory) Refund(ctx context.Context, user auth.Claims, productID, saleID string, nr NewRefund, now time.Time) (*Refund, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Refund")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if _, err := uuid.Parse(saleID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if err := validRefund(nr); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[productID]
+	if !ok || p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return nil, ErrForbidden
+	}
+
+	var sale *Sale
+	for i := range m.sales {
+		if m.sales[i].ID == saleID && m.sales[i].ProductID == productID {
+			sale = &m.sales[i]
+		}
+	}
+	if sale == nil {
+		return nil, ErrNotFound
+	}
+
+	quantity, amount := nr.Quantity, nr.Amount
+	for _, r := range m.refunds {
+		if r.SaleID == saleID {
+			quantity += r.Quantity
+			amount += r.Amount
+		}
+	}
+	if quantity > sale.Quantity || amount > sale.Paid {
+		return nil, ErrInvalidRefund
+	}
+
+	r := Refund{
+		ID:          uuid.New().String(),
+		SaleID:      saleID,
+		ProductID:   productID,
+		Quantity:    nr.Quantity,
+		Amount:      nr.Amount,
+		Restock:     nr.Restock,
+		Reason:      nr.Reason,
+		UserID:      user.Subject,
+		DateCreated: now.UTC(),
+	}
+	m.addRefund(r)
+
+	return &r, nil
+}
+
+// ListRefunds gives all Refunds of the Sales of a Product.
+func (m *Memory) ListRefunds(ctx context.Context, productID string) ([]Refund, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ListRefunds")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	refunds := []Refund{}
+	for _, r := range m.refunds {
+		if r.ProductID == productID {
+			refunds = append(refunds, r)
+		}
+	}
+
+	sort.SliceStable(refunds, func(i, j int) bool {
+		return refunds[i].DateCreated.Before(refunds[j].DateCreated)
+	})
+
+	return refunds, nil
+}
+
+// Revenue totals the revenue of every Product per currency, net of refunds.
+// Products that were deleted but not purged are included.
+func (m *Memory) Revenue(ctx context.Context) ([]money.Money, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Revenue")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	totals := make(map[string]int)
+	currencies := make(map[string]string)
+	for _, s := range m.sales {
+		totals[s.Currency] += s.Paid
+		currencies[s.ID] = s.Currency
+	}
+	for _, r := range m.refunds {
+		totals[currencies[r.SaleID]] -= r.Amount
+	}
+
+	revenue := []money.Money{}
+	for c, amount := range totals {
+		revenue = append(revenue, money.Money{Amount: amount, Currency: c})
+	}
+
+	sort.Slice(revenue, func(i, j int) bool {
+		return revenue[i].Currency < revenue[j].Currency
+	})
+
+	return revenue, nil
+}
+
+// SetRates stores exchange rates, replacing any earlier rate between the same
+// currencies.
+func (m *Memory) SetRates(ctx context.Context, rates []money.Rate, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.SetRates")
+	defer span.End()
+
+	for _, r := range rates {
+		if !money.Valid(r.From) || !money.Valid(r.To) {
+			return money.ErrInvalidCurrency
+		}
+		if r.Rate <= 0 {
+			return money.ErrInvalidRate
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range rates {
+		r.DateUpdated = now.UTC()
+
+		replaced := false
+		for i := range m.rates {
+			if m.rates[i].From == r.From && m.rates[i].To == r.To {
+				m.rates[i] = r
+				replaced = true
+			}
+		}
+		if !replaced {
+			m.rates = append(m.rates, r)
+		}
+	}
+
+	return nil
+}
+
+// ListRates gives every stored exchange rate.
+func (m *Memory) ListRates(ctx context.Context) ([]money.Rate, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ListRates")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rates := make([]money.Rate, len(m.rates))
+	copy(rates, m.rates)
+
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].From != rates[j].From {
+			return rates[i].From < rates[j].From
+		}
+		return rates[i].To < rates[j].To
+	})
+
+	return rates, nil
+}
+
+// Convert changes mn into the currency to using the stored exchange rates.
+func (m *Memory) Convert(ctx context.Context, mn money.Money, to string) (money.Money, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Convert")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.convert(mn, to)
+}
+
+// SetTiers replaces the quantity breaks of a Product. Only admins and the user
+// who created the Product may change them.
+func (m *Memory) SetTiers(ctx context.Context, user auth.Claims, productID string, nts []NewPriceTier, now time.Time) ([]PriceTier, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.SetTiers")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if err := validTiers(nts); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[productID]
+	if !ok || p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return nil, ErrForbidden
+	}
+
+	tiers := newTiers(productID, nts, now)
+	m.tiers[productID] = tiers
+
+	return append([]PriceTier{}, tiers...), nil
+}
+
+// ListTiers gives the quantity breaks of a Product ordered by quantity.
+func (m *Memory) ListTiers(ctx context.Context, productID string) ([]PriceTier, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ListTiers")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]PriceTier{}, m.tiers[productID]...), nil
+}
+
+// CreateCoupon adds a Coupon. Codes are unique.
+func (m *Memory) CreateCoupon(ctx context.Context, nc NewCoupon, now time.Time) (*Coupon, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.CreateCoupon")
+	defer span.End()
+
+	c, err := newCoupon(nc, now)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.coupons[c.Code]; ok {
+		return nil, ErrCouponExists
+	}
+	m.coupons[c.Code] = *c
+
+	return c, nil
+}
+
+// ListCoupons gives every Coupon ordered by code.
+func (m *Memory) ListCoupons(ctx context.Context) ([]Coupon, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ListCoupons")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	coupons := []Coupon{}
+	for _, c := range m.coupons {
+		coupons = append(coupons, c)
+	}
+
+	sort.Slice(coupons, func(i, j int) bool {
+		return coupons[i].Code < coupons[j].Code
+	})
+
+	return coupons, nil
+}
+
+// DeleteCoupon removes a Coupon so it can no longer be used. Sales keep the
+// code of the coupons that were applied to them.
+func (m *Memory) DeleteCoupon(ctx context.Context, code string) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.DeleteCoupon")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.coupons[code]; !ok {
+		return ErrNotFound
+	}
+	delete(m.coupons, code)
+
+	return nil
+}
+
+// SetDiscount sets the percentage taken off every Sale made by a user. A
+// discount of zero removes it.
+func (m *Memory) SetDiscount(ctx context.Context, userID string, nd NewDiscount, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.SetDiscount")
+	defer span.End()
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return ErrInvalidID
+	}
+	if nd.Percent < 0 || nd.Percent > 100 {
+		return ErrInvalidDiscount
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if nd.Percent == 0 {
+		delete(m.discounts, userID)
+		return nil
+	}
+	m.discounts[userID] = Discount{UserID: userID, Percent: nd.Percent, DateUpdated: now.UTC()}
+
+	return nil
+}
+
+// Quote gives the price the pricing rules set for the user buying a quantity
+// of a Product.
+func (m *Memory) Quote(ctx context.Context, user auth.Claims, productID string, nq NewQuote, now time.Time) (*Quote, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Quote")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if nq.Quantity <= 0 {
+		return nil, ErrInvalidQuantity
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.products[productID]
+	if !ok || p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	q, err := m.quote(user, p, nq, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &q, nil
+}
+
+// Adjust records a change to the stock of a Product made by hand. Only admins
+// and the owner of the Product may adjust its stock.
+func (m *Memory) Adjust(ctx context.Context, user auth.Claims, productID string, na NewAdjustment, now time.Time) (*Movement, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Adjust")
+	defer span.End()
+
+	if err := validAdjustment(na); err != nil {
+		return nil, err
+	}
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[productID]
+	if !ok || p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return nil, ErrForbidden
+	}
+
+	mv := Movement{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		Kind:        na.Kind,
+		Quantity:    na.Quantity,
+		Reason:      na.Reason,
+		UserID:      &user.Subject,
+		DateCreated: now.UTC(),
+	}
+	if err := m.move(mv, now); err != nil {
+		return nil, err
+	}
+
+	return &mv, nil
+}
+
+// Reserve holds items of a Product so they can not be taken by anyone else.
+// The reservation is released automatically once it expires.
+func (m *Memory) Reserve(ctx context.Context, user auth.Claims, productID string, nr NewReservation, now time.Time) (*Movement, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Reserve")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	mv, err := newReservation(user, productID, nr, now)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.move(mv, now); err != nil {
+		return nil, err
+	}
+
+	return &mv, nil
+}
+
+// Release returns the items held by a reservation to the available stock.
+// Releasing a reservation more than once does nothing. Only the user who made
+// the reservation, the owner of the product or an admin may release it.
+func (m *Memory) Release(ctx context.Context, user auth.Claims, productID, reservationID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Release")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return ErrInvalidID
+	}
+	if _, err := uuid.Parse(reservationID); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[productID]
+	if !ok || p.DeletedAt != nil {
+		return ErrNotFound
+	}
+
+	for _, r := range m.movements {
+		if r.ID == reservationID && r.ProductID == productID && r.Kind == MovementReservation {
+			if !canRelease(user, p, r) {
+				return ErrForbidden
+			}
+			m.release(r, "Released", now)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// ListMovements gives the inventory ledger of a Product in the order the
+// movements were made.
+func (m *Memory) ListMovements(ctx context.Context, productID string) ([]Movement, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ListMovements")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	movements := []Movement{}
+	for _, mv := range m.movements {
+		if mv.ProductID == productID {
+			movements = append(movements, mv)
+		}
+	}
+
+	sort.SliceStable(movements, func(i, j int) bool {
+		return movements[i].DateCreated.Before(movements[j].DateCreated)
+	})
+
+	return movements, nil
+}
+
+// ExpireReservations releases every reservation that has expired at the
+// provided time. It returns the number of reservations released.
+func (m *Memory) ExpireReservations(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ExpireReservations")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.expire("", now), nil
+}
+
+// ListCategories gives every Category ordered by name.
+func (m *Memory) ListCategories(ctx context.Context) ([]Category, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.ListCategories")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	categories := make([]Category, 0, len(m.categories))
+	for _, c := range m.categories {
+		c.Schema = append(Schema{}, c.Schema...)
+		categories = append(categories, c)
+	}
+
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Name != categories[j].Name {
+			return categories[i].Name < categories[j].Name
+		}
+		return categories[i].ID < categories[j].ID
+	})
+
+	return categories, nil
+}
+
+// CreateCategory adds a Category under an optional parent.
+func (m *Memory) CreateCategory(ctx context.Context, nc NewCategory, now time.Time) (*Category, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.CreateCategory")
+	defer span.End()
+
+	c := Category{
+		ID:          uuid.New().String(),
+		Name:        nc.Name,
+		Schema:      append(Schema{}, nc.Schema...),
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+	if nc.ParentID != nil && *nc.ParentID != "" {
+		c.ParentID = nc.ParentID
+	}
+	if err := validSchema(c.Schema); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c.ParentID != nil {
+		if _, err := m.category(*c.ParentID); err != nil {
+			return nil, err
+		}
+	}
+
+	m.categories[c.ID] = c
+
+	c.Schema = append(Schema{}, c.Schema...)
+	return &c, nil
+}
+
+// RetrieveCategory finds the Category identified by a given ID.
+func (m *Memory) RetrieveCategory(ctx context.Context, id string) (*Category, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.RetrieveCategory")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, err := m.category(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Schema = append(Schema{}, c.Schema...)
+	return &c, nil
+}
+
+// UpdateCategory modifies a Category. It will error if the Category would
+// become its own ancestor or if the new schema does not describe the
+// attributes of its Products.
+func (m *Memory) UpdateCategory(ctx context.Context, id string, uc UpdateCategory, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.UpdateCategory")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.category(id)
+	if err != nil {
+		return err
+	}
+
+	if uc.Name != nil {
+		c.Name = *uc.Name
+	}
+	if uc.ParentID != nil {
+		c.ParentID = nil
+		if *uc.ParentID != "" {
+			c.ParentID = uc.ParentID
+			for cur := uc.ParentID; cur != nil; {
+				if *cur == id {
+					return ErrInvalidCategory
+				}
+				parent, err := m.category(*cur)
+				if err != nil {
+					return err
+				}
+				cur = parent.ParentID
+			}
+		}
+	}
+	if uc.Schema != nil {
+		if err := validSchema(*uc.Schema); err != nil {
+			return err
+		}
+		c.Schema = append(Schema{}, *uc.Schema...)
+
+		for _, p := range m.products {
+			if p.CategoryID == nil || *p.CategoryID != id {
+				continue
+			}
+			if _, err := checkAttributes(c.Schema, p.Attributes); err != nil {
+				return err
+			}
+		}
+	}
+	c.DateUpdated = now.UTC()
+
+	m.categories[id] = c
+
+	return nil
+}
+
+// DeleteCategory removes a Category that has no subcategories and no active
+// Products. Deleted Products in the Category lose their Category.
+func (m *Memory) DeleteCategory(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.DeleteCategory")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.category(id); err != nil {
+		return err
+	}
+
+	for _, c := range m.categories {
+		if c.ParentID != nil && *c.ParentID == id {
+			return ErrCategoryInUse
+		}
+	}
+	for _, p := range m.products {
+		if p.CategoryID != nil && *p.CategoryID == id && p.DeletedAt == nil {
+			return ErrCategoryInUse
+		}
+	}
+
+	for pid, p := range m.products {
+		if p.CategoryID != nil && *p.CategoryID == id {
+			p.CategoryID = nil
+			m.products[pid] = p
+		}
+	}
+	delete(m.categories, id)
+
+	return nil
+}
+
+// category finds a Category. The caller must hold the lock.
+func (m *Memory) category(id string) (Category, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Category{}, ErrInvalidID
+	}
+
+	c, ok := m.categories[id]
+	if !ok {
+		return Category{}, ErrCategoryNotFound
+	}
+	return c, nil
+}
+
+// categorize checks the Category and attributes of a Product and gives the
+// attributes to store. The caller must hold the lock.
+func (m *Memory) categorize(categoryID *string, a Attributes) (*string, Attributes, error) {
+	if categoryID == nil || *categoryID == "" {
+		if len(a) > 0 {
+			return nil, nil, ErrInvalidAttributes
+		}
+		return nil, Attributes{}, nil
+	}
+
+	c, err := m.category(*categoryID)
+	if err != nil {
+		if err == ErrInvalidID {
+			return nil, nil, ErrCategoryNotFound
+		}
+		return nil, nil, err
+	}
+
+	a, err = checkAttributes(c.Schema, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := *categoryID
+	return &id, a, nil
+}
+
+// subcategories gives the IDs of a Category and all of its descendants. The
+// caller must hold the lock.
+func (m *Memory) subcategories(id string) map[string]bool {
+	ids := map[string]bool{id: true}
+	for grew := true; grew; {
+		grew = false
+		for _, c := range m.categories {
+			if c.ParentID != nil && ids[*c.ParentID] && !ids[c.ID] {
+				ids[c.ID] = true
+				grew = true
+			}
+		}
+	}
+	return ids
+}
+
+// hasTag reports whether tags contains tag.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// move adds a Movement to the ledger of an active Product. Expired
+// reservations of the Product are released first so they do not hold stock.
+// A movement that takes items fails if fewer items are available. The caller
+// must hold the lock.
+func (m *Memory) move(mv Movement, now time.Time) error {
+	p, ok := m.products[mv.ProductID]
+	if !ok || p.DeletedAt != nil {
+		return ErrNotFound
+	}
+
+	if mv.Quantity < 0 {
+		m.expire(mv.ProductID, now)
+		if m.aggregate(p).Available+mv.Quantity < 0 {
+			return ErrInsufficientStock
+		}
+	}
+
+	m.movements = append(m.movements, mv)
+	return nil
+}
+
+// expire releases the expired reservations of a Product, or of every Product
+// when productID is blank. It returns the number released. The caller must
+// hold the lock.
+func (m *Memory) expire(productID string, now time.Time) int {
+	var n int
+	for _, r := range m.movements {
+		if r.Kind != MovementReservation || (productID != "" && r.ProductID != productID) {
+			continue
+		}
+		if expired(r, now) && m.release(r, "Expired", now) {
+			n++
+		}
+	}
+	return n
+}
+
+// release adds the Movement that releases reservation r unless it was already
+// released. It reports if a movement was added. The caller must hold the lock.
+func (m *Memory) release(r Movement, reason string, now time.Time) bool {
+	for _, mv := range m.movements {
+		if mv.Kind == MovementRelease && mv.ReservationID != nil && *mv.ReservationID == r.ID {
+			return false
+		}
+	}
+
+	id := r.ID
+	m.movements = append(m.movements, Movement{
+		ID:            uuid.New().String(),
+		ProductID:     r.ProductID,
+		Kind:          MovementRelease,
+		Quantity:      -r.Quantity,
+		Reason:        reason,
+		ReservationID: &id,
+		DateCreated:   now.UTC(),
+	})
+	return true
+}
+
+// aggregate fills in the Sold, Revenue, OnHand and Available fields of p from
+// the recorded Sales and Movements. The caller must hold the lock.
+func (m *Memory) aggregate(p Product) Product {
+	p.Tags = append([]string{}, p.Tags...)
+	attrs := make(Attributes, len(p.Attributes))
+	for k, v := range p.Attributes {
+		attrs[k] = v
+	}
+	p.Attributes = attrs
+
+	p.Sold, p.Revenue = 0, 0
+	for _, s := range m.sales {
+		if s.ProductID == p.ID {
+			p.Sold += s.Quantity
+			p.Revenue += s.Paid
+		}
+	}
+	for _, r := range m.refunds {
+		if r.ProductID == p.ID {
+			p.Sold -= r.Quantity
+			p.Revenue -= r.Amount
+		}
+	}
+
+	p.OnHand, p.Available = 0, 0
+	for _, mv := range m.movements {
+		if mv.ProductID != p.ID {
+			continue
+		}
+		p.Available += mv.Quantity
+		if mv.Kind != MovementReservation && mv.Kind != MovementRelease {
+			p.OnHand += mv.Quantity
+		}
+	}
+	return p
+}
+
+// convert changes mn into the currency to. The caller must hold the lock.
+func (m *Memory) convert(mn money.Money, to string) (money.Money, error) {
+	if !money.Valid(mn.Currency) || !money.Valid(to) {
+		return money.Money{}, money.ErrInvalidCurrency
+	}
+	if mn.Currency == to {
+		return mn, nil
+	}
+
+	r, err := pickRate(m.rates, mn.Currency, to)
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	return r.Convert(mn)
+}
+
+// quote prices items of p for the user with the stored rules. The caller must
+// hold the lock.
+func (m *Memory) quote(user auth.Claims, p Product, nq NewQuote, now time.Time) (Quote, error) {
+	r := rules{
+		tiers:    m.tiers[p.ID],
+		discount: m.discounts[user.Subject].Percent,
+	}
+
+	if nq.Coupon != "" {
+		c, ok := m.coupons[nq.Coupon]
+		if !ok {
+			return Quote{}, ErrInvalidCoupon
+		}
+		r.coupon = &c
+	}
+
+	return price(p, user, nq.Quantity, r, now, m.convert)
+}
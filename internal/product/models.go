@@ -6,22 +6,56 @@ import (
 
 // Product is an item we sell.
 type Product struct {
-	ID          string    `db:"product_id" json:"id"`             // Unique identifier.
-	Name        string    `db:"name" json:"name"`                 // Display name of the product.
-	Cost        int       `db:"cost" json:"cost"`                 // Price for one item in cents.
-	Quantity    int       `db:"quantity" json:"quantity"`         // Original number of items available.
-	Sold        int       `db:"sold" json:"sold"`                 // Aggregate field showing number of items sold.
-	Revenue     int       `db:"revenue" json:"revenue"`           // Aggregate field showing total cost of sold items.
-	UserID      string    `db:"user_id" json:"user_id"`           // ID of the user who created the product.
-	DateCreated time.Time `db:"date_created" json:"date_created"` // When the product was added.
-	DateUpdated time.Time `db:"date_updated" json:"date_updated"` // When the product record was last modified.
+	ID          string     `db:"product_id" json:"id"`                     // Unique identifier.
+	Name        string     `db:"name" json:"name"`                         // Display name of the product.
+	Cost        int        `db:"cost" json:"cost"`                         // Price for one item in the minor unit of Currency.
+	Currency    string     `db:"currency" json:"currency"`                 // ISO 4217 code of the currency of Cost.
+	Quantity    int        `db:"quantity" json:"quantity"`                 // Original number of items available.
+	Sold        int        `db:"sold" json:"sold"`                         // Aggregate field showing number of items sold.
+	Revenue     int        `db:"revenue" json:"revenue"`                   // Aggregate field showing total paid for sold items in Currency.
+	OnHand      int        `db:"on_hand" json:"on_hand"`                   // Aggregate field showing number of items in stock.
+	Available   int        `db:"available" json:"available"`               // Aggregate field showing items in stock that are not reserved.
+	CategoryID  *string    `db:"category_id" json:"category_id,omitempty"` // Category the product is listed under.
+	Tags        []string   `db:"-" json:"tags"`                            // Free-form labels in lower case.
+	Attributes  Attributes `db:"attributes" json:"attributes"`             // Custom attributes defined by the schema of the category.
+	UserID      string     `db:"user_id" json:"user_id"`                   // ID of the user who created the product.
+	DateCreated time.Time  `db:"date_created" json:"date_created"`         // When the product was added.
+	DateUpdated time.Time  `db:"date_updated" json:"date_updated"`         // When the product record was last modified.
+	DeletedAt   *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`   // When the product was deleted. Nil while active.
+}
+
+// Version is the state of a Product after it was created or updated. Versions
+// are numbered from 1 and record the user who made the change.
+type Version struct {
+	ProductID   string     `db:"product_id" json:"product_id"`
+	Version     int        `db:"version" json:"version"`
+	Name        string     `db:"name" json:"name"`
+	Cost        int        `db:"cost" json:"cost"`
+	Currency    string     `db:"currency" json:"currency"`
+	Quantity    int        `db:"quantity" json:"quantity"`
+	CategoryID  *string    `db:"category_id" json:"category_id,omitempty"`
+	Tags        TagList    `db:"tags" json:"tags"`
+	Attributes  Attributes `db:"attributes" json:"attributes"`
+	ChangedBy   string     `db:"changed_by" json:"changed_by"`     // Subject of the claims that made the change.
+	DateCreated time.Time  `db:"date_created" json:"date_created"` // When the change was made.
+}
+
+// Filter narrows the set of Products returned by a List.
+type Filter struct {
+	IncludeDeleted bool   // Also return Products that have been deleted.
+	Category       string // Only return Products in this Category or its subcategories.
+	Tag            string // Only return Products with this tag.
 }
 
 // NewProduct is what we require from clients when adding a Product.
 type NewProduct struct {
-	Name     string `json:"name" validate:"required"`
-	Cost     int    `json:"cost" validate:"required,gte=0"`
-	Quantity int    `json:"quantity" validate:"gte=1"`
+	Name       string     `json:"name" validate:"required"`
+	Cost       int        `json:"cost" validate:"required,gte=0"`
+	Currency   string     `json:"currency" validate:"omitempty,len=3"`
+	Quantity   int        `json:"quantity" validate:"gte=1"`
+	CategoryID *string    `json:"category_id"`
+	Tags       []string   `json:"tags" validate:"dive,max=64"`
+	Attributes Attributes `json:"attributes"`
 }
 
 // UpdateProduct defines what information may be provided to modify an
@@ -30,26 +64,332 @@ type NewProduct struct {
 // between a field that was not provided and a field that was provided as
 // explicitly blank. Normally we do not want to use pointers to basic types but
 // we make exceptions around marshalling/unmarshalling.
+//
+// Setting CategoryID to an empty string removes the Product from its Category
+// along with its attributes.
 type UpdateProduct struct {
-	Name     *string `json:"name"`
-	Cost     *int    `json:"cost" validate:"omitempty,gte=0"`
-	Quantity *int    `json:"quantity" validate:"omitempty,gte=1"`
+	Name       *string     `json:"name"`
+	Cost       *int        `json:"cost" validate:"omitempty,gte=0"`
+	Quantity   *int        `json:"quantity" validate:"omitempty,gte=1"`
+	CategoryID *string     `json:"category_id"`
+	Tags       *[]string   `json:"tags" validate:"omitempty,dive,max=64"`
+	Attributes *Attributes `json:"attributes"`
 }
 
 // Sale represents one item of a transaction where some amount of a product was
 // sold. Quantity is the number of units sold and Paid is the total price paid.
-// Note that due to haggling the Paid value might not equal Quantity sold *
-// Product cost.
+// Price is what the pricing rules asked for the items and Rules lists the rules
+// that changed it from Quantity * Product cost. Paid is below Price only when
+// someone allowed to override prices agreed to it. Paid and Price are always
+// kept in the currency of the Product.
 type Sale struct {
-	ID          string    `db:"sale_id" json:"id"`
+	ID          string        `db:"sale_id" json:"id"`
+	ProductID   string        `db:"product_id" json:"product_id"`
+	Quantity    int           `db:"quantity" json:"quantity"`
+	Paid        int           `db:"paid" json:"paid"`
+	Price       int           `db:"price" json:"price"`
+	UnitPrice   int           `db:"unit_price" json:"unit_price"` // List Cost of one item when the sale was made.
+	Currency    string        `db:"currency" json:"currency"`
+	Rules       []AppliedRule `db:"-" json:"rules"`
+	DateCreated time.Time     `db:"date_created" json:"date_created"`
+}
+
+// NewSale is what we require from clients for recording new transactions. A
+// sale paid in another currency than the one of the Product is converted
+// using the stored exchange rates. The currency of the Product is assumed
+// when none is given.
+type NewSale struct {
+	Quantity int    `json:"quantity" validate:"gte=0"`
+	Paid     int    `json:"paid" validate:"gte=0"`
+	Currency string `json:"currency" validate:"omitempty,len=3"`
+	Coupon   string `json:"coupon"`
+}
+
+// Refund reverses all or part of a Sale. The refunded quantity and amount are
+// taken off the sold and revenue aggregates of the Product.
+type Refund struct {
+	ID          string    `db:"refund_id" json:"id"`
+	SaleID      string    `db:"sale_id" json:"sale_id"`
 	ProductID   string    `db:"product_id" json:"product_id"`
 	Quantity    int       `db:"quantity" json:"quantity"`
-	Paid        int       `db:"paid" json:"paid"`
+	Amount      int       `db:"amount" json:"amount"` // Refunded amount in the currency of the Sale.
+	Restock     bool      `db:"restock" json:"restock"`
+	Reason      string    `db:"reason" json:"reason"`
+	UserID      string    `db:"user_id" json:"user_id"`
 	DateCreated time.Time `db:"date_created" json:"date_created"`
 }
 
-// NewSale is what we require from clients for recording new transactions.
-type NewSale struct {
-	Quantity int `json:"quantity" validate:"gte=0"`
-	Paid     int `json:"paid" validate:"gte=0"`
+// NewRefund is what we require from clients when refunding a Sale. When
+// Restock is set the refunded items return to the inventory.
+type NewRefund struct {
+	Quantity int    `json:"quantity" validate:"gte=0"`
+	Amount   int    `json:"amount" validate:"gte=0"`
+	Restock  bool   `json:"restock"`
+	Reason   string `json:"reason" validate:"required"`
+}
+
+// SaleLine is a NewSale for a specific Product. Several lines are recorded
+// together when a customer buys more than one Product at once.
+type SaleLine struct {
+	ProductID string
+	NewSale
+}
+
+// Kinds of inventory Movement.
+const (
+	MovementReceive     = "receive"     // Items added to stock.
+	MovementAdjust      = "adjust"      // Correction after counting stock.
+	MovementSale        = "sale"        // Items removed from stock by a Sale.
+	MovementReturn      = "return"      // Sold items brought back into stock.
+	MovementReservation = "reservation" // Items held for a customer.
+	MovementRelease     = "release"     // A reservation that was released or expired.
+)
+
+// DefaultReservationTTL is how long a reservation holds stock when the client
+// does not ask for a specific duration.
+const DefaultReservationTTL = 15 * time.Minute
+
+// Movement is one entry in the inventory ledger of a Product. Movements are
+// never modified or removed. Quantity is the change in stock and is negative
+// when items leave. Stock on hand is the sum of every movement except
+// reservations and releases. Available stock is the sum of every movement.
+type Movement struct {
+	ID            string     `db:"movement_id" json:"id"`
+	ProductID     string     `db:"product_id" json:"product_id"`
+	Kind          string     `db:"kind" json:"kind"`
+	Quantity      int        `db:"quantity" json:"quantity"`
+	Reason        string     `db:"reason" json:"reason"`
+	ReservationID *string    `db:"reservation_id" json:"reservation_id,omitempty"` // Reservation a release applies to.
+	UserID        *string    `db:"user_id" json:"user_id,omitempty"`               // User who posted an adjustment or made a reservation.
+	ExpiresAt     *time.Time `db:"expires_at" json:"expires_at,omitempty"`         // When a reservation is released.
+	DateCreated   time.Time  `db:"date_created" json:"date_created"`
+}
+
+// NewAdjustment is what we require from clients when changing the stock of a
+// Product by hand. Receive and return movements add items so their Quantity
+// must be positive.
+type NewAdjustment struct {
+	Kind     string `json:"kind" validate:"required,oneof=receive adjust return"`
+	Quantity int    `json:"quantity" validate:"required"`
+	Reason   string `json:"reason" validate:"required"`
+}
+
+// NewReservation is what we require from clients to hold stock of a Product.
+// The reservation is released automatically after TTL seconds.
+type NewReservation struct {
+	Quantity int `json:"quantity" validate:"gte=1"`
+	TTL      int `json:"ttl" validate:"omitempty,gte=1,lte=86400"`
+}
+
+// Kinds of pricing rule applied to a Sale.
+const (
+	RuleTier     = "tier"     // Quantity-break price of the Product.
+	RuleUser     = "user"     // Discount given to the buying user.
+	RuleCoupon   = "coupon"   // Coupon presented with the Sale.
+	RuleOverride = "override" // Paid below the price with permission.
+)
+
+// Kinds of Coupon.
+const (
+	CouponPercent = "percent" // Takes a percentage off the price.
+	CouponFixed   = "fixed"   // Takes a fixed amount off the price.
+)
+
+// PriceTier sets the unit price of a Product when at least MinQuantity items
+// are bought at once. The tier with the highest MinQuantity that applies wins.
+type PriceTier struct {
+	ProductID   string    `db:"product_id" json:"product_id"`
+	MinQuantity int       `db:"min_quantity" json:"min_quantity"`
+	UnitPrice   int       `db:"unit_price" json:"unit_price"` // In the currency of the Product.
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+}
+
+// NewPriceTier is what we require from clients when setting the quantity
+// breaks of a Product.
+type NewPriceTier struct {
+	MinQuantity int `json:"min_quantity" validate:"gte=2"`
+	UnitPrice   int `json:"unit_price" validate:"gte=0"`
+}
+
+// NewTiers is what we require from clients when replacing the quantity
+// breaks of a Product.
+type NewTiers struct {
+	Tiers []NewPriceTier `json:"tiers" validate:"dive"`
+}
+
+// Coupon takes a percentage or a fixed amount off the price of a Sale. It may
+// only be used MaxUses times, if MaxUses is not zero, and only between
+// ValidFrom and ValidUntil.
+type Coupon struct {
+	Code        string     `db:"code" json:"code"`
+	Kind        string     `db:"kind" json:"kind"`
+	Value       int        `db:"value" json:"value"`       // Percent off, or amount off in the minor unit of Currency.
+	Currency    string     `db:"currency" json:"currency"` // Currency of a fixed amount.
+	MaxUses     int        `db:"max_uses" json:"max_uses"`
+	Uses        int        `db:"uses" json:"uses"`
+	ValidFrom   time.Time  `db:"valid_from" json:"valid_from"`
+	ValidUntil  *time.Time `db:"valid_until" json:"valid_until,omitempty"`
+	DateCreated time.Time  `db:"date_created" json:"date_created"`
+}
+
+// NewCoupon is what we require from clients when creating a Coupon. A coupon
+// without ValidFrom is valid from the moment it is created.
+type NewCoupon struct {
+	Code       string     `json:"code" validate:"required,max=64"`
+	Kind       string     `json:"kind" validate:"required,oneof=percent fixed"`
+	Value      int        `json:"value" validate:"gte=1"`
+	Currency   string     `json:"currency" validate:"omitempty,len=3"`
+	MaxUses    int        `json:"max_uses" validate:"gte=0"`
+	ValidFrom  *time.Time `json:"valid_from"`
+	ValidUntil *time.Time `json:"valid_until"`
+}
+
+// Discount takes a percentage off every Sale made by a user.
+type Discount struct {
+	UserID      string    `db:"user_id" json:"user_id"`
+	Percent     int       `db:"percent" json:"percent"`
+	DateUpdated time.Time `db:"date_updated" json:"date_updated"`
+}
+
+// NewDiscount is what we require from clients when setting the discount of a
+// user. A discount of zero removes it.
+type NewDiscount struct {
+	Percent int `json:"percent" validate:"gte=0,lte=100"`
+}
+
+// AppliedRule is a pricing rule that changed the price of a Sale. Amount is
+// what the rule took off the price in the currency of the Product.
+type AppliedRule struct {
+	SaleID    string `db:"sale_id" json:"-"`
+	Position  int    `db:"position" json:"-"`
+	Rule      string `db:"rule" json:"rule"`
+	Reference string `db:"reference" json:"reference"` // Tier quantity, user ID or coupon code.
+	Amount    int    `db:"amount" json:"amount"`
+}
+
+// Quote is the price the pricing rules give for a quantity of a Product.
+type Quote struct {
+	ProductID string        `json:"product_id"`
+	Quantity  int           `json:"quantity"`
+	Price     int           `json:"price"`
+	Currency  string        `json:"currency"`
+	Rules     []AppliedRule `json:"rules"`
+}
+
+// NewQuote is what we require from clients asking for the price of a Product.
+type NewQuote struct {
+	Quantity int    `json:"quantity" validate:"gte=1"`
+	Coupon   string `json:"coupon"`
+}
+
+// Types of custom attribute.
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+)
+
+// Category groups Products of the same type. Categories form a tree through
+// ParentID. The Schema lists the custom attributes Products of the Category
+// may have.
+type Category struct {
+	ID          string    `db:"category_id" json:"id"`
+	ParentID    *string   `db:"parent_id" json:"parent_id,omitempty"`
+	Name        string    `db:"name" json:"name"`
+	Schema      Schema    `db:"schema" json:"schema"`
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+	DateUpdated time.Time `db:"date_updated" json:"date_updated"`
+}
+
+// NewCategory is what we require from clients when adding a Category.
+type NewCategory struct {
+	Name     string  `json:"name" validate:"required"`
+	ParentID *string `json:"parent_id"`
+	Schema   Schema  `json:"schema" validate:"dive"`
+}
+
+// UpdateCategory defines what information may be provided to modify an
+// existing Category. Setting ParentID to an empty string makes it a top level
+// Category. A new Schema must still describe the attributes of every Product
+// in the Category.
+type UpdateCategory struct {
+	Name     *string `json:"name"`
+	ParentID *string `json:"parent_id"`
+	Schema   *Schema `json:"schema" validate:"omitempty,dive"`
+}
+
+// AttributeDef describes one custom attribute of the Products of a Category.
+type AttributeDef struct {
+	Name     string `json:"name" validate:"required"`
+	Type     string `json:"type" validate:"required,oneof=string number boolean"`
+	Required bool   `json:"required"`
+}
+
+// SearchQuery is what we require from clients to search Products.
+type SearchQuery struct {
+	Text     string // Words to find. Each word matches the words starting with it.
+	Category string // Only return Products in this Category or its subcategories.
+	Band     string // Only return Products in this price band like "10-50".
+	Limit    int    // Maximum number of hits. Zero gives DefaultSearchLimit.
+	Offset   int    // Number of hits to skip.
+}
+
+// SearchResult holds a page of ranked hits with the total number of hits and
+// facet counts of the matching Products.
+type SearchResult struct {
+	Total  int    `json:"total"`
+	Hits   []Hit  `json:"hits"`
+	Facets Facets `json:"facets"`
+}
+
+// Hit is a Product matching a search.
+type Hit struct {
+	Product Product `json:"product"`
+	Rank    float64 `json:"rank"`    // Higher ranks match better.
+	Snippet string  `json:"snippet"` // Name with the matching words in <b> tags.
+}
+
+// Facets count the Products matching a search by category and by price band.
+type Facets struct {
+	Categories []Facet `json:"categories"`
+	Prices     []Facet `json:"prices"`
+}
+
+// Facet is the number of matching Products with a value.
+type Facet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// ImportOptions controls how a bulk import treats invalid rows.
+type ImportOptions struct {
+	DryRun bool // Check every row without keeping any Product.
+	Atomic bool // Keep no Product unless every row is valid.
+}
+
+// ImportRow is one Product read from an import file. Err is set when the row
+// could not be decoded or does not pass the validation of NewProduct.
+type ImportRow struct {
+	Row     int // Position of the row in the file starting at 1.
+	Product NewProduct
+	Err     error
+}
+
+// ImportResult reports how every row of a bulk import went. Valid counts the
+// rows that could create a Product and Created the Products that were kept.
+type ImportResult struct {
+	DryRun  bool          `json:"dry_run"`
+	Atomic  bool          `json:"atomic"`
+	Valid   int           `json:"valid"`
+	Failed  int           `json:"failed"`
+	Created int           `json:"created"`
+	Rows    []ImportedRow `json:"rows"`
+}
+
+// ImportedRow is the outcome of one row of a bulk import. ID is set when the
+// row created a Product and Error when the row was rejected.
+type ImportedRow struct {
+	Row   int    `json:"row"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
 }
@@ -0,0 +1,478 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// SetTiers replaces the quantity breaks of a Product. Only admins and the user
+// who created the Product may change them.
+func (s *DB) SetTiers(ctx context.Context, user auth.Claims, productID string, nts []NewPriceTier, now time.Time) ([]PriceTier, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.SetTiers")
+	defer span.End()
+
+	if err := validTiers(nts); err != nil {
+		return nil, err
+	}
+
+	p, err := s.Retrieve(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return nil, ErrForbidden
+	}
+
+	tiers := newTiers(productID, nts, now)
+
+	const del = `DELETE FROM price_tiers WHERE product_id = $1`
+	const ins = `INSERT INTO price_tiers
+		(product_id, min_quantity, unit_price, date_created)
+		VALUES ($1, $2, $3, $4)`
+
+	err = database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if _, err := lockProduct(ctx, tx, productID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, del, productID); err != nil {
+			return errors.Wrap(err, "deleting tiers")
+		}
+		for _, t := range tiers {
+			if _, err := tx.ExecContext(ctx, ins, t.ProductID, t.MinQuantity, t.UnitPrice, t.DateCreated); err != nil {
+				return errors.Wrap(err, "inserting tier")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tiers, nil
+}
+
+// ListTiers gives the quantity breaks of a Product ordered by quantity.
+func (s *DB) ListTiers(ctx context.Context, productID string) ([]PriceTier, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ListTiers")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	tiers := []PriceTier{}
+	const q = `SELECT * FROM price_tiers WHERE product_id = $1 ORDER BY min_quantity`
+
+	if err := s.db.SelectContext(ctx, &tiers, q, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting tiers")
+	}
+
+	return tiers, nil
+}
+
+// CreateCoupon adds a Coupon. Codes are unique.
+func (s *DB) CreateCoupon(ctx context.Context, nc NewCoupon, now time.Time) (*Coupon, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.CreateCoupon")
+	defer span.End()
+
+	c, err := newCoupon(nc, now)
+	if err != nil {
+		return nil, err
+	}
+
+	const q = `INSERT INTO coupons
+		(code, kind, value, currency, max_uses, uses, valid_from, valid_until, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (code) DO NOTHING`
+
+	res, err := s.db.ExecContext(ctx, q,
+		c.Code, c.Kind, c.Value, c.Currency,
+		c.MaxUses, c.Uses, c.ValidFrom, c.ValidUntil,
+		c.DateCreated,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "inserting coupon")
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, ErrCouponExists
+	}
+
+	return c, nil
+}
+
+// ListCoupons gives every Coupon ordered by code.
+func (s *DB) ListCoupons(ctx context.Context) ([]Coupon, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ListCoupons")
+	defer span.End()
+
+	coupons := []Coupon{}
+	const q = `SELECT * FROM coupons ORDER BY code`
+
+	if err := s.db.SelectContext(ctx, &coupons, q); err != nil {
+		return nil, errors.Wrap(err, "selecting coupons")
+	}
+
+	return coupons, nil
+}
+
+// DeleteCoupon removes a Coupon so it can no longer be used. Sales keep the
+// code of the coupons that were applied to them.
+func (s *DB) DeleteCoupon(ctx context.Context, code string) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.DeleteCoupon")
+	defer span.End()
+
+	const q = `DELETE FROM coupons WHERE code = $1`
+
+	res, err := s.db.ExecContext(ctx, q, code)
+	if err != nil {
+		return errors.Wrapf(err, "deleting coupon %s", code)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetDiscount sets the percentage taken off every Sale made by a user. A
+// discount of zero removes it.
+func (s *DB) SetDiscount(ctx context.Context, userID string, nd NewDiscount, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.SetDiscount")
+	defer span.End()
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return ErrInvalidID
+	}
+	if nd.Percent < 0 || nd.Percent > 100 {
+		return ErrInvalidDiscount
+	}
+
+	if nd.Percent == 0 {
+		const q = `DELETE FROM discounts WHERE user_id = $1`
+		if _, err := s.db.ExecContext(ctx, q, userID); err != nil {
+			return errors.Wrap(err, "deleting discount")
+		}
+		return nil
+	}
+
+	const q = `INSERT INTO discounts
+		(user_id, percent, date_updated)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET percent = $2, date_updated = $3`
+
+	if _, err := s.db.ExecContext(ctx, q, userID, nd.Percent, now.UTC()); err != nil {
+		return errors.Wrap(err, "storing discount")
+	}
+
+	return nil
+}
+
+// Quote gives the price the pricing rules set for the user buying a quantity
+// of a Product.
+func (s *DB) Quote(ctx context.Context, user auth.Claims, productID string, nq NewQuote, now time.Time) (*Quote, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Quote")
+	defer span.End()
+
+	var q *Quote
+	err := database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var err error
+		q, err = QuoteTx(ctx, tx, user, productID, nq, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// QuoteTx prices a quantity of a Product as part of the transaction tx so other
+// packages can charge the same price they later record a Sale for.
+func QuoteTx(ctx context.Context, tx *sqlx.Tx, user auth.Claims, productID string, nq NewQuote, now time.Time) (*Quote, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if nq.Quantity <= 0 {
+		return nil, ErrInvalidQuantity
+	}
+
+	var p Product
+	const q = `SELECT * FROM products WHERE product_id = $1 AND deleted_at IS NULL`
+	if err := tx.GetContext(ctx, &p, q, productID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting product %s", productID)
+	}
+
+	qt, err := quote(ctx, tx, user, &p, nq, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &qt, nil
+}
+
+// quote prices items of p for the user with the rules stored in the database.
+func quote(ctx context.Context, db sqlx.QueryerContext, user auth.Claims, p *Product, nq NewQuote, now time.Time) (Quote, error) {
+	var r rules
+
+	const qt = `SELECT * FROM price_tiers WHERE product_id = $1`
+	if err := sqlx.SelectContext(ctx, db, &r.tiers, qt, p.ID); err != nil {
+		return Quote{}, errors.Wrap(err, "selecting tiers")
+	}
+
+	if _, err := uuid.Parse(user.Subject); err == nil {
+		const qd = `SELECT percent FROM discounts WHERE user_id = $1`
+		if err := sqlx.GetContext(ctx, db, &r.discount, qd, user.Subject); err != nil && err != sql.ErrNoRows {
+			return Quote{}, errors.Wrap(err, "selecting discount")
+		}
+	}
+
+	if nq.Coupon != "" {
+		var c Coupon
+		const qc = `SELECT * FROM coupons WHERE code = $1`
+		if err := sqlx.GetContext(ctx, db, &c, qc, nq.Coupon); err != nil {
+			if err == sql.ErrNoRows {
+				return Quote{}, ErrInvalidCoupon
+			}
+			return Quote{}, errors.Wrap(err, "selecting coupon")
+		}
+		r.coupon = &c
+	}
+
+	return price(*p, user, nq.Quantity, r, now, func(m money.Money, to string) (money.Money, error) {
+		return convert(ctx, db, m, to)
+	})
+}
+
+// useCoupon counts a use of a coupon. It fails if the coupon was used up by
+// a concurrent Sale since it was priced.
+func useCoupon(ctx context.Context, tx *sqlx.Tx, code string) error {
+	const q = `UPDATE coupons SET uses = uses + 1
+		WHERE code = $1 AND (max_uses = 0 OR uses < max_uses)`
+
+	res, err := tx.ExecContext(ctx, q, code)
+	if err != nil {
+		return errors.Wrapf(err, "using coupon %s", code)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrInvalidCoupon
+	}
+
+	return nil
+}
+
+// insertRules records the pricing rules that were applied to a Sale.
+func insertRules(ctx context.Context, tx *sqlx.Tx, saleID string, rs []AppliedRule) error {
+	const q = `INSERT INTO sale_rules
+		(sale_id, position, rule, reference, amount)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	for i, r := range rs {
+		if _, err := tx.ExecContext(ctx, q, saleID, i, r.Rule, r.Reference, r.Amount); err != nil {
+			return errors.Wrap(err, "inserting sale rule")
+		}
+	}
+
+	return nil
+}
+
+// rules are the pricing rules that may apply to a Sale of one Product.
+type rules struct {
+	tiers    []PriceTier
+	discount int // Percentage taken off for the buying user.
+	coupon   *Coupon
+}
+
+// price applies the rules to quantity items of p. The best quantity break sets
+// the unit price, then the discount of the user and finally the coupon are
+// taken off. convert changes the amount of a fixed coupon into the currency
+// of p.
+func price(p Product, user auth.Claims, quantity int, r rules, now time.Time, convert func(money.Money, string) (money.Money, error)) (Quote, error) {
+	q := Quote{
+		ProductID: p.ID,
+		Quantity:  quantity,
+		Currency:  p.Currency,
+		Rules:     []AppliedRule{},
+	}
+
+	unit := p.Cost
+	var tier *PriceTier
+	for i, t := range r.tiers {
+		if quantity >= t.MinQuantity && (tier == nil || t.MinQuantity > tier.MinQuantity) {
+			tier = &r.tiers[i]
+		}
+	}
+	if tier != nil && tier.UnitPrice < unit {
+		q.Rules = append(q.Rules, AppliedRule{
+			Rule:      RuleTier,
+			Reference: strconv.Itoa(tier.MinQuantity),
+			Amount:    (unit - tier.UnitPrice) * quantity,
+		})
+		unit = tier.UnitPrice
+	}
+	q.Price = unit * quantity
+
+	if r.discount > 0 {
+		off := percentOf(q.Price, r.discount)
+		q.Rules = append(q.Rules, AppliedRule{Rule: RuleUser, Reference: user.Subject, Amount: off})
+		q.Price -= off
+	}
+
+	if c := r.coupon; c != nil {
+		if !usable(c, now) {
+			return Quote{}, ErrInvalidCoupon
+		}
+
+		var off int
+		switch c.Kind {
+		case CouponPercent:
+			off = percentOf(q.Price, c.Value)
+		case CouponFixed:
+			m, err := convert(money.Money{Amount: c.Value, Currency: c.Currency}, p.Currency)
+			if err != nil {
+				return Quote{}, err
+			}
+			off = m.Amount
+		}
+		if off > q.Price {
+			off = q.Price
+		}
+
+		q.Rules = append(q.Rules, AppliedRule{Rule: RuleCoupon, Reference: c.Code, Amount: off})
+		q.Price -= off
+	}
+
+	return q, nil
+}
+
+// charge checks the amount paid for a Sale against its quote. Paying less than
+// the price needs the override permission and is added to the rules of the
+// quote. It returns the amount paid in the currency of the Product.
+func charge(user auth.Claims, ns NewSale, q *Quote, convert func(money.Money, string) (money.Money, error)) (int, error) {
+	due := q.Price
+	if ns.Currency != "" && ns.Currency != q.Currency {
+		m, err := convert(money.Money{Amount: q.Price, Currency: q.Currency}, ns.Currency)
+		if err != nil {
+			return 0, err
+		}
+		due = m.Amount
+	}
+
+	paid, err := salePaid(ns, q.Currency, func(m money.Money) (money.Money, error) {
+		return convert(m, q.Currency)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if ns.Paid < due {
+		if !user.HasRole(auth.RoleAdmin, auth.RolePriceOverride) {
+			return 0, ErrPriceTooLow
+		}
+		q.Rules = append(q.Rules, AppliedRule{Rule: RuleOverride, Reference: user.Subject, Amount: q.Price - paid})
+	}
+
+	return paid, nil
+}
+
+// usable reports if a coupon may be used at the time now.
+func usable(c *Coupon, now time.Time) bool {
+	if now.Before(c.ValidFrom) {
+		return false
+	}
+	if c.ValidUntil != nil && !now.Before(*c.ValidUntil) {
+		return false
+	}
+	return c.MaxUses == 0 || c.Uses < c.MaxUses
+}
+
+// percentOf gives pct percent of amount rounded to the nearest minor unit.
+func percentOf(amount, pct int) int {
+	return (amount*pct + 50) / 100
+}
+
+// validTiers checks the quantity breaks of a Product do not repeat.
+func validTiers(nts []NewPriceTier) error {
+	seen := make(map[int]bool)
+	for _, nt := range nts {
+		if nt.MinQuantity < 2 || nt.UnitPrice < 0 || seen[nt.MinQuantity] {
+			return ErrInvalidTier
+		}
+		seen[nt.MinQuantity] = true
+	}
+	return nil
+}
+
+// newTiers builds the stored tiers of a Product ordered by quantity.
+func newTiers(productID string, nts []NewPriceTier, now time.Time) []PriceTier {
+	tiers := make([]PriceTier, len(nts))
+	for i, nt := range nts {
+		tiers[i] = PriceTier{
+			ProductID:   productID,
+			MinQuantity: nt.MinQuantity,
+			UnitPrice:   nt.UnitPrice,
+			DateCreated: now.UTC(),
+		}
+	}
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MinQuantity < tiers[j].MinQuantity
+	})
+	return tiers
+}
+
+// newCoupon checks a new Coupon and fills in its defaults.
+func newCoupon(nc NewCoupon, now time.Time) (*Coupon, error) {
+	if nc.Code == "" || nc.Value <= 0 || nc.MaxUses < 0 {
+		return nil, ErrInvalidCoupon
+	}
+
+	c := Coupon{
+		Code:        nc.Code,
+		Kind:        nc.Kind,
+		Value:       nc.Value,
+		MaxUses:     nc.MaxUses,
+		ValidFrom:   now.UTC(),
+		DateCreated: now.UTC(),
+	}
+
+	switch nc.Kind {
+	case CouponPercent:
+		if nc.Value > 100 || nc.Currency != "" {
+			return nil, ErrInvalidCoupon
+		}
+	case CouponFixed:
+		cur, err := newCurrency(nc.Currency)
+		if err != nil {
+			return nil, err
+		}
+		c.Currency = cur
+	default:
+		return nil, ErrInvalidCoupon
+	}
+
+	if nc.ValidFrom != nil {
+		c.ValidFrom = nc.ValidFrom.UTC()
+	}
+	if nc.ValidUntil != nil {
+		until := nc.ValidUntil.UTC()
+		if !until.After(c.ValidFrom) {
+			return nil, ErrInvalidCoupon
+		}
+		c.ValidUntil = &until
+	}
+
+	return &c, nil
+}
@@ -3,8 +3,12 @@ package product
 import (
 	"context"
 	"database/sql"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/money"
 	"github.com/ardanlabs/service/internal/platform/auth"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
@@ -23,63 +27,302 @@ var (
 	// ErrForbidden occurs when a user tries to do something that is forbidden to
 	// them according to our access control policies.
 	ErrForbidden = errors.New("Attempted action is not allowed")
+
+	// ErrInsufficientStock occurs when a movement would take more items than
+	// are available.
+	ErrInsufficientStock = errors.New("Not enough stock available")
+
+	// ErrInvalidMovement occurs when the kind or quantity of an inventory
+	// movement does not make sense.
+	ErrInvalidMovement = errors.New("Inventory movement is not valid")
+
+	// ErrInvalidRefund occurs when a refund is empty or would return more
+	// items or money than remain on the sale.
+	ErrInvalidRefund = errors.New("Refund is not valid")
+
+	// ErrNoRate occurs when an amount must be converted between currencies
+	// that have no stored exchange rate.
+	ErrNoRate = errors.New("No exchange rate between the currencies")
+
+	// ErrPriceTooLow occurs when a Sale is paid below its price by a user who
+	// may not override prices.
+	ErrPriceTooLow = errors.New("Paid amount is below the price")
+
+	// ErrInvalidCoupon occurs when a coupon does not exist, is used up, is
+	// outside of its validity window or is not well formed.
+	ErrInvalidCoupon = errors.New("Coupon is not valid")
+
+	// ErrCouponExists occurs when creating a coupon with a code in use.
+	ErrCouponExists = errors.New("Coupon already exists")
+
+	// ErrInvalidTier occurs when quantity breaks repeat a quantity or do not
+	// make sense.
+	ErrInvalidTier = errors.New("Price tier is not valid")
+
+	// ErrInvalidDiscount occurs when a discount is not a percentage.
+	ErrInvalidDiscount = errors.New("Discount is not valid")
+
+	// ErrInvalidQuantity occurs when asking the price of no items.
+	ErrInvalidQuantity = errors.New("Quantity must be positive")
+
+	// ErrCategoryNotFound is used when a Category is requested or referenced
+	// but does not exist.
+	ErrCategoryNotFound = errors.New("Category not found")
+
+	// ErrInvalidCategory occurs when a Category would become its own ancestor
+	// or its schema repeats an attribute.
+	ErrInvalidCategory = errors.New("Category is not valid")
+
+	// ErrCategoryInUse occurs when deleting a Category that still has
+	// subcategories or Products.
+	ErrCategoryInUse = errors.New("Category has products or subcategories")
+
+	// ErrInvalidAttributes occurs when the attributes of a Product do not
+	// match the schema of its Category.
+	ErrInvalidAttributes = errors.New("Attributes do not match the category")
+
+	// ErrInvalidQuery occurs when a search has no words, an unknown price band
+	// or a negative limit or offset.
+	ErrInvalidQuery = errors.New("Search query is not valid")
+
+	// ErrInvalidImport occurs when an import file can not be read as a whole.
+	ErrInvalidImport = errors.New("Import is not valid")
 )
 
-// List gets all Products from the database.
-func List(ctx context.Context, db *sqlx.DB) ([]Product, error) {
+// Store defines the set of behaviors required to persist and retrieve
+// Products and their Sales. Every implementation must honor the same
+// semantics for aggregates, ownership and the predefined errors.
+//
+// Stock is tracked in a ledger of Movements. No movement may take more items
+// than are available, even when made concurrently.
+//
+// Sales are priced by the pricing rules: quantity breaks of the Product, the
+// discount of the buying user and an optional coupon. Paying less than the
+// price requires the admin or price override role.
+//
+// Refunds are netted out of the sold and revenue aggregates of a Product.
+// Cancelling or refunding Sales in bulk refunds whatever is left of them so
+// they stay in the history.
+// Sales are kept in the currency of their Product and amounts paid in another
+// currency are converted with the stored exchange rates.
+//
+// Products may belong to a Category. Categories form a tree and the schema of
+// a Category describes the custom attributes of its Products. Listing the
+// Products of a Category includes those of its subcategories.
+//
+// Search matches every word of a query against the start of the words in the
+// name and tags of active Products. Hits are ranked with the name counting
+// more than tags.
+//
+// Import creates Products from the rows of a bulk import. Rows with invalid
+// values are reported and skipped. A dry run or an atomic import with invalid
+// rows keeps no Product.
+//
+// Creating or updating a Product records its new state as a Version so its
+// values at any time can be retrieved. Sales keep the unit price of their
+// Product at the time they were made.
+//
+// Deleting a Product only marks it as deleted. It is hidden from List and
+// Retrieve but keeps its Sales until it is purged.
+//
+// Transfer hands every Product of a user, deleted or not, to another user so
+// none is left pointing at a user who is going away.
+type Store interface {
+	List(ctx context.Context, f Filter) ([]Product, error)
+	Create(ctx context.Context, user auth.Claims, np NewProduct, now time.Time) (*Product, error)
+	Retrieve(ctx context.Context, id string) (*Product, error)
+	History(ctx context.Context, id string) ([]Version, error)
+	RetrieveVersion(ctx context.Context, id string, asOf time.Time) (*Version, error)
+	Update(ctx context.Context, user auth.Claims, id string, update UpdateProduct, now time.Time) error
+	Delete(ctx context.Context, id string, now time.Time) error
+	Restore(ctx context.Context, id string, now time.Time) error
+	Transfer(ctx context.Context, from, to string, now time.Time) (int, error)
+	Purge(ctx context.Context, before time.Time) (int, error)
+	AddSale(ctx context.Context, user auth.Claims, productID string, ns NewSale, now time.Time) (*Sale, error)
+	AddSales(ctx context.Context, user auth.Claims, lines []SaleLine, now time.Time) ([]Sale, error)
+	CancelSales(ctx context.Context, user auth.Claims, saleIDs []string, now time.Time) error
+	RefundSales(ctx context.Context, user auth.Claims, saleIDs []string, reason string, now time.Time) error
+	ListSales(ctx context.Context, productID string) ([]Sale, error)
+	Refund(ctx context.Context, user auth.Claims, productID, saleID string, nr NewRefund, now time.Time) (*Refund, error)
+	ListRefunds(ctx context.Context, productID string) ([]Refund, error)
+	Revenue(ctx context.Context) ([]money.Money, error)
+	SetRates(ctx context.Context, rates []money.Rate, now time.Time) error
+	ListRates(ctx context.Context) ([]money.Rate, error)
+	Convert(ctx context.Context, m money.Money, to string) (money.Money, error)
+	SetTiers(ctx context.Context, user auth.Claims, productID string, nts []NewPriceTier, now time.Time) ([]PriceTier, error)
+	ListTiers(ctx context.Context, productID string) ([]PriceTier, error)
+	CreateCoupon(ctx context.Context, nc NewCoupon, now time.Time) (*Coupon, error)
+	ListCoupons(ctx context.Context) ([]Coupon, error)
+	DeleteCoupon(ctx context.Context, code string) error
+	SetDiscount(ctx context.Context, userID string, nd NewDiscount, now time.Time) error
+	Quote(ctx context.Context, user auth.Claims, productID string, nq NewQuote, now time.Time) (*Quote, error)
+	Adjust(ctx context.Context, user auth.Claims, productID string, na NewAdjustment, now time.Time) (*Movement, error)
+	Reserve(ctx context.Context, user auth.Claims, productID string, nr NewReservation, now time.Time) (*Movement, error)
+	Release(ctx context.Context, user auth.Claims, productID, reservationID string, now time.Time) error
+	ListMovements(ctx context.Context, productID string) ([]Movement, error)
+	ExpireReservations(ctx context.Context, now time.Time) (int, error)
+	ListCategories(ctx context.Context) ([]Category, error)
+	CreateCategory(ctx context.Context, nc NewCategory, now time.Time) (*Category, error)
+	RetrieveCategory(ctx context.Context, id string) (*Category, error)
+	UpdateCategory(ctx context.Context, id string, uc UpdateCategory, now time.Time) error
+	DeleteCategory(ctx context.Context, id string, now time.Time) error
+	Search(ctx context.Context, sq SearchQuery) (*SearchResult, error)
+	Import(ctx context.Context, user auth.Claims, rows []ImportRow, opts ImportOptions, now time.Time) (*ImportResult, error)
+}
+
+// DB is a Store backed by a Postgres database. Every change is committed
+// together with a domain event in the outbox.
+type DB struct {
+	db *sqlx.DB
+}
+
+// NewDB constructs a Store that persists Products using the provided database.
+func NewDB(db *sqlx.DB) *DB {
+	return &DB{db: db}
+}
+
+// List gets all Products from the database. Deleted Products are only
+// included when the filter asks for them.
+func (s *DB) List(ctx context.Context, f Filter) ([]Product, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.product.List")
 	defer span.End()
 
+	where := `($1 OR p.deleted_at IS NULL)`
+	args := []interface{}{f.IncludeDeleted}
+
+	if f.Category != "" {
+		if _, err := uuid.Parse(f.Category); err != nil {
+			return nil, ErrInvalidID
+		}
+		args = append(args, f.Category)
+		where += ` AND p.category_id IN (` + subcategoriesQuery(len(args)) + `)`
+	}
+	if f.Tag != "" {
+		args = append(args, strings.ToLower(strings.TrimSpace(f.Tag)))
+		where += ` AND p.product_id IN (SELECT product_id FROM product_tags WHERE tag = $` + strconv.Itoa(len(args)) + `)`
+	}
+
+	return s.list(ctx, where, args...)
+}
+
+// list gets the Products matching the where clause with their aggregates and
+// tags.
+func (s *DB) list(ctx context.Context, where string, args ...interface{}) ([]Product, error) {
 	products := []Product{}
-	const q = `SELECT
+	q := `SELECT
 			p.*,
-			COALESCE(SUM(s.quantity) ,0) AS sold,
-			COALESCE(SUM(s.paid), 0) AS revenue
+			COALESCE(SUM(s.quantity), 0) - ` + refundedQuantity + ` AS sold,
+			COALESCE(SUM(s.paid), 0) - ` + refundedAmount + ` AS revenue,
+			` + stockColumns + `
 		FROM products AS p
 		LEFT JOIN sales AS s ON p.product_id = s.product_id
+		WHERE ` + where + `
 		GROUP BY p.product_id`
 
-	if err := db.SelectContext(ctx, &products, q); err != nil {
+	if err := s.db.SelectContext(ctx, &products, q, args...); err != nil {
 		return nil, errors.Wrap(err, "selecting products")
 	}
 
+	if err := loadTags(ctx, s.db, products); err != nil {
+		return nil, err
+	}
+
 	return products, nil
 }
 
 // Create adds a Product to the database. It returns the created Product with
 // fields like ID and DateCreated populated..
-func Create(ctx context.Context, db *sqlx.DB, user auth.Claims, np NewProduct, now time.Time) (*Product, error) {
+func (s *DB) Create(ctx context.Context, user auth.Claims, np NewProduct, now time.Time) (*Product, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.product.Create")
 	defer span.End()
 
+	var p *Product
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var err error
+		p, err = create(ctx, tx, user, np, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// create inserts a Product with its initial stock. Invalid values are
+// reported before anything is written so a failed create leaves the
+// transaction usable.
+func create(ctx context.Context, tx *sqlx.Tx, user auth.Claims, np NewProduct, now time.Time) (*Product, error) {
+	currency, err := newCurrency(np.Currency)
+	if err != nil {
+		return nil, err
+	}
+
 	p := Product{
 		ID:          uuid.New().String(),
 		Name:        np.Name,
 		Cost:        np.Cost,
+		Currency:    currency,
 		Quantity:    np.Quantity,
 		UserID:      user.Subject,
+		OnHand:      np.Quantity,
+		Available:   np.Quantity,
+		Tags:        normalizeTags(np.Tags),
 		DateCreated: now.UTC(),
 		DateUpdated: now.UTC(),
 	}
 
 	const q = `
 		INSERT INTO products
-		(product_id, user_id, name, cost, quantity, date_created, date_updated)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		(product_id, user_id, name, cost, currency, quantity, category_id, attributes, date_created, date_updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
 
-	_, err := db.ExecContext(ctx, q,
+	p.CategoryID, p.Attributes, err = categorize(ctx, tx, np.CategoryID, np.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, q,
 		p.ID, p.UserID,
-		p.Name, p.Cost, p.Quantity,
+		p.Name, p.Cost, p.Currency, p.Quantity,
+		p.CategoryID, p.Attributes,
 		p.DateCreated, p.DateUpdated)
 	if err != nil {
 		return nil, errors.Wrap(err, "inserting product")
 	}
 
+	if err := setTags(ctx, tx, p.ID, p.Tags); err != nil {
+		return nil, err
+	}
+
+	if err := recordVersion(ctx, tx, p, user.Subject, now); err != nil {
+		return nil, err
+	}
+
+	if err := event.Record(ctx, tx, event.ProductCreated, p.ID, p, now); err != nil {
+		return nil, err
+	}
+
+	// The initial stock shares the ID of the product.
+	m := Movement{
+		ID:          p.ID,
+		ProductID:   p.ID,
+		Kind:        MovementReceive,
+		Quantity:    p.Quantity,
+		Reason:      "Initial stock",
+		UserID:      &p.UserID,
+		DateCreated: p.DateCreated,
+	}
+	if err := move(ctx, tx, m, now); err != nil {
+		return nil, err
+	}
+
 	return &p, nil
 }
 
-// Retrieve finds the product identified by a given ID.
-func Retrieve(ctx context.Context, db *sqlx.DB, id string) (*Product, error) {
+// Retrieve finds the product identified by a given ID. Deleted products are
+// not found.
+func (s *DB) Retrieve(ctx context.Context, id string) (*Product, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.product.Retrieve")
 	defer span.End()
 
@@ -87,18 +330,24 @@ func Retrieve(ctx context.Context, db *sqlx.DB, id string) (*Product, error) {
 		return nil, ErrInvalidID
 	}
 
+	return retrieve(ctx, s.db, id)
+}
+
+// retrieve gets the active Product with the ID and its aggregates from db.
+func retrieve(ctx context.Context, db sqlx.QueryerContext, id string) (*Product, error) {
 	var p Product
 
-	const q = `SELECT
+	q := `SELECT
 			p.*,
-			COALESCE(SUM(s.quantity), 0) AS sold,
-			COALESCE(SUM(s.paid), 0) AS revenue
+			COALESCE(SUM(s.quantity), 0) - ` + refundedQuantity + ` AS sold,
+			COALESCE(SUM(s.paid), 0) - ` + refundedAmount + ` AS revenue,
+			` + stockColumns + `
 		FROM products AS p
 		LEFT JOIN sales AS s ON p.product_id = s.product_id
-		WHERE p.product_id = $1
+		WHERE p.product_id = $1 AND p.deleted_at IS NULL
 		GROUP BY p.product_id`
 
-	if err := db.GetContext(ctx, &p, q, id); err != nil {
+	if err := sqlx.GetContext(ctx, db, &p, q, id); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrNotFound
 		}
@@ -106,69 +355,322 @@ func Retrieve(ctx context.Context, db *sqlx.DB, id string) (*Product, error) {
 		return nil, errors.Wrap(err, "selecting single product")
 	}
 
-	return &p, nil
+	ps := []Product{p}
+	if err := loadTags(ctx, db, ps); err != nil {
+		return nil, err
+	}
+
+	return &ps[0], nil
 }
 
 // Update modifies data about a Product. It will error if the specified ID is
-// invalid or does not reference an existing Product.
-func Update(ctx context.Context, db *sqlx.DB, user auth.Claims, id string, update UpdateProduct, now time.Time) error {
+// invalid or does not reference an existing Product. The Product is read
+// again once locked so changes made since are neither lost nor skip the
+// ownership check.
+func (s *DB) Update(ctx context.Context, user auth.Claims, id string, update UpdateProduct, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.product.Update")
 	defer span.End()
 
-	p, err := Retrieve(ctx, db, id)
-	if err != nil {
-		return err
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `UPDATE products SET
+		"name" = $2,
+		"cost" = $3,
+		"quantity" = $4,
+		"category_id" = $5,
+		"attributes" = $6,
+		"date_updated" = $7
+		WHERE product_id = $1 AND deleted_at IS NULL`
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		cur, err := lockProduct(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		p, err := retrieve(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		// If you do not have the admin role ...
+		// and you are not the owner of this product ...
+		// then get outta here!
+		if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+			return ErrForbidden
+		}
+
+		if update.Name != nil {
+			p.Name = *update.Name
+		}
+		if update.Cost != nil {
+			p.Cost = *update.Cost
+		}
+		if update.Quantity != nil {
+			p.Quantity = *update.Quantity
+		}
+		if update.Tags != nil {
+			p.Tags = normalizeTags(*update.Tags)
+		}
+		p.DateUpdated = now
+
+		// Changing the category checks the attributes against its schema.
+		// Clearing it also clears the attributes.
+		categoryID, attrs := cur.CategoryID, cur.Attributes
+		if update.CategoryID != nil {
+			categoryID = update.CategoryID
+			if *categoryID == "" {
+				attrs = nil
+			}
+		}
+		if update.Attributes != nil {
+			attrs = *update.Attributes
+		}
+		if update.CategoryID != nil || update.Attributes != nil {
+			p.CategoryID, p.Attributes, err = categorize(ctx, tx, categoryID, attrs)
+			if err != nil {
+				return err
+			}
+		}
+
+		if update.Tags != nil {
+			if err := setTags(ctx, tx, id, p.Tags); err != nil {
+				return err
+			}
+		}
+
+		// Changing the quantity moves the difference through the ledger.
+		if update.Quantity != nil && *update.Quantity != cur.Quantity {
+			m := Movement{
+				ID:          uuid.New().String(),
+				ProductID:   id,
+				Kind:        MovementAdjust,
+				Quantity:    *update.Quantity - cur.Quantity,
+				Reason:      "Quantity updated",
+				UserID:      &user.Subject,
+				DateCreated: now.UTC(),
+			}
+			if err := move(ctx, tx, m, now); err != nil {
+				return err
+			}
+			p.OnHand += m.Quantity
+			p.Available += m.Quantity
+		}
+
+		_, err = tx.ExecContext(ctx, q, id,
+			p.Name, p.Cost,
+			p.Quantity, p.CategoryID, p.Attributes,
+			p.DateUpdated,
+		)
+		if err != nil {
+			return errors.Wrap(err, "updating product")
+		}
+
+		if err := recordVersion(ctx, tx, *p, user.Subject, now); err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, event.ProductUpdated, p.ID, p, now)
+	})
+}
+
+// Delete marks the product identified by a given ID as deleted. Its Sales are
+// kept. An event is only recorded if an active product existed.
+func (s *DB) Delete(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Delete")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
 	}
 
-	// If you do not have the admin role ...
-	// and you are not the owner of this product ...
-	// then get outta here!
-	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
-		return ErrForbidden
+	const q = `UPDATE products SET
+		"deleted_at" = $2
+		WHERE product_id = $1 AND deleted_at IS NULL`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "deleting product %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "deleting product %s", id)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.ProductDeleted, id, data, now)
+	})
+}
+
+// Restore returns a deleted product to the active set. Restoring a product
+// that is not deleted does nothing. It will error if the specified ID is
+// invalid or does not reference an existing Product.
+func (s *DB) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
 	}
 
-	if update.Name != nil {
-		p.Name = *update.Name
+	const q = `UPDATE products SET
+		"deleted_at" = NULL,
+		"date_updated" = $2
+		WHERE product_id = $1 AND deleted_at IS NOT NULL`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "restoring product %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "restoring product %s", id)
+		}
+		if n == 0 {
+			var count int
+			const q = `SELECT COUNT(*) FROM products WHERE product_id = $1`
+			if err := tx.GetContext(ctx, &count, q, id); err != nil {
+				return errors.Wrapf(err, "selecting product %s", id)
+			}
+			if count == 0 {
+				return ErrNotFound
+			}
+			return nil
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.ProductRestored, id, data, now)
+	})
+}
+
+// Transfer gives every product owned by the user from, deleted or not, to
+// the user to. It returns the number of products transferred.
+func (s *DB) Transfer(ctx context.Context, from, to string, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Transfer")
+	defer span.End()
+
+	if _, err := uuid.Parse(from); err != nil {
+		return 0, ErrInvalidID
 	}
-	if update.Cost != nil {
-		p.Cost = *update.Cost
+	if _, err := uuid.Parse(to); err != nil {
+		return 0, ErrInvalidID
 	}
-	if update.Quantity != nil {
-		p.Quantity = *update.Quantity
+
+	var ids []string
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		const sel = `SELECT product_id FROM products WHERE user_id = $1 ORDER BY product_id`
+		if err := tx.SelectContext(ctx, &ids, sel, from); err != nil {
+			return errors.Wrapf(err, "selecting products of user %s", from)
+		}
+
+		const q = `UPDATE products SET
+			"user_id" = $2,
+			"date_updated" = $3
+			WHERE product_id = $1`
+		for _, id := range ids {
+			if _, err := tx.ExecContext(ctx, q, id, to, now.UTC()); err != nil {
+				return errors.Wrapf(err, "transferring product %s", id)
+			}
+
+			data := struct {
+				ID   string `json:"id"`
+				From string `json:"from"`
+				To   string `json:"to"`
+			}{id, from, to}
+			if err := event.Record(ctx, tx, event.ProductTransferred, id, data, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	p.DateUpdated = now
 
-	const q = `UPDATE products SET
-		"name" = $2,
-		"cost" = $3,
-		"quantity" = $4,
-		"date_updated" = $5
-		WHERE product_id = $1`
-	_, err = db.ExecContext(ctx, q, id,
-		p.Name, p.Cost,
-		p.Quantity, p.DateUpdated,
-	)
+	return len(ids), nil
+}
+
+// Purge permanently removes products that were deleted before the provided
+// time along with their Sales. It returns the number of products removed.
+func (s *DB) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Purge")
+	defer span.End()
+
+	const q = `DELETE FROM products WHERE deleted_at IS NOT NULL AND deleted_at < $1`
+
+	res, err := s.db.ExecContext(ctx, q, before.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "purging products")
+	}
+
+	n, err := res.RowsAffected()
 	if err != nil {
-		return errors.Wrap(err, "updating product")
+		return 0, errors.Wrap(err, "purging products")
 	}
 
-	return nil
+	return int(n), nil
 }
 
-// Delete removes the product identified by a given ID.
-func Delete(ctx context.Context, db *sqlx.DB, id string) error {
-	ctx, span := trace.StartSpan(ctx, "internal.product.Delete")
+// AddSale records a sales transaction for a single Product made by the user.
+// It will error if the specified ID is invalid or does not reference an
+// existing Product, if not enough items are available or if the user may not
+// agree to the amount paid.
+func (s *DB) AddSale(ctx context.Context, user auth.Claims, productID string, ns NewSale, now time.Time) (*Sale, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.AddSale")
 	defer span.End()
 
-	if _, err := uuid.Parse(id); err != nil {
-		return ErrInvalidID
+	sales, err := s.AddSales(ctx, user, []SaleLine{{ProductID: productID, NewSale: ns}}, now)
+	if err != nil {
+		return nil, err
 	}
 
-	const q = `DELETE FROM products WHERE product_id = $1`
+	return &sales[0], nil
+}
 
-	if _, err := db.ExecContext(ctx, q, id); err != nil {
-		return errors.Wrapf(err, "deleting product %s", id)
+// ListSales gives all Sales for a Product in the order they were recorded.
+func (s *DB) ListSales(ctx context.Context, productID string) ([]Sale, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ListSales")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	sales := []Sale{}
+	const q = `SELECT * FROM sales WHERE product_id = $1 ORDER BY date_created`
+
+	if err := s.db.SelectContext(ctx, &sales, q, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting sales")
+	}
+
+	var rs []AppliedRule
+	const qr = `SELECT r.* FROM sale_rules AS r
+		JOIN sales AS s ON s.sale_id = r.sale_id
+		WHERE s.product_id = $1
+		ORDER BY r.sale_id, r.position`
+
+	if err := s.db.SelectContext(ctx, &rs, qr, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting sale rules")
+	}
+
+	bySale := make(map[string][]AppliedRule)
+	for _, r := range rs {
+		bySale[r.SaleID] = append(bySale[r.SaleID], r)
+	}
+	for i := range sales {
+		sales[i].Rules = append([]AppliedRule{}, bySale[sales[i].ID]...)
 	}
 
-	return nil
+	return sales, nil
 }
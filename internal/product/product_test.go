@@ -1,10 +1,14 @@
 package product_test
 
 import (
+	"bytes"
 	"context"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ardanlabs/service/internal/money"
 	"github.com/ardanlabs/service/internal/platform/auth"
 	"github.com/ardanlabs/service/internal/product"
 	"github.com/ardanlabs/service/internal/tests"
@@ -12,11 +16,50 @@ import (
 	"github.com/pkg/errors"
 )
 
-// TestProduct validates the full set of CRUD operations on Product values.
+// TestProduct validates the Store backed by the database.
 func TestProduct(t *testing.T) {
 	db, teardown := tests.NewUnit(t)
 	defer teardown()
 
+	testStore(t, product.NewDB(db))
+}
+
+// TestProductMemory validates the in-memory Store against the same suite used
+// for the database so both implementations behave identically.
+func TestProductMemory(t *testing.T) {
+	testStore(t, product.NewMemory())
+}
+
+// seller records the Sales of the suite. It may agree to any amount so the
+// subtests can pick the amounts paid freely.
+var seller = auth.NewClaims(
+	"718ffbea-f4a1-4667-8ae3-b349da52675e",
+	[]string{auth.RoleUser, auth.RolePriceOverride},
+	time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC), time.Hour,
+)
+
+// testStore is the conformance suite every product.Store must pass.
+func testStore(t *testing.T, s product.Store) {
+	t.Run("crud", func(t *testing.T) { crud(t, s) })
+	t.Run("sales", func(t *testing.T) { sales(t, s) })
+	t.Run("batchSales", func(t *testing.T) { batchSales(t, s) })
+	t.Run("refunds", func(t *testing.T) { refunds(t, s) })
+	t.Run("currencies", func(t *testing.T) { currencies(t, s) })
+	t.Run("pricing", func(t *testing.T) { pricing(t, s) })
+	t.Run("categories", func(t *testing.T) { categories(t, s) })
+	t.Run("search", func(t *testing.T) { search(t, s) })
+	t.Run("bulk", func(t *testing.T) { bulk(t, s) })
+	t.Run("history", func(t *testing.T) { history(t, s) })
+	t.Run("softDelete", func(t *testing.T) { softDelete(t, s) })
+	t.Run("inventory", func(t *testing.T) { inventory(t, s) })
+	t.Run("reservations", func(t *testing.T) { reservations(t, s) })
+	t.Run("ownership", func(t *testing.T) { ownership(t, s) })
+	t.Run("transfer", func(t *testing.T) { transfer(t, s) })
+	t.Run("invalid", func(t *testing.T) { invalid(t, s) })
+}
+
+// crud validates the full set of CRUD operations on Product values.
+func crud(t *testing.T, s product.Store) {
 	t.Log("Given the need to work with Product records.")
 	{
 		t.Log("\tWhen handling a single Product.")
@@ -35,13 +78,13 @@ func TestProduct(t *testing.T) {
 				now, time.Hour,
 			)
 
-			p, err := product.Create(ctx, db, claims, np, now)
+			p, err := s.Create(ctx, claims, np, now)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to create a product.", tests.Success)
 
-			saved, err := product.Retrieve(ctx, db, p.ID)
+			saved, err := s.Retrieve(ctx, p.ID)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
 			}
@@ -59,12 +102,12 @@ func TestProduct(t *testing.T) {
 			}
 			updatedTime := time.Date(2019, time.January, 1, 1, 1, 1, 0, time.UTC)
 
-			if err := product.Update(ctx, db, claims, p.ID, upd, updatedTime); err != nil {
+			if err := s.Update(ctx, claims, p.ID, upd, updatedTime); err != nil {
 				t.Fatalf("\t%s\tShould be able to update product : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to update product.", tests.Success)
 
-			saved, err = product.Retrieve(ctx, db, p.ID)
+			saved, err = s.Retrieve(ctx, p.ID)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to retrieve updated product : %s.", tests.Failed, err)
 			}
@@ -76,6 +119,8 @@ func TestProduct(t *testing.T) {
 			want.Name = *upd.Name
 			want.Cost = *upd.Cost
 			want.Quantity = *upd.Quantity
+			want.OnHand = *upd.Quantity
+			want.Available = *upd.Quantity
 			want.DateUpdated = updatedTime
 
 			if diff := cmp.Diff(want, *saved); diff != "" {
@@ -87,12 +132,12 @@ func TestProduct(t *testing.T) {
 				Name: tests.StringPointer("Graphic Novels"),
 			}
 
-			if err := product.Update(ctx, db, claims, p.ID, upd, updatedTime); err != nil {
+			if err := s.Update(ctx, claims, p.ID, upd, updatedTime); err != nil {
 				t.Fatalf("\t%s\tShould be able to update just some fields of product : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to update just some fields of product.", tests.Success)
 
-			saved, err = product.Retrieve(ctx, db, p.ID)
+			saved, err = s.Retrieve(ctx, p.ID)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to retrieve updated product : %s.", tests.Failed, err)
 			}
@@ -104,12 +149,12 @@ func TestProduct(t *testing.T) {
 				t.Logf("\t%s\tShould be able to see updated Name field.", tests.Success)
 			}
 
-			if err := product.Delete(ctx, db, p.ID); err != nil {
+			if err := s.Delete(ctx, p.ID, now); err != nil {
 				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to delete product.", tests.Success)
 
-			saved, err = product.Retrieve(ctx, db, p.ID)
+			saved, err = s.Retrieve(ctx, p.ID)
 			if errors.Cause(err) != product.ErrNotFound {
 				t.Fatalf("\t%s\tShould NOT be able to retrieve deleted product : %s.", tests.Failed, err)
 			}
@@ -117,3 +162,1522 @@ func TestProduct(t *testing.T) {
 		}
 	}
 }
+
+// sales validates recording Sales and the aggregates they produce.
+func sales(t *testing.T, s product.Store) {
+	t.Log("Given the need to record Sales for a Product.")
+	{
+		t.Log("\tWhen adding Sales to a single Product.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			claims := auth.NewClaims(
+				"718ffbea-f4a1-4667-8ae3-b349da52675e",
+				[]string{auth.RoleUser},
+				now, time.Hour,
+			)
+
+			np := product.NewProduct{
+				Name:     "Puzzles",
+				Cost:     25,
+				Quantity: 10,
+			}
+
+			p, err := s.Create(ctx, claims, np, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to create a product.", tests.Success)
+
+			news := []product.NewSale{
+				{Quantity: 2, Paid: 50},
+				{Quantity: 3, Paid: 70},
+			}
+			for i, ns := range news {
+				if _, err := s.AddSale(ctx, seller, p.ID, ns, now.Add(time.Duration(i)*time.Minute)); err != nil {
+					t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+				}
+			}
+			t.Logf("\t%s\tShould be able to add sales.", tests.Success)
+
+			saved, err := s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Sold != 5 || saved.Revenue != 120 {
+				t.Fatalf("\t%s\tShould see aggregates of 5 sold for 120 : got %d sold for %d.", tests.Failed, saved.Sold, saved.Revenue)
+			}
+			t.Logf("\t%s\tShould see aggregates on the retrieved product.", tests.Success)
+
+			list, err := s.List(ctx, product.Filter{})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list products : %s.", tests.Failed, err)
+			}
+			var found bool
+			for _, lp := range list {
+				if lp.ID == p.ID {
+					found = true
+					if lp.Sold != 5 || lp.Revenue != 120 {
+						t.Fatalf("\t%s\tShould see aggregates in the list : got %d sold for %d.", tests.Failed, lp.Sold, lp.Revenue)
+					}
+				}
+			}
+			if !found {
+				t.Fatalf("\t%s\tShould find the product in the list.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould see aggregates in the list.", tests.Success)
+
+			ss, err := s.ListSales(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list sales : %s.", tests.Failed, err)
+			}
+			if len(ss) != 2 || ss[0].Quantity != 2 || ss[1].Quantity != 3 {
+				t.Fatalf("\t%s\tShould get back the sales in order : %+v.", tests.Failed, ss)
+			}
+			t.Logf("\t%s\tShould get back the sales in order.", tests.Success)
+
+			if err := s.Delete(ctx, p.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+
+			ss, err = s.ListSales(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list sales : %s.", tests.Failed, err)
+			}
+			if len(ss) != 2 {
+				t.Fatalf("\t%s\tShould keep sales of a deleted product : got %d.", tests.Failed, len(ss))
+			}
+			t.Logf("\t%s\tShould keep sales of a deleted product.", tests.Success)
+
+			if _, err := s.AddSale(ctx, seller, p.ID, news[0], now); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT be able to add a sale to a deleted product : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to add a sale to a deleted product.", tests.Success)
+		}
+	}
+}
+
+// batchSales validates Sales of several Products are recorded and cancelled
+// all at once.
+func batchSales(t *testing.T, s product.Store) {
+	t.Log("Given the need to record Sales for several Products at once.")
+	{
+		t.Log("\tWhen adding Sales to two Products.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			claims := auth.NewClaims(
+				"718ffbea-f4a1-4667-8ae3-b349da52675e",
+				[]string{auth.RoleUser},
+				now, time.Hour,
+			)
+
+			a, err := s.Create(ctx, claims, product.NewProduct{Name: "Kites", Cost: 15, Quantity: 5}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			b, err := s.Create(ctx, claims, product.NewProduct{Name: "Yoyos", Cost: 3, Quantity: 2}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to create products.", tests.Success)
+
+			lines := []product.SaleLine{
+				{ProductID: a.ID, NewSale: product.NewSale{Quantity: 2, Paid: 30}},
+				{ProductID: b.ID, NewSale: product.NewSale{Quantity: 3, Paid: 9}},
+			}
+			if _, err := s.AddSales(ctx, seller, lines, now); errors.Cause(err) != product.ErrInsufficientStock {
+				t.Fatalf("\t%s\tShould NOT be able to sell more than is available : %v.", tests.Failed, err)
+			}
+			saved, err := s.Retrieve(ctx, a.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Sold != 0 || saved.Available != 5 {
+				t.Fatalf("\t%s\tShould record none of the sales : got %d sold and %d available.", tests.Failed, saved.Sold, saved.Available)
+			}
+			t.Logf("\t%s\tShould record none of the sales when one line fails.", tests.Success)
+
+			lines[1].Quantity = 2
+			ss, err := s.AddSales(ctx, seller, lines, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to add sales : %s.", tests.Failed, err)
+			}
+			if len(ss) != 2 || ss[0].ProductID != a.ID || ss[1].ProductID != b.ID {
+				t.Fatalf("\t%s\tShould get back the sales in the order of the lines : %+v.", tests.Failed, ss)
+			}
+			t.Logf("\t%s\tShould be able to add sales.", tests.Success)
+
+			if err := s.CancelSales(ctx, seller, []string{ss[0].ID, ss[1].ID}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to cancel sales : %s.", tests.Failed, err)
+			}
+			for _, id := range []string{a.ID, b.ID} {
+				saved, err := s.Retrieve(ctx, id)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+				}
+				if saved.Sold != 0 || saved.Available != saved.Quantity {
+					t.Fatalf("\t%s\tShould return the items to stock : got %d sold and %d available.", tests.Failed, saved.Sold, saved.Available)
+				}
+			}
+			t.Logf("\t%s\tShould return the items of cancelled sales to stock.", tests.Success)
+
+			sales, err := s.ListSales(ctx, a.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list sales : %s.", tests.Failed, err)
+			}
+			if len(sales) != 1 || sales[0].ID != ss[0].ID {
+				t.Fatalf("\t%s\tShould keep cancelled sales in the history : %+v.", tests.Failed, sales)
+			}
+			refunds, err := s.ListRefunds(ctx, a.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list refunds : %s.", tests.Failed, err)
+			}
+			if len(refunds) != 1 || refunds[0].Quantity != 2 || refunds[0].Amount != 30 || !refunds[0].Restock {
+				t.Fatalf("\t%s\tShould reverse cancelled sales with a refund : %+v.", tests.Failed, refunds)
+			}
+			t.Logf("\t%s\tShould keep cancelled sales in the history.", tests.Success)
+
+			if err := s.CancelSales(ctx, seller, []string{ss[0].ID}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to cancel a sale twice : %s.", tests.Failed, err)
+			}
+			saved, err = s.Retrieve(ctx, a.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Sold != 0 || saved.Available != saved.Quantity {
+				t.Fatalf("\t%s\tShould NOT return items twice : got %d sold and %d available.", tests.Failed, saved.Sold, saved.Available)
+			}
+			t.Logf("\t%s\tShould NOT return the items of a sale cancelled twice.", tests.Success)
+
+			if err := s.CancelSales(ctx, seller, []string{a.ID}, now); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT find an unknown sale : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT find an unknown sale.", tests.Success)
+		}
+	}
+}
+
+// refunds validates Refunds are netted out of the Sales of a Product and can
+// return items to stock.
+func refunds(t *testing.T, s product.Store) {
+	t.Log("Given the need to refund Sales of a Product.")
+	{
+		t.Log("\tWhen refunding part of a Sale.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+			other := auth.NewClaims("4bf4ff8a-8fb4-4e2d-9e4f-d5bb1a7a15d8", []string{auth.RoleUser}, now, time.Hour)
+
+			p, err := s.Create(ctx, owner, product.NewProduct{Name: "Lanterns", Cost: 20, Quantity: 10}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			sale, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 4, Paid: 80}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to sell a product.", tests.Success)
+
+			nr := product.NewRefund{Quantity: 1, Amount: 20, Restock: true, Reason: "Broken"}
+			if _, err := s.Refund(ctx, other, p.ID, sale.ID, nr, now); errors.Cause(err) != product.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT allow another user to refund : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow another user to refund.", tests.Success)
+
+			if _, err := s.Refund(ctx, owner, p.ID, sale.ID, nr, now); err != nil {
+				t.Fatalf("\t%s\tShould allow the owner to refund : %s.", tests.Failed, err)
+			}
+			nr = product.NewRefund{Quantity: 0, Amount: 10, Reason: "Late delivery"}
+			if _, err := s.Refund(ctx, owner, p.ID, sale.ID, nr, now.Add(time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould allow the owner to refund : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould allow the owner to refund.", tests.Success)
+
+			saved, err := s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Sold != 3 || saved.Revenue != 50 || saved.Available != 7 {
+				t.Fatalf("\t%s\tShould net out refunds : got %d sold for %d and %d available.", tests.Failed, saved.Sold, saved.Revenue, saved.Available)
+			}
+			t.Logf("\t%s\tShould net out refunds and restock the returned items.", tests.Success)
+
+			list, err := s.List(ctx, product.Filter{})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list products : %s.", tests.Failed, err)
+			}
+			for _, lp := range list {
+				if lp.ID == p.ID && (lp.Sold != 3 || lp.Revenue != 50) {
+					t.Fatalf("\t%s\tShould net out refunds in the list : got %d sold for %d.", tests.Failed, lp.Sold, lp.Revenue)
+				}
+			}
+			t.Logf("\t%s\tShould net out refunds in the list.", tests.Success)
+
+			nr = product.NewRefund{Quantity: 1, Amount: 60, Reason: "Too much"}
+			if _, err := s.Refund(ctx, owner, p.ID, sale.ID, nr, now); errors.Cause(err) != product.ErrInvalidRefund {
+				t.Fatalf("\t%s\tShould NOT refund more than was paid : %v.", tests.Failed, err)
+			}
+			nr = product.NewRefund{Restock: true, Amount: 5, Reason: "Nothing to restock"}
+			if _, err := s.Refund(ctx, owner, p.ID, sale.ID, nr, now); errors.Cause(err) != product.ErrInvalidRefund {
+				t.Fatalf("\t%s\tShould NOT restock a refund without items : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept invalid refunds.", tests.Success)
+
+			rs, err := s.ListRefunds(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list refunds : %s.", tests.Failed, err)
+			}
+			if len(rs) != 2 || rs[0].Reason != "Broken" || !rs[0].Restock {
+				t.Fatalf("\t%s\tShould get back the refunds in order : %+v.", tests.Failed, rs)
+			}
+			t.Logf("\t%s\tShould get back the refunds in order.", tests.Success)
+
+			if err := s.CancelSales(ctx, seller, []string{sale.ID}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to cancel the sale : %s.", tests.Failed, err)
+			}
+			saved, err = s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Sold != 0 || saved.Revenue != 0 || saved.Available != 10 {
+				t.Fatalf("\t%s\tShould not restock refunded items twice : got %d sold for %d and %d available.", tests.Failed, saved.Sold, saved.Revenue, saved.Available)
+			}
+			t.Logf("\t%s\tShould not restock refunded items twice.", tests.Success)
+
+			sale, err = s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 2, Paid: 40}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+			}
+			if err := s.RefundSales(ctx, other, []string{sale.ID}, "Returned", now); errors.Cause(err) != product.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT allow another user to refund sales : %v.", tests.Failed, err)
+			}
+			if err := s.RefundSales(ctx, owner, []string{sale.ID}, "Returned", now); err != nil {
+				t.Fatalf("\t%s\tShould be able to refund sales : %s.", tests.Failed, err)
+			}
+			if err := s.RefundSales(ctx, owner, []string{sale.ID}, "Returned", now); err != nil {
+				t.Fatalf("\t%s\tShould be able to refund sales twice : %s.", tests.Failed, err)
+			}
+			saved, err = s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Sold != 0 || saved.Revenue != 0 || saved.Available != 10 {
+				t.Fatalf("\t%s\tShould refund what is left of the sales : got %d sold for %d and %d available.", tests.Failed, saved.Sold, saved.Revenue, saved.Available)
+			}
+			t.Logf("\t%s\tShould refund what is left of the sales and restock them.", tests.Success)
+		}
+	}
+}
+
+// currencies validates sales in other currencies are converted with the stored
+// exchange rates and revenue is reported per currency.
+func currencies(t *testing.T, s product.Store) {
+	t.Log("Given the need to sell Products priced in other currencies.")
+	{
+		t.Log("\tWhen selling a Product priced in EUR.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+
+			np := product.NewProduct{Name: "Clogs", Cost: 1000, Quantity: 10, Currency: "XXX"}
+			if _, err := s.Create(ctx, owner, np, now); errors.Cause(err) != money.ErrInvalidCurrency {
+				t.Fatalf("\t%s\tShould NOT create a product in an unknown currency : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT create a product in an unknown currency.", tests.Success)
+
+			np.Currency = "EUR"
+			p, err := s.Create(ctx, owner, np, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			if p.Currency != "EUR" {
+				t.Fatalf("\t%s\tShould keep the currency of the product : got %q.", tests.Failed, p.Currency)
+			}
+			t.Logf("\t%s\tShould be able to create a product in EUR.", tests.Success)
+
+			ns := product.NewSale{Quantity: 1, Paid: 1100, Currency: "USD"}
+			if _, err := s.AddSale(ctx, seller, p.ID, ns, now); errors.Cause(err) != product.ErrNoRate {
+				t.Fatalf("\t%s\tShould NOT sell in USD without a rate : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT sell in USD without a rate.", tests.Success)
+
+			rates := []money.Rate{{From: "EUR", To: "USD", Rate: 1.1}}
+			if err := s.SetRates(ctx, rates, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to store rates : %s.", tests.Failed, err)
+			}
+			if err := s.SetRates(ctx, []money.Rate{{From: "EUR", To: "USD", Rate: 0}}, now); errors.Cause(err) != money.ErrInvalidRate {
+				t.Fatalf("\t%s\tShould NOT store an invalid rate : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to store rates.", tests.Success)
+
+			sale, err := s.AddSale(ctx, seller, p.ID, ns, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to sell in USD : %s.", tests.Failed, err)
+			}
+			if sale.Paid != 1000 || sale.Currency != "EUR" {
+				t.Fatalf("\t%s\tShould convert the sale to EUR : got %d %s.", tests.Failed, sale.Paid, sale.Currency)
+			}
+			t.Logf("\t%s\tShould convert the sale to the currency of the product.", tests.Success)
+
+			m, err := s.Convert(ctx, money.Money{Amount: 2000, Currency: "EUR"}, "USD")
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to convert money : %s.", tests.Failed, err)
+			}
+			if m != (money.Money{Amount: 2200, Currency: "USD"}) {
+				t.Fatalf("\t%s\tShould convert with the stored rate : got %+v.", tests.Failed, m)
+			}
+			t.Logf("\t%s\tShould convert with the stored rate.", tests.Success)
+
+			revenue, err := s.Revenue(ctx)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to total revenue : %s.", tests.Failed, err)
+			}
+			var found bool
+			for _, r := range revenue {
+				if r.Currency == "EUR" {
+					found = r.Amount == 1000
+				}
+			}
+			if !found {
+				t.Fatalf("\t%s\tShould report revenue in EUR : got %+v.", tests.Failed, revenue)
+			}
+			t.Logf("\t%s\tShould report revenue per currency.", tests.Success)
+		}
+	}
+}
+
+// pricing validates Sales are priced with quantity breaks, user discounts and
+// coupons and that paying less needs the override permission.
+func pricing(t *testing.T, s product.Store) {
+	t.Log("Given the need to price Sales with pricing rules.")
+	{
+		t.Log("\tWhen selling a Product with quantity breaks.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+			buyer := auth.NewClaims("c8f2b3a4-6c27-4f3e-9d6a-3f5e8b1d2a90", []string{auth.RoleUser}, now, time.Hour)
+
+			p, err := s.Create(ctx, owner, product.NewProduct{Name: "Kazoos", Cost: 100, Quantity: 100}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+
+			nts := []product.NewPriceTier{{MinQuantity: 10, UnitPrice: 70}, {MinQuantity: 5, UnitPrice: 80}}
+			if _, err := s.SetTiers(ctx, buyer, p.ID, nts, now); errors.Cause(err) != product.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT allow another user to set tiers : %v.", tests.Failed, err)
+			}
+			dup := []product.NewPriceTier{{MinQuantity: 5, UnitPrice: 80}, {MinQuantity: 5, UnitPrice: 70}}
+			if _, err := s.SetTiers(ctx, owner, p.ID, dup, now); errors.Cause(err) != product.ErrInvalidTier {
+				t.Fatalf("\t%s\tShould NOT allow repeated tiers : %v.", tests.Failed, err)
+			}
+			tiers, err := s.SetTiers(ctx, owner, p.ID, nts, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to set tiers : %s.", tests.Failed, err)
+			}
+			if len(tiers) != 2 || tiers[0].MinQuantity != 5 {
+				t.Fatalf("\t%s\tShould get back the tiers by quantity : %+v.", tests.Failed, tiers)
+			}
+			t.Logf("\t%s\tShould allow the owner to set tiers.", tests.Success)
+
+			quotes := []struct {
+				quantity int
+				price    int
+				rules    int
+			}{
+				{4, 400, 0},
+				{5, 400, 1},
+				{10, 700, 1},
+			}
+			for _, tc := range quotes {
+				q, err := s.Quote(ctx, buyer, p.ID, product.NewQuote{Quantity: tc.quantity}, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to quote %d items : %s.", tests.Failed, tc.quantity, err)
+				}
+				if q.Price != tc.price || len(q.Rules) != tc.rules {
+					t.Fatalf("\t%s\tShould quote %d items at %d : got %+v.", tests.Failed, tc.quantity, tc.price, q)
+				}
+			}
+			t.Logf("\t%s\tShould apply the best quantity break.", tests.Success)
+
+			if err := s.SetDiscount(ctx, buyer.Subject, product.NewDiscount{Percent: 10}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to set a discount : %s.", tests.Failed, err)
+			}
+			q, err := s.Quote(ctx, buyer, p.ID, product.NewQuote{Quantity: 10}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to quote : %s.", tests.Failed, err)
+			}
+			if q.Price != 630 {
+				t.Fatalf("\t%s\tShould take the discount of the user off : got %d.", tests.Failed, q.Price)
+			}
+			t.Logf("\t%s\tShould take the discount of the user off.", tests.Success)
+		}
+
+		t.Log("\tWhen selling with coupons.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+			buyer := auth.NewClaims("6a1d9c3e-2b4f-4e8a-8c7d-5f0e9a1b2c3d", []string{auth.RoleUser}, now, time.Hour)
+
+			p, err := s.Create(ctx, owner, product.NewProduct{Name: "Whistles", Cost: 100, Quantity: 100}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+
+			nc := product.NewCoupon{Code: "SAVE50", Kind: product.CouponFixed, Value: 50, MaxUses: 1}
+			if _, err := s.CreateCoupon(ctx, nc, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to create a coupon : %s.", tests.Failed, err)
+			}
+			if _, err := s.CreateCoupon(ctx, nc, now); errors.Cause(err) != product.ErrCouponExists {
+				t.Fatalf("\t%s\tShould NOT create a coupon twice : %v.", tests.Failed, err)
+			}
+			from, until := now.Add(-48*time.Hour), now.Add(-24*time.Hour)
+			old := product.NewCoupon{Code: "OLD", Kind: product.CouponPercent, Value: 10, ValidFrom: &from, ValidUntil: &until}
+			if _, err := s.CreateCoupon(ctx, old, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to create a coupon : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to create coupons.", tests.Success)
+
+			for _, code := range []string{"OLD", "MISSING"} {
+				if _, err := s.Quote(ctx, buyer, p.ID, product.NewQuote{Quantity: 1, Coupon: code}, now); errors.Cause(err) != product.ErrInvalidCoupon {
+					t.Fatalf("\t%s\tShould NOT accept coupon %s : %v.", tests.Failed, code, err)
+				}
+			}
+			t.Logf("\t%s\tShould NOT accept expired or unknown coupons.", tests.Success)
+
+			ns := product.NewSale{Quantity: 2, Paid: 100, Coupon: "SAVE50"}
+			if _, err := s.AddSale(ctx, buyer, p.ID, ns, now); errors.Cause(err) != product.ErrPriceTooLow {
+				t.Fatalf("\t%s\tShould NOT allow paying below the price : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow paying below the price.", tests.Success)
+
+			ns.Paid = 150
+			sale, err := s.AddSale(ctx, buyer, p.ID, ns, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to sell with a coupon : %s.", tests.Failed, err)
+			}
+			if sale.Price != 150 || len(sale.Rules) != 1 || sale.Rules[0].Rule != product.RuleCoupon || sale.Rules[0].Amount != 50 {
+				t.Fatalf("\t%s\tShould record the coupon on the sale : %+v.", tests.Failed, sale)
+			}
+			t.Logf("\t%s\tShould record the coupon on the sale.", tests.Success)
+
+			if _, err := s.AddSale(ctx, buyer, p.ID, ns, now); errors.Cause(err) != product.ErrInvalidCoupon {
+				t.Fatalf("\t%s\tShould NOT use a coupon more than allowed : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT use a coupon more than allowed.", tests.Success)
+
+			over, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 1, Paid: 60}, now.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("\t%s\tShould allow overriding the price : %s.", tests.Failed, err)
+			}
+			if over.Price != 100 || len(over.Rules) != 1 || over.Rules[0].Rule != product.RuleOverride || over.Rules[0].Amount != 40 {
+				t.Fatalf("\t%s\tShould record the override on the sale : %+v.", tests.Failed, over)
+			}
+			t.Logf("\t%s\tShould allow overriding the price with permission.", tests.Success)
+
+			ss, err := s.ListSales(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list sales : %s.", tests.Failed, err)
+			}
+			if len(ss) != 2 || len(ss[0].Rules) != 1 || ss[0].Rules[0].Reference != "SAVE50" {
+				t.Fatalf("\t%s\tShould keep the rules of the sales : %+v.", tests.Failed, ss)
+			}
+			t.Logf("\t%s\tShould keep the rules of the sales.", tests.Success)
+
+			if err := s.CancelSales(ctx, seller, []string{sale.ID}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to cancel the sale : %s.", tests.Failed, err)
+			}
+			coupons, err := s.ListCoupons(ctx)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list coupons : %s.", tests.Failed, err)
+			}
+			for _, c := range coupons {
+				if c.Code == "SAVE50" && c.Uses != 0 {
+					t.Fatalf("\t%s\tShould return the use of the coupon : got %d uses.", tests.Failed, c.Uses)
+				}
+			}
+			t.Logf("\t%s\tShould return the use of the coupon when cancelling.", tests.Success)
+
+			if err := s.DeleteCoupon(ctx, "SAVE50"); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete a coupon : %s.", tests.Failed, err)
+			}
+			if err := s.DeleteCoupon(ctx, "SAVE50"); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT delete a coupon twice : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to delete a coupon.", tests.Success)
+		}
+	}
+}
+
+// categories validates categories, tags and custom attributes of Products.
+func categories(t *testing.T, s product.Store) {
+	t.Log("Given the need to organize Products in categories.")
+	{
+		now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+		ctx := context.Background()
+
+		owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+
+		t.Log("\tWhen building a category tree.")
+		{
+			bad := product.NewCategory{Name: "Bad", Schema: product.Schema{
+				{Name: "size", Type: product.AttributeNumber},
+				{Name: "size", Type: product.AttributeString},
+			}}
+			if _, err := s.CreateCategory(ctx, bad, now); errors.Cause(err) != product.ErrInvalidCategory {
+				t.Fatalf("\t%s\tShould NOT allow a schema repeating an attribute : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow a schema repeating an attribute.", tests.Success)
+
+			music, err := s.CreateCategory(ctx, product.NewCategory{Name: "Music"}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a category : %s.", tests.Failed, err)
+			}
+			nc := product.NewCategory{
+				Name:     "Guitars",
+				ParentID: &music.ID,
+				Schema: product.Schema{
+					{Name: "strings", Type: product.AttributeNumber, Required: true},
+					{Name: "electric", Type: product.AttributeBoolean},
+				},
+			}
+			guitars, err := s.CreateCategory(ctx, nc, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a subcategory : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to create a subcategory.", tests.Success)
+
+			if err := s.UpdateCategory(ctx, music.ID, product.UpdateCategory{ParentID: &guitars.ID}, now); errors.Cause(err) != product.ErrInvalidCategory {
+				t.Fatalf("\t%s\tShould NOT allow a category under its own subcategory : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow a category under its own subcategory.", tests.Success)
+
+			np := product.NewProduct{
+				Name:       "Strat",
+				Cost:       900,
+				Quantity:   3,
+				CategoryID: &guitars.ID,
+				Attributes: product.Attributes{"electric": true},
+			}
+			if _, err := s.Create(ctx, owner, np, now); errors.Cause(err) != product.ErrInvalidAttributes {
+				t.Fatalf("\t%s\tShould NOT allow missing required attributes : %v.", tests.Failed, err)
+			}
+			np.Attributes["strings"] = "six"
+			if _, err := s.Create(ctx, owner, np, now); errors.Cause(err) != product.ErrInvalidAttributes {
+				t.Fatalf("\t%s\tShould NOT allow attributes of the wrong type : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould check attributes against the schema.", tests.Success)
+
+			np.Attributes["strings"] = 6
+			np.Tags = []string{" Vintage ", "vintage", "Used"}
+			strat, err := s.Create(ctx, owner, np, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product in a category : %s.", tests.Failed, err)
+			}
+
+			saved, err := s.Retrieve(ctx, strat.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve the product : %s.", tests.Failed, err)
+			}
+			if diff := cmp.Diff([]string{"used", "vintage"}, saved.Tags); diff != "" {
+				t.Fatalf("\t%s\tShould keep normalized tags. Diff:\n%s", tests.Failed, diff)
+			}
+			if diff := cmp.Diff(product.Attributes{"strings": 6.0, "electric": true}, saved.Attributes); diff != "" {
+				t.Fatalf("\t%s\tShould keep the attributes. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould keep the category, tags and attributes.", tests.Success)
+
+			drums, err := s.Create(ctx, owner, product.NewProduct{Name: "Snare", Cost: 300, Quantity: 2, CategoryID: &music.ID, Tags: []string{"Used"}}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+
+			list, err := s.List(ctx, product.Filter{Category: music.ID})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list a category : %s.", tests.Failed, err)
+			}
+			if len(list) != 2 {
+				t.Fatalf("\t%s\tShould list the products of subcategories : got %d.", tests.Failed, len(list))
+			}
+			list, err = s.List(ctx, product.Filter{Category: guitars.ID, Tag: "USED"})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list a tag : %s.", tests.Failed, err)
+			}
+			if len(list) != 1 || list[0].ID != strat.ID {
+				t.Fatalf("\t%s\tShould list the products with the tag in the category : got %+v.", tests.Failed, list)
+			}
+			t.Logf("\t%s\tShould filter by category and tag.", tests.Success)
+
+			strict := product.UpdateCategory{Schema: &product.Schema{{Name: "strings", Type: product.AttributeNumber}}}
+			if err := s.UpdateCategory(ctx, guitars.ID, strict, now); errors.Cause(err) != product.ErrInvalidAttributes {
+				t.Fatalf("\t%s\tShould NOT allow a schema that drops used attributes : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow a schema that drops used attributes.", tests.Success)
+
+			if err := s.DeleteCategory(ctx, music.ID, now); errors.Cause(err) != product.ErrCategoryInUse {
+				t.Fatalf("\t%s\tShould NOT delete a category with subcategories : %v.", tests.Failed, err)
+			}
+			none := ""
+			if err := s.Update(ctx, owner, strat.ID, product.UpdateProduct{CategoryID: &none}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to remove the category : %s.", tests.Failed, err)
+			}
+			saved, err = s.Retrieve(ctx, strat.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve the product : %s.", tests.Failed, err)
+			}
+			if saved.CategoryID != nil || len(saved.Attributes) != 0 {
+				t.Fatalf("\t%s\tShould clear the attributes with the category : %+v.", tests.Failed, saved)
+			}
+			if err := s.DeleteCategory(ctx, guitars.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete an unused category : %s.", tests.Failed, err)
+			}
+			if err := s.Delete(ctx, drums.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete the product : %s.", tests.Failed, err)
+			}
+			if err := s.DeleteCategory(ctx, music.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete a category of deleted products : %s.", tests.Failed, err)
+			}
+			if _, err := s.RetrieveCategory(ctx, music.ID); errors.Cause(err) != product.ErrCategoryNotFound {
+				t.Fatalf("\t%s\tShould NOT find a deleted category : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould only delete unused categories.", tests.Success)
+		}
+	}
+}
+
+// search validates Products are found by the words of their name and tags.
+func search(t *testing.T, s product.Store) {
+	t.Log("Given the need to search Products.")
+	{
+		now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+		ctx := context.Background()
+
+		owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+
+		c, err := s.CreateCategory(ctx, product.NewCategory{Name: "Harmonicas"}, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create a category : %s.", tests.Failed, err)
+		}
+
+		nps := []product.NewProduct{
+			{Name: "Zephyr Flute", Cost: 500, Quantity: 1, Tags: []string{"woodwind"}},
+			{Name: "Zephyrine Horn", Cost: 2000, Quantity: 1},
+			{Name: "Blues Harp", Cost: 20000, Quantity: 1, Tags: []string{"zephyr"}, CategoryID: &c.ID},
+			{Name: "Zephyr Drum", Cost: 700, Quantity: 1},
+		}
+		ids := make([]string, len(nps))
+		for i, np := range nps {
+			p, err := s.Create(ctx, owner, np, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			ids[i] = p.ID
+		}
+		if err := s.Delete(ctx, ids[3], now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete a product : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen searching for a word.")
+		{
+			res, err := s.Search(ctx, product.SearchQuery{Text: "zephyr"})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to search : %s.", tests.Failed, err)
+			}
+
+			var names []string
+			for _, h := range res.Hits {
+				names = append(names, h.Product.Name)
+			}
+			want := []string{"Zephyr Flute", "Zephyrine Horn", "Blues Harp"}
+			if diff := cmp.Diff(want, names); diff != "" {
+				t.Fatalf("\t%s\tShould rank whole words in names first. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould rank whole words in names first.", tests.Success)
+
+			if res.Hits[0].Snippet != "<b>Zephyr</b> Flute" {
+				t.Fatalf("\t%s\tShould highlight the matching words : got %q.", tests.Failed, res.Hits[0].Snippet)
+			}
+			t.Logf("\t%s\tShould highlight the matching words.", tests.Success)
+
+			prices := []product.Facet{{Value: "0-10", Count: 1}, {Value: "10-50", Count: 1}, {Value: "50-100"}, {Value: "100+", Count: 1}}
+			if diff := cmp.Diff(prices, res.Facets.Prices); diff != "" {
+				t.Fatalf("\t%s\tShould count hits by price band. Diff:\n%s", tests.Failed, diff)
+			}
+			categories := []product.Facet{{Value: c.ID, Count: 1}}
+			if diff := cmp.Diff(categories, res.Facets.Categories); diff != "" {
+				t.Fatalf("\t%s\tShould count hits by category. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould count hits by category and price band.", tests.Success)
+		}
+
+		t.Log("\tWhen narrowing a search.")
+		{
+			queries := []struct {
+				sq    product.SearchQuery
+				total int
+				name  string
+			}{
+				{product.SearchQuery{Text: "zephyr FL"}, 1, "Zephyr Flute"},
+				{product.SearchQuery{Text: "zeph", Category: c.ID}, 1, "Blues Harp"},
+				{product.SearchQuery{Text: "zeph", Band: "10-50"}, 1, "Zephyrine Horn"},
+				{product.SearchQuery{Text: "zephyr", Limit: 1, Offset: 1}, 3, "Zephyrine Horn"},
+			}
+			for _, tc := range queries {
+				res, err := s.Search(ctx, tc.sq)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to search %+v : %s.", tests.Failed, tc.sq, err)
+				}
+				if res.Total != tc.total || len(res.Hits) != 1 || res.Hits[0].Product.Name != tc.name {
+					t.Fatalf("\t%s\tShould find %q for %+v : got %+v.", tests.Failed, tc.name, tc.sq, res)
+				}
+			}
+			t.Logf("\t%s\tShould narrow by words, category, price band and page.", tests.Success)
+
+			if _, err := s.Search(ctx, product.SearchQuery{Text: " - "}); errors.Cause(err) != product.ErrInvalidQuery {
+				t.Fatalf("\t%s\tShould NOT allow a search without words : %v.", tests.Failed, err)
+			}
+			if _, err := s.Search(ctx, product.SearchQuery{Text: "zephyr", Band: "cheap"}); errors.Cause(err) != product.ErrInvalidQuery {
+				t.Fatalf("\t%s\tShould NOT allow an unknown price band : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow invalid searches.", tests.Success)
+		}
+	}
+}
+
+// softDelete validates deleted Products are hidden but can be restored until
+// they are purged.
+func softDelete(t *testing.T, s product.Store) {
+	t.Log("Given the need to recover deleted Products.")
+	{
+		t.Log("\tWhen deleting a Product with Sales.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+
+			p, err := s.Create(ctx, claims, product.NewProduct{Name: "Board Games", Cost: 30, Quantity: 5}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			if _, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 1, Paid: 30}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+			}
+
+			deleted := now.Add(time.Hour)
+			if err := s.Delete(ctx, p.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to delete product.", tests.Success)
+
+			list, err := s.List(ctx, product.Filter{})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list products : %s.", tests.Failed, err)
+			}
+			for _, lp := range list {
+				if lp.ID == p.ID {
+					t.Fatalf("\t%s\tShould NOT list a deleted product.", tests.Failed)
+				}
+			}
+			t.Logf("\t%s\tShould NOT list a deleted product.", tests.Success)
+
+			list, err = s.List(ctx, product.Filter{IncludeDeleted: true})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list products : %s.", tests.Failed, err)
+			}
+			var found *product.Product
+			for i := range list {
+				if list[i].ID == p.ID {
+					found = &list[i]
+				}
+			}
+			if found == nil || found.DeletedAt == nil || !found.DeletedAt.Equal(deleted) {
+				t.Fatalf("\t%s\tShould list a deleted product when asked : %+v.", tests.Failed, found)
+			}
+			if found.Sold != 1 || found.Revenue != 30 {
+				t.Fatalf("\t%s\tShould keep aggregates of a deleted product : got %d sold for %d.", tests.Failed, found.Sold, found.Revenue)
+			}
+			t.Logf("\t%s\tShould list a deleted product when asked.", tests.Success)
+
+			if err := s.Update(ctx, claims, p.ID, product.UpdateProduct{}, now); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT be able to update a deleted product : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to update a deleted product.", tests.Success)
+
+			if err := s.Restore(ctx, p.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to restore product : %s.", tests.Failed, err)
+			}
+			saved, err := s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve restored product : %s.", tests.Failed, err)
+			}
+			if saved.DeletedAt != nil || saved.Sold != 1 || saved.Revenue != 30 {
+				t.Fatalf("\t%s\tShould get back the product with its sales : %+v.", tests.Failed, saved)
+			}
+			t.Logf("\t%s\tShould get back the product with its sales.", tests.Success)
+
+			if err := s.Restore(ctx, p.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould allow restoring an active product : %s.", tests.Failed, err)
+			}
+			if err := s.Restore(ctx, "a224a8d6-3f9e-4b11-9900-e81a25d80702", deleted); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould not find an unknown ID on restore : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould handle restoring active and unknown products.", tests.Success)
+
+			if err := s.Delete(ctx, p.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+
+			if _, err := s.Purge(ctx, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to purge products : %s.", tests.Failed, err)
+			}
+			if err := s.Restore(ctx, p.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould NOT purge products deleted within retention : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT purge products deleted within retention.", tests.Success)
+
+			if err := s.Delete(ctx, p.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+
+			n, err := s.Purge(ctx, deleted.Add(time.Second))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to purge products : %s.", tests.Failed, err)
+			}
+			if n < 1 {
+				t.Fatalf("\t%s\tShould purge the deleted product : got %d.", tests.Failed, n)
+			}
+			if err := s.Restore(ctx, p.ID, deleted); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT be able to restore a purged product : %v.", tests.Failed, err)
+			}
+			ss, err := s.ListSales(ctx, p.ID)
+			if err != nil || len(ss) != 0 {
+				t.Fatalf("\t%s\tShould remove sales of a purged product : %d %v.", tests.Failed, len(ss), err)
+			}
+			t.Logf("\t%s\tShould purge the deleted product and its sales.", tests.Success)
+		}
+	}
+}
+
+// inventory validates the stock of a Product follows its ledger.
+func inventory(t *testing.T, s product.Store) {
+	t.Log("Given the need to track the stock of a Product.")
+	{
+		t.Log("\tWhen moving items in and out of stock.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+			other := auth.NewClaims("4bf4ff8a-8fb4-4e2d-9e4f-d5bb1a7a15d8", []string{auth.RoleUser}, now, time.Hour)
+
+			p, err := s.Create(ctx, owner, product.NewProduct{Name: "Marbles", Cost: 1, Quantity: 10}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+
+			na := product.NewAdjustment{Kind: product.MovementReceive, Quantity: 5, Reason: "Delivery"}
+			if _, err := s.Adjust(ctx, other, p.ID, na, now.Add(time.Minute)); errors.Cause(err) != product.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT allow another user to adjust stock : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow another user to adjust stock.", tests.Success)
+
+			if _, err := s.Adjust(ctx, owner, p.ID, na, now.Add(time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould be able to receive stock : %s.", tests.Failed, err)
+			}
+			na = product.NewAdjustment{Kind: product.MovementAdjust, Quantity: -3, Reason: "Lost"}
+			if _, err := s.Adjust(ctx, owner, p.ID, na, now.Add(2*time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould be able to adjust stock : %s.", tests.Failed, err)
+			}
+			if _, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 4, Paid: 4}, now.Add(3*time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to move stock.", tests.Success)
+
+			saved, err := s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.OnHand != 8 || saved.Available != 8 {
+				t.Fatalf("\t%s\tShould have 8 items on hand and available : got %d and %d.", tests.Failed, saved.OnHand, saved.Available)
+			}
+			t.Logf("\t%s\tShould compute stock from the ledger.", tests.Success)
+
+			ms, err := s.ListMovements(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list movements : %s.", tests.Failed, err)
+			}
+			kinds := []string{product.MovementReceive, product.MovementReceive, product.MovementAdjust, product.MovementSale}
+			if len(ms) != len(kinds) {
+				t.Fatalf("\t%s\tShould get back %d movements : got %d.", tests.Failed, len(kinds), len(ms))
+			}
+			for i, m := range ms {
+				if m.Kind != kinds[i] {
+					t.Fatalf("\t%s\tShould get back the movements in order : got %s at %d.", tests.Failed, m.Kind, i)
+				}
+			}
+			t.Logf("\t%s\tShould get back the movements in order.", tests.Success)
+
+			if _, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 9, Paid: 9}, now.Add(4*time.Minute)); errors.Cause(err) != product.ErrInsufficientStock {
+				t.Fatalf("\t%s\tShould NOT sell more than is available : %v.", tests.Failed, err)
+			}
+			na = product.NewAdjustment{Kind: product.MovementAdjust, Quantity: -9, Reason: "Lost"}
+			if _, err := s.Adjust(ctx, owner, p.ID, na, now.Add(4*time.Minute)); errors.Cause(err) != product.ErrInsufficientStock {
+				t.Fatalf("\t%s\tShould NOT remove more than is available : %v.", tests.Failed, err)
+			}
+			na = product.NewAdjustment{Kind: product.MovementReturn, Quantity: -1, Reason: "Refund"}
+			if _, err := s.Adjust(ctx, owner, p.ID, na, now.Add(4*time.Minute)); errors.Cause(err) != product.ErrInvalidMovement {
+				t.Fatalf("\t%s\tShould NOT return a negative quantity : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reject movements that do not fit the stock.", tests.Success)
+
+			if err := s.Update(ctx, owner, p.ID, product.UpdateProduct{Quantity: tests.IntPointer(20)}, now.Add(5*time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould be able to update the quantity : %s.", tests.Failed, err)
+			}
+			saved, err = s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.OnHand != 18 {
+				t.Fatalf("\t%s\tShould move a quantity update through the ledger : got %d on hand.", tests.Failed, saved.OnHand)
+			}
+			t.Logf("\t%s\tShould move a quantity update through the ledger.", tests.Success)
+
+			if err := s.Delete(ctx, p.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+		}
+	}
+}
+
+// reservations validates reserved items are held until they are released or
+// expire and that concurrent reservations never oversell.
+func reservations(t *testing.T, s product.Store) {
+	t.Log("Given the need to hold stock for customers.")
+	{
+		t.Log("\tWhen reserving items of a Product.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+			buyer := auth.NewClaims("45b5fbd3-755f-4379-8f07-a58d4a30fa2f", []string{auth.RoleUser}, now, time.Hour)
+			stranger := auth.NewClaims("c9f5a3e0-2f0e-4a52-9d54-3c1f0b3f1d8a", []string{auth.RoleUser}, now, time.Hour)
+
+			p, err := s.Create(ctx, claims, product.NewProduct{Name: "Kites", Cost: 15, Quantity: 5}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+
+			r, err := s.Reserve(ctx, buyer, p.ID, product.NewReservation{Quantity: 2, TTL: 60}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to reserve items : %s.", tests.Failed, err)
+			}
+			if r.UserID == nil || *r.UserID != buyer.Subject {
+				t.Fatalf("\t%s\tShould record who reserved the items : %v.", tests.Failed, r.UserID)
+			}
+			if r.ExpiresAt == nil || !r.ExpiresAt.Equal(now.Add(time.Minute)) {
+				t.Fatalf("\t%s\tShould expire after the TTL : %v.", tests.Failed, r.ExpiresAt)
+			}
+			t.Logf("\t%s\tShould be able to reserve items.", tests.Success)
+
+			saved, err := s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.OnHand != 5 || saved.Available != 3 {
+				t.Fatalf("\t%s\tShould hold reserved items : got %d on hand and %d available.", tests.Failed, saved.OnHand, saved.Available)
+			}
+			t.Logf("\t%s\tShould hold reserved items.", tests.Success)
+
+			if _, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 4, Paid: 60}, now); errors.Cause(err) != product.ErrInsufficientStock {
+				t.Fatalf("\t%s\tShould NOT sell reserved items : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT sell reserved items.", tests.Success)
+
+			if err := s.Release(ctx, stranger, p.ID, r.ID, now); errors.Cause(err) != product.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT release the reservation of another user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT release the reservation of another user.", tests.Success)
+
+			if err := s.Release(ctx, buyer, p.ID, r.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to release a reservation : %s.", tests.Failed, err)
+			}
+			if err := s.Release(ctx, claims, p.ID, r.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to release a reservation twice : %s.", tests.Failed, err)
+			}
+			if err := s.Release(ctx, claims, p.ID, p.ID, now); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould not find an unknown reservation : %v.", tests.Failed, err)
+			}
+			saved, err = s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Available != 5 {
+				t.Fatalf("\t%s\tShould return released items once : got %d available.", tests.Failed, saved.Available)
+			}
+			t.Logf("\t%s\tShould return released items once.", tests.Success)
+
+			if _, err := s.Reserve(ctx, claims, p.ID, product.NewReservation{Quantity: 5, TTL: 60}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to reserve all items : %s.", tests.Failed, err)
+			}
+			if _, err := s.Reserve(ctx, claims, p.ID, product.NewReservation{Quantity: 1, TTL: 60}, now); errors.Cause(err) != product.ErrInsufficientStock {
+				t.Fatalf("\t%s\tShould NOT reserve more than is available : %v.", tests.Failed, err)
+			}
+			if _, err := s.Reserve(ctx, claims, p.ID, product.NewReservation{Quantity: 1, TTL: 60}, now.Add(time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould reserve items of an expired reservation : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reserve items of an expired reservation.", tests.Success)
+
+			n, err := s.ExpireReservations(ctx, now.Add(2*time.Minute))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to expire reservations : %s.", tests.Failed, err)
+			}
+			if n < 1 {
+				t.Fatalf("\t%s\tShould expire the remaining reservation : got %d.", tests.Failed, n)
+			}
+			saved, err = s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if saved.Available != 5 {
+				t.Fatalf("\t%s\tShould return expired items : got %d available.", tests.Failed, saved.Available)
+			}
+			t.Logf("\t%s\tShould return expired items.", tests.Success)
+
+			const attempts = 10
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				reserved int
+			)
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := s.Reserve(ctx, claims, p.ID, product.NewReservation{Quantity: 1, TTL: 60}, now.Add(3*time.Minute))
+					switch errors.Cause(err) {
+					case nil:
+						mu.Lock()
+						reserved++
+						mu.Unlock()
+					case product.ErrInsufficientStock:
+					default:
+						t.Errorf("\t%s\tShould be able to reserve concurrently : %s.", tests.Failed, err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			saved, err = s.Retrieve(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product by ID: %s.", tests.Failed, err)
+			}
+			if reserved != 5 || saved.Available != 0 {
+				t.Fatalf("\t%s\tShould reserve exactly the available items concurrently : got %d reserved and %d available.", tests.Failed, reserved, saved.Available)
+			}
+			t.Logf("\t%s\tShould reserve exactly the available items concurrently.", tests.Success)
+
+			if err := s.Delete(ctx, p.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+		}
+	}
+}
+
+// ownership validates only admins and owners may modify a Product.
+func ownership(t *testing.T, s product.Store) {
+	t.Log("Given the need to protect Products from other users.")
+	{
+		t.Log("\tWhen a different user modifies a Product.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			owner := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+			other := auth.NewClaims("4bf4ff8a-8fb4-4e2d-9e4f-d5bb1a7a15d8", []string{auth.RoleUser}, now, time.Hour)
+			admin := auth.NewClaims("9f5e7e39-0a2a-4b1c-a1cb-16be24e8d0f3", []string{auth.RoleAdmin}, now, time.Hour)
+
+			np := product.NewProduct{
+				Name:     "Yo-yos",
+				Cost:     5,
+				Quantity: 100,
+			}
+
+			p, err := s.Create(ctx, owner, np, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			if p.UserID != owner.Subject {
+				t.Fatalf("\t%s\tShould record the creator as owner : got %q.", tests.Failed, p.UserID)
+			}
+			t.Logf("\t%s\tShould record the creator as owner.", tests.Success)
+
+			upd := product.UpdateProduct{Cost: tests.IntPointer(1)}
+
+			if err := s.Update(ctx, other, p.ID, upd, now); errors.Cause(err) != product.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT allow another user to update : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT allow another user to update.", tests.Success)
+
+			if err := s.Update(ctx, owner, p.ID, upd, now); err != nil {
+				t.Fatalf("\t%s\tShould allow the owner to update : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould allow the owner to update.", tests.Success)
+
+			if err := s.Update(ctx, admin, p.ID, upd, now); err != nil {
+				t.Fatalf("\t%s\tShould allow an admin to update : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould allow an admin to update.", tests.Success)
+
+			if err := s.Delete(ctx, p.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+		}
+	}
+}
+
+// history validates every change of a Product is kept as a Version that can
+// be retrieved by time and that Sales keep the unit price they were made at.
+func history(t *testing.T, s product.Store) {
+	t.Log("Given the need to know the past values of Products.")
+	{
+		ctx := context.Background()
+		now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+		admin := auth.NewClaims("5cf37266-3473-4006-984f-9325122678b7", []string{auth.RoleAdmin}, now, time.Hour)
+
+		np := product.NewProduct{Name: "Clocks", Cost: 100, Quantity: 10, Tags: []string{"time"}}
+		p, err := s.Create(ctx, seller, np, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+		}
+
+		sale, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 1, Paid: 100}, now.Add(30*time.Minute))
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+		}
+
+		if err := s.Update(ctx, admin, p.ID, product.UpdateProduct{Cost: tests.IntPointer(150)}, now.Add(time.Hour)); err != nil {
+			t.Fatalf("\t%s\tShould be able to update the product : %s.", tests.Failed, err)
+		}
+		name := "Wall Clocks"
+		if err := s.Update(ctx, seller, p.ID, product.UpdateProduct{Name: &name}, now.Add(2*time.Hour)); err != nil {
+			t.Fatalf("\t%s\tShould be able to update the product : %s.", tests.Failed, err)
+		}
+
+		later, err := s.AddSale(ctx, seller, p.ID, product.NewSale{Quantity: 1, Paid: 150}, now.Add(3*time.Hour))
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen listing the history of a Product.")
+		{
+			versions, err := s.History(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list the versions : %s.", tests.Failed, err)
+			}
+			if len(versions) != 3 {
+				t.Fatalf("\t%s\tShould get a version for every change : got %d.", tests.Failed, len(versions))
+			}
+			t.Logf("\t%s\tShould get a version for every change.", tests.Success)
+
+			for i, want := range []struct {
+				cost      int
+				name      string
+				changedBy string
+			}{
+				{100, "Clocks", seller.Subject},
+				{150, "Clocks", admin.Subject},
+				{150, "Wall Clocks", seller.Subject},
+			} {
+				v := versions[i]
+				if v.Version != i+1 || v.Cost != want.cost || v.Name != want.name || v.ChangedBy != want.changedBy {
+					t.Fatalf("\t%s\tShould record the values and the user of change %d : got %+v.", tests.Failed, i+1, v)
+				}
+			}
+			if !cmp.Equal([]string(versions[2].Tags), []string{"time"}) {
+				t.Fatalf("\t%s\tShould keep the tags : got %v.", tests.Failed, versions[2].Tags)
+			}
+			t.Logf("\t%s\tShould record the values and the user of every change.", tests.Success)
+		}
+
+		t.Log("\tWhen retrieving a Product as of a time.")
+		{
+			v, err := s.RetrieveVersion(ctx, p.ID, sale.DateCreated)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve a version : %s.", tests.Failed, err)
+			}
+			if v.Version != 1 || v.Cost != 100 {
+				t.Fatalf("\t%s\tShould get the price at the time of the sale : got %+v.", tests.Failed, v)
+			}
+			t.Logf("\t%s\tShould get the price at the time of the sale.", tests.Success)
+
+			if v, err = s.RetrieveVersion(ctx, p.ID, now.Add(time.Hour)); err != nil || v.Version != 2 {
+				t.Fatalf("\t%s\tShould get the version made at that exact time : %+v, %v.", tests.Failed, v, err)
+			}
+			t.Logf("\t%s\tShould get the version made at that exact time.", tests.Success)
+
+			if _, err := s.RetrieveVersion(ctx, p.ID, now.Add(-time.Second)); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould not find a version before the product was created : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould not find a version before the product was created.", tests.Success)
+		}
+
+		t.Log("\tWhen listing the Sales of a Product.")
+		{
+			if sale.UnitPrice != 100 || later.UnitPrice != 150 {
+				t.Fatalf("\t%s\tShould keep the unit price of every sale : got %d and %d.", tests.Failed, sale.UnitPrice, later.UnitPrice)
+			}
+			sales, err := s.ListSales(ctx, p.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list sales : %s.", tests.Failed, err)
+			}
+			if len(sales) != 2 || sales[0].UnitPrice != 100 || sales[1].UnitPrice != 150 {
+				t.Fatalf("\t%s\tShould store the unit price of every sale : got %+v.", tests.Failed, sales)
+			}
+			t.Logf("\t%s\tShould keep the unit price of every sale.", tests.Success)
+		}
+
+		t.Log("\tWhen the Product is deleted.")
+		{
+			if err := s.Delete(ctx, p.ID, now.Add(4*time.Hour)); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete the product : %s.", tests.Failed, err)
+			}
+			if _, err := s.History(ctx, p.ID); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould hide the history of deleted products : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould hide the history of deleted products.", tests.Success)
+		}
+	}
+}
+
+// bulk validates Products are imported row by row and exported in a form that
+// can be imported again.
+func bulk(t *testing.T, s product.Store) {
+	t.Log("Given the need to import and export Products in bulk.")
+	{
+		ctx := context.Background()
+		now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+		c, err := s.CreateCategory(ctx, product.NewCategory{Name: "Kitchen", Schema: product.Schema{
+			{Name: "color", Type: product.AttributeString, Required: true},
+		}}, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create a category : %s.", tests.Failed, err)
+		}
+
+		data := "name,cost,quantity,currency,tags,category_id,attributes\n" +
+			`Kettles,1500,10,USD,Steel; Kitchen,` + c.ID + `,"{""color"":""red""}"` + "\n" +
+			",100,1,,,,\n" +
+			"Toasters,abc,1,,,,\n" +
+			"Pans,900,2,XXX,,,\n" +
+			"Pots,700,0,,,,\n"
+
+		count := func() int {
+			ps, err := s.List(ctx, product.Filter{Category: c.ID})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list products : %s.", tests.Failed, err)
+			}
+			return len(ps)
+		}
+
+		t.Log("\tWhen decoding a CSV file.")
+		{
+			rows, err := product.DecodeProducts(strings.NewReader(data), product.FormatCSV)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to decode the file : %s.", tests.Failed, err)
+			}
+			if len(rows) != 5 || rows[0].Err != nil || rows[1].Err == nil || rows[2].Err == nil || rows[3].Err != nil || rows[4].Err == nil {
+				t.Fatalf("\t%s\tShould validate every row : got %+v.", tests.Failed, rows)
+			}
+			t.Logf("\t%s\tShould validate every row.", tests.Success)
+
+			_, err = product.DecodeProducts(strings.NewReader("name,price\n"), product.FormatCSV)
+			if errors.Cause(err) != product.ErrInvalidImport {
+				t.Fatalf("\t%s\tShould reject unknown columns : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reject unknown columns.", tests.Success)
+		}
+
+		rows, err := product.DecodeProducts(strings.NewReader(data), product.FormatCSV)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to decode the file : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen importing without keeping the Products.")
+		{
+			for _, opts := range []product.ImportOptions{{DryRun: true}, {Atomic: true}} {
+				res, err := s.Import(ctx, seller, rows, opts, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to import : %s.", tests.Failed, err)
+				}
+				if res.Valid != 1 || res.Failed != 4 || res.Created != 0 || res.Rows[0].ID != "" {
+					t.Fatalf("\t%s\tShould report the rows without keeping any : got %+v.", tests.Failed, res)
+				}
+				if res.Rows[3].Error == "" || res.Rows[3].Row != 4 {
+					t.Fatalf("\t%s\tShould report the rows the store rejects : got %+v.", tests.Failed, res.Rows[3])
+				}
+				if n := count(); n != 0 {
+					t.Fatalf("\t%s\tShould keep no product : got %d.", tests.Failed, n)
+				}
+			}
+			t.Logf("\t%s\tShould report the rows of dry runs and failed atomic imports without keeping any.", tests.Success)
+		}
+
+		t.Log("\tWhen importing on a best-effort basis.")
+		{
+			res, err := s.Import(ctx, seller, rows, product.ImportOptions{}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to import : %s.", tests.Failed, err)
+			}
+			if res.Created != 1 || res.Failed != 4 || res.Rows[0].ID == "" {
+				t.Fatalf("\t%s\tShould keep the valid rows : got %+v.", tests.Failed, res)
+			}
+			t.Logf("\t%s\tShould keep the valid rows.", tests.Success)
+
+			p, err := s.Retrieve(ctx, res.Rows[0].ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve the product : %s.", tests.Failed, err)
+			}
+			if p.Name != "Kettles" || p.Cost != 1500 || p.OnHand != 10 || p.Attributes["color"] != "red" || !cmp.Equal(p.Tags, []string{"kitchen", "steel"}) {
+				t.Fatalf("\t%s\tShould import every column : got %+v.", tests.Failed, p)
+			}
+			t.Logf("\t%s\tShould import every column.", tests.Success)
+		}
+
+		t.Log("\tWhen exporting the imported Products.")
+		{
+			ps, err := s.List(ctx, product.Filter{Category: c.ID})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list products : %s.", tests.Failed, err)
+			}
+
+			for _, format := range []string{product.FormatCSV, product.FormatNDJSON} {
+				var buf bytes.Buffer
+				if err := product.EncodeProducts(&buf, format, ps); err != nil {
+					t.Fatalf("\t%s\tShould be able to export as %s : %s.", tests.Failed, format, err)
+				}
+
+				exported, err := product.DecodeProducts(&buf, format)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to decode the %s export : %s.", tests.Failed, format, err)
+				}
+				if len(exported) != 1 || exported[0].Err != nil {
+					t.Fatalf("\t%s\tShould export valid rows as %s : got %+v.", tests.Failed, format, exported)
+				}
+				if diff := cmp.Diff(rows[0].Product.Attributes, exported[0].Product.Attributes); diff != "" || exported[0].Product.Name != "Kettles" || *exported[0].Product.CategoryID != c.ID {
+					t.Fatalf("\t%s\tShould round trip the product as %s : got %+v.", tests.Failed, format, exported[0].Product)
+				}
+			}
+			t.Logf("\t%s\tShould round trip the products as CSV and NDJSON.", tests.Success)
+		}
+	}
+}
+
+// invalid validates the errors returned for bad or unknown IDs.
+func invalid(t *testing.T, s product.Store) {
+	t.Log("Given the need to reject unusable Product IDs.")
+	{
+		t.Log("\tWhen using malformed and unknown IDs.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+			claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+			if _, err := s.Retrieve(ctx, "12345"); errors.Cause(err) != product.ErrInvalidID {
+				t.Fatalf("\t%s\tShould reject a malformed ID on retrieve : %v.", tests.Failed, err)
+			}
+			if err := s.Update(ctx, claims, "12345", product.UpdateProduct{}, now); errors.Cause(err) != product.ErrInvalidID {
+				t.Fatalf("\t%s\tShould reject a malformed ID on update : %v.", tests.Failed, err)
+			}
+			if err := s.Delete(ctx, "12345", now); errors.Cause(err) != product.ErrInvalidID {
+				t.Fatalf("\t%s\tShould reject a malformed ID on delete : %v.", tests.Failed, err)
+			}
+			if err := s.Restore(ctx, "12345", now); errors.Cause(err) != product.ErrInvalidID {
+				t.Fatalf("\t%s\tShould reject a malformed ID on restore : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reject malformed IDs.", tests.Success)
+
+			const unknown = "a224a8d6-3f9e-4b11-9900-e81a25d80702"
+			if _, err := s.Retrieve(ctx, unknown); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould not find an unknown ID on retrieve : %v.", tests.Failed, err)
+			}
+			if err := s.Update(ctx, claims, unknown, product.UpdateProduct{}, now); errors.Cause(err) != product.ErrNotFound {
+				t.Fatalf("\t%s\tShould not find an unknown ID on update : %v.", tests.Failed, err)
+			}
+			if err := s.Delete(ctx, unknown, now); err != nil {
+				t.Fatalf("\t%s\tShould allow deleting an unknown ID : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould handle unknown IDs.", tests.Success)
+		}
+	}
+}
+
+// transfer validates every Product of a user can be handed to another user.
+func transfer(t *testing.T, s product.Store) {
+	t.Log("Given the need to keep the Products of users who leave.")
+	{
+		t.Log("\tWhen transferring the Products of a user.")
+		{
+			now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+			ctx := context.Background()
+
+			from := auth.NewClaims("3d2a5c47-94b5-4a8f-8d1e-0c6b1f2e7a90", []string{auth.RoleUser}, now, time.Hour)
+			to := auth.NewClaims("c8e1f0a2-5b7d-4c3e-9f6a-2d4b8e1c7f35", []string{auth.RoleUser}, now, time.Hour)
+
+			kept, err := s.Create(ctx, from, product.NewProduct{Name: "Kites", Cost: 15, Quantity: 3}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			gone, err := s.Create(ctx, from, product.NewProduct{Name: "Marbles", Cost: 2, Quantity: 50}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+			}
+			if err := s.Delete(ctx, gone.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete product : %s.", tests.Failed, err)
+			}
+
+			if _, err := s.Transfer(ctx, "bad", to.Subject, now); errors.Cause(err) != product.ErrInvalidID {
+				t.Fatalf("\t%s\tShould NOT transfer from an invalid ID : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT transfer from an invalid ID.", tests.Success)
+
+			n, err := s.Transfer(ctx, from.Subject, to.Subject, now.Add(time.Hour))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to transfer products : %s.", tests.Failed, err)
+			}
+			if n != 2 {
+				t.Fatalf("\t%s\tShould transfer deleted products too : got %d.", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould transfer deleted products too.", tests.Success)
+
+			p, err := s.Retrieve(ctx, kept.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve product : %s.", tests.Failed, err)
+			}
+			if p.UserID != to.Subject {
+				t.Fatalf("\t%s\tShould have the new owner : got %q.", tests.Failed, p.UserID)
+			}
+			t.Logf("\t%s\tShould have the new owner.", tests.Success)
+
+			upd := product.UpdateProduct{Cost: tests.IntPointer(20)}
+			if err := s.Update(ctx, to, p.ID, upd, now.Add(time.Hour)); err != nil {
+				t.Fatalf("\t%s\tShould let the new owner update : %s.", tests.Failed, err)
+			}
+			if err := s.Update(ctx, from, p.ID, upd, now.Add(time.Hour)); errors.Cause(err) != product.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT let the old owner update : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould only let the new owner update.", tests.Success)
+		}
+	}
+}
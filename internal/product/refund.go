@@ -0,0 +1,254 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// refundedQuantity and refundedAmount compute the refund totals of the
+// product aliased as p so they can be taken off its sales aggregates.
+const (
+	refundedQuantity = `(SELECT COALESCE(SUM(r.quantity), 0) FROM refunds AS r WHERE r.product_id = p.product_id)`
+	refundedAmount   = `(SELECT COALESCE(SUM(r.amount), 0) FROM refunds AS r WHERE r.product_id = p.product_id)`
+)
+
+// Refund reverses all or part of a Sale of a Product. Only admins and the
+// owner of the Product may refund its Sales. The refunds of a Sale can never
+// add up to more items or money than the Sale recorded.
+func (s *DB) Refund(ctx context.Context, user auth.Claims, productID, saleID string, nr NewRefund, now time.Time) (*Refund, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Refund")
+	defer span.End()
+
+	if _, err := uuid.Parse(saleID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if err := validRefund(nr); err != nil {
+		return nil, err
+	}
+
+	p, err := s.Retrieve(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	// If you do not have the admin role ...
+	// and you are not the owner of this product ...
+	// then get outta here!
+	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
+		return nil, ErrForbidden
+	}
+
+	r := Refund{
+		ID:          uuid.New().String(),
+		SaleID:      saleID,
+		ProductID:   productID,
+		Quantity:    nr.Quantity,
+		Amount:      nr.Amount,
+		Restock:     nr.Restock,
+		Reason:      nr.Reason,
+		UserID:      user.Subject,
+		DateCreated: now.UTC(),
+	}
+
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if _, err := lockProduct(ctx, tx, productID); err != nil {
+			return err
+		}
+
+		var sale Sale
+		const qs = `SELECT * FROM sales WHERE sale_id = $1 AND product_id = $2`
+		if err := tx.GetContext(ctx, &sale, qs, saleID, productID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return errors.Wrapf(err, "selecting sale %s", saleID)
+		}
+
+		done, err := refundedTx(ctx, tx, saleID)
+		if err != nil {
+			return err
+		}
+		if done.Quantity+r.Quantity > sale.Quantity || done.Amount+r.Amount > sale.Paid {
+			return ErrInvalidRefund
+		}
+
+		return insertRefund(ctx, tx, r, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// ListRefunds gives all Refunds of the Sales of a Product.
+func (s *DB) ListRefunds(ctx context.Context, productID string) ([]Refund, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.ListRefunds")
+	defer span.End()
+
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	refunds := []Refund{}
+	const q = `SELECT * FROM refunds WHERE product_id = $1 ORDER BY date_created`
+
+	if err := s.db.SelectContext(ctx, &refunds, q, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting refunds")
+	}
+
+	return refunds, nil
+}
+
+// RefundSalesTx refunds whatever is left of Sales as part of the transaction
+// tx and returns their items to stock. Only admins and the owners of the
+// Products may refund their Sales. Sales already refunded in full are left
+// as they are.
+func RefundSalesTx(ctx context.Context, tx *sqlx.Tx, user auth.Claims, saleIDs []string, reason string, now time.Time) error {
+	for _, id := range saleIDs {
+		sale, err := lockSale(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		var owner string
+		const q = `SELECT user_id FROM products WHERE product_id = $1`
+		if err := tx.GetContext(ctx, &owner, q, sale.ProductID); err != nil {
+			return errors.Wrapf(err, "selecting owner of product %s", sale.ProductID)
+		}
+		if !user.HasRole(auth.RoleAdmin) && owner != user.Subject {
+			return ErrForbidden
+		}
+
+		if _, err := reverseSale(ctx, tx, user, *sale, reason, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockSale reads a Sale and locks its Product for the rest of the
+// transaction. Sales of a deleted Product can still be reversed.
+func lockSale(ctx context.Context, tx *sqlx.Tx, id string) (*Sale, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	var sale Sale
+	const q = `SELECT * FROM sales WHERE sale_id = $1`
+	if err := tx.GetContext(ctx, &sale, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting sale %s", id)
+	}
+
+	if _, err := lockProduct(ctx, tx, sale.ProductID); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	return &sale, nil
+}
+
+// reverseSale refunds the items and money of sale that were not refunded yet
+// and returns those items to stock. It reports if there was anything left to
+// refund.
+func reverseSale(ctx context.Context, tx *sqlx.Tx, user auth.Claims, sale Sale, reason string, now time.Time) (bool, error) {
+	done, err := refundedTx(ctx, tx, sale.ID)
+	if err != nil {
+		return false, err
+	}
+
+	r := remainder(user, sale, done, reason, now)
+	if r.Quantity == 0 && r.Amount == 0 {
+		return false, nil
+	}
+
+	return true, insertRefund(ctx, tx, r, now)
+}
+
+// refundedTx sums the Refunds already made of a Sale.
+func refundedTx(ctx context.Context, tx *sqlx.Tx, saleID string) (Refund, error) {
+	var done Refund
+	const q = `SELECT COALESCE(SUM(quantity), 0) AS quantity, COALESCE(SUM(amount), 0) AS amount
+		FROM refunds WHERE sale_id = $1`
+	if err := tx.GetContext(ctx, &done, q, saleID); err != nil {
+		return Refund{}, errors.Wrapf(err, "selecting refunds of sale %s", saleID)
+	}
+	return done, nil
+}
+
+// insertRefund records r as part of the transaction tx and returns its items
+// to stock when it restocks.
+func insertRefund(ctx context.Context, tx *sqlx.Tx, r Refund, now time.Time) error {
+	const q = `INSERT INTO refunds
+		(refund_id, sale_id, product_id, quantity, amount, restock, reason, user_id, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := tx.ExecContext(ctx, q,
+		r.ID, r.SaleID, r.ProductID,
+		r.Quantity, r.Amount, r.Restock,
+		r.Reason, r.UserID, r.DateCreated,
+	)
+	if err != nil {
+		return errors.Wrap(err, "inserting refund")
+	}
+
+	if r.Restock && r.Quantity > 0 {
+		if err := insertMovement(ctx, tx, restockMovement(r), now); err != nil {
+			return err
+		}
+	}
+
+	return event.Record(ctx, tx, event.SaleRefunded, r.SaleID, r, now)
+}
+
+// remainder builds the Refund of what is left of sale after the refunds
+// totalled in done. The items it refunds go back to stock.
+func remainder(user auth.Claims, sale Sale, done Refund, reason string, now time.Time) Refund {
+	quantity := sale.Quantity - done.Quantity
+	return Refund{
+		ID:          uuid.New().String(),
+		SaleID:      sale.ID,
+		ProductID:   sale.ProductID,
+		Quantity:    quantity,
+		Amount:      sale.Paid - done.Amount,
+		Restock:     quantity > 0,
+		Reason:      reason,
+		UserID:      user.Subject,
+		DateCreated: now.UTC(),
+	}
+}
+
+// validRefund checks a refund gives something back.
+func validRefund(nr NewRefund) error {
+	if nr.Quantity < 0 || nr.Amount < 0 || (nr.Quantity == 0 && nr.Amount == 0) {
+		return ErrInvalidRefund
+	}
+	if nr.Restock && nr.Quantity == 0 {
+		return ErrInvalidRefund
+	}
+	return nil
+}
+
+// restockMovement builds the Movement that returns the items of r to stock.
+// It shares the ID of the refund.
+func restockMovement(r Refund) Movement {
+	return Movement{
+		ID:          r.ID,
+		ProductID:   r.ProductID,
+		Kind:        MovementReturn,
+		Quantity:    r.Quantity,
+		Reason:      r.Reason,
+		UserID:      &r.UserID,
+		DateCreated: r.DateCreated,
+	}
+}
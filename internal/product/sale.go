@@ -0,0 +1,193 @@
+package product
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/money"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// AddSales records several sales transactions made by the user at once.
+// Either every Sale is recorded or none are. It will error if an ID is invalid
+// or does not reference an existing Product, if not enough items are available
+// or if the user may not agree to an amount paid.
+func (s *DB) AddSales(ctx context.Context, user auth.Claims, lines []SaleLine, now time.Time) ([]Sale, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.AddSales")
+	defer span.End()
+
+	var sales []Sale
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var err error
+		sales, err = AddSalesTx(ctx, tx, user, lines, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sales, nil
+}
+
+// CancelSales reverses Sales that were never paid for and returns their items
+// to stock. Either every Sale is cancelled or none are.
+func (s *DB) CancelSales(ctx context.Context, user auth.Claims, saleIDs []string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.CancelSales")
+	defer span.End()
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		return CancelSalesTx(ctx, tx, user, saleIDs, now)
+	})
+}
+
+// RefundSales refunds whatever is left of Sales and returns their items to
+// stock. Either every Sale is refunded or none are.
+func (s *DB) RefundSales(ctx context.Context, user auth.Claims, saleIDs []string, reason string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.product.RefundSales")
+	defer span.End()
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		return RefundSalesTx(ctx, tx, user, saleIDs, reason, now)
+	})
+}
+
+// AddSalesTx records Sales as part of the transaction tx so other packages can
+// commit them together with their own changes. The Sales are returned in the
+// order of the lines.
+func AddSalesTx(ctx context.Context, tx *sqlx.Tx, user auth.Claims, lines []SaleLine, now time.Time) ([]Sale, error) {
+	for _, l := range lines {
+		if _, err := uuid.Parse(l.ProductID); err != nil {
+			return nil, ErrInvalidID
+		}
+	}
+
+	// Lock the products in a consistent order so concurrent transactions
+	// selling the same products can not deadlock.
+	order := make([]int, len(lines))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return lines[order[i]].ProductID < lines[order[j]].ProductID
+	})
+
+	const q = `INSERT INTO sales
+		(sale_id, product_id, quantity, paid, price, unit_price, currency, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	sales := make([]Sale, len(lines))
+	for _, i := range order {
+		p, err := lockProduct(ctx, tx, lines[i].ProductID)
+		if err != nil {
+			return nil, err
+		}
+
+		ns := lines[i].NewSale
+		qt, err := quote(ctx, tx, user, p, NewQuote{Quantity: ns.Quantity, Coupon: ns.Coupon}, now)
+		if err != nil {
+			return nil, err
+		}
+
+		paid, err := charge(user, ns, &qt, func(m money.Money, to string) (money.Money, error) {
+			return convert(ctx, tx, m, to)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sale := Sale{
+			ID:          uuid.New().String(),
+			ProductID:   lines[i].ProductID,
+			Quantity:    ns.Quantity,
+			Paid:        paid,
+			Price:       qt.Price,
+			UnitPrice:   p.Cost,
+			Currency:    p.Currency,
+			Rules:       qt.Rules,
+			DateCreated: now.UTC(),
+		}
+
+		// The items leave stock with a movement that shares the ID of the sale.
+		m := Movement{
+			ID:          sale.ID,
+			ProductID:   sale.ProductID,
+			Kind:        MovementSale,
+			Quantity:    -sale.Quantity,
+			DateCreated: sale.DateCreated,
+		}
+		if err := move(ctx, tx, m, now); err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, q,
+			sale.ID, sale.ProductID,
+			sale.Quantity, sale.Paid, sale.Price, sale.UnitPrice, sale.Currency,
+			sale.DateCreated,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "inserting sale")
+		}
+
+		if err := insertRules(ctx, tx, sale.ID, sale.Rules); err != nil {
+			return nil, err
+		}
+		if ns.Coupon != "" {
+			if err := useCoupon(ctx, tx, ns.Coupon); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := event.Record(ctx, tx, event.SaleRecorded, sale.ID, sale, now); err != nil {
+			return nil, err
+		}
+
+		sales[i] = sale
+	}
+
+	return sales, nil
+}
+
+// CancelSalesTx reverses Sales as part of the transaction tx by refunding
+// whatever is left of them and returning those items to stock. The Sales stay
+// in the history. Coupons used by the Sales may be used again. Cancelling a
+// Sale that was already refunded in full changes nothing.
+func CancelSalesTx(ctx context.Context, tx *sqlx.Tx, user auth.Claims, saleIDs []string, now time.Time) error {
+	for _, id := range saleIDs {
+		sale, err := lockSale(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		reversed, err := reverseSale(ctx, tx, user, *sale, "Sale cancelled", now)
+		if err != nil {
+			return err
+		}
+		if !reversed {
+			continue
+		}
+
+		// Coupons used by the sale may be used again.
+		const qc = `UPDATE coupons SET uses = uses - 1
+			WHERE uses > 0 AND code IN (
+				SELECT reference FROM sale_rules WHERE sale_id = $1 AND rule = $2
+			)`
+		if _, err := tx.ExecContext(ctx, qc, id, RuleCoupon); err != nil {
+			return errors.Wrapf(err, "returning coupons of sale %s", id)
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		if err := event.Record(ctx, tx, event.SaleCancelled, id, data, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
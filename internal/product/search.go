@@ -0,0 +1,342 @@
+package product
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// These are the limits on the number of hits returned by a search.
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+)
+
+// priceBands group Products by Cost in the minor unit of their currency. A
+// Max of zero means the band has no upper bound.
+var priceBands = []struct {
+	Name string
+	Min  int
+	Max  int
+}{
+	{"0-10", 0, 1000},
+	{"10-50", 1000, 5000},
+	{"50-100", 5000, 10000},
+	{"100+", 10000, 0},
+}
+
+// Search finds the active Products matching the words of the query. On
+// Postgres the words are matched with the full-text index. Other databases
+// match them in process like the Memory store does.
+func (s *DB) Search(ctx context.Context, sq SearchQuery) (*SearchResult, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Search")
+	defer span.End()
+
+	words, err := checkSearch(&sq)
+	if err != nil {
+		return nil, err
+	}
+
+	var categories map[string]bool
+	if sq.Category != "" {
+		var ids []string
+		if err := s.db.SelectContext(ctx, &ids, subcategoriesQuery(1), sq.Category); err != nil {
+			return nil, errors.Wrap(err, "selecting subcategories")
+		}
+		categories = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			categories[id] = true
+		}
+	}
+
+	if s.db.DriverName() != database.DriverPostgres {
+		products, err := s.list(ctx, `p.deleted_at IS NULL`)
+		if err != nil {
+			return nil, err
+		}
+		return search(products, sq, categories, matchWords(words)), nil
+	}
+
+	// Every word matches the words of a document starting with it.
+	tsquery := strings.Join(words, ":* & ") + ":*"
+
+	var rows []struct {
+		ProductID string  `db:"product_id"`
+		Rank      float64 `db:"rank"`
+		Snippet   string  `db:"snippet"`
+	}
+	const q = `SELECT
+			ps.product_id,
+			ts_rank(ps.document, q) AS rank,
+			ts_headline('simple', p.name, q) AS snippet
+		FROM product_search AS ps
+		JOIN products AS p ON p.product_id = ps.product_id,
+		to_tsquery('simple', $1) AS q
+		WHERE ps.document @@ q AND p.deleted_at IS NULL`
+	if err := s.db.SelectContext(ctx, &rows, q, tsquery); err != nil {
+		return nil, errors.Wrap(err, "searching products")
+	}
+
+	hits := make(map[string]Hit, len(rows))
+	for _, r := range rows {
+		hits[r.ProductID] = Hit{Rank: r.Rank, Snippet: r.Snippet}
+	}
+
+	products, err := s.list(ctx, `p.deleted_at IS NULL AND p.product_id IN (
+			SELECT product_id FROM product_search WHERE document @@ to_tsquery('simple', $1)
+		)`, tsquery)
+	if err != nil {
+		return nil, err
+	}
+
+	match := func(p Product) (Hit, bool) {
+		h, ok := hits[p.ID]
+		return h, ok
+	}
+	return search(products, sq, categories, match), nil
+}
+
+// Search finds the active Products matching the words of the query.
+func (m *Memory) Search(ctx context.Context, sq SearchQuery) (*SearchResult, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.product.Memory.Search")
+	defer span.End()
+
+	words, err := checkSearch(&sq)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var categories map[string]bool
+	if sq.Category != "" {
+		categories = m.subcategories(sq.Category)
+	}
+
+	products := make([]Product, 0, len(m.products))
+	for _, p := range m.products {
+		if p.DeletedAt == nil {
+			products = append(products, m.aggregate(p))
+		}
+	}
+
+	return search(products, sq, categories, matchWords(words)), nil
+}
+
+// checkSearch validates a query, fills in its defaults and gives its words.
+func checkSearch(sq *SearchQuery) ([]string, error) {
+	words := splitWords(sq.Text)
+	if len(words) == 0 || sq.Limit < 0 || sq.Offset < 0 {
+		return nil, ErrInvalidQuery
+	}
+	if sq.Category != "" {
+		if _, err := uuid.Parse(sq.Category); err != nil {
+			return nil, ErrInvalidID
+		}
+	}
+	if sq.Band != "" && bandOf(sq.Band) < 0 {
+		return nil, ErrInvalidQuery
+	}
+
+	switch {
+	case sq.Limit == 0:
+		sq.Limit = DefaultSearchLimit
+	case sq.Limit > MaxSearchLimit:
+		sq.Limit = MaxSearchLimit
+	}
+
+	return words, nil
+}
+
+// search ranks the products accepted by match. The facets count the matching
+// products before the category and price band of the query narrow the hits
+// so clients can show what other choices would give.
+func search(products []Product, sq SearchQuery, categories map[string]bool, match func(Product) (Hit, bool)) *SearchResult {
+	res := SearchResult{
+		Hits: []Hit{},
+		Facets: Facets{
+			Categories: []Facet{},
+			Prices:     make([]Facet, len(priceBands)),
+		},
+	}
+	for i, b := range priceBands {
+		res.Facets.Prices[i].Value = b.Name
+	}
+
+	byCategory := make(map[string]int)
+	for _, p := range products {
+		h, ok := match(p)
+		if !ok {
+			continue
+		}
+
+		band := priceBand(p.Cost)
+		res.Facets.Prices[band].Count++
+		if p.CategoryID != nil {
+			byCategory[*p.CategoryID]++
+		}
+
+		if categories != nil && (p.CategoryID == nil || !categories[*p.CategoryID]) {
+			continue
+		}
+		if sq.Band != "" && priceBands[band].Name != sq.Band {
+			continue
+		}
+
+		h.Product = p
+		res.Hits = append(res.Hits, h)
+	}
+
+	for id, n := range byCategory {
+		res.Facets.Categories = append(res.Facets.Categories, Facet{Value: id, Count: n})
+	}
+	sort.Slice(res.Facets.Categories, func(i, j int) bool {
+		ci, cj := res.Facets.Categories[i], res.Facets.Categories[j]
+		if ci.Count != cj.Count {
+			return ci.Count > cj.Count
+		}
+		return ci.Value < cj.Value
+	})
+
+	sort.Slice(res.Hits, func(i, j int) bool {
+		hi, hj := res.Hits[i], res.Hits[j]
+		if hi.Rank != hj.Rank {
+			return hi.Rank > hj.Rank
+		}
+		if hi.Product.Name != hj.Product.Name {
+			return hi.Product.Name < hj.Product.Name
+		}
+		return hi.Product.ID < hj.Product.ID
+	})
+
+	res.Total = len(res.Hits)
+	if sq.Offset > len(res.Hits) {
+		sq.Offset = len(res.Hits)
+	}
+	res.Hits = res.Hits[sq.Offset:]
+	if len(res.Hits) > sq.Limit {
+		res.Hits = res.Hits[:sq.Limit]
+	}
+
+	return &res
+}
+
+// matchWords matches Products in process. Every word must start a word of
+// the name or a tag. Words found in the name rank above words found in tags
+// and whole words rank above prefixes. Matching words of the name are
+// highlighted in the snippet.
+func matchWords(words []string) func(Product) (Hit, bool) {
+	return func(p Product) (Hit, bool) {
+		name := splitWords(p.Name)
+		var tags []string
+		for _, t := range p.Tags {
+			tags = append(tags, splitWords(t)...)
+		}
+
+		var h Hit
+		for _, w := range words {
+			rank := wordRank(w, name, 1)
+			if r := wordRank(w, tags, 0.4); r > rank {
+				rank = r
+			}
+			if rank == 0 {
+				return Hit{}, false
+			}
+			h.Rank += rank
+		}
+
+		h.Snippet = highlight(p.Name, words)
+		return h, true
+	}
+}
+
+// wordRank gives weight if w is one of the words, half of it if w starts one
+// of them and zero otherwise.
+func wordRank(w string, words []string, weight float64) float64 {
+	var rank float64
+	for _, d := range words {
+		switch {
+		case d == w:
+			return weight
+		case strings.HasPrefix(d, w):
+			rank = weight / 2
+		}
+	}
+	return rank
+}
+
+// highlight wraps the words of text that start with one of words in <b> tags
+// like the Postgres headline does.
+func highlight(text string, words []string) string {
+	var b strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if !isWord(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(runes) && isWord(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		if startsAny(strings.ToLower(word), words) {
+			b.WriteString("<b>" + word + "</b>")
+		} else {
+			b.WriteString(word)
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// startsAny reports whether one of words is a prefix of w.
+func startsAny(w string, words []string) bool {
+	for _, p := range words {
+		if strings.HasPrefix(w, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitWords lower cases text and splits it into words of letters and digits.
+func splitWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWord(r)
+	})
+}
+
+// isWord reports whether r is part of a word.
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// priceBand gives the index of the price band of cost.
+func priceBand(cost int) int {
+	for i, b := range priceBands {
+		if cost >= b.Min && (b.Max == 0 || cost < b.Max) {
+			return i
+		}
+	}
+	return 0
+}
+
+// bandOf gives the index of the named price band or -1.
+func bandOf(name string) int {
+	for i, b := range priceBands {
+		if b.Name == name {
+			return i
+		}
+	}
+	return -1
+}
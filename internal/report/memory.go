@@ -0,0 +1,156 @@
+package report
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/service/internal/product"
+	"go.opencensus.io/trace"
+)
+
+// Memory is a Store that keeps the rollups of the sales of a product.Store in
+// memory. It is safe for concurrent use and is intended for tests and local
+// development where running a database is not practical.
+type Memory struct {
+	mu       sync.RWMutex
+	rollups  []row
+	products product.Store
+}
+
+// NewMemory constructs a Store for reports over the sales of products.
+func NewMemory(products product.Store) *Memory {
+	return &Memory{products: products}
+}
+
+// Series gives the sales of every interval of the range.
+func (m *Memory) Series(ctx context.Context, q Query) ([]Bucket, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Memory.Series")
+	defer span.End()
+
+	rows, err := m.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return series(rows, q), nil
+}
+
+// TopProducts gives the Products that sold the most during the range.
+func (m *Memory) TopProducts(ctx context.Context, q Query) ([]ProductTotal, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Memory.TopProducts")
+	defer span.End()
+
+	rows, err := m.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return topProducts(rows, q), nil
+}
+
+// Owners gives the sales of the Products of every user during the range.
+func (m *Memory) Owners(ctx context.Context, q Query) ([]OwnerTotal, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Memory.Owners")
+	defer span.End()
+
+	rows, err := m.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return owners(rows), nil
+}
+
+// Prices gives the average selling price of every Product sold during the
+// range next to its list Cost.
+func (m *Memory) Prices(ctx context.Context, q Query) ([]PriceTotal, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Memory.Prices")
+	defer span.End()
+
+	rows, err := m.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return prices(rows), nil
+}
+
+// Refresh rebuilds the rollups of every hour starting at or after since.
+func (m *Memory) Refresh(ctx context.Context, since time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Memory.Refresh")
+	defer span.End()
+
+	from := since.UTC().Truncate(time.Hour)
+
+	products, err := m.products.List(ctx, product.Filter{IncludeDeleted: true})
+	if err != nil {
+		return err
+	}
+
+	var entries []entry
+	for _, p := range products {
+		sales, err := m.products.ListSales(ctx, p.ID)
+		if err != nil {
+			return err
+		}
+		for _, s := range sales {
+			if !s.DateCreated.Before(from) {
+				entries = append(entries, entry{s.ProductID, s.Currency, s.Quantity, s.Paid, s.DateCreated})
+			}
+		}
+
+		refunds, err := m.products.ListRefunds(ctx, p.ID)
+		if err != nil {
+			return err
+		}
+		for _, r := range refunds {
+			if !r.DateCreated.Before(from) {
+				entries = append(entries, entry{r.ProductID, p.Currency, -r.Quantity, -r.Amount, r.DateCreated})
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rollups := make([]row, 0, len(m.rollups))
+	for _, r := range m.rollups {
+		if r.Hour.Before(from) {
+			rollups = append(rollups, r)
+		}
+	}
+	m.rollups = append(rollups, rollup(entries)...)
+
+	return nil
+}
+
+// rows checks the query and gives the rollups of the hours it covers along
+// with what reports need to know about their Products. Rollups of purged
+// Products are left out like the database does.
+func (m *Memory) rows(ctx context.Context, q *Query) ([]row, error) {
+	if err := checkQuery(q); err != nil {
+		return nil, err
+	}
+
+	products, err := m.products.List(ctx, product.Filter{IncludeDeleted: true})
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]product.Product, len(products))
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	from, to := q.From.UTC(), q.To.UTC()
+	var rows []row
+	for _, r := range m.rollups {
+		p, ok := byID[r.ProductID]
+		if !ok || r.Hour.Before(from) || !r.Hour.Before(to) {
+			continue
+		}
+		r.Name, r.Cost, r.UserID = p.Name, p.Cost, p.UserID
+		rows = append(rows, r)
+	}
+
+	return rows, nil
+}
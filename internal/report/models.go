@@ -0,0 +1,91 @@
+package report
+
+import (
+	"time"
+)
+
+// These are the intervals a sales Series can be bucketed by.
+const (
+	Day   = "day"
+	Week  = "week"
+	Month = "month"
+)
+
+// These are the orders TopProducts can rank Products by.
+const (
+	ByUnits   = "units"
+	ByRevenue = "revenue"
+)
+
+// These are the limits on the number of Products ranked by TopProducts.
+const (
+	DefaultLimit = 10
+	MaxLimit     = 100
+)
+
+// Query selects the sales a report covers. Sales made at or after From and
+// before To are included, both of which must be on a whole hour. Buckets and
+// date boundaries follow Location which defaults to UTC and must be a whole
+// number of hours off UTC during the range.
+type Query struct {
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+	Interval string // Day, Week or Month for a Series. Defaults to Day.
+	By       string // ByUnits or ByRevenue for TopProducts. Defaults to ByUnits.
+	Limit    int    // Number of Products given by TopProducts.
+}
+
+// Bucket is the total of the sales made in one interval of a Series in one
+// currency. Refunds are netted out of the interval they were made in.
+type Bucket struct {
+	Start    time.Time `json:"start"`
+	Currency string    `json:"currency"`
+	Units    int       `json:"units"`
+	Revenue  int       `json:"revenue"`
+}
+
+// ProductTotal is the total of the sales of a Product.
+type ProductTotal struct {
+	ProductID string `json:"product_id"`
+	Name      string `json:"name"`
+	Currency  string `json:"currency"`
+	Units     int    `json:"units"`
+	Revenue   int    `json:"revenue"`
+}
+
+// OwnerTotal is the total of the sales of the Products of a user in one
+// currency.
+type OwnerTotal struct {
+	UserID   string `json:"user_id"`
+	Currency string `json:"currency"`
+	Products int    `json:"products"`
+	Units    int    `json:"units"`
+	Revenue  int    `json:"revenue"`
+}
+
+// PriceTotal compares the average price a Product sold for with its list
+// Cost. Difference is AveragePrice minus Cost so discounts are negative.
+type PriceTotal struct {
+	ProductID    string `json:"product_id"`
+	Name         string `json:"name"`
+	Currency     string `json:"currency"`
+	Cost         int    `json:"cost"`
+	Units        int    `json:"units"`
+	Revenue      int    `json:"revenue"`
+	AveragePrice int    `json:"average_price"`
+	Difference   int    `json:"difference"`
+}
+
+// row is the rolled up sales of a Product in one currency during one hour
+// along with what reports need to know about the Product.
+type row struct {
+	Hour      time.Time `db:"hour"`
+	ProductID string    `db:"product_id"`
+	Currency  string    `db:"currency"`
+	Units     int       `db:"units"`
+	Revenue   int       `db:"revenue"`
+	Name      string    `db:"name"`
+	Cost      int       `db:"cost"`
+	UserID    string    `db:"user_id"`
+}
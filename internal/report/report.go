@@ -0,0 +1,432 @@
+// Package report computes sales analytics. Sales and refunds are rolled up
+// per Product, currency and hour so reports over long ranges read few rows.
+// Rolling up by the hour lets reports bucket sales by day, week or month in
+// any time zone whose offset is a whole number of hours. Queries in other
+// zones or with bounds inside an hour are rejected rather than rounded.
+package report
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// ErrInvalidQuery is used when the range, time zone, interval, order or limit
+// of a report query is not valid.
+var ErrInvalidQuery = errors.New("Report query is not valid")
+
+// Store defines the set of behaviors required to report on sales. Every
+// implementation must honor the same semantics for ranges and buckets.
+//
+// Units and revenue are net of refunds and amounts stay in the currency of
+// the Product they were paid for. Refresh rolls up the sales and refunds
+// made since the given time. Reports only see sales that were rolled up.
+type Store interface {
+	Series(ctx context.Context, q Query) ([]Bucket, error)
+	TopProducts(ctx context.Context, q Query) ([]ProductTotal, error)
+	Owners(ctx context.Context, q Query) ([]OwnerTotal, error)
+	Prices(ctx context.Context, q Query) ([]PriceTotal, error)
+	Refresh(ctx context.Context, since time.Time) error
+}
+
+// DB is a Store that reads the rollups kept in a database.
+type DB struct {
+	db *sqlx.DB
+}
+
+// NewDB constructs a Store for reports over the sales in db.
+func NewDB(db *sqlx.DB) *DB {
+	return &DB{db: db}
+}
+
+// Series gives the sales of every interval of the range.
+func (s *DB) Series(ctx context.Context, q Query) ([]Bucket, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Series")
+	defer span.End()
+
+	rows, err := s.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return series(rows, q), nil
+}
+
+// TopProducts gives the Products that sold the most during the range.
+func (s *DB) TopProducts(ctx context.Context, q Query) ([]ProductTotal, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.TopProducts")
+	defer span.End()
+
+	rows, err := s.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return topProducts(rows, q), nil
+}
+
+// Owners gives the sales of the Products of every user during the range.
+func (s *DB) Owners(ctx context.Context, q Query) ([]OwnerTotal, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Owners")
+	defer span.End()
+
+	rows, err := s.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return owners(rows), nil
+}
+
+// Prices gives the average selling price of every Product sold during the
+// range next to its list Cost.
+func (s *DB) Prices(ctx context.Context, q Query) ([]PriceTotal, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Prices")
+	defer span.End()
+
+	rows, err := s.rows(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	return prices(rows), nil
+}
+
+// Refresh rebuilds the rollups of every hour starting at or after since. A
+// zero since rebuilds all of them. Hours are rebuilt whole so sales cancelled
+// since the last refresh drop out of the rollups.
+func (s *DB) Refresh(ctx context.Context, since time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.report.Refresh")
+	defer span.End()
+
+	from := since.UTC().Truncate(time.Hour)
+
+	return database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var entries []entry
+		const qs = `SELECT product_id, currency, quantity AS units, paid AS revenue, date_created
+			FROM sales WHERE date_created >= $1`
+		if err := tx.SelectContext(ctx, &entries, qs, from); err != nil {
+			return errors.Wrap(err, "selecting sales")
+		}
+
+		var refunds []entry
+		const qr = `SELECT r.product_id, s.currency, -r.quantity AS units, -r.amount AS revenue, r.date_created
+			FROM refunds AS r
+			JOIN sales AS s ON s.sale_id = r.sale_id
+			WHERE r.date_created >= $1`
+		if err := tx.SelectContext(ctx, &refunds, qr, from); err != nil {
+			return errors.Wrap(err, "selecting refunds")
+		}
+
+		const del = `DELETE FROM sales_rollups WHERE hour >= $1`
+		if _, err := tx.ExecContext(ctx, del, from); err != nil {
+			return errors.Wrap(err, "deleting rollups")
+		}
+
+		const ins = `INSERT INTO sales_rollups
+			(hour, product_id, currency, units, revenue)
+			VALUES ($1, $2, $3, $4, $5)`
+		for _, r := range rollup(append(entries, refunds...)) {
+			if _, err := tx.ExecContext(ctx, ins, r.Hour, r.ProductID, r.Currency, r.Units, r.Revenue); err != nil {
+				return errors.Wrap(err, "inserting rollup")
+			}
+		}
+
+		return nil
+	})
+}
+
+// rows checks the query and gives the rollups of the hours it covers.
+func (s *DB) rows(ctx context.Context, q *Query) ([]row, error) {
+	if err := checkQuery(q); err != nil {
+		return nil, err
+	}
+
+	var rows []row
+	const sq = `SELECT
+			r.hour, r.product_id, r.currency, r.units, r.revenue,
+			p.name, p.cost, p.user_id
+		FROM sales_rollups AS r
+		JOIN products AS p ON p.product_id = r.product_id
+		WHERE r.hour >= $1 AND r.hour < $2`
+	if err := s.db.SelectContext(ctx, &rows, sq, q.From.UTC(), q.To.UTC()); err != nil {
+		return nil, errors.Wrap(err, "selecting rollups")
+	}
+
+	return rows, nil
+}
+
+// entry is a sale or a refund to roll up. Refunds have negative units and
+// revenue.
+type entry struct {
+	ProductID   string    `db:"product_id"`
+	Currency    string    `db:"currency"`
+	Units       int       `db:"units"`
+	Revenue     int       `db:"revenue"`
+	DateCreated time.Time `db:"date_created"`
+}
+
+// rollup totals entries per Product, currency and hour.
+func rollup(entries []entry) []row {
+	type key struct {
+		hour      time.Time
+		productID string
+		currency  string
+	}
+
+	totals := make(map[key]*row)
+	var rows []*row
+	for _, e := range entries {
+		k := key{e.DateCreated.UTC().Truncate(time.Hour), e.ProductID, e.Currency}
+		r, ok := totals[k]
+		if !ok {
+			r = &row{Hour: k.hour, ProductID: k.productID, Currency: k.currency}
+			totals[k] = r
+			rows = append(rows, r)
+		}
+		r.Units += e.Units
+		r.Revenue += e.Revenue
+	}
+
+	out := make([]row, len(rows))
+	for i, r := range rows {
+		out[i] = *r
+	}
+	return out
+}
+
+// checkQuery validates a query and fills in its defaults.
+func checkQuery(q *Query) error {
+	if q.From.IsZero() || q.To.IsZero() || !q.From.Before(q.To) {
+		return ErrInvalidQuery
+	}
+	if !onHour(q.From) || !onHour(q.To) {
+		return ErrInvalidQuery
+	}
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if !hourlyZone(q.Location, q.From, q.To) {
+		return ErrInvalidQuery
+	}
+
+	switch q.Interval {
+	case "":
+		q.Interval = Day
+	case Day, Week, Month:
+	default:
+		return ErrInvalidQuery
+	}
+
+	switch q.By {
+	case "":
+		q.By = ByUnits
+	case ByUnits, ByRevenue:
+	default:
+		return ErrInvalidQuery
+	}
+
+	switch {
+	case q.Limit < 0:
+		return ErrInvalidQuery
+	case q.Limit == 0:
+		q.Limit = DefaultLimit
+	case q.Limit > MaxLimit:
+		q.Limit = MaxLimit
+	}
+
+	return nil
+}
+
+// onHour reports whether t is the start of an hour of the rollups.
+func onHour(t time.Time) bool {
+	return t.Equal(t.Truncate(time.Hour))
+}
+
+// hourlyZone reports whether loc is a whole number of hours off UTC on every
+// day of the range, so the days, weeks and months it buckets by start on an
+// hour of the rollups.
+func hourlyZone(loc *time.Location, from, to time.Time) bool {
+	for t := from; t.Before(to); t = t.Add(24 * time.Hour) {
+		if _, offset := t.In(loc).Zone(); offset%3600 != 0 {
+			return false
+		}
+	}
+	_, offset := to.In(loc).Zone()
+	return offset%3600 == 0
+}
+
+// bucketStart gives the start of the interval t falls in.
+func bucketStart(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch interval {
+	case Week:
+		// Weeks start on Monday.
+		d -= (int(t.Weekday()) + 6) % 7
+	case Month:
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// series totals the rows per interval and currency in chronological order.
+func series(rows []row, q Query) []Bucket {
+	type key struct {
+		start    time.Time
+		currency string
+	}
+
+	totals := make(map[key]int)
+	buckets := []Bucket{}
+	for _, r := range rows {
+		k := key{bucketStart(r.Hour, q.Interval, q.Location), r.Currency}
+		i, ok := totals[k]
+		if !ok {
+			i = len(buckets)
+			totals[k] = i
+			buckets = append(buckets, Bucket{Start: k.start, Currency: k.currency})
+		}
+		buckets[i].Units += r.Units
+		buckets[i].Revenue += r.Revenue
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if !buckets[i].Start.Equal(buckets[j].Start) {
+			return buckets[i].Start.Before(buckets[j].Start)
+		}
+		return buckets[i].Currency < buckets[j].Currency
+	})
+
+	return buckets
+}
+
+// productTotals totals the rows per Product and currency.
+func productTotals(rows []row) []ProductTotal {
+	type key struct {
+		productID string
+		currency  string
+	}
+
+	totals := make(map[key]int)
+	products := []ProductTotal{}
+	for _, r := range rows {
+		k := key{r.ProductID, r.Currency}
+		i, ok := totals[k]
+		if !ok {
+			i = len(products)
+			totals[k] = i
+			products = append(products, ProductTotal{ProductID: r.ProductID, Name: r.Name, Currency: r.Currency})
+		}
+		products[i].Units += r.Units
+		products[i].Revenue += r.Revenue
+	}
+
+	return products
+}
+
+// topProducts ranks the Products by the order of the query. Revenue is
+// compared as is so it is best used when every Product has the same currency.
+func topProducts(rows []row, q Query) []ProductTotal {
+	products := productTotals(rows)
+
+	value := func(p ProductTotal) int {
+		if q.By == ByRevenue {
+			return p.Revenue
+		}
+		return p.Units
+	}
+	sort.Slice(products, func(i, j int) bool {
+		pi, pj := products[i], products[j]
+		if value(pi) != value(pj) {
+			return value(pi) > value(pj)
+		}
+		if pi.Name != pj.Name {
+			return pi.Name < pj.Name
+		}
+		return pi.ProductID < pj.ProductID
+	})
+
+	if len(products) > q.Limit {
+		products = products[:q.Limit]
+	}
+	return products
+}
+
+// owners totals the rows per owner of the Products and currency.
+func owners(rows []row) []OwnerTotal {
+	type key struct {
+		userID   string
+		currency string
+	}
+
+	totals := make(map[key]int)
+	seen := make(map[key]map[string]bool)
+	users := []OwnerTotal{}
+	for _, r := range rows {
+		k := key{r.UserID, r.Currency}
+		i, ok := totals[k]
+		if !ok {
+			i = len(users)
+			totals[k] = i
+			seen[k] = make(map[string]bool)
+			users = append(users, OwnerTotal{UserID: r.UserID, Currency: r.Currency})
+		}
+		if !seen[k][r.ProductID] {
+			seen[k][r.ProductID] = true
+			users[i].Products++
+		}
+		users[i].Units += r.Units
+		users[i].Revenue += r.Revenue
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		ui, uj := users[i], users[j]
+		if ui.Currency != uj.Currency {
+			return ui.Currency < uj.Currency
+		}
+		if ui.Revenue != uj.Revenue {
+			return ui.Revenue > uj.Revenue
+		}
+		return ui.UserID < uj.UserID
+	})
+
+	return users
+}
+
+// prices gives the average selling price of the Products with units sold.
+// Averages are rounded to the nearest minor unit.
+func prices(rows []row) []PriceTotal {
+	costs := make(map[string]int)
+	for _, r := range rows {
+		costs[r.ProductID] = r.Cost
+	}
+
+	out := []PriceTotal{}
+	for _, p := range productTotals(rows) {
+		if p.Units <= 0 {
+			continue
+		}
+		avg := (2*p.Revenue + p.Units) / (2 * p.Units)
+		out = append(out, PriceTotal{
+			ProductID:    p.ProductID,
+			Name:         p.Name,
+			Currency:     p.Currency,
+			Cost:         costs[p.ProductID],
+			Units:        p.Units,
+			Revenue:      p.Revenue,
+			AveragePrice: avg,
+			Difference:   avg - costs[p.ProductID],
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].ProductID < out[j].ProductID
+	})
+
+	return out
+}
@@ -0,0 +1,268 @@
+package report_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/report"
+	"github.com/ardanlabs/service/internal/tests"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+)
+
+// TestReport validates the Store backed by the database.
+func TestReport(t *testing.T) {
+	db, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	products := product.NewDB(db)
+	testStore(t, report.NewDB(db), products)
+}
+
+// TestReportMemory validates the in-memory Store against the same suite used
+// for the database so both implementations behave identically.
+func TestReportMemory(t *testing.T) {
+	products := product.NewMemory()
+	testStore(t, report.NewMemory(products), products)
+}
+
+// testStore is the conformance suite every report.Store must pass. The
+// products must be the ones the Store reports on.
+func testStore(t *testing.T, s report.Store, products product.Store) {
+	t.Run("reports", func(t *testing.T) { reports(t, s, products) })
+	t.Run("invalid", func(t *testing.T) { invalid(t, s) })
+}
+
+var (
+	now    = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	admin  = auth.NewClaims("5cf37266-3473-4006-984f-9325122678b7", []string{auth.RoleAdmin, auth.RolePriceOverride}, now, time.Hour)
+	owner1 = auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+	owner2 = auth.NewClaims("45b5fbd3-755f-4379-8f07-a58d4a30fa2f", []string{auth.RoleUser}, now, time.Hour)
+)
+
+// at gives a time on a day of January 2019 in UTC.
+func at(day, hour, min int) time.Time {
+	return time.Date(2019, time.January, day, hour, min, 0, 0, time.UTC)
+}
+
+// reports validates the reports over rolled up sales and refunds.
+func reports(t *testing.T, s report.Store, products product.Store) {
+	t.Log("Given the need to report on sales.")
+	{
+		ctx := context.Background()
+
+		lamps, err := products.Create(ctx, owner1, product.NewProduct{Name: "Lamps", Cost: 1000, Quantity: 100}, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+		}
+		mugs, err := products.Create(ctx, owner2, product.NewProduct{Name: "Mugs", Cost: 500, Quantity: 100}, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create a product : %s.", tests.Failed, err)
+		}
+
+		sell := func(p *product.Product, quantity, paid int, when time.Time) *product.Sale {
+			sale, err := products.AddSale(ctx, admin, p.ID, product.NewSale{Quantity: quantity, Paid: paid}, when)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to add a sale : %s.", tests.Failed, err)
+			}
+			return sale
+		}
+		sell(lamps, 2, 1800, at(1, 10, 0))
+		sell(lamps, 1, 1000, at(2, 3, 0))
+		sale := sell(mugs, 4, 2000, at(1, 23, 30))
+		sell(mugs, 1, 500, at(8, 12, 0))
+
+		nr := product.NewRefund{Quantity: 1, Amount: 500, Reason: "Broken"}
+		if _, err := products.Refund(ctx, admin, mugs.ID, sale.ID, nr, at(8, 13, 0)); err != nil {
+			t.Fatalf("\t%s\tShould be able to refund a sale : %s.", tests.Failed, err)
+		}
+
+		q := report.Query{From: at(1, 0, 0), To: at(10, 0, 0)}
+
+		t.Log("\tWhen the sales have not been rolled up.")
+		{
+			buckets, err := s.Series(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get a series : %s.", tests.Failed, err)
+			}
+			if len(buckets) != 0 {
+				t.Fatalf("\t%s\tShould get no buckets : got %v.", tests.Failed, buckets)
+			}
+			t.Logf("\t%s\tShould only see sales that were rolled up.", tests.Success)
+		}
+
+		if err := s.Refresh(ctx, time.Time{}); err != nil {
+			t.Fatalf("\t%s\tShould be able to refresh the rollups : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen bucketing sales by day.")
+		{
+			buckets, err := s.Series(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get a series : %s.", tests.Failed, err)
+			}
+			want := []report.Bucket{
+				{Start: at(1, 0, 0), Currency: "USD", Units: 6, Revenue: 3800},
+				{Start: at(2, 0, 0), Currency: "USD", Units: 1, Revenue: 1000},
+				{Start: at(8, 0, 0), Currency: "USD", Units: 0, Revenue: 0},
+			}
+			if diff := cmp.Diff(want, buckets); diff != "" {
+				t.Fatalf("\t%s\tShould net refunds out of the day they were made. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould net refunds out of the day they were made.", tests.Success)
+		}
+
+		t.Log("\tWhen bucketing sales in another time zone.")
+		{
+			loc := time.FixedZone("EST", -5*60*60)
+			q := q
+			q.Location = loc
+
+			buckets, err := s.Series(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get a series : %s.", tests.Failed, err)
+			}
+			if len(buckets) != 2 {
+				t.Fatalf("\t%s\tShould get two days : got %v.", tests.Failed, buckets)
+			}
+			if !buckets[0].Start.Equal(time.Date(2019, time.January, 1, 0, 0, 0, 0, loc)) || buckets[0].Units != 7 || buckets[0].Revenue != 4800 {
+				t.Fatalf("\t%s\tShould bucket by the local day : got %+v.", tests.Failed, buckets[0])
+			}
+			t.Logf("\t%s\tShould bucket by the local day.", tests.Success)
+
+			q.Interval = report.Week
+			if buckets, err = s.Series(ctx, q); err != nil {
+				t.Fatalf("\t%s\tShould be able to get a series : %s.", tests.Failed, err)
+			}
+			if len(buckets) != 2 || !buckets[0].Start.Equal(time.Date(2018, time.December, 31, 0, 0, 0, 0, loc)) || !buckets[1].Start.Equal(time.Date(2019, time.January, 7, 0, 0, 0, 0, loc)) {
+				t.Fatalf("\t%s\tShould start weeks on Monday : got %v.", tests.Failed, buckets)
+			}
+			t.Logf("\t%s\tShould start weeks on Monday.", tests.Success)
+
+			q.Interval = report.Month
+			if buckets, err = s.Series(ctx, q); err != nil {
+				t.Fatalf("\t%s\tShould be able to get a series : %s.", tests.Failed, err)
+			}
+			if len(buckets) != 1 || buckets[0].Units != 7 || buckets[0].Revenue != 4800 {
+				t.Fatalf("\t%s\tShould bucket by month : got %v.", tests.Failed, buckets)
+			}
+			t.Logf("\t%s\tShould bucket by month.", tests.Success)
+		}
+
+		t.Log("\tWhen ranking Products.")
+		{
+			top, err := s.TopProducts(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to rank products : %s.", tests.Failed, err)
+			}
+			want := []report.ProductTotal{
+				{ProductID: mugs.ID, Name: "Mugs", Currency: "USD", Units: 4, Revenue: 2000},
+				{ProductID: lamps.ID, Name: "Lamps", Currency: "USD", Units: 3, Revenue: 2800},
+			}
+			if diff := cmp.Diff(want, top); diff != "" {
+				t.Fatalf("\t%s\tShould rank by units. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould rank by units.", tests.Success)
+
+			q := q
+			q.By, q.Limit = report.ByRevenue, 1
+			if top, err = s.TopProducts(ctx, q); err != nil {
+				t.Fatalf("\t%s\tShould be able to rank products : %s.", tests.Failed, err)
+			}
+			if len(top) != 1 || top[0].ProductID != lamps.ID {
+				t.Fatalf("\t%s\tShould rank by revenue up to the limit : got %v.", tests.Failed, top)
+			}
+			t.Logf("\t%s\tShould rank by revenue up to the limit.", tests.Success)
+		}
+
+		t.Log("\tWhen totaling sales per owner.")
+		{
+			users, err := s.Owners(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to total owners : %s.", tests.Failed, err)
+			}
+			want := []report.OwnerTotal{
+				{UserID: owner1.Subject, Currency: "USD", Products: 1, Units: 3, Revenue: 2800},
+				{UserID: owner2.Subject, Currency: "USD", Products: 1, Units: 4, Revenue: 2000},
+			}
+			if diff := cmp.Diff(want, users); diff != "" {
+				t.Fatalf("\t%s\tShould total the Products of every owner. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould total the Products of every owner.", tests.Success)
+		}
+
+		t.Log("\tWhen comparing selling prices with list prices.")
+		{
+			ps, err := s.Prices(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to compare prices : %s.", tests.Failed, err)
+			}
+			want := []report.PriceTotal{
+				{ProductID: lamps.ID, Name: "Lamps", Currency: "USD", Cost: 1000, Units: 3, Revenue: 2800, AveragePrice: 933, Difference: -67},
+				{ProductID: mugs.ID, Name: "Mugs", Currency: "USD", Cost: 500, Units: 4, Revenue: 2000, AveragePrice: 500, Difference: 0},
+			}
+			if diff := cmp.Diff(want, ps); diff != "" {
+				t.Fatalf("\t%s\tShould give the average selling price. Diff:\n%s", tests.Failed, diff)
+			}
+			t.Logf("\t%s\tShould give the average selling price.", tests.Success)
+		}
+
+		t.Log("\tWhen refreshing recent hours.")
+		{
+			sell(lamps, 1, 1000, at(9, 8, 0))
+			if err := s.Refresh(ctx, at(9, 0, 0)); err != nil {
+				t.Fatalf("\t%s\tShould be able to refresh the rollups : %s.", tests.Failed, err)
+			}
+
+			buckets, err := s.Series(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get a series : %s.", tests.Failed, err)
+			}
+			if len(buckets) != 4 || buckets[0].Units != 6 || buckets[3].Units != 1 {
+				t.Fatalf("\t%s\tShould add the new sales and keep older rollups : got %v.", tests.Failed, buckets)
+			}
+			t.Logf("\t%s\tShould add the new sales and keep older rollups.", tests.Success)
+		}
+
+		t.Log("\tWhen narrowing the range.")
+		{
+			q := report.Query{From: at(2, 0, 0), To: at(8, 13, 0)}
+			buckets, err := s.Series(ctx, q)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get a series : %s.", tests.Failed, err)
+			}
+			if len(buckets) != 2 || buckets[1].Units != 1 || buckets[1].Revenue != 500 {
+				t.Fatalf("\t%s\tShould only include the hours of the range : got %v.", tests.Failed, buckets)
+			}
+			t.Logf("\t%s\tShould only include the hours of the range.", tests.Success)
+		}
+	}
+}
+
+// invalid validates malformed queries are rejected.
+func invalid(t *testing.T, s report.Store) {
+	t.Log("Given the need to reject malformed report queries.")
+	{
+		ctx := context.Background()
+
+		queries := []report.Query{
+			{},
+			{From: at(2, 0, 0), To: at(1, 0, 0)},
+			{From: at(1, 0, 0), To: at(2, 0, 0), Interval: "year"},
+			{From: at(1, 0, 0), To: at(2, 0, 0), By: "name"},
+			{From: at(1, 0, 0), To: at(2, 0, 0), Limit: -1},
+			{From: at(1, 10, 30), To: at(2, 0, 0)},
+			{From: at(1, 0, 0), To: at(2, 0, 15)},
+			{From: at(1, 0, 0), To: at(2, 0, 0), Location: time.FixedZone("IST", 5*60*60+30*60)},
+		}
+		for _, q := range queries {
+			if _, err := s.TopProducts(ctx, q); errors.Cause(err) != report.ErrInvalidQuery {
+				t.Fatalf("\t%s\tShould reject query %+v : %v.", tests.Failed, q, err)
+			}
+		}
+		t.Logf("\t%s\tShould reject malformed queries.", tests.Success)
+	}
+}
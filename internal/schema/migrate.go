@@ -1,20 +1,99 @@
 package schema
 
 import (
+	"strings"
+
 	"github.com/GuiaBolso/darwin"
+	"github.com/ardanlabs/service/internal/platform/database"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 )
 
 // Migrate attempts to bring the schema for db up to date with the migrations
-// defined in this package.
+// defined in this package. The dialect is chosen from the driver db was
+// opened with.
 func Migrate(db *sqlx.DB) error {
-	driver := darwin.NewGenericDriver(db.DB, darwin.PostgresDialect{})
+	var driver *darwin.GenericDriver
+	ms := migrations
+
+	switch db.DriverName() {
+	case database.DriverSQLite:
+		driver = darwin.NewGenericDriver(db.DB, darwin.SqliteDialect{})
+		ms = sqliteMigrations()
+	default:
+		driver = darwin.NewGenericDriver(db.DB, darwin.PostgresDialect{})
+	}
 
-	d := darwin.New(driver, migrations, nil)
+	if err := checkEmails(db, driver); err != nil {
+		return err
+	}
+
+	d := darwin.New(driver, ms, nil)
 
 	return d.Migrate()
 }
 
+// checkEmails names the users whose emails only differ in case or white space
+// when migration 24 still has to run. Its unique index can not be created
+// until they are merged by hand, which is easier than reading the error of
+// the index half way through.
+func checkEmails(db *sqlx.DB, driver *darwin.GenericDriver) error {
+	if err := driver.Create(); err != nil {
+		return errors.Wrap(err, "creating migrations table")
+	}
+	records, err := driver.All()
+	if err != nil {
+		return errors.Wrap(err, "selecting applied migrations")
+	}
+
+	applied := make(map[float64]bool)
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+	if !applied[3] || applied[24] {
+		return nil
+	}
+
+	var users []struct {
+		Email string `db:"email"`
+		ID    string `db:"user_id"`
+	}
+	const q = `SELECT LOWER(TRIM(email)) AS email, user_id FROM users
+		WHERE LOWER(TRIM(email)) IN (
+			SELECT LOWER(TRIM(email)) FROM users
+			GROUP BY LOWER(TRIM(email)) HAVING COUNT(*) > 1
+		)
+		ORDER BY 1, 2`
+	if err := db.Select(&users, q); err != nil {
+		return errors.Wrap(err, "selecting users with the same email")
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	var dups []string
+	for i, u := range users {
+		if i == 0 || users[i-1].Email != u.Email {
+			dups = append(dups, u.Email+":")
+		}
+		dups[len(dups)-1] += " " + u.ID
+	}
+	return errors.Errorf("users share an email that only differs in case, merge them before migrating: %s", strings.Join(dups, "; "))
+}
+
+// sqliteMigrations returns the migrations with the scripts that are not
+// portable replaced by their SQLite equivalents.
+func sqliteMigrations() []darwin.Migration {
+	ms := make([]darwin.Migration, len(migrations))
+	for i, m := range migrations {
+		if script, ok := sqliteScripts[m.Version]; ok {
+			m.Script = script
+		}
+		ms[i] = m
+	}
+	return ms
+}
+
 // migrations contains the queries needed to construct the database schema.
 // Entries should never be removed from this slice once they have been ran in
 // production.
@@ -80,4 +159,832 @@ ALTER TABLE products
 	ADD COLUMN user_id UUID DEFAULT '00000000-0000-0000-0000-000000000000'
 `,
 	},
+	{
+		Version:     5,
+		Description: "Add outbox",
+		Script: `
+CREATE TABLE outbox (
+	seq            BIGSERIAL,
+	event_id       UUID,
+	type           TEXT,
+	aggregate_id   UUID,
+	payload        TEXT,
+	status         TEXT,
+	attempts       INT,
+	last_error     TEXT,
+	next_attempt   TIMESTAMP,
+	date_created   TIMESTAMP,
+	date_delivered TIMESTAMP,
+
+	PRIMARY KEY (seq)
+);
+CREATE INDEX outbox_status_idx ON outbox (status, seq);`,
+	},
+	{
+		Version:     6,
+		Description: "Add soft delete to products and users",
+		Script: `
+ALTER TABLE products ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;`,
+	},
+	{
+		Version:     7,
+		Description: "Add inventory movements",
+		Script: `
+CREATE TABLE inventory_movements (
+	movement_id    UUID,
+	product_id     UUID,
+	kind           TEXT,
+	quantity       INT,
+	reason         TEXT,
+	reservation_id UUID,
+	user_id        UUID,
+	expires_at     TIMESTAMP,
+	date_created   TIMESTAMP,
+
+	PRIMARY KEY (movement_id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX inventory_movements_product_idx ON inventory_movements (product_id, date_created);
+CREATE UNIQUE INDEX inventory_movements_reservation_idx ON inventory_movements (reservation_id, kind);
+INSERT INTO inventory_movements (movement_id, product_id, kind, quantity, reason, date_created)
+	SELECT product_id, product_id, 'receive', quantity, 'Initial stock', date_created FROM products;
+INSERT INTO inventory_movements (movement_id, product_id, kind, quantity, reason, date_created)
+	SELECT sale_id, product_id, 'sale', -quantity, '', date_created FROM sales;`,
+	},
+	{
+		Version:     8,
+		Description: "Add orders",
+		Script: `
+CREATE TABLE orders (
+	order_id     UUID,
+	user_id      UUID,
+	status       TEXT,
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (order_id)
+);
+CREATE INDEX orders_user_idx ON orders (user_id, date_created);
+CREATE TABLE order_lines (
+	line_id      UUID,
+	order_id     UUID,
+	product_id   UUID,
+	quantity     INT,
+	unit_price   INT,
+	sale_id      UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (line_id),
+	FOREIGN KEY (order_id) REFERENCES orders(order_id) ON DELETE CASCADE
+);
+CREATE INDEX order_lines_order_idx ON order_lines (order_id, date_created);`,
+	},
+	{
+		Version:     9,
+		Description: "Add refunds",
+		Script: `
+CREATE TABLE refunds (
+	refund_id    UUID,
+	sale_id      UUID,
+	product_id   UUID,
+	quantity     INT,
+	amount       INT,
+	restock      BOOLEAN,
+	reason       TEXT,
+	user_id      UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (refund_id),
+	FOREIGN KEY (sale_id) REFERENCES sales(sale_id) ON DELETE CASCADE,
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX refunds_sale_idx ON refunds (sale_id);
+CREATE INDEX refunds_product_idx ON refunds (product_id, date_created);`,
+	},
+	{
+		Version:     10,
+		Description: "Add currencies",
+		Script: `
+ALTER TABLE products ADD COLUMN currency TEXT DEFAULT 'USD';
+ALTER TABLE sales ADD COLUMN currency TEXT DEFAULT 'USD';
+ALTER TABLE orders ADD COLUMN currency TEXT DEFAULT 'USD';
+CREATE TABLE exchange_rates (
+	from_currency TEXT,
+	to_currency   TEXT,
+	rate          DOUBLE PRECISION,
+	date_updated  TIMESTAMP,
+
+	PRIMARY KEY (from_currency, to_currency)
+);`,
+	},
+	{
+		Version:     11,
+		Description: "Add pricing rules",
+		Script: `
+ALTER TABLE sales ADD COLUMN price INT DEFAULT 0;
+UPDATE sales SET price = paid;
+ALTER TABLE order_lines ADD COLUMN discount INT DEFAULT 0;
+CREATE TABLE price_tiers (
+	product_id   UUID,
+	min_quantity INT,
+	unit_price   INT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (product_id, min_quantity),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE TABLE coupons (
+	code         TEXT,
+	kind         TEXT,
+	value        INT,
+	currency     TEXT,
+	max_uses     INT,
+	uses         INT,
+	valid_from   TIMESTAMP,
+	valid_until  TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (code)
+);
+CREATE TABLE discounts (
+	user_id      UUID,
+	percent      INT,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (user_id)
+);
+CREATE TABLE sale_rules (
+	sale_id   UUID,
+	position  INT,
+	rule      TEXT,
+	reference TEXT,
+	amount    INT,
+
+	PRIMARY KEY (sale_id, position),
+	FOREIGN KEY (sale_id) REFERENCES sales(sale_id) ON DELETE CASCADE
+);`,
+	},
+	{
+		Version:     12,
+		Description: "Add categories",
+		Script: `
+CREATE TABLE categories (
+	category_id  UUID,
+	parent_id    UUID,
+	name         TEXT,
+	schema       TEXT DEFAULT '[]',
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (category_id),
+	FOREIGN KEY (parent_id) REFERENCES categories(category_id)
+);
+CREATE INDEX categories_parent_idx ON categories (parent_id);
+ALTER TABLE products ADD COLUMN category_id UUID REFERENCES categories(category_id) ON DELETE SET NULL;
+ALTER TABLE products ADD COLUMN attributes TEXT DEFAULT '{}';
+CREATE INDEX products_category_idx ON products (category_id);
+CREATE TABLE product_tags (
+	product_id UUID,
+	tag        TEXT,
+
+	PRIMARY KEY (product_id, tag),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX product_tags_tag_idx ON product_tags (tag);`,
+	},
+	{
+		Version:     13,
+		Description: "Add product search",
+		Script: `
+CREATE TABLE product_search (
+	product_id UUID,
+	document   TSVECTOR,
+
+	PRIMARY KEY (product_id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX product_search_document_idx ON product_search USING GIN (document);
+CREATE FUNCTION index_product(UUID) RETURNS VOID AS $$
+	INSERT INTO product_search (product_id, document)
+	SELECT
+		p.product_id,
+		setweight(to_tsvector('simple', COALESCE(p.name, '')), 'A') ||
+		setweight(to_tsvector('simple', COALESCE(string_agg(t.tag, ' '), '')), 'B')
+	FROM products AS p
+	LEFT JOIN product_tags AS t ON t.product_id = p.product_id
+	WHERE p.product_id = $1
+	GROUP BY p.product_id
+	ON CONFLICT (product_id) DO UPDATE SET document = EXCLUDED.document;
+$$ LANGUAGE SQL;
+CREATE FUNCTION index_product_trigger() RETURNS TRIGGER AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		PERFORM index_product(OLD.product_id);
+	ELSE
+		PERFORM index_product(NEW.product_id);
+	END IF;
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER products_search AFTER INSERT OR UPDATE OF name ON products
+	FOR EACH ROW EXECUTE PROCEDURE index_product_trigger();
+CREATE TRIGGER product_tags_search AFTER INSERT OR DELETE ON product_tags
+	FOR EACH ROW EXECUTE PROCEDURE index_product_trigger();
+SELECT index_product(product_id) FROM products;`,
+	},
+	{
+		Version:     14,
+		Description: "Add images",
+		Script: `
+-- Images have no foreign key to products so purging products leaves them for
+-- the media purge to find and remove their blobs.
+CREATE TABLE images (
+	image_id     UUID,
+	product_id   UUID,
+	name         TEXT,
+	content_type TEXT,
+	size         INT,
+	width        INT,
+	height       INT,
+	user_id      UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (image_id)
+);
+CREATE INDEX images_product_idx ON images (product_id, date_created);`,
+	},
+	{
+		Version:     15,
+		Description: "Add sales rollups",
+		Script: `
+-- Sales and refunds are rolled up per product, currency and hour by the
+-- report refresh.
+CREATE TABLE sales_rollups (
+	hour       TIMESTAMP,
+	product_id UUID,
+	currency   TEXT,
+	units      INT,
+	revenue    INT,
+
+	PRIMARY KEY (hour, product_id, currency),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX sales_date_idx ON sales (date_created);
+CREATE INDEX refunds_date_idx ON refunds (date_created);`,
+	},
+	{
+		Version:     16,
+		Description: "Add product history",
+		Script: `
+-- Products changed before history was kept get their current values as their
+-- first version and their sales get the current cost as their unit price.
+CREATE TABLE product_versions (
+	product_id   UUID,
+	version      INT,
+	name         TEXT,
+	cost         INT,
+	currency     TEXT,
+	quantity     INT,
+	category_id  UUID,
+	tags         TEXT DEFAULT '[]',
+	attributes   TEXT DEFAULT '{}',
+	changed_by   UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (product_id, version),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+INSERT INTO product_versions
+	(product_id, version, name, cost, currency, quantity, category_id, tags, attributes, changed_by, date_created)
+SELECT
+	p.product_id, 1, p.name, p.cost, p.currency, p.quantity, p.category_id,
+	COALESCE((SELECT json_agg(t.tag ORDER BY t.tag) FROM product_tags AS t WHERE t.product_id = p.product_id)::TEXT, '[]'),
+	p.attributes, p.user_id, p.date_created
+FROM products AS p;
+ALTER TABLE sales ADD COLUMN unit_price INT DEFAULT 0;
+UPDATE sales SET unit_price = (SELECT cost FROM products AS p WHERE p.product_id = sales.product_id);`,
+	},
+	{
+		Version:     17,
+		Description: "Add password resets",
+		Script: `
+-- Tokens issued before tokens_valid_after are no longer accepted. Only a hash
+-- of every reset token is kept.
+ALTER TABLE users ADD COLUMN tokens_valid_after TIMESTAMP;
+CREATE TABLE password_resets (
+	token_hash   TEXT,
+	user_id      UUID,
+	expires_at   TIMESTAMP,
+	used_at      TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (token_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX password_resets_user_idx ON password_resets (user_id);`,
+	},
+	{
+		Version:     18,
+		Description: "Add login throttling",
+		Script: `
+-- Failed logins are counted per user and per source address so guessing can
+-- be slowed down and locked out.
+ALTER TABLE users ADD COLUMN login_failures INT DEFAULT 0;
+ALTER TABLE users ADD COLUMN last_login_failure TIMESTAMP;
+ALTER TABLE users ADD COLUMN locked_until TIMESTAMP;
+ALTER TABLE users ADD COLUMN last_login TIMESTAMP;
+CREATE TABLE login_sources (
+	source       TEXT,
+	failures     INT DEFAULT 0,
+	last_failure TIMESTAMP,
+	locked_until TIMESTAMP,
+
+	PRIMARY KEY (source)
+);`,
+	},
+	{
+		Version:     19,
+		Description: "Add two-factor authentication",
+		Script: `
+-- A user is enrolled once mfa_secret is set and has to use it to log in once
+-- mfa_enabled is set. mfa_last_step keeps codes from being used twice. Only a
+-- hash of every recovery code is kept.
+ALTER TABLE users ADD COLUMN mfa_secret TEXT DEFAULT '';
+ALTER TABLE users ADD COLUMN mfa_enabled BOOLEAN DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN mfa_last_step BIGINT DEFAULT 0;
+CREATE TABLE mfa_recovery_codes (
+	user_id   UUID,
+	code_hash TEXT,
+	used_at   TIMESTAMP,
+
+	PRIMARY KEY (user_id, code_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);`,
+	},
+	{
+		Version:     20,
+		Description: "Add email verification",
+		Script: `
+-- Users who sign up themselves are unverified until they use one of their
+-- verification tokens. Only a hash of every token is kept.
+ALTER TABLE users ADD COLUMN unverified BOOLEAN DEFAULT FALSE;
+CREATE TABLE email_verifications (
+	token_hash   TEXT,
+	user_id      UUID,
+	expires_at   TIMESTAMP,
+	used_at      TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (token_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX email_verifications_user_idx ON email_verifications (user_id);`,
+	},
+	{
+		Version:     21,
+		Description: "Add API keys",
+		Script: `
+-- Keys are found by their prefix and only a hash of their secret is kept.
+-- Scopes are the roles a key can use.
+CREATE TABLE api_keys (
+	key_id       UUID,
+	user_id      UUID,
+	name         TEXT,
+	prefix       TEXT UNIQUE,
+	secret_hash  TEXT,
+	scopes       TEXT[],
+	expires_at   TIMESTAMP,
+	last_used    TIMESTAMP,
+	revoked_at   TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (key_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX api_keys_user_idx ON api_keys (user_id);`,
+	},
+	{
+		Version:     22,
+		Description: "Add user deactivation and sessions",
+		Script: `
+-- Disabled users keep their record but can not log in and lose their tokens.
+-- Every login token belongs to a session that can be revoked on its own.
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN disabled_reason TEXT DEFAULT '';
+CREATE TABLE sessions (
+	session_id   UUID,
+	user_id      UUID,
+	source       TEXT,
+	expires_at   TIMESTAMP,
+	revoked_at   TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (session_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX sessions_user_idx ON sessions (user_id);`,
+	},
+	{
+		Version:     23,
+		Description: "Add external identities",
+		Script: `
+-- Identities link the subject of an external identity provider to the local
+-- user it logs in as.
+CREATE TABLE identities (
+	issuer       TEXT,
+	subject      TEXT,
+	user_id      UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (issuer, subject),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX identities_user_idx ON identities (user_id);`,
+	},
+	{
+		Version:     24,
+		Description: "Add case-insensitive unique index on user emails",
+		Script: `
+-- Emails are stored trimmed and in lower case. Users whose emails only differ
+-- in case have to be merged by hand before this runs.
+UPDATE users SET email = LOWER(TRIM(email));
+CREATE UNIQUE INDEX users_email_lower_idx ON users (LOWER(email));`,
+	},
+	{
+		Version:     25,
+		Description: "Mark identities that provisioned their user",
+		Script: `
+-- The provider decides the roles of the users it created. Users linked by
+-- their email keep the roles given here. A provider created the users without
+-- a password that were linked the moment they were created.
+ALTER TABLE identities ADD COLUMN provisioned BOOLEAN DEFAULT FALSE;
+UPDATE identities SET provisioned = TRUE WHERE EXISTS (
+	SELECT 1 FROM users
+	WHERE users.user_id = identities.user_id
+	AND users.password_hash IS NULL
+	AND users.date_created = identities.date_created
+);`,
+	},
+	{
+		Version:     26,
+		Description: "Add outbox lock",
+		Script: `
+-- Transactions that record events lock this single row first so they commit
+-- in the order their events were numbered in the outbox.
+CREATE TABLE outbox_lock (
+	id INT,
+
+	PRIMARY KEY (id)
+);
+INSERT INTO outbox_lock (id) VALUES (1);`,
+	},
+}
+
+// sqliteScripts holds SQLite versions of the migrations whose Postgres script
+// can not run on SQLite, keyed by migration version. SQLite has no UUID or
+// array types so those columns are stored as TEXT. Roles are kept in the same
+// '{ADMIN,USER}' text form Postgres uses for arrays so they scan identically.
+var sqliteScripts = map[float64]string{
+	1: `
+CREATE TABLE products (
+	product_id   TEXT,
+	name         TEXT,
+	cost         INT,
+	quantity     INT,
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (product_id)
+);`,
+	2: `
+CREATE TABLE sales (
+	sale_id      TEXT,
+	product_id   TEXT,
+	quantity     INT,
+	paid         INT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (sale_id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);`,
+	3: `
+CREATE TABLE users (
+	user_id       TEXT,
+	name          TEXT,
+	email         TEXT UNIQUE,
+	roles         TEXT,
+	password_hash TEXT,
+
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (user_id)
+);`,
+	4: `
+ALTER TABLE products
+	ADD COLUMN user_id TEXT DEFAULT '00000000-0000-0000-0000-000000000000'
+`,
+	5: `
+CREATE TABLE outbox (
+	seq            INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id       TEXT,
+	type           TEXT,
+	aggregate_id   TEXT,
+	payload        BLOB,
+	status         TEXT,
+	attempts       INT,
+	last_error     TEXT,
+	next_attempt   TIMESTAMP,
+	date_created   TIMESTAMP,
+	date_delivered TIMESTAMP
+);
+CREATE INDEX outbox_status_idx ON outbox (status, seq);`,
+	7: `
+CREATE TABLE inventory_movements (
+	movement_id    TEXT,
+	product_id     TEXT,
+	kind           TEXT,
+	quantity       INT,
+	reason         TEXT,
+	reservation_id TEXT,
+	user_id        TEXT,
+	expires_at     TIMESTAMP,
+	date_created   TIMESTAMP,
+
+	PRIMARY KEY (movement_id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX inventory_movements_product_idx ON inventory_movements (product_id, date_created);
+CREATE UNIQUE INDEX inventory_movements_reservation_idx ON inventory_movements (reservation_id, kind);
+INSERT INTO inventory_movements (movement_id, product_id, kind, quantity, reason, date_created)
+	SELECT product_id, product_id, 'receive', quantity, 'Initial stock', date_created FROM products;
+INSERT INTO inventory_movements (movement_id, product_id, kind, quantity, reason, date_created)
+	SELECT sale_id, product_id, 'sale', -quantity, '', date_created FROM sales;`,
+	8: `
+CREATE TABLE orders (
+	order_id     TEXT,
+	user_id      TEXT,
+	status       TEXT,
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (order_id)
+);
+CREATE INDEX orders_user_idx ON orders (user_id, date_created);
+CREATE TABLE order_lines (
+	line_id      TEXT,
+	order_id     TEXT,
+	product_id   TEXT,
+	quantity     INT,
+	unit_price   INT,
+	sale_id      TEXT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (line_id),
+	FOREIGN KEY (order_id) REFERENCES orders(order_id) ON DELETE CASCADE
+);
+CREATE INDEX order_lines_order_idx ON order_lines (order_id, date_created);`,
+	9: `
+CREATE TABLE refunds (
+	refund_id    TEXT,
+	sale_id      TEXT,
+	product_id   TEXT,
+	quantity     INT,
+	amount       INT,
+	restock      BOOLEAN,
+	reason       TEXT,
+	user_id      TEXT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (refund_id),
+	FOREIGN KEY (sale_id) REFERENCES sales(sale_id) ON DELETE CASCADE,
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX refunds_sale_idx ON refunds (sale_id);
+CREATE INDEX refunds_product_idx ON refunds (product_id, date_created);`,
+	11: `
+ALTER TABLE sales ADD COLUMN price INT DEFAULT 0;
+UPDATE sales SET price = paid;
+ALTER TABLE order_lines ADD COLUMN discount INT DEFAULT 0;
+CREATE TABLE price_tiers (
+	product_id   TEXT,
+	min_quantity INT,
+	unit_price   INT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (product_id, min_quantity),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE TABLE coupons (
+	code         TEXT,
+	kind         TEXT,
+	value        INT,
+	currency     TEXT,
+	max_uses     INT,
+	uses         INT,
+	valid_from   TIMESTAMP,
+	valid_until  TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (code)
+);
+CREATE TABLE discounts (
+	user_id      TEXT,
+	percent      INT,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (user_id)
+);
+CREATE TABLE sale_rules (
+	sale_id   TEXT,
+	position  INT,
+	rule      TEXT,
+	reference TEXT,
+	amount    INT,
+
+	PRIMARY KEY (sale_id, position),
+	FOREIGN KEY (sale_id) REFERENCES sales(sale_id) ON DELETE CASCADE
+);`,
+	12: `
+CREATE TABLE categories (
+	category_id  TEXT,
+	parent_id    TEXT,
+	name         TEXT,
+	schema       TEXT DEFAULT '[]',
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (category_id),
+	FOREIGN KEY (parent_id) REFERENCES categories(category_id)
+);
+CREATE INDEX categories_parent_idx ON categories (parent_id);
+ALTER TABLE products ADD COLUMN category_id TEXT REFERENCES categories(category_id) ON DELETE SET NULL;
+ALTER TABLE products ADD COLUMN attributes TEXT DEFAULT '{}';
+CREATE INDEX products_category_idx ON products (category_id);
+CREATE TABLE product_tags (
+	product_id TEXT,
+	tag        TEXT,
+
+	PRIMARY KEY (product_id, tag),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX product_tags_tag_idx ON product_tags (tag);`,
+	13: `
+-- SQLite has no full-text index the searches can share with Postgres so
+-- products are searched in process.
+SELECT 1;`,
+	14: `
+-- Images have no foreign key to products so purging products leaves them for
+-- the media purge to find and remove their blobs.
+CREATE TABLE images (
+	image_id     TEXT,
+	product_id   TEXT,
+	name         TEXT,
+	content_type TEXT,
+	size         INT,
+	width        INT,
+	height       INT,
+	user_id      TEXT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (image_id)
+);
+CREATE INDEX images_product_idx ON images (product_id, date_created);`,
+	15: `
+CREATE TABLE sales_rollups (
+	hour       TIMESTAMP,
+	product_id TEXT,
+	currency   TEXT,
+	units      INT,
+	revenue    INT,
+
+	PRIMARY KEY (hour, product_id, currency),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+CREATE INDEX sales_date_idx ON sales (date_created);
+CREATE INDEX refunds_date_idx ON refunds (date_created);`,
+	16: `
+-- Products changed before history was kept get their current values as their
+-- first version and their sales get the current cost as their unit price.
+CREATE TABLE product_versions (
+	product_id   TEXT,
+	version      INT,
+	name         TEXT,
+	cost         INT,
+	currency     TEXT,
+	quantity     INT,
+	category_id  TEXT,
+	tags         TEXT DEFAULT '[]',
+	attributes   TEXT DEFAULT '{}',
+	changed_by   TEXT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (product_id, version),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+INSERT INTO product_versions
+	(product_id, version, name, cost, currency, quantity, category_id, tags, attributes, changed_by, date_created)
+SELECT
+	p.product_id, 1, p.name, p.cost, p.currency, p.quantity, p.category_id,
+	'[' || COALESCE((SELECT group_concat('"' || replace(replace(t.tag, '\', '\\'), '"', '\"') || '"', ',')
+		FROM product_tags AS t WHERE t.product_id = p.product_id), '') || ']',
+	p.attributes, p.user_id, p.date_created
+FROM products AS p;
+ALTER TABLE sales ADD COLUMN unit_price INT DEFAULT 0;
+UPDATE sales SET unit_price = (SELECT cost FROM products AS p WHERE p.product_id = sales.product_id);`,
+	17: `
+-- Tokens issued before tokens_valid_after are no longer accepted. Only a hash
+-- of every reset token is kept.
+ALTER TABLE users ADD COLUMN tokens_valid_after TIMESTAMP;
+CREATE TABLE password_resets (
+	token_hash   TEXT,
+	user_id      TEXT,
+	expires_at   TIMESTAMP,
+	used_at      TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (token_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX password_resets_user_idx ON password_resets (user_id);`,
+	19: `
+-- A user is enrolled once mfa_secret is set and has to use it to log in once
+-- mfa_enabled is set. mfa_last_step keeps codes from being used twice. Only a
+-- hash of every recovery code is kept.
+ALTER TABLE users ADD COLUMN mfa_secret TEXT DEFAULT '';
+ALTER TABLE users ADD COLUMN mfa_enabled BOOLEAN DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN mfa_last_step BIGINT DEFAULT 0;
+CREATE TABLE mfa_recovery_codes (
+	user_id   TEXT,
+	code_hash TEXT,
+	used_at   TIMESTAMP,
+
+	PRIMARY KEY (user_id, code_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);`,
+	20: `
+-- Users who sign up themselves are unverified until they use one of their
+-- verification tokens. Only a hash of every token is kept.
+ALTER TABLE users ADD COLUMN unverified BOOLEAN DEFAULT FALSE;
+CREATE TABLE email_verifications (
+	token_hash   TEXT,
+	user_id      TEXT,
+	expires_at   TIMESTAMP,
+	used_at      TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (token_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX email_verifications_user_idx ON email_verifications (user_id);`,
+	21: `
+-- Keys are found by their prefix and only a hash of their secret is kept.
+-- Scopes are the roles a key can use.
+CREATE TABLE api_keys (
+	key_id       TEXT,
+	user_id      TEXT,
+	name         TEXT,
+	prefix       TEXT UNIQUE,
+	secret_hash  TEXT,
+	scopes       TEXT,
+	expires_at   TIMESTAMP,
+	last_used    TIMESTAMP,
+	revoked_at   TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (key_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX api_keys_user_idx ON api_keys (user_id);`,
+	22: `
+-- Disabled users keep their record but can not log in and lose their tokens.
+-- Every login token belongs to a session that can be revoked on its own.
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN disabled_reason TEXT DEFAULT '';
+CREATE TABLE sessions (
+	session_id   TEXT,
+	user_id      TEXT,
+	source       TEXT,
+	expires_at   TIMESTAMP,
+	revoked_at   TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (session_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX sessions_user_idx ON sessions (user_id);`,
+	23: `
+-- Identities link the subject of an external identity provider to the local
+-- user it logs in as.
+CREATE TABLE identities (
+	issuer       TEXT,
+	subject      TEXT,
+	user_id      TEXT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (issuer, subject),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+CREATE INDEX identities_user_idx ON identities (user_id);`,
 }
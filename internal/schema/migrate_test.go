@@ -0,0 +1,42 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GuiaBolso/darwin"
+	"github.com/ardanlabs/service/internal/platform/database"
+)
+
+// TestCheckEmails validates migrating over emails that only differ in case
+// names the users instead of failing on the unique index.
+func TestCheckEmails(t *testing.T) {
+	db, err := database.Open(database.Config{Driver: database.DriverSQLite})
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+
+	driver := darwin.NewGenericDriver(db.DB, darwin.SqliteDialect{})
+	if err := darwin.New(driver, sqliteMigrations()[:23], nil).Migrate(); err != nil {
+		t.Fatalf("migrating to version 23: %v", err)
+	}
+
+	const users = `INSERT INTO users (user_id, email) VALUES
+		('a', 'Jo@example.com'), ('b', 'jo@example.com '), ('c', 'kim@example.com')`
+	if _, err := db.Exec(users); err != nil {
+		t.Fatalf("inserting users: %v", err)
+	}
+
+	err = Migrate(db)
+	if err == nil || !strings.Contains(err.Error(), "jo@example.com: a b") || strings.Contains(err.Error(), "kim") {
+		t.Fatalf("should name the users with the same email : got %v", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM users WHERE user_id = 'b'`); err != nil {
+		t.Fatalf("deleting user: %v", err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatalf("should migrate once the users are merged : %v", err)
+	}
+}
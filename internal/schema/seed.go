@@ -1,6 +1,10 @@
 package schema
 
 import (
+	"time"
+
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/user"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -25,24 +29,65 @@ func Seed(db *sqlx.DB) error {
 // seeds is a string constant containing all of the queries needed to get the
 // db seeded to a useful state for development.
 //
-// Note that database servers besides PostgreSQL may not support running
-// multiple queries as part of the same execution so this single large constant
-// may need to be broken up.
+// Note that database servers besides PostgreSQL and SQLite may not support
+// running multiple queries as part of the same execution so this single large
+// constant may need to be broken up. Timestamps include a full UTC offset so
+// both databases parse them the same way.
 const seeds = `
 INSERT INTO products (product_id, name, cost, quantity, date_created, date_updated) VALUES
-	('a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 'Comic Books', 50, 42, '2019-01-01 00:00:01.000001+00', '2019-01-01 00:00:01.000001+00'),
-	('72f8b983-3eb4-48db-9ed0-e45cc6bd716b', 'McDonalds Toys', 75, 120, '2019-01-01 00:00:02.000001+00', '2019-01-01 00:00:02.000001+00')
+	('a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 'Comic Books', 50, 42, '2019-01-01 00:00:01.000001+00:00', '2019-01-01 00:00:01.000001+00:00'),
+	('72f8b983-3eb4-48db-9ed0-e45cc6bd716b', 'McDonalds Toys', 75, 120, '2019-01-01 00:00:02.000001+00:00', '2019-01-01 00:00:02.000001+00:00')
+	ON CONFLICT DO NOTHING;
+
+INSERT INTO product_versions (product_id, version, name, cost, currency, quantity, changed_by, date_created) VALUES
+	('a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 1, 'Comic Books', 50, 'USD', 42, '00000000-0000-0000-0000-000000000000', '2019-01-01 00:00:01.000001+00:00'),
+	('72f8b983-3eb4-48db-9ed0-e45cc6bd716b', 1, 'McDonalds Toys', 75, 'USD', 120, '00000000-0000-0000-0000-000000000000', '2019-01-01 00:00:02.000001+00:00')
+	ON CONFLICT DO NOTHING;
+
+INSERT INTO sales (sale_id, product_id, quantity, paid, price, unit_price, date_created) VALUES
+	('98b6d4b8-f04b-4c79-8c2e-a0aef46854b7', 'a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 2, 100, 100, 50, '2019-01-01 00:00:03.000001+00:00'),
+	('85f6fb09-eb05-4874-ae39-82d1a30fe0d7', 'a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 5, 250, 250, 50, '2019-01-01 00:00:04.000001+00:00'),
+	('a235be9e-ab5d-44e6-a987-fa1c749264c7', '72f8b983-3eb4-48db-9ed0-e45cc6bd716b', 3, 225, 225, 75, '2019-01-01 00:00:05.000001+00:00')
 	ON CONFLICT DO NOTHING;
 
-INSERT INTO sales (sale_id, product_id, quantity, paid, date_created) VALUES
-	('98b6d4b8-f04b-4c79-8c2e-a0aef46854b7', 'a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 2, 100, '2019-01-01 00:00:03.000001+00'),
-	('85f6fb09-eb05-4874-ae39-82d1a30fe0d7', 'a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 5, 250, '2019-01-01 00:00:04.000001+00'),
-	('a235be9e-ab5d-44e6-a987-fa1c749264c7', '72f8b983-3eb4-48db-9ed0-e45cc6bd716b', 3, 225, '2019-01-01 00:00:05.000001+00')
+-- Stock received with each product and taken by each sale share their IDs.
+INSERT INTO inventory_movements (movement_id, product_id, kind, quantity, reason, date_created) VALUES
+	('a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 'a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 'receive', 42, 'Initial stock', '2019-01-01 00:00:01.000001+00:00'),
+	('72f8b983-3eb4-48db-9ed0-e45cc6bd716b', '72f8b983-3eb4-48db-9ed0-e45cc6bd716b', 'receive', 120, 'Initial stock', '2019-01-01 00:00:02.000001+00:00'),
+	('98b6d4b8-f04b-4c79-8c2e-a0aef46854b7', 'a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 'sale', -2, '', '2019-01-01 00:00:03.000001+00:00'),
+	('85f6fb09-eb05-4874-ae39-82d1a30fe0d7', 'a2b0639f-2cc6-44b8-b97b-15d69dbb511e', 'sale', -5, '', '2019-01-01 00:00:04.000001+00:00'),
+	('a235be9e-ab5d-44e6-a987-fa1c749264c7', '72f8b983-3eb4-48db-9ed0-e45cc6bd716b', 'sale', -3, '', '2019-01-01 00:00:05.000001+00:00')
 	ON CONFLICT DO NOTHING;
 
 -- Create admin and regular User with password "gophers"
 INSERT INTO users (user_id, name, email, roles, password_hash, date_created, date_updated) VALUES
-	('5cf37266-3473-4006-984f-9325122678b7', 'Admin Gopher', 'admin@example.com', '{ADMIN,USER}', '$2a$10$1ggfMVZV6Js0ybvJufLRUOWHS5f6KneuP0XwwHpJ8L8ipdry9f2/a', '2019-03-24 00:00:00', '2019-03-24 00:00:00'),
-	('45b5fbd3-755f-4379-8f07-a58d4a30fa2f', 'User Gopher', 'user@example.com', '{USER}', '$2a$10$9/XASPKBbJKVfCAZKDH.UuhsuALDr5vVm6VrYA9VFR8rccK86C1hW', '2019-03-24 00:00:00', '2019-03-24 00:00:00')
+	('5cf37266-3473-4006-984f-9325122678b7', 'Admin Gopher', 'admin@example.com', '{ADMIN,USER}', '$2a$10$1ggfMVZV6Js0ybvJufLRUOWHS5f6KneuP0XwwHpJ8L8ipdry9f2/a', '2019-03-24 00:00:00+00:00', '2019-03-24 00:00:00+00:00'),
+	('45b5fbd3-755f-4379-8f07-a58d4a30fa2f', 'User Gopher', 'user@example.com', '{USER}', '$2a$10$9/XASPKBbJKVfCAZKDH.UuhsuALDr5vVm6VrYA9VFR8rccK86C1hW', '2019-03-24 00:00:00+00:00', '2019-03-24 00:00:00+00:00')
 	ON CONFLICT DO NOTHING;
 `
+
+// SeedMemory loads the same records defined by the seed queries into the
+// provided in-memory stores.
+func SeedMemory(products *product.Memory, users *user.Memory) {
+	at := func(sec, usec int) time.Time {
+		return time.Date(2019, time.January, 1, 0, 0, sec, usec*1000, time.UTC)
+	}
+
+	products.Load(
+		[]product.Product{
+			{ID: "a2b0639f-2cc6-44b8-b97b-15d69dbb511e", Name: "Comic Books", Cost: 50, Quantity: 42, UserID: "00000000-0000-0000-0000-000000000000", DateCreated: at(1, 1), DateUpdated: at(1, 1)},
+			{ID: "72f8b983-3eb4-48db-9ed0-e45cc6bd716b", Name: "McDonalds Toys", Cost: 75, Quantity: 120, UserID: "00000000-0000-0000-0000-000000000000", DateCreated: at(2, 1), DateUpdated: at(2, 1)},
+		},
+		[]product.Sale{
+			{ID: "98b6d4b8-f04b-4c79-8c2e-a0aef46854b7", ProductID: "a2b0639f-2cc6-44b8-b97b-15d69dbb511e", Quantity: 2, Paid: 100, Price: 100, UnitPrice: 50, DateCreated: at(3, 1)},
+			{ID: "85f6fb09-eb05-4874-ae39-82d1a30fe0d7", ProductID: "a2b0639f-2cc6-44b8-b97b-15d69dbb511e", Quantity: 5, Paid: 250, Price: 250, UnitPrice: 50, DateCreated: at(4, 1)},
+			{ID: "a235be9e-ab5d-44e6-a987-fa1c749264c7", ProductID: "72f8b983-3eb4-48db-9ed0-e45cc6bd716b", Quantity: 3, Paid: 225, Price: 225, UnitPrice: 75, DateCreated: at(5, 1)},
+		},
+	)
+
+	created := time.Date(2019, time.March, 24, 0, 0, 0, 0, time.UTC)
+	users.Load([]user.User{
+		{ID: "5cf37266-3473-4006-984f-9325122678b7", Name: "Admin Gopher", Email: "admin@example.com", Roles: []string{"ADMIN", "USER"}, PasswordHash: []byte("$2a$10$1ggfMVZV6Js0ybvJufLRUOWHS5f6KneuP0XwwHpJ8L8ipdry9f2/a"), DateCreated: created, DateUpdated: created},
+		{ID: "45b5fbd3-755f-4379-8f07-a58d4a30fa2f", Name: "User Gopher", Email: "user@example.com", Roles: []string{"USER"}, PasswordHash: []byte("$2a$10$9/XASPKBbJKVfCAZKDH.UuhsuALDr5vVm6VrYA9VFR8rccK86C1hW"), DateCreated: created, DateUpdated: created},
+	})
+}
@@ -4,15 +4,23 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/ardanlabs/service/internal/media"
+	"github.com/ardanlabs/service/internal/order"
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/blob"
 	"github.com/ardanlabs/service/internal/platform/database"
 	"github.com/ardanlabs/service/internal/platform/database/databasetest"
+	"github.com/ardanlabs/service/internal/platform/notify"
 	"github.com/ardanlabs/service/internal/platform/web"
+	"github.com/ardanlabs/service/internal/product"
+	"github.com/ardanlabs/service/internal/report"
 	"github.com/ardanlabs/service/internal/schema"
 	"github.com/ardanlabs/service/internal/user"
 	"github.com/google/uuid"
@@ -32,9 +40,17 @@ const (
 	UserID  = "45b5fbd3-755f-4379-8f07-a58d4a30fa2f"
 )
 
+// DriverEnv names the environment variable that selects the database used by
+// the tests. When it is set to "sqlite" the tests use a temporary SQLite file
+// instead of starting a Postgres container with Docker.
+const DriverEnv = "TEST_DB_DRIVER"
+
 // NewUnit creates a test database inside a Docker container. It creates the
 // required table structure but the database is otherwise empty.
 //
+// If the DriverEnv environment variable selects SQLite the database is a
+// temporary SQLite file and Docker is not required.
+//
 // It does not return errors as this intended for testing only. Instead it will
 // call Fatal on the provided testing.T if anything goes wrong.
 //
@@ -43,6 +59,10 @@ const (
 func NewUnit(t *testing.T) (*sqlx.DB, func()) {
 	t.Helper()
 
+	if os.Getenv(DriverEnv) == database.DriverSQLite {
+		return newSQLiteUnit(t)
+	}
+
 	c := databasetest.StartContainer(t)
 
 	db, err := database.Open(database.Config{
@@ -92,9 +112,51 @@ func NewUnit(t *testing.T) (*sqlx.DB, func()) {
 	return db, teardown
 }
 
+// newSQLiteUnit creates a test database in a temporary SQLite file. The file
+// is removed by the returned teardown function.
+func newSQLiteUnit(t *testing.T) (*sqlx.DB, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sales-test")
+	if err != nil {
+		t.Fatalf("creating database directory: %v", err)
+	}
+
+	db, err := database.Open(database.Config{
+		Driver: database.DriverSQLite,
+		Name:   filepath.Join(dir, "sales.db"),
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("migrating: %s", err)
+	}
+
+	// teardown is the function that should be invoked when the caller is done
+	// with the database.
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	return db, teardown
+}
+
 // Test owns state for running and shutting down tests.
 type Test struct {
 	DB            *sqlx.DB
+	Products      product.Store
+	Users         user.Store
+	Orders        order.Store
+	Images        media.Store
+	Reports       report.Store
+	Notifier      *notify.Memory
 	Log           *log.Logger
 	Authenticator *auth.Authenticator
 
@@ -113,29 +175,66 @@ func NewIntegration(t *testing.T) *Test {
 		t.Fatal(err)
 	}
 
+	products := product.NewDB(db)
+	test := Test{
+		DB:       db,
+		Products: products,
+		Users:    user.NewDB(db, user.Config{}),
+		Orders:   order.NewDB(db),
+		Images:   media.NewDB(db, products, blob.NewMemory()),
+		Reports:  report.NewDB(db),
+		Notifier: notify.NewMemory(),
+		t:        t,
+		cleanup:  cleanup,
+	}
+	test.init()
+
+	return &test
+}
+
+// NewMemory seeds in-memory stores and constructs an authenticator. It does
+// not require a database so the DB field of the returned value is nil.
+func NewMemory(t *testing.T) *Test {
+	t.Helper()
+
+	products := product.NewMemory()
+	users := user.NewMemory(user.Config{})
+	schema.SeedMemory(products, users)
+
+	test := Test{
+		Products: products,
+		Users:    users,
+		Orders:   order.NewMemory(products),
+		Images:   media.NewMemory(products, blob.NewMemory()),
+		Reports:  report.NewMemory(products),
+		Notifier: notify.NewMemory(),
+		t:        t,
+		cleanup:  func() {},
+	}
+	test.init()
+
+	return &test
+}
+
+// init constructs the logger and authenticator shared by every kind of Test.
+func (test *Test) init() {
+	test.t.Helper()
+
 	// Create the logger to use.
-	logger := log.New(os.Stdout, "TEST : ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	test.Log = log.New(os.Stdout, "TEST : ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
 
 	// Create RSA keys to enable authentication in our service.
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		t.Fatal(err)
+		test.t.Fatal(err)
 	}
 
 	// Build an authenticator using this static key.
 	kid := "4754d86b-7a6d-4df5-9c65-224741361492"
 	kf := auth.NewSimpleKeyLookupFunc(kid, key.Public().(*rsa.PublicKey))
-	authenticator, err := auth.NewAuthenticator(key, kid, "RS256", kf)
+	test.Authenticator, err = auth.NewAuthenticator(key, kid, "RS256", kf)
 	if err != nil {
-		t.Fatal(err)
-	}
-
-	return &Test{
-		DB:            db,
-		Log:           logger,
-		Authenticator: authenticator,
-		t:             t,
-		cleanup:       cleanup,
+		test.t.Fatal(err)
 	}
 }
 
@@ -148,9 +247,9 @@ func (test *Test) Teardown() {
 func (test *Test) Token(email, pass string) string {
 	test.t.Helper()
 
-	claims, err := user.Authenticate(
-		context.Background(), test.DB, time.Now(),
-		email, pass,
+	claims, err := test.Users.Authenticate(
+		context.Background(), time.Now(),
+		email, pass, "192.0.2.1",
 	)
 	if err != nil {
 		test.t.Fatal(err)
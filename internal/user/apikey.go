@@ -0,0 +1,432 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// APIKeyAudience is the audience of the claims AuthenticateAPIKey gives. It
+// keeps API keys from being used to create more keys.
+const APIKeyAudience = "apikey"
+
+// newAPIKey generates an APIKey with a random prefix and secret for the user
+// with the id. Its scopes must be roles of the claims creating it.
+func newAPIKey(claims auth.Claims, id string, nk NewAPIKey, now time.Time) (*APIKey, error) {
+	if claims.Subject != id || claims.Audience == APIKeyAudience {
+		return nil, ErrForbidden
+	}
+	for _, s := range nk.Scopes {
+		if !claims.HasRole(s) {
+			return nil, ErrInvalidScope
+		}
+	}
+
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "generating key prefix")
+	}
+	secret, err := newToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generating key secret")
+	}
+
+	k := APIKey{
+		ID:          uuid.New().String(),
+		UserID:      id,
+		Name:        nk.Name,
+		Prefix:      hex.EncodeToString(b),
+		SecretHash:  hashToken(secret),
+		Scopes:      append([]string(nil), nk.Scopes...),
+		DateCreated: now.UTC(),
+	}
+	if nk.ExpiresAt != nil {
+		exp := nk.ExpiresAt.UTC()
+		k.ExpiresAt = &exp
+	}
+	k.Key = k.Prefix + "." + secret
+
+	return &k, nil
+}
+
+// splitKey gives the prefix and secret of a full key.
+func splitKey(key string) (string, string, bool) {
+	i := strings.Index(key, ".")
+	if i <= 0 || i == len(key)-1 {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// keyClaims gives the claims of the user u for their key k when secret is the
+// secret of k and both are still in force at now. The claims only carry the
+// scopes u still has a role for. When admins are required to use two-factor
+// authentication, keys of those who have not enrolled are not given the ADMIN
+// role.
+func keyClaims(k APIKey, u User, secret string, adminMFA bool, now time.Time) (auth.Claims, bool) {
+	switch {
+	case subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(hashToken(secret))) != 1,
+		k.RevokedAt != nil,
+		k.ExpiresAt != nil && !now.Before(*k.ExpiresAt),
+		u.DeletedAt != nil,
+		u.DisabledAt != nil,
+		u.Unverified:
+		return auth.Claims{}, false
+	}
+
+	var roles []string
+	for _, s := range k.Scopes {
+		if s == auth.RoleAdmin && adminMFA && !u.MFAEnabled {
+			continue
+		}
+		for _, r := range u.Roles {
+			if s == r {
+				roles = append(roles, s)
+				break
+			}
+		}
+	}
+
+	claims := auth.NewClaims(u.ID, roles, now, time.Hour)
+	claims.Audience = APIKeyAudience
+	return claims, true
+}
+
+// CreateAPIKey creates a key for the specified user. The returned APIKey is
+// the only one holding the full key.
+func (s *DB) CreateAPIKey(ctx context.Context, claims auth.Claims, id string, nk NewAPIKey, now time.Time) (*APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.CreateAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	k, err := newAPIKey(claims, id, nk, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	const sel = `SELECT count(*) FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+	if err := s.db.GetContext(ctx, &n, sel, id); err != nil {
+		return nil, errors.Wrapf(err, "selecting user %q", id)
+	}
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	const q = `INSERT INTO api_keys
+		(key_id, user_id, name, prefix, secret_hash, scopes, expires_at, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(
+			ctx, q,
+			k.ID, k.UserID, k.Name,
+			k.Prefix, k.SecretHash, k.Scopes,
+			k.ExpiresAt, k.DateCreated,
+		)
+		if err != nil {
+			return errors.Wrap(err, "inserting api key")
+		}
+
+		// The event must not carry the full key.
+		data := *k
+		data.Key = ""
+		return event.Record(ctx, tx, event.APIKeyCreated, id, data, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// ListAPIKeys gives the keys of the specified user, including revoked and
+// expired ones, oldest first.
+func (s *DB) ListAPIKeys(ctx context.Context, claims auth.Claims, id string) ([]APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.ListAPIKeys")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	// If you are not an admin and looking to see someone else's keys then you are rejected.
+	if !claims.HasRole(auth.RoleAdmin) && claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	keys := []APIKey{}
+	const q = `SELECT * FROM api_keys WHERE user_id = $1 ORDER BY date_created, key_id`
+	if err := s.db.SelectContext(ctx, &keys, q, id); err != nil {
+		return nil, errors.Wrapf(err, "selecting api keys of user %q", id)
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey stops the specified key of a user from being used. Revoking a
+// key again does nothing.
+func (s *DB) RevokeAPIKey(ctx context.Context, claims auth.Claims, id, keyID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.RevokeAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+	if _, err := uuid.Parse(keyID); err != nil {
+		return ErrInvalidID
+	}
+
+	// If you are not an admin and looking to revoke someone else's key then you are rejected.
+	if !claims.HasRole(auth.RoleAdmin) && claims.Subject != id {
+		return ErrForbidden
+	}
+
+	const q = `UPDATE api_keys SET
+		"revoked_at" = COALESCE(revoked_at, $3)
+		WHERE key_id = $1 AND user_id = $2`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, keyID, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "revoking api key %s", keyID)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "revoking api key %s", keyID)
+		}
+		if n == 0 {
+			return ErrAPIKeyNotFound
+		}
+
+		data := struct {
+			ID     string `json:"id"`
+			UserID string `json:"user_id"`
+		}{keyID, id}
+		return event.Record(ctx, tx, event.APIKeyRevoked, id, data, now)
+	})
+}
+
+// AuthenticateAPIKey finds the key by its prefix and verifies its secret. On
+// success it returns the claims of its user and records when it was used.
+func (s *DB) AuthenticateAPIKey(ctx context.Context, now time.Time, key string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.AuthenticateAPIKey")
+	defer span.End()
+
+	prefix, secret, ok := splitKey(key)
+	if !ok {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	var k APIKey
+	const q = `SELECT * FROM api_keys WHERE prefix = $1`
+	switch err := s.db.GetContext(ctx, &k, q, prefix); err {
+	case nil:
+	case sql.ErrNoRows:
+		return auth.Claims{}, ErrAuthenticationFailure
+	default:
+		return auth.Claims{}, errors.Wrap(err, "selecting api key")
+	}
+
+	var u User
+	const sel = `SELECT * FROM users WHERE user_id = $1`
+	if err := s.db.GetContext(ctx, &u, sel, k.UserID); err != nil {
+		return auth.Claims{}, errors.Wrapf(err, "selecting user %q", k.UserID)
+	}
+
+	claims, ok := keyClaims(k, u, secret, s.adminMFA, now)
+	if !ok {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	const upd = `UPDATE api_keys SET "last_used" = $2 WHERE key_id = $1`
+	if _, err := s.db.ExecContext(ctx, upd, k.ID, now.UTC()); err != nil {
+		return auth.Claims{}, errors.Wrapf(err, "recording use of api key %s", k.ID)
+	}
+
+	return claims, nil
+}
+
+// CreateAPIKey creates a key for the specified user. The returned APIKey is
+// the only one holding the full key.
+func (m *Memory) CreateAPIKey(ctx context.Context, claims auth.Claims, id string, nk NewAPIKey, now time.Time) (*APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.CreateAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	k, err := newAPIKey(claims, id, nk, now)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[id]; !ok || u.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	stored := copyAPIKey(*k)
+	stored.Key = ""
+	m.keys[k.ID] = stored
+
+	return k, nil
+}
+
+// ListAPIKeys gives the keys of the specified user, including revoked and
+// expired ones, oldest first.
+func (m *Memory) ListAPIKeys(ctx context.Context, claims auth.Claims, id string) ([]APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.ListAPIKeys")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	// If you are not an admin and looking to see someone else's keys then you are rejected.
+	if !claims.HasRole(auth.RoleAdmin) && claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, k := range m.keys {
+		if k.UserID == id {
+			keys = append(keys, copyAPIKey(k))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].DateCreated.Equal(keys[j].DateCreated) {
+			return keys[i].DateCreated.Before(keys[j].DateCreated)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+// RevokeAPIKey stops the specified key of a user from being used. Revoking a
+// key again does nothing.
+func (m *Memory) RevokeAPIKey(ctx context.Context, claims auth.Claims, id, keyID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.RevokeAPIKey")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+	if _, err := uuid.Parse(keyID); err != nil {
+		return ErrInvalidID
+	}
+
+	// If you are not an admin and looking to revoke someone else's key then you are rejected.
+	if !claims.HasRole(auth.RoleAdmin) && claims.Subject != id {
+		return ErrForbidden
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[keyID]
+	if !ok || k.UserID != id {
+		return ErrAPIKeyNotFound
+	}
+	if k.RevokedAt == nil {
+		revoked := now.UTC()
+		k.RevokedAt = &revoked
+		m.keys[keyID] = k
+	}
+
+	return nil
+}
+
+// AuthenticateAPIKey finds the key by its prefix and verifies its secret. On
+// success it returns the claims of its user and records when it was used.
+func (m *Memory) AuthenticateAPIKey(ctx context.Context, now time.Time, key string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.AuthenticateAPIKey")
+	defer span.End()
+
+	prefix, secret, ok := splitKey(key)
+	if !ok {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, k := range m.keys {
+		if k.Prefix != prefix {
+			continue
+		}
+
+		u, found := m.users[k.UserID]
+		claims, ok := keyClaims(k, u, secret, m.adminMFA, now)
+		if !found || !ok {
+			return auth.Claims{}, ErrAuthenticationFailure
+		}
+
+		used := now.UTC()
+		k.LastUsed = &used
+		m.keys[id] = k
+
+		return claims, nil
+	}
+
+	return auth.Claims{}, ErrAuthenticationFailure
+}
+
+// revokeAPIKeys revokes every key of the user with the id.
+func revokeAPIKeys(ctx context.Context, tx *sqlx.Tx, id string, now time.Time) error {
+	const q = `UPDATE api_keys SET
+		"revoked_at" = $2
+		WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, q, id, now.UTC()); err != nil {
+		return errors.Wrapf(err, "revoking api keys of user %q", id)
+	}
+	return nil
+}
+
+// revokeAPIKeys revokes every key of the user with the id. The caller must
+// hold the lock.
+func (m *Memory) revokeAPIKeys(id string, now time.Time) {
+	for kid, k := range m.keys {
+		if k.UserID == id && k.RevokedAt == nil {
+			revoked := now.UTC()
+			k.RevokedAt = &revoked
+			m.keys[kid] = k
+		}
+	}
+}
+
+// copyAPIKey returns a copy of k that shares no memory with the original so
+// callers can not modify the stored value.
+func copyAPIKey(k APIKey) APIKey {
+	k.Scopes = append([]string(nil), k.Scopes...)
+	for _, t := range []**time.Time{&k.ExpiresAt, &k.LastUsed, &k.RevokedAt} {
+		if *t != nil {
+			c := **t
+			*t = &c
+		}
+	}
+	return k
+}
@@ -0,0 +1,83 @@
+package user
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// emails normalizes the emails users are stored and looked up with. Emails
+// are compared without regard to case or surrounding white space and, when
+// stripPlus is set, without the +tag of their local part.
+type emails struct {
+	stripPlus bool
+}
+
+// newEmails prepares the email handling of cfg.
+func newEmails(cfg Config) emails {
+	return emails{stripPlus: cfg.StripPlusTags}
+}
+
+// normalize gives the form of email users are stored with. It is used as-is
+// for lookups, where an invalid email simply does not match anyone.
+func (e emails) normalize(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !e.stripPlus {
+		return email
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	if plus := strings.Index(email[:at], "+"); plus > 0 {
+		email = email[:plus] + email[at:]
+	}
+	return email
+}
+
+// parse gives the normalized form of an email a user is given. It is
+// ErrInvalidEmail unless it is a bare address with a local part and domain.
+func (e emails) parse(email string) (string, error) {
+	email = e.normalize(email)
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", ErrInvalidEmail
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 1 || at == len(email)-1 {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// CheckEmails reports the stored emails that are not in the form emails are
+// looked up with, which happens when StripPlusTags is set after users signed
+// up with a tag. Those users could no longer be found by their email and may
+// clash with others once their tag is dropped, so the service does not start
+// until they are fixed by hand.
+func (s *DB) CheckEmails(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.CheckEmails")
+	defer span.End()
+
+	var stored []string
+	const q = `SELECT email FROM users WHERE email LIKE '%+%'`
+	if err := s.db.SelectContext(ctx, &stored, q); err != nil {
+		return errors.Wrap(err, "selecting tagged emails")
+	}
+
+	var bad []string
+	for _, email := range stored {
+		if s.emails.normalize(email) != email {
+			bad = append(bad, email)
+		}
+	}
+	if len(bad) > 0 {
+		return errors.Errorf("%d users have emails with a +tag: %s", len(bad), strings.Join(bad, ", "))
+	}
+	return nil
+}
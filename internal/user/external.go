@@ -0,0 +1,420 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/oidc"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// sameRoles reports whether a and b hold the same roles in the same order.
+func sameRoles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// linkable reports why the user with the email of ext, who is not linked to
+// it yet, can not log in as ext. Only a provider that verified the email can
+// claim the account and deleted users keep theirs until they are purged.
+func linkable(u User, ext External) error {
+	if !ext.EmailVerified || u.DeletedAt != nil {
+		return ErrAuthenticationFailure
+	}
+	return nil
+}
+
+// claim gives u once the owner of their email, as vouched for by a provider,
+// takes over the account. An unverified account may have been signed up by
+// someone else before, so its password and tokens stop working.
+func claim(u User, now time.Time) User {
+	if !u.Unverified {
+		return u
+	}
+	valid := now.UTC()
+	u.Unverified = false
+	u.PasswordHash = nil
+	u.TokensValidAfter = &valid
+	u.DateUpdated = valid
+	return u
+}
+
+// NewExternal gives the External an OpenID Connect provider vouched for with
+// the identity.
+func NewExternal(id oidc.Identity) External {
+	return External{
+		Issuer:        id.Issuer,
+		Subject:       id.Subject,
+		Email:         id.Email,
+		EmailVerified: id.EmailVerified,
+		Name:          id.Name,
+		Roles:         id.Roles,
+	}
+}
+
+// dropsAdmin reports whether replacing the roles of u with roles takes away
+// their ADMIN role.
+func dropsAdmin(u User, roles []string) bool {
+	return hasRole(u.Roles, auth.RoleAdmin) && !hasRole(roles, auth.RoleAdmin)
+}
+
+// idTokenClaims gives the claims of u for a request made with an ID token of
+// the issuer until it expires. An ID token can not answer a two-factor
+// challenge so it is ErrMFARequired for users who turned it on, and admins
+// lose the role like they do in Authenticate.
+func idTokenClaims(u User, adminMFA bool, issuer string, expires, now time.Time) (auth.Claims, error) {
+	claims := loginClaims(u, adminMFA, now)
+	if claims.Audience == ChallengeAudience {
+		return auth.Claims{}, ErrMFARequired
+	}
+	claims.Issuer = issuer
+	claims.ExpiresAt = expires.Unix()
+	return claims, nil
+}
+
+// externalUser gives the User provisioned for ext. They have no password.
+func externalUser(ext External, now time.Time) User {
+	name := ext.Name
+	if name == "" {
+		name = ext.Email
+	}
+	return User{
+		ID:          uuid.New().String(),
+		Name:        name,
+		Email:       ext.Email,
+		Roles:       append([]string{}, ext.Roles...),
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+}
+
+// Provision gives the User the external identity logs in as. It is the user
+// linked to the identity, else the user with its email once linked, else a new
+// user without a password. An unverified user with the email loses their
+// password when linked. The roles of users the provider created are replaced
+// with the roles of ext, unless that takes ADMIN from the last admin.
+func (s *DB) Provision(ctx context.Context, ext External, now time.Time) (*User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Provision")
+	defer span.End()
+
+	var u *User
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		var err error
+		u, err = s.provision(ctx, tx, ext, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// AuthenticateExternal provisions the User the external identity logs in as
+// and gives their claims, which start a Session like those of Authenticate.
+// Users with two-factor authentication on get a challenge for VerifyMFA and
+// admins need it for the ADMIN role just as they do with a password.
+func (s *DB) AuthenticateExternal(ctx context.Context, now time.Time, ext External, source string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.AuthenticateExternal")
+	defer span.End()
+
+	var claims auth.Claims
+	err := event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		u, err := s.provision(ctx, tx, ext, now)
+		if err != nil {
+			return err
+		}
+
+		// Challenges start no Session and VerifyMFA records the login.
+		claims = loginClaims(*u, s.adminMFA, now)
+		sess := startSession(&claims, source, now)
+		if sess == nil {
+			return nil
+		}
+		if err := insertSession(ctx, tx, sess); err != nil {
+			return err
+		}
+		return s.recordUser(ctx, tx, *u, true, now)
+	})
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	return claims, nil
+}
+
+// AuthenticateIDToken provisions the User an ID token of the external
+// identity logs in as and gives their claims for the request it came with,
+// which last until expires and start no Session. It is ErrMFARequired for
+// users with two-factor authentication on and admins need it for the ADMIN
+// role just as they do with a password.
+func (s *DB) AuthenticateIDToken(ctx context.Context, now time.Time, ext External, expires time.Time) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.AuthenticateIDToken")
+	defer span.End()
+
+	u, err := s.Provision(ctx, ext, now)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	return idTokenClaims(*u, s.adminMFA, ext.Issuer, expires, now)
+}
+
+// provision finds, links or creates the User ext logs in as in tx.
+func (s *DB) provision(ctx context.Context, tx *sqlx.Tx, ext External, now time.Time) (*User, error) {
+	ext.Email = s.emails.normalize(ext.Email)
+
+	var row struct {
+		User
+		Provisioned bool `db:"provisioned"`
+	}
+	const linked = `SELECT users.*, identities.provisioned FROM users
+		JOIN identities ON identities.user_id = users.user_id
+		WHERE identities.issuer = $1 AND identities.subject = $2`
+	err := tx.GetContext(ctx, &row, linked, ext.Issuer, ext.Subject)
+	u, provisioned := row.User, row.Provisioned
+	switch err {
+	case nil:
+		if u.DeletedAt != nil {
+			return nil, ErrAuthenticationFailure
+		}
+
+	case sql.ErrNoRows:
+		if ext.Email == "" {
+			return nil, ErrAuthenticationFailure
+		}
+
+		const byEmail = `SELECT * FROM users WHERE email = $1`
+		switch err := tx.GetContext(ctx, &u, byEmail, ext.Email); err {
+		case nil:
+			if err := linkable(u, ext); err != nil {
+				return nil, err
+			}
+			if u.Unverified {
+				u = claim(u, now)
+				const q = `UPDATE users SET
+					"unverified" = FALSE,
+					"password_hash" = $2,
+					"tokens_valid_after" = $3,
+					"date_updated" = $3
+					WHERE user_id = $1`
+				if _, err := tx.ExecContext(ctx, q, u.ID, u.PasswordHash, u.TokensValidAfter); err != nil {
+					return nil, errors.Wrapf(err, "verifying user %s", u.ID)
+				}
+				if err := revokeSessions(ctx, tx, u.ID, now); err != nil {
+					return nil, err
+				}
+				if err := revokeAPIKeys(ctx, tx, u.ID, now); err != nil {
+					return nil, err
+				}
+			}
+
+		case sql.ErrNoRows:
+			u, provisioned = externalUser(ext, now), true
+			const q = `INSERT INTO users
+				(user_id, name, email, password_hash, roles, date_created, date_updated)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`
+			if _, err := tx.ExecContext(ctx, q, u.ID, u.Name, u.Email, u.PasswordHash, u.Roles, u.DateCreated, u.DateUpdated); err != nil {
+				return nil, errors.Wrap(err, "inserting user")
+			}
+			if err := event.Record(ctx, tx, event.UserCreated, u.ID, u, now); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, errors.Wrap(err, "selecting single user")
+		}
+
+		const link = `INSERT INTO identities
+			(issuer, subject, user_id, provisioned, date_created)
+			VALUES ($1, $2, $3, $4, $5)`
+		if _, err := tx.ExecContext(ctx, link, ext.Issuer, ext.Subject, u.ID, provisioned, now.UTC()); err != nil {
+			return nil, errors.Wrap(err, "inserting identity")
+		}
+		data := struct {
+			ID      string `json:"id"`
+			Issuer  string `json:"issuer"`
+			Subject string `json:"subject"`
+		}{u.ID, ext.Issuer, ext.Subject}
+		if err := event.Record(ctx, tx, event.IdentityLinked, u.ID, data, now); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, errors.Wrap(err, "selecting linked user")
+	}
+
+	if u.DisabledAt != nil {
+		return nil, ErrDisabled
+	}
+
+	if provisioned && !sameRoles(u.Roles, ext.Roles) {
+		if dropsAdmin(u, ext.Roles) {
+			if err := s.lastAdmin(ctx, tx, u.ID); err != nil {
+				return nil, err
+			}
+		}
+
+		u.Roles = append([]string{}, ext.Roles...)
+		u.DateUpdated = now.UTC()
+		const q = `UPDATE users SET
+			"roles" = $2,
+			"date_updated" = $3
+			WHERE user_id = $1`
+		if _, err := tx.ExecContext(ctx, q, u.ID, u.Roles, u.DateUpdated); err != nil {
+			return nil, errors.Wrapf(err, "updating roles of user %s", u.ID)
+		}
+		if err := event.Record(ctx, tx, event.UserUpdated, u.ID, u, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return &u, nil
+}
+
+// identity is the key of an external identity linked to a user.
+type identity struct {
+	issuer  string
+	subject string
+}
+
+// identityLink is the user an external identity logs in as and whether the
+// provider created them.
+type identityLink struct {
+	userID      string
+	provisioned bool
+}
+
+// Provision gives the User the external identity logs in as. It is the user
+// linked to the identity, else the user with its email once linked, else a new
+// user without a password. An unverified user with the email loses their
+// password when linked. The roles of users the provider created are replaced
+// with the roles of ext, unless that takes ADMIN from the last admin.
+func (m *Memory) Provision(ctx context.Context, ext External, now time.Time) (*User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Provision")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, err := m.provision(ext, now)
+	if err != nil {
+		return nil, err
+	}
+
+	c := copyUser(u)
+	return &c, nil
+}
+
+// AuthenticateExternal provisions the User the external identity logs in as
+// and gives their claims, which start a Session like those of Authenticate.
+// Users with two-factor authentication on get a challenge for VerifyMFA and
+// admins need it for the ADMIN role just as they do with a password.
+func (m *Memory) AuthenticateExternal(ctx context.Context, now time.Time, ext External, source string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.AuthenticateExternal")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, err := m.provision(ext, now)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	// Challenges start no Session and VerifyMFA records the login.
+	claims := loginClaims(u, m.adminMFA, now)
+	if sess := startSession(&claims, source, now); sess != nil {
+		m.sessions[sess.ID] = *sess
+		m.users[u.ID] = m.lockout.record(u, true, now)
+	}
+
+	return claims, nil
+}
+
+// AuthenticateIDToken provisions the User an ID token of the external
+// identity logs in as and gives their claims for the request it came with,
+// which last until expires and start no Session. It is ErrMFARequired for
+// users with two-factor authentication on and admins need it for the ADMIN
+// role just as they do with a password.
+func (m *Memory) AuthenticateIDToken(ctx context.Context, now time.Time, ext External, expires time.Time) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.AuthenticateIDToken")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, err := m.provision(ext, now)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	return idTokenClaims(u, m.adminMFA, ext.Issuer, expires, now)
+}
+
+// provision finds, links or creates the User ext logs in as. Nothing changes
+// when it fails. The caller must hold the lock.
+func (m *Memory) provision(ext External, now time.Time) (User, error) {
+	ext.Email = m.emails.normalize(ext.Email)
+	key := identity{ext.Issuer, ext.Subject}
+
+	var u User
+	link, linked := m.identities[key]
+	switch {
+	case linked:
+		var ok bool
+		if u, ok = m.users[link.userID]; !ok || u.DeletedAt != nil {
+			return User{}, ErrAuthenticationFailure
+		}
+	case ext.Email == "":
+		return User{}, ErrAuthenticationFailure
+	default:
+		u, link.provisioned = externalUser(ext, now), true
+		for _, usr := range m.users {
+			if usr.Email == ext.Email {
+				if err := linkable(usr, ext); err != nil {
+					return User{}, err
+				}
+				u, link.provisioned = claim(usr, now), false
+				break
+			}
+		}
+	}
+
+	if u.DisabledAt != nil {
+		return User{}, ErrDisabled
+	}
+
+	if link.provisioned && !sameRoles(u.Roles, ext.Roles) {
+		if dropsAdmin(u, ext.Roles) {
+			if err := m.lastAdmin(u.ID); err != nil {
+				return User{}, err
+			}
+		}
+
+		u.Roles = append([]string{}, ext.Roles...)
+		u.DateUpdated = now.UTC()
+	}
+	if prev, ok := m.users[u.ID]; ok && prev.Unverified && !u.Unverified {
+		m.revokeSessions(u.ID, now)
+		m.revokeAPIKeys(u.ID, now)
+	}
+	link.userID = u.ID
+	m.users[u.ID] = u
+	m.identities[key] = link
+
+	return u, nil
+}
@@ -0,0 +1,292 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// withDefaults replaces the zero values of cfg with reasonable defaults.
+func (cfg LockoutConfig) withDefaults() LockoutConfig {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 5
+	}
+	if cfg.MaxSourceFailures <= 0 {
+		cfg.MaxSourceFailures = 50
+	}
+	if cfg.LockDuration <= 0 {
+		cfg.LockDuration = 15 * time.Minute
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = time.Second
+	}
+	if cfg.MaxDelay < cfg.BaseDelay {
+		cfg.MaxDelay = time.Minute
+	}
+	return cfg
+}
+
+// delay gives how long to wait after the given number of failures.
+func (cfg LockoutConfig) delay(failures int) time.Duration {
+	d := cfg.BaseDelay
+	for i := 1; i < failures && d < cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > cfg.MaxDelay {
+		d = cfg.MaxDelay
+	}
+	return d
+}
+
+// throttle is the failed authentications of an account or source address.
+type throttle struct {
+	Failures    int        `db:"failures"`
+	LastFailure *time.Time `db:"last_failure"`
+	LockedUntil *time.Time `db:"locked_until"`
+}
+
+// current gives the throttle as of now. Ended locks and failures older than
+// the lock duration are forgotten.
+func (t throttle) current(cfg LockoutConfig, now time.Time) throttle {
+	if t.LockedUntil != nil && !now.Before(*t.LockedUntil) {
+		return throttle{}
+	}
+	if t.LastFailure != nil && !now.Before(t.LastFailure.Add(cfg.LockDuration)) {
+		return throttle{}
+	}
+	return t
+}
+
+// blocked reports whether an attempt at now must fail without checking the
+// password. Attempts are only delayed after a failure when delay is set.
+func (t throttle) blocked(cfg LockoutConfig, now time.Time, delay bool) bool {
+	t = t.current(cfg, now)
+	if t.LockedUntil != nil {
+		return true
+	}
+	if delay && t.Failures > 0 && now.Before(t.LastFailure.Add(cfg.delay(t.Failures))) {
+		return true
+	}
+	return false
+}
+
+// fail records a failed attempt at now. The throttle is locked once it has
+// max failures.
+func (t throttle) fail(cfg LockoutConfig, max int, now time.Time) throttle {
+	t = t.current(cfg, now)
+
+	now = now.UTC()
+	t.Failures++
+	t.LastFailure = &now
+	if t.Failures >= max {
+		until := now.Add(cfg.LockDuration)
+		t.LockedUntil = &until
+	}
+	return t
+}
+
+// userThrottle gives the throttle of the account of u.
+func userThrottle(u User) throttle {
+	return throttle{
+		Failures:    u.LoginFailures,
+		LastFailure: u.LastLoginFailure,
+		LockedUntil: u.LockedUntil,
+	}
+}
+
+// record gives u after an authentication at now, which succeeded if ok.
+func (cfg LockoutConfig) record(u User, ok bool, now time.Time) User {
+	if ok {
+		login := now.UTC()
+		u.LastLogin = &login
+		u.LoginFailures = 0
+		u.LastLoginFailure = nil
+		u.LockedUntil = nil
+		return u
+	}
+
+	t := userThrottle(u).fail(cfg, cfg.MaxFailures, now)
+	u.LoginFailures = t.Failures
+	u.LastLoginFailure = t.LastFailure
+	u.LockedUntil = t.LockedUntil
+	return u
+}
+
+// passwordOnly reports whether a successful authentication of u does not log
+// them in because they still need to give a two-factor code or verify their
+// email, or are disabled. Their failures are kept until then so guessing
+// codes stays throttled.
+func passwordOnly(u User, ok bool) bool {
+	return ok && (u.MFAEnabled || u.Unverified || u.DisabledAt != nil)
+}
+
+// Unlock forgets the failed authentications of a user so they can try again
+// right away.
+func (s *DB) Unlock(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Unlock")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `UPDATE users SET
+		"login_failures" = 0,
+		"last_login_failure" = NULL,
+		"locked_until" = NULL,
+		"date_updated" = $2
+		WHERE user_id = $1 AND deleted_at IS NULL`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "unlocking user %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "unlocking user %s", id)
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserUnlocked, id, data, now)
+	})
+}
+
+// recordLogin keeps the outcome of an authentication of the account and the
+// source address.
+func (s *DB) recordLogin(ctx context.Context, tx *sqlx.Tx, u *User, source string, src throttle, ok bool, now time.Time) error {
+	if u != nil && !passwordOnly(*u, ok) {
+		if err := s.recordUser(ctx, tx, *u, ok, now); err != nil {
+			return err
+		}
+	}
+	if ok {
+		return nil
+	}
+
+	t := src.fail(s.lockout, s.lockout.MaxSourceFailures, now)
+	const q = `INSERT INTO login_sources
+		(source, failures, last_failure, locked_until)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (source) DO UPDATE SET
+			failures = excluded.failures,
+			last_failure = excluded.last_failure,
+			locked_until = excluded.locked_until`
+	if _, err := tx.ExecContext(ctx, q, source, t.Failures, t.LastFailure, t.LockedUntil); err != nil {
+		return errors.Wrapf(err, "recording failed login from %s", source)
+	}
+
+	return nil
+}
+
+// recordUser keeps the outcome of an authentication of the account of u.
+func (s *DB) recordUser(ctx context.Context, tx *sqlx.Tx, u User, ok bool, now time.Time) error {
+	u = s.lockout.record(u, ok, now)
+
+	const q = `UPDATE users SET
+		"login_failures" = $2,
+		"last_login_failure" = $3,
+		"locked_until" = $4,
+		"last_login" = $5
+		WHERE user_id = $1`
+	if _, err := tx.ExecContext(ctx, q, u.ID, u.LoginFailures, u.LastLoginFailure, u.LockedUntil, u.LastLogin); err != nil {
+		return errors.Wrapf(err, "recording login of user %s", u.ID)
+	}
+	return nil
+}
+
+// lockUser locks the row of u for the rest of tx and reads its throttle
+// again, so authentications of the account made at the same time are counted
+// one after the other.
+func lockUser(ctx context.Context, tx *sqlx.Tx, u *User) error {
+	const lock = `UPDATE users SET user_id = user_id WHERE user_id = $1`
+	if _, err := tx.ExecContext(ctx, lock, u.ID); err != nil {
+		return errors.Wrapf(err, "locking user %s", u.ID)
+	}
+
+	var t throttle
+	const q = `SELECT login_failures AS failures, last_login_failure AS last_failure, locked_until
+		FROM users WHERE user_id = $1`
+	if err := tx.GetContext(ctx, &t, q, u.ID); err != nil {
+		return errors.Wrapf(err, "selecting failed logins of user %s", u.ID)
+	}
+
+	u.LoginFailures = t.Failures
+	u.LastLoginFailure = t.LastFailure
+	u.LockedUntil = t.LockedUntil
+	return nil
+}
+
+// lockSource locks the throttle of the source address for the rest of tx and
+// reads it again. A source without a row only gets one to lock when the
+// attempt failed.
+func lockSource(ctx context.Context, tx *sqlx.Tx, source string, failed bool) (throttle, error) {
+	if failed {
+		const ins = `INSERT INTO login_sources (source, failures) VALUES ($1, 0)
+			ON CONFLICT (source) DO NOTHING`
+		if _, err := tx.ExecContext(ctx, ins, source); err != nil {
+			return throttle{}, errors.Wrapf(err, "inserting login source %s", source)
+		}
+	}
+
+	const lock = `UPDATE login_sources SET source = source WHERE source = $1`
+	if _, err := tx.ExecContext(ctx, lock, source); err != nil {
+		return throttle{}, errors.Wrapf(err, "locking login source %s", source)
+	}
+
+	var t throttle
+	const q = `SELECT failures, last_failure, locked_until FROM login_sources WHERE source = $1`
+	if err := tx.GetContext(ctx, &t, q, source); err != nil && err != sql.ErrNoRows {
+		return throttle{}, errors.Wrapf(err, "selecting failed logins from %s", source)
+	}
+	return t, nil
+}
+
+// sourceThrottle gives the throttle of the source address.
+func (s *DB) sourceThrottle(ctx context.Context, source string) (throttle, error) {
+	var t throttle
+	const q = `SELECT failures, last_failure, locked_until FROM login_sources WHERE source = $1`
+	if err := s.db.GetContext(ctx, &t, q, source); err != nil && err != sql.ErrNoRows {
+		return throttle{}, errors.Wrapf(err, "selecting failed logins from %s", source)
+	}
+	return t, nil
+}
+
+// Unlock forgets the failed authentications of a user so they can try again
+// right away.
+func (m *Memory) Unlock(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Unlock")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return ErrNotFound
+	}
+
+	u.LoginFailures = 0
+	u.LastLoginFailure = nil
+	u.LockedUntil = nil
+	u.DateUpdated = now.UTC()
+	m.users[id] = u
+
+	return nil
+}
@@ -0,0 +1,413 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/google/uuid"
+	"go.opencensus.io/trace"
+)
+
+// Memory is a Store that keeps Users in memory. It is safe for concurrent use
+// and is intended for tests and local development where running a database is
+// not practical.
+type Memory struct {
+	mu            sync.RWMutex
+	users         map[string]User
+	resets        map[string]pending
+	verifications map[string]pending
+	sources       map[string]throttle
+	recovery      map[string]map[string]bool
+	keys          map[string]APIKey
+	sessions      map[string]Session
+	identities    map[identity]identityLink
+	lockout       LockoutConfig
+	adminMFA      bool
+	domains       []string
+	passwords     passwords
+	emails        emails
+}
+
+// NewMemory constructs an empty in-memory Store. Zero values in the lockout
+// config are replaced with reasonable defaults.
+func NewMemory(cfg Config) *Memory {
+	return &Memory{
+		users:         make(map[string]User),
+		resets:        make(map[string]pending),
+		verifications: make(map[string]pending),
+		sources:       make(map[string]throttle),
+		recovery:      make(map[string]map[string]bool),
+		keys:          make(map[string]APIKey),
+		sessions:      make(map[string]Session),
+		identities:    make(map[identity]identityLink),
+		lockout:       cfg.Lockout.withDefaults(),
+		adminMFA:      cfg.AdminMFA,
+		domains:       cfg.SignupDomains,
+		passwords:     newPasswords(cfg),
+		emails:        newEmails(cfg),
+	}
+}
+
+// Load adds existing Users to the store as-is. It is used to seed the store
+// with known records.
+func (m *Memory) Load(users []User) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range users {
+		m.users[u.ID] = copyUser(u)
+	}
+}
+
+// List retrieves a list of existing users from the store. Deleted users are
+// only included when the filter asks for them.
+func (m *Memory) List(ctx context.Context, f Filter) ([]User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.List")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		if u.DeletedAt != nil && !f.IncludeDeleted {
+			continue
+		}
+		users = append(users, copyUser(u))
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].DateCreated.Before(users[j].DateCreated)
+	})
+
+	return users, nil
+}
+
+// Retrieve gets the specified user from the store. Deleted users are not
+// found.
+func (m *Memory) Retrieve(ctx context.Context, claims auth.Claims, id string) (*User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Retrieve")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	// If you are not an admin and looking to retrieve someone else then you are rejected.
+	if !claims.HasRole(auth.RoleAdmin) && claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	u = copyUser(u)
+	return &u, nil
+}
+
+// Create inserts a new user into the store. The claims must have every role
+// given to the user.
+func (m *Memory) Create(ctx context.Context, claims auth.Claims, n NewUser, now time.Time) (*User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Create")
+	defer span.End()
+
+	if err := checkRoles(claims, nil, n.Roles); err != nil {
+		return nil, err
+	}
+	email, err := m.emails.parse(n.Email)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := m.passwords.hash(n.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	u := User{
+		ID:           uuid.New().String(),
+		Name:         n.Name,
+		Email:        email,
+		PasswordHash: hash,
+		Roles:        n.Roles,
+		DateCreated:  now.UTC(),
+		DateUpdated:  now.UTC(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.emailTaken(u.Email, u.ID) {
+		return nil, ErrEmailTaken
+	}
+
+	m.users[u.ID] = copyUser(u)
+
+	return &u, nil
+}
+
+// Update replaces a user in the store. The claims must have every role added
+// to the user and the last admin keeps the ADMIN role.
+func (m *Memory) Update(ctx context.Context, claims auth.Claims, id string, upd UpdateUser, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Update")
+	defer span.End()
+
+	u, err := m.Retrieve(ctx, claims, id)
+	if err != nil {
+		return err
+	}
+
+	demoted, err := applyUpdate(m.emails, m.passwords, claims, u, upd, now)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.update(*u, demoted)
+}
+
+// update stores the changed u. The last admin can not be demoted. The caller
+// must hold the lock.
+func (m *Memory) update(u User, demoted bool) error {
+	if cur, ok := m.users[u.ID]; !ok || cur.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if demoted {
+		if err := m.lastAdmin(u.ID); err != nil {
+			return err
+		}
+	}
+	if m.emailTaken(u.Email, u.ID) {
+		return ErrEmailTaken
+	}
+
+	m.users[u.ID] = copyUser(u)
+
+	return nil
+}
+
+// Delete marks a user as deleted and revokes their sessions and API keys. The
+// last admin can not be deleted.
+func (m *Memory) Delete(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Delete")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return nil
+	}
+	if err := m.lastAdmin(id); err != nil {
+		return err
+	}
+
+	deleted := now.UTC()
+	u.DeletedAt = &deleted
+	m.users[id] = u
+
+	m.revokeSessions(id, now)
+	m.revokeAPIKeys(id, now)
+
+	return nil
+}
+
+// Restore returns a deleted user to the active set. Restoring a user that is
+// not deleted does nothing. It will error if the specified ID is invalid or
+// does not reference an existing User.
+func (m *Memory) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if u.DeletedAt == nil {
+		return nil
+	}
+
+	u.DeletedAt = nil
+	u.DateUpdated = now.UTC()
+	m.users[id] = u
+
+	return nil
+}
+
+// Purge permanently removes users that were deleted before the provided time.
+// It returns the number of users removed.
+func (m *Memory) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Purge")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for id, u := range m.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(before) {
+			delete(m.users, id)
+			n++
+		}
+	}
+	for h, r := range m.resets {
+		if _, ok := m.users[r.userID]; !ok {
+			delete(m.resets, h)
+		}
+	}
+	for h, v := range m.verifications {
+		if _, ok := m.users[v.userID]; !ok {
+			delete(m.verifications, h)
+		}
+	}
+	for id := range m.recovery {
+		if _, ok := m.users[id]; !ok {
+			delete(m.recovery, id)
+		}
+	}
+	for id, k := range m.keys {
+		if _, ok := m.users[k.UserID]; !ok {
+			delete(m.keys, id)
+		}
+	}
+	for id, sess := range m.sessions {
+		if _, ok := m.users[sess.UserID]; !ok {
+			delete(m.sessions, id)
+		}
+	}
+	for key, link := range m.identities {
+		if _, ok := m.users[link.userID]; !ok {
+			delete(m.identities, key)
+		}
+	}
+
+	return n, nil
+}
+
+// Authenticate finds a user by their email and verifies their password. On
+// success it returns a Claims value representing this user. The claims can be
+// used to generate a token for future authentication, or to complete the
+// login with VerifyMFA when they are a challenge. Failures are counted for the
+// account and the source address the attempt came from.
+func (m *Memory) Authenticate(ctx context.Context, now time.Time, email, password, source string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Authenticate")
+	defer span.End()
+
+	email = m.emails.normalize(email)
+
+	m.mu.RLock()
+	var u *User
+	for _, usr := range m.users {
+		if usr.Email == email && usr.DeletedAt == nil {
+			usr = copyUser(usr)
+			u = &usr
+			break
+		}
+	}
+	src := m.sources[source]
+	m.mu.RUnlock()
+
+	// Do not leak to an unauthenticated user which emails are in the system.
+	// Blocked attempts fail without looking at the password and are not
+	// counted.
+	blocked := src.blocked(m.lockout, now, false) || (u != nil && userThrottle(*u).blocked(m.lockout, now, true))
+	ok := m.passwords.check(u, password, blocked)
+	if blocked {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	// Now that we know the password, an outdated hash can be upgraded.
+	var hash []byte
+	if ok {
+		var err error
+		if hash, err = m.passwords.rehash(*u, password); err != nil {
+			return auth.Claims{}, err
+		}
+	}
+
+	var claims auth.Claims
+	var sess *Session
+	if ok && !u.Unverified && u.DisabledAt == nil {
+		claims = loginClaims(*u, m.adminMFA, now)
+		sess = startSession(&claims, source, now)
+	}
+
+	m.mu.Lock()
+	if sess != nil {
+		m.sessions[sess.ID] = *sess
+	}
+	if u != nil {
+		if cur, found := m.users[u.ID]; found && hash != nil && bytes.Equal(cur.PasswordHash, u.PasswordHash) {
+			cur.PasswordHash = hash
+			m.users[u.ID] = cur
+		}
+		if cur, found := m.users[u.ID]; found && !passwordOnly(cur, ok) {
+			m.users[u.ID] = m.lockout.record(cur, ok, now)
+		}
+	}
+	if !ok {
+		m.sources[source] = m.sources[source].fail(m.lockout, m.lockout.MaxSourceFailures, now)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+	if u.Unverified {
+		return auth.Claims{}, ErrUnverified
+	}
+	if u.DisabledAt != nil {
+		return auth.Claims{}, ErrDisabled
+	}
+
+	return claims, nil
+}
+
+// emailTaken reports if a user other than id already uses the email, in any
+// case like the unique index of the database. Deleted users keep their email
+// until they are purged. The caller must hold the lock.
+func (m *Memory) emailTaken(email, id string) bool {
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) && u.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUser returns a copy of u that shares no memory with the original so
+// callers can not modify the stored value.
+func copyUser(u User) User {
+	u.Roles = append([]string(nil), u.Roles...)
+	u.PasswordHash = append([]byte(nil), u.PasswordHash...)
+	for _, t := range []**time.Time{&u.TokensValidAfter, &u.LastLogin, &u.LastLoginFailure, &u.LockedUntil} {
+		if *t != nil {
+			c := **t
+			*t = &c
+		}
+	}
+	return u
+}
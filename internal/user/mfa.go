@@ -0,0 +1,537 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/ardanlabs/service/internal/platform/totp"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// ChallengeAudience is the audience of the claims Authenticate gives users
+// with two-factor authentication enabled. Their tokens are only good for
+// completing the login with VerifyMFA.
+const ChallengeAudience = "mfa"
+
+const (
+	challengeTTL      = 5 * time.Minute // How long a user has to give their code.
+	mfaIssuer         = "Garage Sale"   // The name authenticator apps show.
+	recoveryCodeCount = 10              // Recovery codes given on enrollment.
+)
+
+// loginClaims gives the claims for u after their password was verified. Users
+// with two-factor authentication enabled get a challenge instead. When admins
+// are required to use it, those who have not enrolled yet are not given the
+// ADMIN role.
+func loginClaims(u User, adminMFA bool, now time.Time) auth.Claims {
+	if u.MFAEnabled {
+		c := auth.NewClaims(u.ID, nil, now, challengeTTL)
+		c.Audience = ChallengeAudience
+		return c
+	}
+
+	roles := []string(u.Roles)
+	if adminMFA {
+		roles = make([]string, 0, len(u.Roles))
+		for _, r := range u.Roles {
+			if r != auth.RoleAdmin {
+				roles = append(roles, r)
+			}
+		}
+	}
+	return auth.NewClaims(u.ID, roles, now, time.Hour)
+}
+
+// newRecoveryCodes generates a set of random recovery codes. They are grouped
+// in fours to be easier to copy down.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, errors.Wrap(err, "generating recovery code")
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = c[0:4] + "-" + c[4:8] + "-" + c[8:12] + "-" + c[12:16]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode gives the form a recovery code is stored in. Codes are
+// compared without their dashes or case.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
+
+// checkCode compares code with the codes of the secret of u that have not
+// been used yet. It returns the period of the code when it matches. Recovery
+// codes never match.
+func checkCode(u User, code string, now time.Time) (int64, bool, error) {
+	if len(code) != totp.Digits || u.MFASecret == "" {
+		return 0, false, nil
+	}
+	return totp.Validate(u.MFASecret, code, now, u.MFALastStep)
+}
+
+// EnrollMFA starts the two-factor enrollment of the specified user with a new
+// secret. It can be started over until the enrollment is confirmed.
+func (s *DB) EnrollMFA(ctx context.Context, claims auth.Claims, id string, now time.Time) (*MFAEnrollment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.EnrollMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	var u User
+	const sel = `SELECT * FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+	if err := s.db.GetContext(ctx, &u, sel, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting user %q", id)
+	}
+	if u.MFAEnabled {
+		return nil, ErrMFAEnabled
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	const q = `UPDATE users SET
+		"mfa_secret" = $2,
+		"date_updated" = $3
+		WHERE user_id = $1 AND NOT mfa_enabled`
+	res, err := s.db.ExecContext(ctx, q, id, secret, now.UTC())
+	if err != nil {
+		return nil, errors.Wrapf(err, "enrolling user %q", id)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, errors.Wrapf(err, "enrolling user %q", id)
+	}
+	if n == 0 {
+		return nil, ErrMFAEnabled
+	}
+
+	e := MFAEnrollment{
+		Secret: secret,
+		URI:    totp.URI(mfaIssuer, u.Email, secret),
+	}
+	return &e, nil
+}
+
+// ConfirmMFA enables two-factor authentication for the specified user once
+// they give a code of the secret they enrolled with. It returns their recovery
+// codes, which are not kept in a form that can be shown again.
+func (s *DB) ConfirmMFA(ctx context.Context, claims auth.Claims, id, code string, now time.Time) ([]string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.ConfirmMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	var u User
+	const sel = `SELECT * FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+	if err := s.db.GetContext(ctx, &u, sel, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting user %q", id)
+	}
+
+	switch {
+	case u.MFAEnabled:
+		return nil, ErrMFAEnabled
+	case u.MFASecret == "":
+		return nil, ErrMFANotEnrolled
+	}
+
+	step, ok, err := checkCode(u, code, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+
+		// Requiring the secret that was checked keeps an enrollment that was
+		// started over in the meantime from being enabled.
+		const q = `UPDATE users SET
+			"mfa_enabled" = TRUE,
+			"mfa_last_step" = $3,
+			"date_updated" = $4
+			WHERE user_id = $1 AND mfa_secret = $2 AND NOT mfa_enabled`
+		res, err := tx.ExecContext(ctx, q, id, u.MFASecret, step, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "enabling two-factor authentication of user %q", id)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "enabling two-factor authentication of user %q", id)
+		}
+		if n == 0 {
+			return ErrInvalidMFACode
+		}
+
+		const del = `DELETE FROM mfa_recovery_codes WHERE user_id = $1`
+		if _, err := tx.ExecContext(ctx, del, id); err != nil {
+			return errors.Wrapf(err, "deleting recovery codes of user %q", id)
+		}
+
+		const ins = `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+		for _, c := range codes {
+			if _, err := tx.ExecContext(ctx, ins, id, hashRecoveryCode(c)); err != nil {
+				return errors.Wrapf(err, "inserting recovery code of user %q", id)
+			}
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserMFAEnabled, id, data, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableMFA turns off two-factor authentication for the specified user and
+// forgets their secret and recovery codes. Admins can disable it for users who
+// lost access to their codes.
+func (s *DB) DisableMFA(ctx context.Context, claims auth.Claims, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.DisableMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	// If you are not an admin and looking to disable someone else then you are rejected.
+	if !claims.HasRole(auth.RoleAdmin) && claims.Subject != id {
+		return ErrForbidden
+	}
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		const q = `UPDATE users SET
+			"mfa_secret" = '',
+			"mfa_enabled" = FALSE,
+			"mfa_last_step" = 0,
+			"date_updated" = $2
+			WHERE user_id = $1 AND deleted_at IS NULL`
+		res, err := tx.ExecContext(ctx, q, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "disabling two-factor authentication of user %q", id)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "disabling two-factor authentication of user %q", id)
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		const del = `DELETE FROM mfa_recovery_codes WHERE user_id = $1`
+		if _, err := tx.ExecContext(ctx, del, id); err != nil {
+			return errors.Wrapf(err, "deleting recovery codes of user %q", id)
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserMFADisabled, id, data, now)
+	})
+}
+
+// VerifyMFA completes a login given the challenge claims from Authenticate and
+// a code from the authenticator app or an unused recovery code. On success it
+// returns the claims of the user. Every failure is ErrAuthenticationFailure.
+func (s *DB) VerifyMFA(ctx context.Context, now time.Time, claims auth.Claims, code, source string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.VerifyMFA")
+	defer span.End()
+
+	if claims.Audience != ChallengeAudience {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	var u User
+	const sel = `SELECT * FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+	switch err := s.db.GetContext(ctx, &u, sel, claims.Subject); err {
+	case nil:
+	case sql.ErrNoRows:
+		return auth.Claims{}, ErrAuthenticationFailure
+	default:
+		return auth.Claims{}, errors.Wrapf(err, "selecting user %q", claims.Subject)
+	}
+
+	// Blocked attempts fail without looking at the code and are not counted.
+	if !u.MFAEnabled || u.DisabledAt != nil || checkIssued(claims, u.TokensValidAfter) != nil || userThrottle(u).blocked(s.lockout, now, true) {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	step, ok, err := checkCode(u, code, now)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	verified := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+	sess := startSession(&verified, source, now)
+
+	var blocked bool
+	err = database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+
+		// Codes tried at the same time are counted one after the other. One of
+		// them may have blocked this attempt since the user was read.
+		if err := lockUser(ctx, tx, &u); err != nil {
+			return err
+		}
+		if blocked = userThrottle(u).blocked(s.lockout, now, true); blocked {
+			return nil
+		}
+
+		// Using the code in the same statement that checks it keeps two
+		// concurrent logins from both succeeding with it.
+		var res sql.Result
+		var err error
+		if ok {
+			const q = `UPDATE users SET
+				"mfa_last_step" = $2
+				WHERE user_id = $1 AND mfa_last_step < $2`
+			res, err = tx.ExecContext(ctx, q, u.ID, step)
+		} else {
+			const q = `UPDATE mfa_recovery_codes SET
+				"used_at" = $3
+				WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+			res, err = tx.ExecContext(ctx, q, u.ID, hashRecoveryCode(code), now.UTC())
+		}
+		if err != nil {
+			return errors.Wrapf(err, "using two-factor code of user %q", u.ID)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "using two-factor code of user %q", u.ID)
+		}
+
+		ok = n == 1
+		if ok {
+			if err := insertSession(ctx, tx, sess); err != nil {
+				return err
+			}
+		}
+		return s.recordUser(ctx, tx, u, ok, now)
+	})
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if blocked || !ok {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	return verified, nil
+}
+
+// EnrollMFA starts the two-factor enrollment of the specified user with a new
+// secret. It can be started over until the enrollment is confirmed.
+func (m *Memory) EnrollMFA(ctx context.Context, claims auth.Claims, id string, now time.Time) (*MFAEnrollment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.EnrollMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	if u.MFAEnabled {
+		return nil, ErrMFAEnabled
+	}
+
+	u.MFASecret = secret
+	u.DateUpdated = now.UTC()
+	m.users[id] = u
+
+	e := MFAEnrollment{
+		Secret: secret,
+		URI:    totp.URI(mfaIssuer, u.Email, secret),
+	}
+	return &e, nil
+}
+
+// ConfirmMFA enables two-factor authentication for the specified user once
+// they give a code of the secret they enrolled with. It returns their recovery
+// codes, which are not kept in a form that can be shown again.
+func (m *Memory) ConfirmMFA(ctx context.Context, claims auth.Claims, id, code string, now time.Time) ([]string, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.ConfirmMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	if claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	switch {
+	case u.MFAEnabled:
+		return nil, ErrMFAEnabled
+	case u.MFASecret == "":
+		return nil, ErrMFANotEnrolled
+	}
+
+	step, ok, err := checkCode(u, code, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	u.MFAEnabled = true
+	u.MFALastStep = step
+	u.DateUpdated = now.UTC()
+	m.users[id] = u
+
+	hashes := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		hashes[hashRecoveryCode(c)] = false
+	}
+	m.recovery[id] = hashes
+
+	return codes, nil
+}
+
+// DisableMFA turns off two-factor authentication for the specified user and
+// forgets their secret and recovery codes. Admins can disable it for users who
+// lost access to their codes.
+func (m *Memory) DisableMFA(ctx context.Context, claims auth.Claims, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.DisableMFA")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	// If you are not an admin and looking to disable someone else then you are rejected.
+	if !claims.HasRole(auth.RoleAdmin) && claims.Subject != id {
+		return ErrForbidden
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return ErrNotFound
+	}
+
+	u.MFASecret = ""
+	u.MFAEnabled = false
+	u.MFALastStep = 0
+	u.DateUpdated = now.UTC()
+	m.users[id] = u
+	delete(m.recovery, id)
+
+	return nil
+}
+
+// VerifyMFA completes a login given the challenge claims from Authenticate and
+// a code from the authenticator app or an unused recovery code. On success it
+// returns the claims of the user. Every failure is ErrAuthenticationFailure.
+func (m *Memory) VerifyMFA(ctx context.Context, now time.Time, claims auth.Claims, code, source string) (auth.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.VerifyMFA")
+	defer span.End()
+
+	if claims.Audience != ChallengeAudience {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, found := m.users[claims.Subject]
+	if !found || u.DeletedAt != nil {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	// Blocked attempts fail without looking at the code and are not counted.
+	if !u.MFAEnabled || u.DisabledAt != nil || checkIssued(claims, u.TokensValidAfter) != nil || userThrottle(u).blocked(m.lockout, now, true) {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	step, ok, err := checkCode(u, code, now)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if ok {
+		u.MFALastStep = step
+	} else if used, exists := m.recovery[u.ID][hashRecoveryCode(code)]; exists && !used {
+		m.recovery[u.ID][hashRecoveryCode(code)] = true
+		ok = true
+	}
+
+	m.users[u.ID] = m.lockout.record(u, ok, now)
+	if !ok {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	verified := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+	sess := startSession(&verified, source, now)
+	m.sessions[sess.ID] = *sess
+
+	return verified, nil
+}
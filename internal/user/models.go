@@ -15,6 +15,100 @@ type User struct {
 	PasswordHash []byte         `db:"password_hash" json:"-"`
 	DateCreated  time.Time      `db:"date_created" json:"date_created"`
 	DateUpdated  time.Time      `db:"date_updated" json:"date_updated"`
+	DeletedAt    *time.Time     `db:"deleted_at" json:"deleted_at,omitempty"`
+
+	// TokensValidAfter is when the password was last reset. Tokens issued
+	// before then are no longer accepted.
+	TokensValidAfter *time.Time `db:"tokens_valid_after" json:"-"`
+
+	// LastLogin is the time of the last successful authentication. The
+	// failures since then slow down and lock out further attempts.
+	LastLogin        *time.Time `db:"last_login" json:"last_login,omitempty"`
+	LoginFailures    int        `db:"login_failures" json:"-"`
+	LastLoginFailure *time.Time `db:"last_login_failure" json:"-"`
+	LockedUntil      *time.Time `db:"locked_until" json:"locked_until,omitempty"`
+
+	// MFASecret is the TOTP secret of a user who started enrolling in
+	// two-factor authentication. Logging in only asks for a code once the
+	// enrollment is confirmed and MFAEnabled is set. MFALastStep is the period
+	// of the last code used so no code is accepted twice.
+	MFASecret   string `db:"mfa_secret" json:"-"`
+	MFAEnabled  bool   `db:"mfa_enabled" json:"mfa_enabled"`
+	MFALastStep int64  `db:"mfa_last_step" json:"-"`
+
+	// Unverified is set for users who signed up themselves until they verify
+	// their email. They can not authenticate until then.
+	Unverified bool `db:"unverified" json:"unverified,omitempty"`
+
+	// DisabledAt is when an admin disabled the user, who can not authenticate
+	// or use their tokens until they are enabled again. DisabledReason says
+	// why.
+	DisabledAt     *time.Time `db:"disabled_at" json:"disabled_at,omitempty"`
+	DisabledReason string     `db:"disabled_reason" json:"disabled_reason,omitempty"`
+}
+
+// External is someone an external identity provider vouched for. Roles are
+// the roles the provider gives them.
+type External struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Roles         []string
+}
+
+// Config controls the policies of a Store.
+type Config struct {
+	Lockout LockoutConfig // How failed authentications are throttled.
+
+	// AdminMFA requires admins to use two-factor authentication. Until they
+	// enroll, the tokens they get do not carry the ADMIN role.
+	AdminMFA bool
+
+	// SignupDomains are the email domains people can sign up with. Any domain
+	// is allowed when it is empty.
+	SignupDomains []string
+
+	Password PasswordPolicy // What new passwords must look like.
+
+	// Hasher hashes new passwords. The hashes of users who authenticate are
+	// upgraded when they were made with another algorithm or cost. It is
+	// bcrypt with its default cost when nil.
+	Hasher Hasher
+
+	// StripPlusTags drops the +tag from the local part of emails so
+	// jo+sales@example.com and jo@example.com are the same user. Stored
+	// emails are not changed, so it is set when installing; CheckEmails
+	// finds users stored with a tag before it was set.
+	StripPlusTags bool
+}
+
+// PasswordPolicy controls which passwords users can choose. Its zero value
+// allows any password. Character classes are lower case and upper case
+// letters, digits and everything else. Breached passwords are compared
+// without regard to case.
+type PasswordPolicy struct {
+	MinLength  int      // Fewest characters of a password.
+	MinClasses int      // Fewest character classes a password uses.
+	Breached   []string // Known passwords that must not be used.
+}
+
+// LockoutConfig controls how failed authentications are slowed down. Every
+// failure of an account or source address makes the next attempt wait twice
+// as long as the last one and enough failures lock it out. Failures are
+// forgotten once the lock duration passed since the last one.
+type LockoutConfig struct {
+	MaxFailures       int           // Failures of an account before it is locked.
+	MaxSourceFailures int           // Failures from a source address before it is locked.
+	LockDuration      time.Duration // How long a lock lasts.
+	BaseDelay         time.Duration // Wait after the first failure.
+	MaxDelay          time.Duration // Upper bound of the wait between attempts.
+}
+
+// Filter narrows the set of Users returned by a List.
+type Filter struct {
+	IncludeDeleted bool // Also return Users that have been deleted.
 }
 
 // NewUser contains information needed to create a new User.
@@ -26,6 +120,15 @@ type NewUser struct {
 	PasswordConfirm string   `json:"password_confirm" validate:"eqfield=Password"`
 }
 
+// NewRegistration contains information needed for someone to sign up. They
+// always get the USER role.
+type NewRegistration struct {
+	Name            string `json:"name" validate:"required"`
+	Email           string `json:"email" validate:"required"`
+	Password        string `json:"password" validate:"required"`
+	PasswordConfirm string `json:"password_confirm" validate:"eqfield=Password"`
+}
+
 // UpdateUser defines what information may be provided to modify an existing
 // User. All fields are optional so clients can send just the fields they want
 // changed. It uses pointer fields so we can differentiate between a field that
@@ -39,3 +142,129 @@ type UpdateUser struct {
 	Password        *string  `json:"password"`
 	PasswordConfirm *string  `json:"password_confirm" validate:"omitempty,eqfield=Password"`
 }
+
+// UpdateProfile defines what Users may change about themselves. Like
+// UpdateUser all fields are optional. Changing the email or password requires
+// the CurrentPassword.
+type UpdateProfile struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	PasswordConfirm *string `json:"password_confirm" validate:"omitempty,eqfield=Password"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+// PasswordReset is a single use Token that lets a User set a new password
+// without knowing their current one. Only a hash of the Token is stored so it
+// is only known when the reset is requested.
+type PasswordReset struct {
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Token     string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RequestReset is what a User gives to be sent a PasswordReset.
+type RequestReset struct {
+	Email string `json:"email" validate:"required"`
+}
+
+// ConfirmReset is what a User gives to set a new password with the Token of
+// a PasswordReset.
+type ConfirmReset struct {
+	Token           string `json:"token" validate:"required"`
+	Password        string `json:"password" validate:"required"`
+	PasswordConfirm string `json:"password_confirm" validate:"eqfield=Password"`
+}
+
+// Verification is a single use Token that verifies the email of a User who
+// signed up. Only a hash of the Token is stored so it is only known when the
+// verification is created.
+type Verification struct {
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Token     string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RequestVerification is what a User gives to be sent a new Verification.
+type RequestVerification struct {
+	Email string `json:"email" validate:"required"`
+}
+
+// VerifyEmail is what a User gives to verify their email with the Token of a
+// Verification.
+type VerifyEmail struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// MFAEnrollment is the secret a User adds to their authenticator app to
+// enroll in two-factor authentication. URI is the otpauth form apps read from
+// QR codes.
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// MFACode is a code from the authenticator app of a User or one of their
+// recovery codes.
+type MFACode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// RecoveryCodes can each be used once instead of a code from the
+// authenticator app, like when the device with the app is lost. They are only
+// shown when two-factor authentication is enabled.
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// APIKey lets a machine client act as a User without their password. Only a
+// hash of the secret is stored so Key, the full key, is only known when the
+// APIKey is created. Scopes are the roles of the User the key can use.
+type APIKey struct {
+	ID          string         `db:"key_id" json:"id"`
+	UserID      string         `db:"user_id" json:"user_id"`
+	Name        string         `db:"name" json:"name"`
+	Prefix      string         `db:"prefix" json:"prefix"`
+	SecretHash  string         `db:"secret_hash" json:"-"`
+	Scopes      pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt   *time.Time     `db:"expires_at" json:"expires_at,omitempty"`
+	LastUsed    *time.Time     `db:"last_used" json:"last_used,omitempty"`
+	RevokedAt   *time.Time     `db:"revoked_at" json:"revoked_at,omitempty"`
+	DateCreated time.Time      `db:"date_created" json:"date_created"`
+	Key         string         `db:"-" json:"key,omitempty"`
+}
+
+// NewAPIKey is what a User gives to create an APIKey. Keys without an expiry
+// last until they are revoked.
+type NewAPIKey struct {
+	Name      string     `json:"name" validate:"required"`
+	Scopes    []string   `json:"scopes" validate:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Disable is what an admin provides to disable a User.
+type Disable struct {
+	Reason string `json:"reason" validate:"required"`
+}
+
+// Transfer is what an admin provides to hand the products of a User to
+// another User.
+type Transfer struct {
+	UserID string `json:"user_id" validate:"required"`
+}
+
+// Session is a login of a User. Every token given for a password, or for a
+// two-factor code, belongs to a new Session that ends when the token expires
+// or the Session is revoked.
+type Session struct {
+	ID          string     `db:"session_id" json:"id"`
+	UserID      string     `db:"user_id" json:"user_id"`
+	Source      string     `db:"source" json:"source"` // Address the login came from.
+	ExpiresAt   time.Time  `db:"expires_at" json:"expires_at"`
+	RevokedAt   *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+	DateCreated time.Time  `db:"date_created" json:"date_created"`
+}
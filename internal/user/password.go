@@ -0,0 +1,280 @@
+package user
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher hashes passwords for storage. Hashes made by any of the supported
+// algorithms can be checked whichever Hasher a Store uses, so switching to
+// another algorithm or cost keeps existing passwords working.
+type Hasher interface {
+
+	// Hash gives the hash of the password to store.
+	Hash(password string) ([]byte, error)
+
+	// Outdated reports whether hash was made with another algorithm or cost
+	// than Hash uses now.
+	Outdated(hash []byte) bool
+}
+
+// Bcrypt is a Hasher using bcrypt with the given cost.
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash gives the bcrypt hash of the password.
+func (b Bcrypt) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+}
+
+// Outdated reports whether hash is not a bcrypt hash of the same cost.
+func (b Bcrypt) Outdated(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != b.Cost
+}
+
+// Argon2id is a Hasher using argon2id. Time is the cost, the number of passes
+// over Memory KiB made by Threads threads.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// argon2idPrefix starts every argon2id hash in the PHC string format.
+const argon2idPrefix = "$argon2id$"
+
+// Hash gives the argon2id hash of the password with a random salt in the PHC
+// string format.
+func (a Argon2id) Hash(password string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "generating salt")
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, 32)
+	hash := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return []byte(hash), nil
+}
+
+// Outdated reports whether hash is not an argon2id hash with the same
+// parameters.
+func (a Argon2id) Outdated(hash []byte) bool {
+	p, _, _, err := parseArgon2id(hash)
+	return err != nil || p != a
+}
+
+// parseArgon2id gives the parameters, salt and key of an argon2id hash.
+func parseArgon2id(hash []byte) (Argon2id, []byte, []byte, error) {
+	var a Argon2id
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return a, nil, nil, errors.New("not an argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.Memory, &a.Time, &a.Threads); err != nil {
+		return a, nil, nil, errors.Wrap(err, "parsing argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return a, nil, nil, errors.Wrap(err, "decoding argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return a, nil, nil, errors.Wrap(err, "decoding argon2id key")
+	}
+	return a, salt, key, nil
+}
+
+// NewHasher gives the Hasher of the named algorithm, bcrypt or argon2id,
+// with the given cost. A cost of zero uses the default of the algorithm.
+func NewHasher(algorithm string, cost int) (Hasher, error) {
+	switch algorithm {
+	case "bcrypt":
+		if cost == 0 {
+			cost = bcrypt.DefaultCost
+		}
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, errors.Errorf("bcrypt cost %d is not between %d and %d", cost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return Bcrypt{Cost: cost}, nil
+	case "argon2id":
+		if cost == 0 {
+			cost = 3
+		}
+		if cost < 1 {
+			return nil, errors.Errorf("argon2id cost %d is not positive", cost)
+		}
+		return Argon2id{Time: uint32(cost), Memory: 64 * 1024, Threads: 4}, nil
+	default:
+		return nil, errors.Errorf("unknown password hashing algorithm %q", algorithm)
+	}
+}
+
+// ReadBreached reads a list of breached passwords, one per line, to use as
+// the Breached passwords of a PasswordPolicy.
+func ReadBreached(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening breached passwords")
+	}
+	defer f.Close()
+
+	var breached []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			breached = append(breached, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading breached passwords")
+	}
+	return breached, nil
+}
+
+// passwords checks new passwords against the policy and hashes them.
+type passwords struct {
+	minLength  int
+	minClasses int
+	breached   map[string]bool
+	hasher     Hasher
+
+	// dummy is compared against when there is no password to check so every
+	// failed authentication takes as long as a wrong password. Otherwise the
+	// response time would tell which emails are in the system or locked.
+	dummy []byte
+}
+
+// newPasswords prepares the policy and hasher of cfg. Without a Hasher
+// passwords are hashed with bcrypt at its default cost.
+func newPasswords(cfg Config) passwords {
+	p := passwords{
+		minLength:  cfg.Password.MinLength,
+		minClasses: cfg.Password.MinClasses,
+		breached:   make(map[string]bool, len(cfg.Password.Breached)),
+		hasher:     cfg.Hasher,
+	}
+	if p.hasher == nil {
+		p.hasher = Bcrypt{Cost: bcrypt.DefaultCost}
+	}
+	for _, b := range cfg.Password.Breached {
+		p.breached[strings.ToLower(b)] = true
+	}
+
+	// A hasher that fails here fails every Hash as well, which is reported
+	// then. The dummy is only compared against.
+	p.dummy, _ = p.hasher.Hash("dummy password")
+	return p
+}
+
+// validate checks password against the policy.
+func (p passwords) validate(password string) error {
+	if utf8.RuneCountInString(password) < p.minLength {
+		return ErrPasswordTooShort
+	}
+
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.minClasses {
+		return ErrPasswordTooSimple
+	}
+
+	if p.breached[strings.ToLower(password)] {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+// hash validates password against the policy and gives its hash.
+func (p passwords) hash(password string) ([]byte, error) {
+	if err := p.validate(password); err != nil {
+		return nil, err
+	}
+	hash, err := p.hasher.Hash(password)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating password hash")
+	}
+	return hash, nil
+}
+
+// check compares the password with the hash of u unless the attempt is
+// blocked. A comparison is made either way so the outcome can not be told
+// apart by its timing.
+func (p passwords) check(u *User, password string, blocked bool) bool {
+	if u == nil || blocked {
+		compare(p.dummy, password)
+		return false
+	}
+	return compare(u.PasswordHash, password)
+}
+
+// rehash gives a new hash of the password of u, who just authenticated with
+// it, when their hash is outdated and nil otherwise. The policy is not applied
+// since the password is already in use.
+func (p passwords) rehash(u User, password string) ([]byte, error) {
+	if !p.hasher.Outdated(u.PasswordHash) {
+		return nil, nil
+	}
+	hash, err := p.hasher.Hash(password)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating password hash")
+	}
+	return hash, nil
+}
+
+// compare reports whether hash, made by any supported algorithm, is a hash of
+// the password.
+func compare(hash []byte, password string) bool {
+	if !bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+
+	a, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	got := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+// upgradeHash replaces the outdated hash of u. It is left alone when the
+// password was changed in the meantime.
+func (s *DB) upgradeHash(ctx context.Context, tx *sqlx.Tx, u User, hash []byte) error {
+	const q = `UPDATE users SET
+		"password_hash" = $3
+		WHERE user_id = $1 AND password_hash = $2`
+	if _, err := tx.ExecContext(ctx, q, u.ID, u.PasswordHash, hash); err != nil {
+		return errors.Wrapf(err, "upgrading password hash of user %s", u.ID)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/jmoiron/sqlx"
+	"go.opencensus.io/trace"
+)
+
+// needsPassword reports whether upd changes how the user logs in, which takes
+// their current password.
+func needsPassword(upd UpdateProfile) bool {
+	return upd.Email != nil || upd.Password != nil
+}
+
+// profileUpdate gives the UpdateUser that makes the changes of upd to the
+// profile of a user.
+func profileUpdate(upd UpdateProfile) UpdateUser {
+	return UpdateUser{
+		Name:            upd.Name,
+		Email:           upd.Email,
+		Password:        upd.Password,
+		PasswordConfirm: upd.PasswordConfirm,
+	}
+}
+
+// UpdateProfile changes the profile of the user of the claims. Their current
+// password is needed to change their email or password and wrong ones count
+// as failed authentications of the account, which is ErrWrongPassword while
+// it is locked. Changing the password revokes the other sessions of the user.
+func (s *DB) UpdateProfile(ctx context.Context, claims auth.Claims, upd UpdateProfile, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.UpdateProfile")
+	defer span.End()
+
+	u, err := s.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		return err
+	}
+
+	if needsPassword(upd) {
+		if err := s.checkPassword(ctx, u, upd.CurrentPassword, now); err != nil {
+			return err
+		}
+	}
+
+	demoted, err := applyUpdate(s.emails, s.passwords, claims, u, profileUpdate(upd), now)
+	if err != nil {
+		return err
+	}
+
+	// The new password and the end of the other sessions are committed
+	// together so a stolen session can not outlive the change.
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if err := s.update(ctx, tx, *u, demoted, now); err != nil {
+			return err
+		}
+		if upd.Password == nil {
+			return nil
+		}
+		return revokeOtherSessions(ctx, tx, u.ID, claims.Id, now)
+	})
+}
+
+// checkPassword is ErrWrongPassword unless the password is the current one of
+// u. Failures are counted for the account like those of Authenticate.
+func (s *DB) checkPassword(ctx context.Context, u *User, password string, now time.Time) error {
+	blocked := userThrottle(*u).blocked(s.lockout, now, true)
+	if s.passwords.check(u, password, blocked) {
+		return nil
+	}
+	if blocked {
+		return ErrWrongPassword
+	}
+
+	// Failures made at the same time are counted one after the other.
+	err := database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if err := lockUser(ctx, tx, u); err != nil {
+			return err
+		}
+		if userThrottle(*u).blocked(s.lockout, now, true) {
+			return nil
+		}
+		return s.recordUser(ctx, tx, *u, false, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ErrWrongPassword
+}
+
+// UpdateProfile changes the profile of the user of the claims. Their current
+// password is needed to change their email or password and wrong ones count
+// as failed authentications of the account, which is ErrWrongPassword while
+// it is locked. Changing the password revokes the other sessions of the user.
+func (m *Memory) UpdateProfile(ctx context.Context, claims auth.Claims, upd UpdateProfile, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.UpdateProfile")
+	defer span.End()
+
+	u, err := m.Retrieve(ctx, claims, claims.Subject)
+	if err != nil {
+		return err
+	}
+
+	if needsPassword(upd) {
+		if err := m.checkPassword(u, upd.CurrentPassword, now); err != nil {
+			return err
+		}
+	}
+
+	demoted, err := applyUpdate(m.emails, m.passwords, claims, u, profileUpdate(upd), now)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.update(*u, demoted); err != nil {
+		return err
+	}
+	if upd.Password != nil {
+		m.revokeOtherSessions(u.ID, claims.Id, now)
+	}
+	return nil
+}
+
+// checkPassword is ErrWrongPassword unless the password is the current one of
+// u. Failures are counted for the account like those of Authenticate.
+func (m *Memory) checkPassword(u *User, password string, now time.Time) error {
+	blocked := userThrottle(*u).blocked(m.lockout, now, true)
+	if m.passwords.check(u, password, blocked) {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Another failure may have locked the account since it was read.
+	if cur, ok := m.users[u.ID]; ok && !blocked && !userThrottle(cur).blocked(m.lockout, now, true) {
+		m.users[u.ID] = m.lockout.record(cur, false, now)
+	}
+	return ErrWrongPassword
+}
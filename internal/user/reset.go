@@ -0,0 +1,302 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// CheckClaims verifies the token the claims came from is still in force. The
+// tokens of deleted and unknown users never are. It runs on every
+// authenticated request so it only reads a few columns.
+func (s *DB) CheckClaims(ctx context.Context, claims auth.Claims) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.CheckClaims")
+	defer span.End()
+
+	var u struct {
+		TokensValidAfter *time.Time `db:"tokens_valid_after"`
+		DisabledAt       *time.Time `db:"disabled_at"`
+		DeletedAt        *time.Time `db:"deleted_at"`
+	}
+	const q = `SELECT tokens_valid_after, disabled_at, deleted_at FROM users WHERE user_id = $1`
+	if err := s.db.GetContext(ctx, &u, q, claims.Subject); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTokenRevoked
+		}
+		return errors.Wrapf(err, "selecting user %q", claims.Subject)
+	}
+
+	if u.DeletedAt != nil {
+		return ErrTokenRevoked
+	}
+	if u.DisabledAt != nil {
+		return ErrDisabled
+	}
+	if err := checkIssued(claims, u.TokensValidAfter); err != nil {
+		return err
+	}
+	return s.checkSession(ctx, claims)
+}
+
+// RequestReset creates a PasswordReset for the active user with the email.
+// The token expires after ttl.
+func (s *DB) RequestReset(ctx context.Context, email string, ttl time.Duration, now time.Time) (*PasswordReset, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.RequestReset")
+	defer span.End()
+
+	var u User
+	const q = `SELECT * FROM users WHERE email = $1 AND deleted_at IS NULL`
+	if err := s.db.GetContext(ctx, &u, q, s.emails.normalize(email)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "selecting single user")
+	}
+
+	pr, err := newReset(u, ttl, now)
+	if err != nil {
+		return nil, err
+	}
+
+	const ins = `INSERT INTO password_resets
+		(token_hash, user_id, expires_at, date_created)
+		VALUES ($1, $2, $3, $4)`
+	if _, err := s.db.ExecContext(ctx, ins, hashToken(pr.Token), u.ID, pr.ExpiresAt, now.UTC()); err != nil {
+		return nil, errors.Wrap(err, "inserting password reset")
+	}
+
+	return pr, nil
+}
+
+// ConfirmReset sets the password of the user a reset token was issued to. The
+// token must not have expired or been used. Every other token of the user is
+// used up, the tokens and API keys issued to them so far are revoked and their
+// account is unlocked.
+func (s *DB) ConfirmReset(ctx context.Context, token, password string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.ConfirmReset")
+	defer span.End()
+
+	hash, err := s.passwords.hash(password)
+	if err != nil {
+		return err
+	}
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+
+		// Using the token in the same statement that checks it keeps two
+		// concurrent confirmations from both succeeding.
+		const use = `UPDATE password_resets SET
+			"used_at" = $2
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2`
+		res, err := tx.ExecContext(ctx, use, hashToken(token), now.UTC())
+		if err != nil {
+			return errors.Wrap(err, "using password reset")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "using password reset")
+		}
+		if n == 0 {
+			return ErrInvalidResetToken
+		}
+
+		var id string
+		const sel = `SELECT user_id FROM password_resets WHERE token_hash = $1`
+		if err := tx.GetContext(ctx, &id, sel, hashToken(token)); err != nil {
+			return errors.Wrap(err, "selecting password reset")
+		}
+
+		const upd = `UPDATE users SET
+			"password_hash" = $2,
+			"tokens_valid_after" = $3,
+			"login_failures" = 0,
+			"last_login_failure" = NULL,
+			"locked_until" = NULL,
+			"date_updated" = $3
+			WHERE user_id = $1 AND deleted_at IS NULL`
+		res, err = tx.ExecContext(ctx, upd, id, hash, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "resetting password of user %q", id)
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return errors.Wrapf(err, "resetting password of user %q", id)
+		}
+		if n == 0 {
+			return ErrInvalidResetToken
+		}
+
+		const rest = `UPDATE password_resets SET
+			"used_at" = $2
+			WHERE user_id = $1 AND used_at IS NULL`
+		if _, err := tx.ExecContext(ctx, rest, id, now.UTC()); err != nil {
+			return errors.Wrapf(err, "using password resets of user %q", id)
+		}
+
+		if err := revokeSessions(ctx, tx, id, now); err != nil {
+			return err
+		}
+		if err := revokeAPIKeys(ctx, tx, id, now); err != nil {
+			return err
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserPasswordReset, id, data, now)
+	})
+}
+
+// pending is a single use token kept by Memory, like the token of a
+// PasswordReset or a Verification.
+type pending struct {
+	userID    string
+	expiresAt time.Time
+	used      bool
+}
+
+// CheckClaims verifies the token the claims came from is still in force. The
+// tokens of deleted and unknown users never are.
+func (m *Memory) CheckClaims(ctx context.Context, claims auth.Claims) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.CheckClaims")
+	defer span.End()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[claims.Subject]
+	if !ok || u.DeletedAt != nil {
+		return ErrTokenRevoked
+	}
+	if u.DisabledAt != nil {
+		return ErrDisabled
+	}
+	if err := checkIssued(claims, u.TokensValidAfter); err != nil {
+		return err
+	}
+	return m.checkSession(claims)
+}
+
+// RequestReset creates a PasswordReset for the active user with the email.
+// The token expires after ttl.
+func (m *Memory) RequestReset(ctx context.Context, email string, ttl time.Duration, now time.Time) (*PasswordReset, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.RequestReset")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Email != m.emails.normalize(email) || u.DeletedAt != nil {
+			continue
+		}
+
+		pr, err := newReset(u, ttl, now)
+		if err != nil {
+			return nil, err
+		}
+		m.resets[hashToken(pr.Token)] = pending{userID: u.ID, expiresAt: pr.ExpiresAt}
+		return pr, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// ConfirmReset sets the password of the user a reset token was issued to. The
+// token must not have expired or been used. Every other token of the user is
+// used up, the tokens and API keys issued to them so far are revoked and their
+// account is unlocked.
+func (m *Memory) ConfirmReset(ctx context.Context, token, password string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.ConfirmReset")
+	defer span.End()
+
+	hash, err := m.passwords.hash(password)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.resets[hashToken(token)]
+	if !ok || r.used || !r.expiresAt.After(now) {
+		return ErrInvalidResetToken
+	}
+	u, ok := m.users[r.userID]
+	if !ok || u.DeletedAt != nil {
+		return ErrInvalidResetToken
+	}
+
+	for h, r := range m.resets {
+		if r.userID == u.ID {
+			r.used = true
+			m.resets[h] = r
+		}
+	}
+
+	valid := now.UTC()
+	u.PasswordHash = hash
+	u.TokensValidAfter = &valid
+	u.LoginFailures = 0
+	u.LastLoginFailure = nil
+	u.LockedUntil = nil
+	u.DateUpdated = valid
+	m.users[u.ID] = u
+
+	m.revokeSessions(u.ID, now)
+	m.revokeAPIKeys(u.ID, now)
+
+	return nil
+}
+
+// newReset generates a PasswordReset for u with a random token.
+func newReset(u User, ttl time.Duration, now time.Time) (*PasswordReset, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generating reset token")
+	}
+
+	pr := PasswordReset{
+		UserID:    u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Token:     token,
+		ExpiresAt: now.Add(ttl).UTC(),
+	}
+	return &pr, nil
+}
+
+// newToken generates a random token that can be sent in a URL.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken gives the form a single use token is stored in. The tokens are
+// random so a fast hash is enough to keep a leaked table from being usable.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkIssued gives ErrTokenRevoked for claims issued before after. Tokens
+// only record the second they were issued in, so tokens issued within the
+// second of a reset are still accepted.
+func checkIssued(claims auth.Claims, after *time.Time) error {
+	if after != nil && claims.IssuedAt < after.Unix() {
+		return ErrTokenRevoked
+	}
+	return nil
+}
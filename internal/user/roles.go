@@ -0,0 +1,89 @@
+package user
+
+import (
+	"context"
+
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// hasRole reports whether role is one of roles.
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRoles reports why claims can not change the roles of a user from
+// current to roles. Every role must be known and the ones being added must be
+// held by claims so nobody grants more than they have.
+func checkRoles(claims auth.Claims, current, roles []string) error {
+	for _, r := range roles {
+		if !auth.ValidRole(r) {
+			return ErrInvalidRole
+		}
+	}
+	for _, r := range roles {
+		if !hasRole(current, r) && !claims.HasRole(r) {
+			return ErrRoleNotHeld
+		}
+	}
+	return nil
+}
+
+// onlyAdmin is ErrLastAdmin when the user with the id is the only one of the
+// active admins with the ids, who can not lose the role.
+func onlyAdmin(ids []string, id string) error {
+	if len(ids) == 1 && ids[0] == id {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// lastAdmin is ErrLastAdmin when the user with the id is the only active
+// admin in tx. Deleted and disabled users are not active. The admins stay
+// locked until tx ends so two of them can not take the role from each other
+// at the same time. Their roles are matched loosely in the lock, which works
+// on the text form of the array in every database, and exactly after.
+func (s *DB) lastAdmin(ctx context.Context, tx *sqlx.Tx, id string) error {
+	const lock = `UPDATE users SET user_id = user_id
+		WHERE deleted_at IS NULL AND disabled_at IS NULL
+		AND CAST(roles AS TEXT) LIKE $1`
+	if _, err := tx.ExecContext(ctx, lock, "%"+auth.RoleAdmin+"%"); err != nil {
+		return errors.Wrap(err, "locking admins")
+	}
+
+	var users []struct {
+		ID    string         `db:"user_id"`
+		Roles pq.StringArray `db:"roles"`
+	}
+	const q = `SELECT user_id, roles FROM users WHERE deleted_at IS NULL AND disabled_at IS NULL`
+	if err := tx.SelectContext(ctx, &users, q); err != nil {
+		return errors.Wrap(err, "selecting admins")
+	}
+
+	var ids []string
+	for _, u := range users {
+		if hasRole(u.Roles, auth.RoleAdmin) {
+			ids = append(ids, u.ID)
+		}
+	}
+	return onlyAdmin(ids, id)
+}
+
+// lastAdmin is ErrLastAdmin when the user with the id is the only active
+// admin. The caller must hold the lock.
+func (m *Memory) lastAdmin(id string) error {
+	var ids []string
+	for _, u := range m.users {
+		if u.DeletedAt == nil && u.DisabledAt == nil && hasRole(u.Roles, auth.RoleAdmin) {
+			ids = append(ids, u.ID)
+		}
+	}
+	return onlyAdmin(ids, id)
+}
@@ -0,0 +1,416 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// startSession gives the Session the claims of a login from source belong to
+// and sets their ID to it. Challenges do not start a Session; the claims
+// VerifyMFA exchanges them for do.
+func startSession(claims *auth.Claims, source string, now time.Time) *Session {
+	if claims.Audience == ChallengeAudience {
+		return nil
+	}
+
+	claims.Id = uuid.New().String()
+	sess := Session{
+		ID:          claims.Id,
+		UserID:      claims.Subject,
+		Source:      source,
+		ExpiresAt:   time.Unix(claims.ExpiresAt, 0).UTC(),
+		DateCreated: now.UTC(),
+	}
+	return &sess
+}
+
+// insertSession stores sess.
+func insertSession(ctx context.Context, tx *sqlx.Tx, sess *Session) error {
+	const q = `INSERT INTO sessions
+		(session_id, user_id, source, expires_at, date_created)
+		VALUES ($1, $2, $3, $4, $5)`
+	if _, err := tx.ExecContext(ctx, q, sess.ID, sess.UserID, sess.Source, sess.ExpiresAt, sess.DateCreated); err != nil {
+		return errors.Wrap(err, "inserting session")
+	}
+	return nil
+}
+
+// revokeSessions revokes every session of the user with the id.
+func revokeSessions(ctx context.Context, tx *sqlx.Tx, id string, now time.Time) error {
+	const q = `UPDATE sessions SET
+		"revoked_at" = $2
+		WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, q, id, now.UTC()); err != nil {
+		return errors.Wrapf(err, "revoking sessions of user %q", id)
+	}
+	return nil
+}
+
+// revokeOtherSessions revokes every session of the user with the id except
+// the one with the keep ID. All of them are revoked when keep is empty.
+func revokeOtherSessions(ctx context.Context, tx *sqlx.Tx, id, keep string, now time.Time) error {
+	if keep == "" {
+		return revokeSessions(ctx, tx, id, now)
+	}
+
+	const q = `UPDATE sessions SET
+		"revoked_at" = $3
+		WHERE user_id = $1 AND session_id <> $2 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, q, id, keep, now.UTC()); err != nil {
+		return errors.Wrapf(err, "revoking other sessions of user %q", id)
+	}
+	return nil
+}
+
+// checkSession reports ErrTokenRevoked when the claims belong to a Session
+// that was revoked. Claims without an ID were not given for a login.
+func (s *DB) checkSession(ctx context.Context, claims auth.Claims) error {
+	if claims.Id == "" {
+		return nil
+	}
+
+	var revoked *time.Time
+	const q = `SELECT revoked_at FROM sessions WHERE session_id = $1 AND user_id = $2`
+	switch err := s.db.GetContext(ctx, &revoked, q, claims.Id, claims.Subject); err {
+	case nil:
+	case sql.ErrNoRows:
+		return ErrTokenRevoked
+	default:
+		return errors.Wrapf(err, "selecting session %q", claims.Id)
+	}
+	if revoked != nil {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// revokeOtherSessions revokes every session of the user with the id except
+// the one with the keep ID. The caller must hold the lock.
+func (m *Memory) revokeOtherSessions(id, keep string, now time.Time) {
+	for sid, sess := range m.sessions {
+		if sess.UserID == id && sid != keep && sess.RevokedAt == nil {
+			revoked := now.UTC()
+			sess.RevokedAt = &revoked
+			m.sessions[sid] = sess
+		}
+	}
+}
+
+// Disable keeps the specified user from logging in and revokes their
+// sessions and API keys. Disabling a disabled user only replaces the reason. The last admin
+// can not be disabled.
+func (s *DB) Disable(ctx context.Context, id, reason string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Disable")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `UPDATE users SET
+		"disabled_at" = COALESCE(disabled_at, $2),
+		"disabled_reason" = $3,
+		"date_updated" = $2
+		WHERE user_id = $1 AND deleted_at IS NULL`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if err := s.lastAdmin(ctx, tx, id); err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, q, id, now.UTC(), reason)
+		if err != nil {
+			return errors.Wrapf(err, "disabling user %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "disabling user %s", id)
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		if err := revokeSessions(ctx, tx, id, now); err != nil {
+			return err
+		}
+		if err := revokeAPIKeys(ctx, tx, id, now); err != nil {
+			return err
+		}
+
+		data := struct {
+			ID     string `json:"id"`
+			Reason string `json:"reason"`
+		}{id, reason}
+		return event.Record(ctx, tx, event.UserDisabled, id, data, now)
+	})
+}
+
+// Enable lets the specified user log in again. Enabling a user who is not
+// disabled does nothing.
+func (s *DB) Enable(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Enable")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	var disabled *time.Time
+	const sel = `SELECT disabled_at FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+	if err := s.db.GetContext(ctx, &disabled, sel, id); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return errors.Wrapf(err, "selecting user %q", id)
+	}
+	if disabled == nil {
+		return nil
+	}
+
+	const q = `UPDATE users SET
+		"disabled_at" = NULL,
+		"disabled_reason" = '',
+		"date_updated" = $2
+		WHERE user_id = $1 AND disabled_at IS NOT NULL`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "enabling user %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "enabling user %s", id)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserEnabled, id, data, now)
+	})
+}
+
+// ListSessions gives the sessions of the specified user that are active at
+// now, oldest first.
+func (s *DB) ListSessions(ctx context.Context, id string, now time.Time) ([]Session, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.ListSessions")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	sessions := []Session{}
+	const q = `SELECT * FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY date_created, session_id`
+	if err := s.db.SelectContext(ctx, &sessions, q, id, now.UTC()); err != nil {
+		return nil, errors.Wrapf(err, "selecting sessions of user %q", id)
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession ends the specified session of a user. The tokens of the
+// session are no longer accepted. Revoking a session again does nothing.
+func (s *DB) RevokeSession(ctx context.Context, id, sessionID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.RevokeSession")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `UPDATE sessions SET
+		"revoked_at" = COALESCE(revoked_at, $3)
+		WHERE session_id = $1 AND user_id = $2`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, sessionID, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "revoking session %s", sessionID)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "revoking session %s", sessionID)
+		}
+		if n == 0 {
+			return ErrSessionNotFound
+		}
+
+		data := struct {
+			ID     string `json:"id"`
+			UserID string `json:"user_id"`
+		}{sessionID, id}
+		return event.Record(ctx, tx, event.SessionRevoked, id, data, now)
+	})
+}
+
+// checkSession reports ErrTokenRevoked when the claims belong to a Session
+// that was revoked. Claims without an ID were not given for a login. The
+// caller must hold the lock.
+func (m *Memory) checkSession(claims auth.Claims) error {
+	if claims.Id == "" {
+		return nil
+	}
+
+	sess, ok := m.sessions[claims.Id]
+	if !ok || sess.UserID != claims.Subject || sess.RevokedAt != nil {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// revokeSessions revokes every session of the user with the id. The caller
+// must hold the lock.
+func (m *Memory) revokeSessions(id string, now time.Time) {
+	for sid, sess := range m.sessions {
+		if sess.UserID == id && sess.RevokedAt == nil {
+			revoked := now.UTC()
+			sess.RevokedAt = &revoked
+			m.sessions[sid] = sess
+		}
+	}
+}
+
+// Disable keeps the specified user from logging in and revokes their
+// sessions and API keys. Disabling a disabled user only replaces the reason. The last admin
+// can not be disabled.
+func (m *Memory) Disable(ctx context.Context, id, reason string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Disable")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if err := m.lastAdmin(id); err != nil {
+		return err
+	}
+
+	if u.DisabledAt == nil {
+		disabled := now.UTC()
+		u.DisabledAt = &disabled
+	}
+	u.DisabledReason = reason
+	u.DateUpdated = now.UTC()
+	m.users[id] = u
+
+	m.revokeSessions(id, now)
+	m.revokeAPIKeys(id, now)
+
+	return nil
+}
+
+// Enable lets the specified user log in again. Enabling a user who is not
+// disabled does nothing.
+func (m *Memory) Enable(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Enable")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if u.DisabledAt == nil {
+		return nil
+	}
+
+	u.DisabledAt = nil
+	u.DisabledReason = ""
+	u.DateUpdated = now.UTC()
+	m.users[id] = u
+
+	return nil
+}
+
+// ListSessions gives the sessions of the specified user that are active at
+// now, oldest first.
+func (m *Memory) ListSessions(ctx context.Context, id string, now time.Time) ([]Session, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.ListSessions")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := []Session{}
+	for _, sess := range m.sessions {
+		if sess.UserID == id && sess.RevokedAt == nil && sess.ExpiresAt.After(now) {
+			sessions = append(sessions, sess)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].DateCreated.Equal(sessions[j].DateCreated) {
+			return sessions[i].DateCreated.Before(sessions[j].DateCreated)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	return sessions, nil
+}
+
+// RevokeSession ends the specified session of a user. The tokens of the
+// session are no longer accepted. Revoking a session again does nothing.
+func (m *Memory) RevokeSession(ctx context.Context, id, sessionID string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.RevokeSession")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, ok := m.sessions[sessionID]
+	if !ok || sess.UserID != id {
+		return ErrSessionNotFound
+	}
+	if sess.RevokedAt == nil {
+		revoked := now.UTC()
+		sess.RevokedAt = &revoked
+		m.sessions[sessionID] = sess
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/service/internal/event"
+	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/database"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Register creates an Unverified user with the USER role for someone signing
+// up. It returns the Verification they need to verify their email. The token
+// expires after ttl.
+func (s *DB) Register(ctx context.Context, nr NewRegistration, ttl time.Duration, now time.Time) (*Verification, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Register")
+	defer span.End()
+
+	u, err := newRegistered(nr, s.domains, s.passwords, s.emails, now)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVerification(*u, ttl, now)
+	if err != nil {
+		return nil, err
+	}
+
+	const q = `INSERT INTO users
+		(user_id, name, email, password_hash, roles, unverified, date_created, date_updated)
+		VALUES ($1, $2, $3, $4, $5, TRUE, $6, $7)`
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(
+			ctx, q,
+			u.ID, u.Name, u.Email,
+			u.PasswordHash, u.Roles,
+			u.DateCreated, u.DateUpdated,
+		)
+		if err != nil {
+			if database.IsDuplicate(err) {
+				return ErrEmailTaken
+			}
+			return errors.Wrap(err, "inserting user")
+		}
+
+		if err := insertVerification(ctx, tx, v, now); err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, event.UserCreated, u.ID, u, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// RequestVerification creates a new Verification for the unverified user with
+// the email. The token expires after ttl.
+func (s *DB) RequestVerification(ctx context.Context, email string, ttl time.Duration, now time.Time) (*Verification, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.RequestVerification")
+	defer span.End()
+
+	var u User
+	const q = `SELECT * FROM users WHERE email = $1 AND unverified AND deleted_at IS NULL`
+	if err := s.db.GetContext(ctx, &u, q, s.emails.normalize(email)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "selecting single user")
+	}
+
+	v, err := newVerification(u, ttl, now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		return insertVerification(ctx, tx, v, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Verify marks the user a verification token was issued to as verified. The
+// token must not have expired or been used. Every other token of the user is
+// used up.
+func (s *DB) Verify(ctx context.Context, token string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Verify")
+	defer span.End()
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+
+		// Using the token in the same statement that checks it keeps two
+		// concurrent verifications from both succeeding.
+		const use = `UPDATE email_verifications SET
+			"used_at" = $2
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2`
+		res, err := tx.ExecContext(ctx, use, hashToken(token), now.UTC())
+		if err != nil {
+			return errors.Wrap(err, "using verification")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "using verification")
+		}
+		if n == 0 {
+			return ErrInvalidVerificationToken
+		}
+
+		var id string
+		const sel = `SELECT user_id FROM email_verifications WHERE token_hash = $1`
+		if err := tx.GetContext(ctx, &id, sel, hashToken(token)); err != nil {
+			return errors.Wrap(err, "selecting verification")
+		}
+
+		const upd = `UPDATE users SET
+			"unverified" = FALSE,
+			"date_updated" = $2
+			WHERE user_id = $1 AND deleted_at IS NULL`
+		res, err = tx.ExecContext(ctx, upd, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "verifying user %q", id)
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return errors.Wrapf(err, "verifying user %q", id)
+		}
+		if n == 0 {
+			return ErrInvalidVerificationToken
+		}
+
+		const rest = `UPDATE email_verifications SET
+			"used_at" = $2
+			WHERE user_id = $1 AND used_at IS NULL`
+		if _, err := tx.ExecContext(ctx, rest, id, now.UTC()); err != nil {
+			return errors.Wrapf(err, "using verifications of user %q", id)
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserVerified, id, data, now)
+	})
+}
+
+// insertVerification stores the token of v.
+func insertVerification(ctx context.Context, tx *sqlx.Tx, v *Verification, now time.Time) error {
+	const q = `INSERT INTO email_verifications
+		(token_hash, user_id, expires_at, date_created)
+		VALUES ($1, $2, $3, $4)`
+	if _, err := tx.ExecContext(ctx, q, hashToken(v.Token), v.UserID, v.ExpiresAt, now.UTC()); err != nil {
+		return errors.Wrap(err, "inserting verification")
+	}
+	return nil
+}
+
+// Register creates an Unverified user with the USER role for someone signing
+// up. It returns the Verification they need to verify their email. The token
+// expires after ttl.
+func (m *Memory) Register(ctx context.Context, nr NewRegistration, ttl time.Duration, now time.Time) (*Verification, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Register")
+	defer span.End()
+
+	u, err := newRegistered(nr, m.domains, m.passwords, m.emails, now)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVerification(*u, ttl, now)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.emailTaken(u.Email, u.ID) {
+		return nil, ErrEmailTaken
+	}
+
+	m.users[u.ID] = copyUser(*u)
+	m.verifications[hashToken(v.Token)] = pending{userID: u.ID, expiresAt: v.ExpiresAt}
+
+	return v, nil
+}
+
+// RequestVerification creates a new Verification for the unverified user with
+// the email. The token expires after ttl.
+func (m *Memory) RequestVerification(ctx context.Context, email string, ttl time.Duration, now time.Time) (*Verification, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.RequestVerification")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Email != m.emails.normalize(email) || !u.Unverified || u.DeletedAt != nil {
+			continue
+		}
+
+		v, err := newVerification(u, ttl, now)
+		if err != nil {
+			return nil, err
+		}
+		m.verifications[hashToken(v.Token)] = pending{userID: u.ID, expiresAt: v.ExpiresAt}
+		return v, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// Verify marks the user a verification token was issued to as verified. The
+// token must not have expired or been used. Every other token of the user is
+// used up.
+func (m *Memory) Verify(ctx context.Context, token string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Memory.Verify")
+	defer span.End()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.verifications[hashToken(token)]
+	if !ok || v.used || !v.expiresAt.After(now) {
+		return ErrInvalidVerificationToken
+	}
+	u, ok := m.users[v.userID]
+	if !ok || u.DeletedAt != nil {
+		return ErrInvalidVerificationToken
+	}
+
+	for h, v := range m.verifications {
+		if v.userID == u.ID {
+			v.used = true
+			m.verifications[h] = v
+		}
+	}
+
+	u.Unverified = false
+	u.DateUpdated = now.UTC()
+	m.users[u.ID] = u
+
+	return nil
+}
+
+// newRegistered gives the User someone signing up with nr becomes. The domain
+// of their email must be one of domains unless there are none.
+func newRegistered(nr NewRegistration, domains []string, p passwords, e emails, now time.Time) (*User, error) {
+	email, err := e.parse(nr.Email)
+	if err != nil {
+		return nil, err
+	}
+	if !allowedDomain(email, domains) {
+		return nil, ErrDomainNotAllowed
+	}
+
+	hash, err := p.hash(nr.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	u := User{
+		ID:           uuid.New().String(),
+		Name:         nr.Name,
+		Email:        email,
+		PasswordHash: hash,
+		Roles:        []string{auth.RoleUser},
+		DateCreated:  now.UTC(),
+		DateUpdated:  now.UTC(),
+		Unverified:   true,
+	}
+	return &u, nil
+}
+
+// allowedDomain reports whether the domain of email is one of domains. Every
+// domain is allowed when there are none.
+func allowedDomain(email string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := email[i+1:]
+	for _, d := range domains {
+		if strings.EqualFold(domain, strings.TrimSpace(d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newVerification generates a Verification for u with a random token.
+func newVerification(u User, ttl time.Duration, now time.Time) (*Verification, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generating verification token")
+	}
+
+	v := Verification{
+		UserID:    u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Token:     token,
+		ExpiresAt: now.Add(ttl).UTC(),
+	}
+	return &v, nil
+}
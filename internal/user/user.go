@@ -5,12 +5,13 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/ardanlabs/service/internal/event"
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/database"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const usersCollection = "users"
@@ -28,25 +29,241 @@ var (
 
 	// ErrForbidden occurs when a user tries to do something that is forbidden to them according to our access control policies.
 	ErrForbidden = errors.New("Attempted action is not allowed")
+
+	// ErrInvalidResetToken occurs when a password reset token is unknown,
+	// expired or was already used.
+	ErrInvalidResetToken = errors.New("Reset token is not valid")
+
+	// ErrTokenRevoked occurs when a token was issued before the password of
+	// its user was reset.
+	ErrTokenRevoked = errors.New("Token has been revoked")
+
+	// ErrMFARequired occurs when a token is only good to complete a login
+	// with a two-factor code.
+	ErrMFARequired = errors.New("Two-factor authentication must be completed first")
+
+	// ErrMFAEnabled occurs when a user enrolls in two-factor authentication a
+	// second time.
+	ErrMFAEnabled = errors.New("Two-factor authentication is already enabled")
+
+	// ErrMFANotEnrolled occurs when two-factor authentication is confirmed
+	// before it was enrolled in.
+	ErrMFANotEnrolled = errors.New("Two-factor authentication has not been enrolled in")
+
+	// ErrInvalidMFACode occurs when a code does not match the secret being
+	// enrolled.
+	ErrInvalidMFACode = errors.New("Two-factor code is not valid")
+
+	// ErrUnverified occurs when a user who signed up authenticates before
+	// verifying their email.
+	ErrUnverified = errors.New("Email has not been verified")
+
+	// ErrInvalidVerificationToken occurs when a verification token is
+	// unknown, expired or was already used.
+	ErrInvalidVerificationToken = errors.New("Verification token is not valid")
+
+	// ErrDomainNotAllowed occurs when someone signs up with an email domain
+	// that is not allowed.
+	ErrDomainNotAllowed = errors.New("Email domain is not allowed")
+
+	// ErrAPIKeyNotFound is used when a specific APIKey is requested but does
+	// not exist.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+
+	// ErrInvalidScope occurs when an APIKey is given a scope that is not a
+	// role of the user creating it.
+	ErrInvalidScope = errors.New("Scope is not a role of the user")
+
+	// ErrPasswordTooShort occurs when a new password has fewer characters
+	// than the policy requires.
+	ErrPasswordTooShort = errors.New("Password is too short")
+
+	// ErrPasswordTooSimple occurs when a new password uses fewer character
+	// classes than the policy requires.
+	ErrPasswordTooSimple = errors.New("Password needs more kinds of characters")
+
+	// ErrPasswordBreached occurs when a new password is on the list of
+	// breached passwords.
+	ErrPasswordBreached = errors.New("Password is known to be breached")
+
+	// ErrDisabled occurs when a disabled user authenticates or uses a token.
+	ErrDisabled = errors.New("User is disabled")
+
+	// ErrSessionNotFound is used when a specific Session is requested but
+	// does not exist.
+	ErrSessionNotFound = errors.New("Session not found")
+
+	// ErrEmailTaken occurs when a user is given an email another user
+	// already has.
+	ErrEmailTaken = errors.New("Email is already in use")
+
+	// ErrInvalidEmail occurs when a user is given an email that is not a
+	// valid address.
+	ErrInvalidEmail = errors.New("Email is not a valid address")
+
+	// ErrInvalidRole occurs when a user is given a role the service does not
+	// know.
+	ErrInvalidRole = errors.New("Role is not known")
+
+	// ErrRoleNotHeld occurs when someone gives a user a role they do not
+	// have themselves.
+	ErrRoleNotHeld = errors.New("Can not grant a role you do not have")
+
+	// ErrLastAdmin occurs when the last active admin would lose the ADMIN
+	// role by being updated, disabled or deleted.
+	ErrLastAdmin = errors.New("Can not remove the last admin")
+
+	// ErrWrongPassword occurs when a user changes their profile with a
+	// current password that is not theirs.
+	ErrWrongPassword = errors.New("Current password is not correct")
 )
 
-// List retrieves a list of existing users from the database.
-func List(ctx context.Context, db *sqlx.DB) ([]User, error) {
+// Store defines the set of behaviors required to persist, retrieve and
+// authenticate Users. Every implementation must honor the same semantics for
+// access control and the predefined errors.
+//
+// Deleting a User only marks it as deleted. It is hidden from List and
+// Retrieve and can no longer authenticate, but it keeps its email address
+// until it is purged.
+//
+// Emails are stored trimmed and in lower case and every lookup by email,
+// including Authenticate, compares them that way. Creating, updating or
+// registering a User with an email that is not a bare address fails with
+// ErrInvalidEmail and with the email of another User with ErrEmailTaken.
+//
+// Users are given roles the service knows, or ErrInvalidRole, and only roles
+// the claims creating or updating them have, or ErrRoleNotHeld. The last
+// active admin can not lose the ADMIN role by being updated, disabled or
+// deleted, which is ErrLastAdmin. Users change their own profile with
+// UpdateProfile, which needs their current password to change their email or
+// password, or ErrWrongPassword.
+//
+// A forgotten password is replaced by requesting a PasswordReset, which is
+// ErrNotFound for unknown emails, and confirming its token before it expires.
+// Confirming a reset uses up every outstanding token of the User and revokes
+// the tokens issued to them so far, which CheckClaims reports with
+// ErrTokenRevoked.
+//
+// Failed authentications are counted per account and per source address.
+// Repeated failures of an account have to wait longer and longer before the
+// next attempt and enough failures of either lock them out for a while. All of
+// these fail with the same ErrAuthenticationFailure as a wrong password or
+// unknown email so they do not tell which emails are in the system.
+//
+// Users can enroll in two-factor authentication with EnrollMFA and turn it on
+// by confirming a code of the secret, which gives them their recovery codes.
+// From then on Authenticate only gives a short lived challenge, with the
+// ChallengeAudience, that VerifyMFA exchanges for the real claims given a
+// code. Wrong codes count as failed authentications of the account. Only the
+// user themselves can enroll but admins can disable it for anyone.
+//
+// People can also Register themselves. Their account is Unverified until they
+// Verify the token created with it or with RequestVerification, which is
+// ErrNotFound for emails without an unverified user. Authenticating before
+// then fails with ErrUnverified once the password is right.
+//
+// Users can create API keys for themselves with any of the roles of the
+// claims creating them, unless those claims come from an API key. Users see
+// and revoke their own keys and admins those of anyone. AuthenticateAPIKey
+// gives claims with the APIKeyAudience and only the scopes the user still
+// has a role for. Every failure is ErrAuthenticationFailure.
+//
+// Admins can Disable a User instead of deleting them. Disabled users fail to
+// authenticate with ErrDisabled once the password is right, their sessions
+// are revoked and CheckClaims rejects their tokens with ErrDisabled until they
+// are enabled again. API keys of disabled users do not authenticate.
+//
+// Every token given by Authenticate or VerifyMFA belongs to a Session whose
+// ID is the ID of the claims. ListSessions gives the sessions of a User that
+// have not expired or been revoked. CheckClaims rejects the tokens of revoked
+// sessions with ErrTokenRevoked.
+//
+// People an external identity provider vouched for log in as the User linked
+// to their identity. Provision links the user with the same email the first
+// time, as long as the provider verified it, or creates a user without a
+// password. The provider decides the roles of the users it created, which are
+// replaced every time unless that takes ADMIN from the last admin. Logging in
+// with AuthenticateExternal or an ID token follows the two-factor rules of
+// Authenticate. Failures are ErrAuthenticationFailure, ErrDisabled,
+// ErrLastAdmin and, for ID tokens of users with two-factor authentication on,
+// ErrMFARequired.
+type Store interface {
+	List(ctx context.Context, f Filter) ([]User, error)
+	Retrieve(ctx context.Context, claims auth.Claims, id string) (*User, error)
+	Create(ctx context.Context, claims auth.Claims, n NewUser, now time.Time) (*User, error)
+	Update(ctx context.Context, claims auth.Claims, id string, upd UpdateUser, now time.Time) error
+	UpdateProfile(ctx context.Context, claims auth.Claims, upd UpdateProfile, now time.Time) error
+	Delete(ctx context.Context, id string, now time.Time) error
+	Restore(ctx context.Context, id string, now time.Time) error
+	Purge(ctx context.Context, before time.Time) (int, error)
+	Authenticate(ctx context.Context, now time.Time, email, password, source string) (auth.Claims, error)
+	Unlock(ctx context.Context, id string, now time.Time) error
+	CheckClaims(ctx context.Context, claims auth.Claims) error
+	RequestReset(ctx context.Context, email string, ttl time.Duration, now time.Time) (*PasswordReset, error)
+	ConfirmReset(ctx context.Context, token, password string, now time.Time) error
+	EnrollMFA(ctx context.Context, claims auth.Claims, id string, now time.Time) (*MFAEnrollment, error)
+	ConfirmMFA(ctx context.Context, claims auth.Claims, id, code string, now time.Time) ([]string, error)
+	DisableMFA(ctx context.Context, claims auth.Claims, id string, now time.Time) error
+	VerifyMFA(ctx context.Context, now time.Time, claims auth.Claims, code, source string) (auth.Claims, error)
+	Register(ctx context.Context, nr NewRegistration, ttl time.Duration, now time.Time) (*Verification, error)
+	RequestVerification(ctx context.Context, email string, ttl time.Duration, now time.Time) (*Verification, error)
+	Verify(ctx context.Context, token string, now time.Time) error
+	CreateAPIKey(ctx context.Context, claims auth.Claims, id string, nk NewAPIKey, now time.Time) (*APIKey, error)
+	ListAPIKeys(ctx context.Context, claims auth.Claims, id string) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, claims auth.Claims, id, keyID string, now time.Time) error
+	AuthenticateAPIKey(ctx context.Context, now time.Time, key string) (auth.Claims, error)
+	Disable(ctx context.Context, id, reason string, now time.Time) error
+	Enable(ctx context.Context, id string, now time.Time) error
+	ListSessions(ctx context.Context, id string, now time.Time) ([]Session, error)
+	RevokeSession(ctx context.Context, id, sessionID string, now time.Time) error
+	Provision(ctx context.Context, ext External, now time.Time) (*User, error)
+	AuthenticateExternal(ctx context.Context, now time.Time, ext External, source string) (auth.Claims, error)
+	AuthenticateIDToken(ctx context.Context, now time.Time, ext External, expires time.Time) (auth.Claims, error)
+}
+
+// DB is a Store backed by a Postgres database. Every change is committed
+// together with a domain event in the outbox.
+type DB struct {
+	db        *sqlx.DB
+	lockout   LockoutConfig
+	adminMFA  bool
+	domains   []string
+	passwords passwords
+	emails    emails
+}
+
+// NewDB constructs a Store that persists Users using the provided database.
+// Zero values in the lockout config are replaced with reasonable defaults.
+func NewDB(db *sqlx.DB, cfg Config) *DB {
+	return &DB{
+		db:        db,
+		lockout:   cfg.Lockout.withDefaults(),
+		adminMFA:  cfg.AdminMFA,
+		domains:   cfg.SignupDomains,
+		passwords: newPasswords(cfg),
+		emails:    newEmails(cfg),
+	}
+}
+
+// List retrieves a list of existing users from the database. Deleted users are
+// only included when the filter asks for them.
+func (s *DB) List(ctx context.Context, f Filter) ([]User, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.List")
 	defer span.End()
 
 	users := []User{}
-	const q = `SELECT * FROM users`
+	const q = `SELECT * FROM users WHERE $1 OR deleted_at IS NULL`
 
-	if err := db.SelectContext(ctx, &users, q); err != nil {
+	if err := s.db.SelectContext(ctx, &users, q, f.IncludeDeleted); err != nil {
 		return nil, errors.Wrap(err, "selecting users")
 	}
 
 	return users, nil
 }
 
-// Retrieve gets the specified user from the database.
-func Retrieve(ctx context.Context, claims auth.Claims, db *sqlx.DB, id string) (*User, error) {
+// Retrieve gets the specified user from the database. Deleted users are not
+// found.
+func (s *DB) Retrieve(ctx context.Context, claims auth.Claims, id string) (*User, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Retrieve")
 	defer span.End()
 
@@ -60,8 +277,8 @@ func Retrieve(ctx context.Context, claims auth.Claims, db *sqlx.DB, id string) (
 	}
 
 	var u User
-	const q = `SELECT * FROM users WHERE user_id = $1`
-	if err := db.GetContext(ctx, &u, q, id); err != nil {
+	const q = `SELECT * FROM users WHERE user_id = $1 AND deleted_at IS NULL`
+	if err := s.db.GetContext(ctx, &u, q, id); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrNotFound
 		}
@@ -72,20 +289,28 @@ func Retrieve(ctx context.Context, claims auth.Claims, db *sqlx.DB, id string) (
 	return &u, nil
 }
 
-// Create inserts a new user into the database.
-func Create(ctx context.Context, db *sqlx.DB, n NewUser, now time.Time) (*User, error) {
+// Create inserts a new user into the database. The claims must have every
+// role given to the user.
+func (s *DB) Create(ctx context.Context, claims auth.Claims, n NewUser, now time.Time) (*User, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Create")
 	defer span.End()
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(n.Password), bcrypt.DefaultCost)
+	if err := checkRoles(claims, nil, n.Roles); err != nil {
+		return nil, err
+	}
+	email, err := s.emails.parse(n.Email)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := s.passwords.hash(n.Password)
 	if err != nil {
-		return nil, errors.Wrap(err, "generating password hash")
+		return nil, err
 	}
 
 	u := User{
 		ID:           uuid.New().String(),
 		Name:         n.Name,
-		Email:        n.Email,
+		Email:        email,
 		PasswordHash: hash,
 		Roles:        n.Roles,
 		DateCreated:  now.UTC(),
@@ -95,47 +320,93 @@ func Create(ctx context.Context, db *sqlx.DB, n NewUser, now time.Time) (*User,
 	const q = `INSERT INTO users
 		(user_id, name, email, password_hash, roles, date_created, date_updated)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err = db.ExecContext(
-		ctx, q,
-		u.ID, u.Name, u.Email,
-		u.PasswordHash, u.Roles,
-		u.DateCreated, u.DateUpdated,
-	)
+	err = event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(
+			ctx, q,
+			u.ID, u.Name, u.Email,
+			u.PasswordHash, u.Roles,
+			u.DateCreated, u.DateUpdated,
+		)
+		if err != nil {
+			if database.IsDuplicate(err) {
+				return ErrEmailTaken
+			}
+			return errors.Wrap(err, "inserting user")
+		}
+
+		return event.Record(ctx, tx, event.UserCreated, u.ID, u, now)
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "inserting user")
+		return nil, err
 	}
 
 	return &u, nil
 }
 
-// Update replaces a user document in the database.
-func Update(ctx context.Context, claims auth.Claims, db *sqlx.DB, id string, upd UpdateUser, now time.Time) error {
+// Update replaces a user document in the database. The claims must have
+// every role added to the user and the last admin keeps the ADMIN role.
+func (s *DB) Update(ctx context.Context, claims auth.Claims, id string, upd UpdateUser, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Update")
 	defer span.End()
 
-	u, err := Retrieve(ctx, claims, db, id)
+	u, err := s.Retrieve(ctx, claims, id)
 	if err != nil {
 		return err
 	}
 
+	demoted, err := applyUpdate(s.emails, s.passwords, claims, u, upd, now)
+	if err != nil {
+		return err
+	}
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		return s.update(ctx, tx, *u, demoted, now)
+	})
+}
+
+// applyUpdate makes the changes of upd to u as claims. It reports whether u
+// loses the ADMIN role.
+func applyUpdate(e emails, p passwords, claims auth.Claims, u *User, upd UpdateUser, now time.Time) (bool, error) {
+	var demoted bool
+	if upd.Roles != nil {
+		if err := checkRoles(claims, u.Roles, upd.Roles); err != nil {
+			return false, err
+		}
+		demoted = hasRole(u.Roles, auth.RoleAdmin) && !hasRole(upd.Roles, auth.RoleAdmin)
+	}
+
 	if upd.Name != nil {
 		u.Name = *upd.Name
 	}
 	if upd.Email != nil {
-		u.Email = *upd.Email
+		email, err := e.parse(*upd.Email)
+		if err != nil {
+			return false, err
+		}
+		u.Email = email
 	}
 	if upd.Roles != nil {
 		u.Roles = upd.Roles
 	}
 	if upd.Password != nil {
-		pw, err := bcrypt.GenerateFromPassword([]byte(*upd.Password), bcrypt.DefaultCost)
+		pw, err := p.hash(*upd.Password)
 		if err != nil {
-			return errors.Wrap(err, "generating password hash")
+			return false, err
 		}
 		u.PasswordHash = pw
 	}
 
-	u.DateUpdated = now
+	u.DateUpdated = now.UTC()
+	return demoted, nil
+}
+
+// update stores the changed u in tx. The last admin can not be demoted.
+func (s *DB) update(ctx context.Context, tx *sqlx.Tx, u User, demoted bool, now time.Time) error {
+	if demoted {
+		if err := s.lastAdmin(ctx, tx, u.ID); err != nil {
+			return err
+		}
+	}
 
 	const q = `UPDATE users SET
 		"name" = $2,
@@ -143,20 +414,25 @@ func Update(ctx context.Context, claims auth.Claims, db *sqlx.DB, id string, upd
 		"roles" = $4,
 		"password_hash" = $5,
 		"date_updated" = $6
-		WHERE user_id = $1`
-	_, err = db.ExecContext(ctx, q, id,
+		WHERE user_id = $1 AND deleted_at IS NULL`
+	_, err := tx.ExecContext(ctx, q, u.ID,
 		u.Name, u.Email, u.Roles,
 		u.PasswordHash, u.DateUpdated,
 	)
 	if err != nil {
+		if database.IsDuplicate(err) {
+			return ErrEmailTaken
+		}
 		return errors.Wrap(err, "updating user")
 	}
 
-	return nil
+	return event.Record(ctx, tx, event.UserUpdated, u.ID, u, now)
 }
 
-// Delete removes a user from the database.
-func Delete(ctx context.Context, db *sqlx.DB, id string) error {
+// Delete marks a user as deleted and revokes their sessions and API keys. An
+// event is only recorded if an active user existed. The last admin can not be
+// deleted.
+func (s *DB) Delete(ctx context.Context, id string, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Delete")
 	defer span.End()
 
@@ -164,44 +440,205 @@ func Delete(ctx context.Context, db *sqlx.DB, id string) error {
 		return ErrInvalidID
 	}
 
-	const q = `DELETE FROM users WHERE user_id = $1`
+	const q = `UPDATE users SET
+		"deleted_at" = $2
+		WHERE user_id = $1 AND deleted_at IS NULL`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		if err := s.lastAdmin(ctx, tx, id); err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, q, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "deleting user %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "deleting user %s", id)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		if err := revokeSessions(ctx, tx, id, now); err != nil {
+			return err
+		}
+		if err := revokeAPIKeys(ctx, tx, id, now); err != nil {
+			return err
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserDeleted, id, data, now)
+	})
+}
+
+// Restore returns a deleted user to the active set. Restoring a user that is
+// not deleted does nothing. It will error if the specified ID is invalid or
+// does not reference an existing User.
+func (s *DB) Restore(ctx context.Context, id string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Restore")
+	defer span.End()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `UPDATE users SET
+		"deleted_at" = NULL,
+		"date_updated" = $2
+		WHERE user_id = $1 AND deleted_at IS NOT NULL`
+
+	return event.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, id, now.UTC())
+		if err != nil {
+			return errors.Wrapf(err, "restoring user %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "restoring user %s", id)
+		}
+		if n == 0 {
+			var count int
+			const q = `SELECT COUNT(*) FROM users WHERE user_id = $1`
+			if err := tx.GetContext(ctx, &count, q, id); err != nil {
+				return errors.Wrapf(err, "selecting user %q", id)
+			}
+			if count == 0 {
+				return ErrNotFound
+			}
+			return nil
+		}
+
+		data := struct {
+			ID string `json:"id"`
+		}{id}
+		return event.Record(ctx, tx, event.UserRestored, id, data, now)
+	})
+}
+
+// Purge permanently removes users that were deleted before the provided time.
+// It returns the number of users removed.
+func (s *DB) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Purge")
+	defer span.End()
+
+	const q = `DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < $1`
+
+	res, err := s.db.ExecContext(ctx, q, before.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "purging users")
+	}
 
-	if _, err := db.ExecContext(ctx, q, id); err != nil {
-		return errors.Wrapf(err, "deleting user %s", id)
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "purging users")
 	}
 
-	return nil
+	return int(n), nil
 }
 
 // Authenticate finds a user by their email and verifies their password. On
 // success it returns a Claims value representing this user. The claims can be
-// used to generate a token for future authentication.
-func Authenticate(ctx context.Context, db *sqlx.DB, now time.Time, email, password string) (auth.Claims, error) {
+// used to generate a token for future authentication, or to complete the
+// login with VerifyMFA when they are a challenge. Failures are counted for the
+// account and the source address the attempt came from.
+func (s *DB) Authenticate(ctx context.Context, now time.Time, email, password, source string) (auth.Claims, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Authenticate")
 	defer span.End()
 
-	const q = `SELECT * FROM users WHERE email = $1`
+	src, err := s.sourceThrottle(ctx, source)
+	if err != nil {
+		return auth.Claims{}, err
+	}
 
-	var u User
-	if err := db.GetContext(ctx, &u, q, email); err != nil {
+	const q = `SELECT * FROM users WHERE email = $1 AND deleted_at IS NULL`
 
-		// Normally we would return ErrNotFound in this scenario but we do not want
-		// to leak to an unauthenticated user which emails are in the system.
-		if err == sql.ErrNoRows {
-			return auth.Claims{}, ErrAuthenticationFailure
-		}
+	var u *User
+	var usr User
+	switch err := s.db.GetContext(ctx, &usr, q, s.emails.normalize(email)); err {
+	case nil:
+		u = &usr
 
+	// Normally we would return ErrNotFound in this scenario but we do not want
+	// to leak to an unauthenticated user which emails are in the system. The
+	// attempt is checked against a dummy password so it fails just as slowly.
+	case sql.ErrNoRows:
+	default:
 		return auth.Claims{}, errors.Wrap(err, "selecting single user")
 	}
 
-	// Compare the provided password with the saved hash. Use the bcrypt
-	// comparison function so it is cryptographically secure.
-	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)); err != nil {
+	// Compare the provided password with the saved hash. The comparison is
+	// cryptographically secure for every supported algorithm. Blocked attempts
+	// fail without looking at the password and are not counted.
+	blocked := src.blocked(s.lockout, now, false) || (u != nil && userThrottle(*u).blocked(s.lockout, now, true))
+	ok := s.passwords.check(u, password, blocked)
+	if blocked {
 		return auth.Claims{}, ErrAuthenticationFailure
 	}
 
+	// Now that we know the password, an outdated hash can be upgraded.
+	var hash []byte
+	if ok {
+		if hash, err = s.passwords.rehash(*u, password); err != nil {
+			return auth.Claims{}, err
+		}
+	}
+
 	// If we are this far the request is valid. Create some claims for the user
-	// and generate their token.
-	claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+	// and start the session of their token.
+	var claims auth.Claims
+	var sess *Session
+	if ok && !u.Unverified && u.DisabledAt == nil {
+		claims = loginClaims(*u, s.adminMFA, now)
+		sess = startSession(&claims, source, now)
+	}
+
+	err = database.WithTx(ctx, s.db, func(tx *sqlx.Tx) error {
+
+		// Attempts made at the same time are counted one after the other. One
+		// of them may have blocked this attempt since the throttles were read.
+		if src, err = lockSource(ctx, tx, source, !ok); err != nil {
+			return err
+		}
+		if u != nil {
+			if err := lockUser(ctx, tx, u); err != nil {
+				return err
+			}
+		}
+		blocked = src.blocked(s.lockout, now, false) || (u != nil && userThrottle(*u).blocked(s.lockout, now, true))
+		if blocked {
+			return nil
+		}
+
+		if hash != nil {
+			if err := s.upgradeHash(ctx, tx, *u, hash); err != nil {
+				return err
+			}
+		}
+		if sess != nil {
+			if err := insertSession(ctx, tx, sess); err != nil {
+				return err
+			}
+		}
+		return s.recordLogin(ctx, tx, u, source, src, ok, now)
+	})
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if blocked || !ok {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+	if u.Unverified {
+		return auth.Claims{}, ErrUnverified
+	}
+	if u.DisabledAt != nil {
+		return auth.Claims{}, ErrDisabled
+	}
+
 	return claims, nil
 }
@@ -1,21 +1,239 @@
 package user_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ardanlabs/service/internal/platform/auth"
+	"github.com/ardanlabs/service/internal/platform/totp"
 	"github.com/ardanlabs/service/internal/tests"
 	"github.com/ardanlabs/service/internal/user"
 	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
 )
 
-// TestUser validates the full set of CRUD operations on User values.
+// source is the address the authentications of the tests come from.
+const source = "192.0.2.1"
+
+// creator is the admin creating the users of the tests. They have every role
+// so they can give any of them.
+var creator = auth.NewClaims(
+	"718ffbea-f4a1-4667-8ae3-b349da52675e",
+	[]string{auth.RoleAdmin, auth.RoleUser, auth.RolePriceOverride},
+	time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC), time.Hour,
+)
+
+// cfg locks sources after fewer failures than the default so the tests do not
+// spend long hashing passwords.
+var cfg = user.Config{Lockout: user.LockoutConfig{MaxSourceFailures: 10}}
+
+// policy is cfg with a password policy.
+var policy = user.Config{
+	Lockout: cfg.Lockout,
+	Password: user.PasswordPolicy{
+		MinLength:  10,
+		MinClasses: 3,
+		Breached:   []string{"Correct-Horse-1"},
+	},
+}
+
+// upgraded is cfg hashing passwords with argon2id, cheaply so the tests do
+// not spend long hashing them.
+var upgraded = user.Config{
+	Lockout: cfg.Lockout,
+	Hasher:  user.Argon2id{Time: 1, Memory: 8 * 1024, Threads: 1},
+}
+
+// TestUser validates the Store backed by the database.
 func TestUser(t *testing.T) {
 	db, teardown := tests.NewUnit(t)
 	defer teardown()
 
+	testStore(t, user.NewDB(db, cfg))
+
+	strict := cfg
+	strict.AdminMFA = true
+	strict.SignupDomains = []string{"ardanlabs.com"}
+	t.Run("adminMFA", func(t *testing.T) { adminMFA(t, user.NewDB(db, strict)) })
+	t.Run("signupDomains", func(t *testing.T) { signupDomains(t, user.NewDB(db, strict)) })
+	t.Run("passwordPolicy", func(t *testing.T) { passwordPolicy(t, user.NewDB(db, policy)) })
+	t.Run("rehash", func(t *testing.T) { rehash(t, user.NewDB(db, cfg), user.NewDB(db, upgraded), func(user.User) {}) })
+
+	tagged := cfg
+	tagged.StripPlusTags = true
+	t.Run("plusTags", func(t *testing.T) { plusTags(t, user.NewDB(db, tagged)) })
+	t.Run("checkEmails", func(t *testing.T) { checkEmails(t, user.NewDB(db, cfg), user.NewDB(db, tagged)) })
+}
+
+// TestUserMemory validates the in-memory Store against the same suite used
+// for the database so both implementations behave identically.
+func TestUserMemory(t *testing.T) {
+	testStore(t, user.NewMemory(cfg))
+
+	strict := cfg
+	strict.AdminMFA = true
+	strict.SignupDomains = []string{"ardanlabs.com"}
+	mfa := user.NewMemory(strict)
+	keepAdmin(t, mfa)
+	t.Run("adminMFA", func(t *testing.T) { adminMFA(t, mfa) })
+	t.Run("signupDomains", func(t *testing.T) { signupDomains(t, user.NewMemory(strict)) })
+	t.Run("passwordPolicy", func(t *testing.T) { passwordPolicy(t, user.NewMemory(policy)) })
+
+	s := user.NewMemory(upgraded)
+	load := func(u user.User) { s.Load([]user.User{u}) }
+	t.Run("rehash", func(t *testing.T) { rehash(t, user.NewMemory(cfg), s, load) })
+
+	tagged := cfg
+	tagged.StripPlusTags = true
+	t.Run("plusTags", func(t *testing.T) { plusTags(t, user.NewMemory(tagged)) })
+}
+
+// testStore is the conformance suite every user.Store must pass. It starts
+// with an empty store. The admins the roles test leaves behind keep the admins
+// the other tests remove from being the last one.
+func testStore(t *testing.T, s user.Store) {
+	t.Run("roles", func(t *testing.T) { roles(t, s) })
+	t.Run("crud", func(t *testing.T) { crud(t, s) })
+	t.Run("authenticate", func(t *testing.T) { authenticate(t, s) })
+	t.Run("access", func(t *testing.T) { access(t, s) })
+	t.Run("duplicate", func(t *testing.T) { duplicate(t, s) })
+	t.Run("profile", func(t *testing.T) { profile(t, s) })
+	t.Run("softDelete", func(t *testing.T) { softDelete(t, s) })
+	t.Run("reset", func(t *testing.T) { reset(t, s) })
+	t.Run("lockout", func(t *testing.T) { lockoutUser(t, s) })
+	t.Run("mfa", func(t *testing.T) { mfaUser(t, s) })
+	t.Run("register", func(t *testing.T) { register(t, s) })
+	t.Run("apiKeys", func(t *testing.T) { apiKeys(t, s) })
+	t.Run("disable", func(t *testing.T) { disable(t, s) })
+	t.Run("external", func(t *testing.T) { external(t, s) })
+}
+
+// keepAdmin creates an admin who stays active so the admins the tests remove
+// from s are never the last one.
+func keepAdmin(t *testing.T, s user.Store) {
+	t.Helper()
+
+	nu := user.NewUser{
+		Name:            "Kept Gopher",
+		Email:           "kept@ardanlabs.com",
+		Roles:           []string{auth.RoleAdmin},
+		Password:        "gophers",
+		PasswordConfirm: "gophers",
+	}
+	if _, err := s.Create(tests.Context(), creator, nu, time.Now()); err != nil {
+		t.Fatalf("\t%s\tShould be able to create the admin to keep : %s.", tests.Failed, err)
+	}
+}
+
+// roles validates users only get known roles the claims giving them have and
+// the last admin keeps the ADMIN role. It must run on an empty store.
+func roles(t *testing.T, s user.Store) {
+	t.Log("Given the need to safeguard the roles of users.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+		claims := auth.NewClaims(creator.Subject, []string{auth.RoleAdmin, auth.RoleUser}, now, time.Hour)
+
+		nu := user.NewUser{
+			Name:            "Ada Gopher",
+			Email:           "ada@ardanlabs.com",
+			Roles:           []string{auth.RoleAdmin, auth.RoleUser},
+			Password:        "gophers",
+			PasswordConfirm: "gophers",
+		}
+
+		t.Log("\tWhen giving roles to users.")
+		{
+			nu.Roles = []string{"SUPERUSER"}
+			if _, err := s.Create(ctx, claims, nu, now); err != user.ErrInvalidRole {
+				t.Fatalf("\t%s\tShould NOT be able to give an unknown role : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to give an unknown role.", tests.Success)
+
+			nu.Roles = []string{auth.RoleUser, auth.RolePriceOverride}
+			if _, err := s.Create(ctx, claims, nu, now); err != user.ErrRoleNotHeld {
+				t.Fatalf("\t%s\tShould NOT be able to give a role the claims do not have : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to give a role the claims do not have.", tests.Success)
+
+			u, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			upd := user.UpdateUser{Roles: []string{auth.RolePriceOverride}}
+			if err := s.Update(ctx, claims, u.ID, upd, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to keep a role the claims do not have : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to keep a role the claims do not have.", tests.Success)
+
+			upd = user.UpdateUser{Roles: []string{auth.RoleUser}}
+			if err := s.Update(ctx, claims, u.ID, upd, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to remove a role : %s.", tests.Failed, err)
+			}
+			upd = user.UpdateUser{Roles: []string{auth.RoleUser, auth.RolePriceOverride}}
+			if err := s.Update(ctx, claims, u.ID, upd, now); err != user.ErrRoleNotHeld {
+				t.Fatalf("\t%s\tShould NOT be able to add a role the claims do not have : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to add a role the claims do not have.", tests.Success)
+
+			if err := s.Delete(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+		}
+
+		t.Log("\tWhen removing the last admin.")
+		{
+			nu.Roles = []string{auth.RoleAdmin, auth.RoleUser}
+			nu.Email = "root@ardanlabs.com"
+			root, err := s.Create(ctx, claims, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			demote := user.UpdateUser{Roles: []string{auth.RoleUser}}
+			if err := s.Update(ctx, claims, root.ID, demote, now); err != user.ErrLastAdmin {
+				t.Fatalf("\t%s\tShould NOT be able to remove the ADMIN role : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to remove the ADMIN role.", tests.Success)
+
+			if err := s.Disable(ctx, root.ID, "left", now); err != user.ErrLastAdmin {
+				t.Fatalf("\t%s\tShould NOT be able to disable the admin : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to disable the admin.", tests.Success)
+
+			if err := s.Delete(ctx, root.ID, now); err != user.ErrLastAdmin {
+				t.Fatalf("\t%s\tShould NOT be able to delete the admin : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to delete the admin.", tests.Success)
+
+			nu.Email = "ops@ardanlabs.com"
+			ops, err := s.Create(ctx, claims, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+			if err := s.Update(ctx, claims, root.ID, demote, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to remove the ADMIN role with another admin : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to remove the ADMIN role with another admin.", tests.Success)
+
+			if err := s.Disable(ctx, ops.ID, "left", now); err != user.ErrLastAdmin {
+				t.Fatalf("\t%s\tShould NOT be able to disable the new last admin : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to disable the new last admin.", tests.Success)
+
+			// Both stay admins for the tests that follow.
+			promote := user.UpdateUser{Roles: []string{auth.RoleAdmin, auth.RoleUser}}
+			if err := s.Update(ctx, claims, root.ID, promote, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to give the ADMIN role back : %s.", tests.Failed, err)
+			}
+		}
+	}
+}
+
+// crud validates the full set of CRUD operations on User values.
+func crud(t *testing.T, s user.Store) {
 	t.Log("Given the need to work with User records.")
 	{
 		t.Log("\tWhen handling a single User.")
@@ -38,13 +256,13 @@ func TestUser(t *testing.T) {
 				PasswordConfirm: "gophers",
 			}
 
-			u, err := user.Create(ctx, db, nu, now)
+			u, err := s.Create(ctx, creator, nu, now)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to create user.", tests.Success)
 
-			savedU, err := user.Retrieve(ctx, claims, db, u.ID)
+			savedU, err := s.Retrieve(ctx, claims, u.ID)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to retrieve user by ID: %s.", tests.Failed, err)
 			}
@@ -60,12 +278,12 @@ func TestUser(t *testing.T) {
 				Email: tests.StringPointer("jacob@ardanlabs.com"),
 			}
 
-			if err := user.Update(ctx, claims, db, u.ID, upd, now); err != nil {
+			if err := s.Update(ctx, claims, u.ID, upd, now); err != nil {
 				t.Fatalf("\t%s\tShould be able to update user : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to update user.", tests.Success)
 
-			savedU, err = user.Retrieve(ctx, claims, db, u.ID)
+			savedU, err = s.Retrieve(ctx, claims, u.ID)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
 			}
@@ -87,12 +305,12 @@ func TestUser(t *testing.T) {
 				t.Logf("\t%s\tShould be able to see updates to Email.", tests.Success)
 			}
 
-			if err := user.Delete(ctx, db, u.ID); err != nil {
+			if err := s.Delete(ctx, u.ID, now); err != nil {
 				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to delete user.", tests.Success)
 
-			savedU, err = user.Retrieve(ctx, claims, db, u.ID)
+			savedU, err = s.Retrieve(ctx, claims, u.ID)
 			if errors.Cause(err) != user.ErrNotFound {
 				t.Fatalf("\t%s\tShould NOT be able to retrieve user : %s.", tests.Failed, err)
 			}
@@ -101,11 +319,8 @@ func TestUser(t *testing.T) {
 	}
 }
 
-// TestAuthenticate validates the behavior around authenticating users.
-func TestAuthenticate(t *testing.T) {
-	db, teardown := tests.NewUnit(t)
-	defer teardown()
-
+// authenticate validates the behavior around authenticating users.
+func authenticate(t *testing.T, s user.Store) {
 	t.Log("Given the need to authenticate users")
 	{
 		t.Log("\tWhen handling a single User.")
@@ -122,13 +337,13 @@ func TestAuthenticate(t *testing.T) {
 
 			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
 
-			u, err := user.Create(ctx, db, nu, now)
+			u, err := s.Create(ctx, creator, nu, now)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
 			}
 			t.Logf("\t%s\tShould be able to create user.", tests.Success)
 
-			claims, err := user.Authenticate(ctx, db, now, "anna@ardanlabs.com", "goroutines")
+			claims, err := s.Authenticate(ctx, now, "anna@ardanlabs.com", "goroutines", source)
 			if err != nil {
 				t.Fatalf("\t%s\tShould be able to generate claims : %s.", tests.Failed, err)
 			}
@@ -140,6 +355,12 @@ func TestAuthenticate(t *testing.T) {
 			want.ExpiresAt = now.Add(time.Hour).Unix()
 			want.IssuedAt = now.Unix()
 
+			// The ID is the random ID of the session of the claims.
+			if claims.Id == "" {
+				t.Fatalf("\t%s\tShould get the ID of a session.", tests.Failed)
+			}
+			want.Id = claims.Id
+
 			if diff := cmp.Diff(want, claims); diff != "" {
 				t.Fatalf("\t%s\tShould get back the expected claims. Diff:\n%s", tests.Failed, diff)
 			}
@@ -147,3 +368,1743 @@ func TestAuthenticate(t *testing.T) {
 		}
 	}
 }
+
+// access validates regular users may only retrieve themselves.
+func access(t *testing.T, s user.Store) {
+	t.Log("Given the need to restrict access to User records.")
+	{
+		t.Log("\tWhen a regular user retrieves users.")
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{
+				Name:            "Ed Gopher",
+				Email:           "ed@ardanlabs.com",
+				Roles:           []string{auth.RoleUser},
+				Password:        "channels",
+				PasswordConfirm: "channels",
+			}
+
+			u, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to create user.", tests.Success)
+
+			self := auth.NewClaims(u.ID, []string{auth.RoleUser}, now, time.Hour)
+			other := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+
+			if _, err := s.Retrieve(ctx, self, u.ID); err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve themselves : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to retrieve themselves.", tests.Success)
+
+			if _, err := s.Retrieve(ctx, other, u.ID); errors.Cause(err) != user.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT be able to retrieve someone else : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to retrieve someone else.", tests.Success)
+
+			if _, err := s.Retrieve(ctx, self, "12345"); errors.Cause(err) != user.ErrInvalidID {
+				t.Fatalf("\t%s\tShould reject a malformed ID : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reject a malformed ID.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, now, "ed@ardanlabs.com", "wrong", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with a bad password : %v.", tests.Failed, err)
+			}
+			if _, err := s.Authenticate(ctx, now, "nobody@ardanlabs.com", "channels", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate an unknown email : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould fail authentication the same way for bad passwords and unknown emails.", tests.Success)
+
+			if err := s.Delete(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+		}
+	}
+}
+
+// duplicate validates two users can not share an email.
+func duplicate(t *testing.T, s user.Store) {
+	t.Log("Given the need to keep emails unique.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+		claims := auth.NewClaims(tests.AdminID, []string{auth.RoleAdmin, auth.RoleUser}, now, time.Hour)
+
+		nu := user.NewUser{
+			Name:            "Jill Gopher",
+			Email:           " Jill@ArdanLabs.com ",
+			Roles:           []string{auth.RoleUser},
+			Password:        "select",
+			PasswordConfirm: "select",
+		}
+
+		t.Log("\tWhen creating a second user with the same email.")
+		{
+			u, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+			if u.Email != "jill@ardanlabs.com" {
+				t.Fatalf("\t%s\tShould store the email trimmed and in lower case : got %q.", tests.Failed, u.Email)
+			}
+			t.Logf("\t%s\tShould store the email trimmed and in lower case.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, now, "JILL@ardanlabs.com", "select", source); err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate in any case : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to authenticate in any case.", tests.Success)
+
+			nu.Email = "jill@ardanlabs.com"
+			if _, err := s.Create(ctx, creator, nu, now); err != user.ErrEmailTaken {
+				t.Fatalf("\t%s\tShould NOT be able to reuse an email : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to reuse an email.", tests.Success)
+
+			if err := s.Delete(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+			nu.Email = "JILL@ardanlabs.com"
+			if _, err := s.Create(ctx, creator, nu, now); err != user.ErrEmailTaken {
+				t.Fatalf("\t%s\tShould NOT be able to reuse the email of a deleted user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to reuse the email of a deleted user.", tests.Success)
+		}
+
+		t.Log("\tWhen updating a user to the email of another.")
+		{
+			nu.Email = "jack@ardanlabs.com"
+			u, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			upd := user.UpdateUser{Email: tests.StringPointer("Jill@ardanlabs.com")}
+			if err := s.Update(ctx, claims, u.ID, upd, now); err != user.ErrEmailTaken {
+				t.Fatalf("\t%s\tShould NOT be able to take the email : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to take the email.", tests.Success)
+
+			upd = user.UpdateUser{Email: tests.StringPointer("JACK@ardanlabs.com")}
+			if err := s.Update(ctx, claims, u.ID, upd, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to keep its own email in another case : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to keep its own email in another case.", tests.Success)
+
+			if err := s.Delete(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+		}
+
+		t.Log("\tWhen using emails that are not addresses.")
+		{
+			for _, email := range []string{"jill", "jill@", "@ardanlabs.com", "Jill <jill@ardanlabs.com>", "jill smith@ardanlabs.com"} {
+				nu.Email = email
+				if _, err := s.Create(ctx, creator, nu, now); err != user.ErrInvalidEmail {
+					t.Fatalf("\t%s\tShould NOT be able to create a user with %q : %v.", tests.Failed, email, err)
+				}
+				t.Logf("\t%s\tShould NOT be able to create a user with %q.", tests.Success, email)
+			}
+		}
+	}
+}
+
+// profile validates users can change their own profile and need their
+// current password to change their email or password.
+func profile(t *testing.T, s user.Store) {
+	t.Log("Given the need for users to change their own profile.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+		nu := user.NewUser{
+			Name:            "Pat Gopher",
+			Email:           "pat@ardanlabs.com",
+			Roles:           []string{auth.RoleUser},
+			Password:        "gophers",
+			PasswordConfirm: "gophers",
+		}
+		u, err := s.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+		claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+
+		t.Log("\tWhen changing their profile.")
+		{
+			upd := user.UpdateProfile{Name: tests.StringPointer("Patricia Gopher")}
+			if err := s.UpdateProfile(ctx, claims, upd, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to change their name : %s.", tests.Failed, err)
+			}
+			got, err := s.Retrieve(ctx, claims, u.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+			}
+			if got.Name != "Patricia Gopher" {
+				t.Fatalf("\t%s\tShould have the new name : got %q.", tests.Failed, got.Name)
+			}
+			t.Logf("\t%s\tShould be able to change their name.", tests.Success)
+
+			upd = user.UpdateProfile{Password: tests.StringPointer("generics"), CurrentPassword: "wrong"}
+			if err := s.UpdateProfile(ctx, claims, upd, now); err != user.ErrWrongPassword {
+				t.Fatalf("\t%s\tShould NOT change the password without the current one : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT change the password without the current one.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould count the wrong password as a failed authentication : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould count the wrong password as a failed authentication.", tests.Success)
+
+			upd = user.UpdateProfile{Email: tests.StringPointer("patricia@ardanlabs.com")}
+			if err := s.UpdateProfile(ctx, claims, upd, now); err != user.ErrWrongPassword {
+				t.Fatalf("\t%s\tShould NOT change the email without the current password : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT change the email without the current password.", tests.Success)
+		}
+
+		t.Log("\tWhen changing their password.")
+		{
+			later := now.Add(time.Minute)
+			current, err := s.Authenticate(ctx, later, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			other, err := s.Authenticate(ctx, later, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+
+			upd := user.UpdateProfile{Password: tests.StringPointer("generics"), CurrentPassword: nu.Password}
+			if err := s.UpdateProfile(ctx, current, upd, later); err != nil {
+				t.Fatalf("\t%s\tShould be able to change the password : %s.", tests.Failed, err)
+			}
+			if _, err := s.Authenticate(ctx, later, nu.Email, "generics", source); err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate with the new password : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to change the password.", tests.Success)
+
+			if err := s.CheckClaims(ctx, current); err != nil {
+				t.Fatalf("\t%s\tShould keep the session the password was changed in : %s.", tests.Failed, err)
+			}
+			if err := s.CheckClaims(ctx, other); err != user.ErrTokenRevoked {
+				t.Fatalf("\t%s\tShould revoke the other sessions : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould revoke the other sessions.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// plusTags validates emails that only differ in their +tag belong to the same
+// user when the store strips the tags.
+func plusTags(t *testing.T, s user.Store) {
+	t.Log("Given the need to treat tagged emails as the same user.")
+	{
+		t.Log("\tWhen using an email with a tag.")
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{
+				Name:            "Tag Gopher",
+				Email:           "Tag+Sales@ardanlabs.com",
+				Roles:           []string{auth.RoleUser},
+				Password:        "select",
+				PasswordConfirm: "select",
+			}
+			u, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+			if u.Email != "tag@ardanlabs.com" {
+				t.Fatalf("\t%s\tShould store the email without the tag : got %q.", tests.Failed, u.Email)
+			}
+			t.Logf("\t%s\tShould store the email without the tag.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, now, "tag+other@ardanlabs.com", "select", source); err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate with another tag : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to authenticate with another tag.", tests.Success)
+
+			nu.Email = "tag@ardanlabs.com"
+			if _, err := s.Create(ctx, creator, nu, now); err != user.ErrEmailTaken {
+				t.Fatalf("\t%s\tShould NOT be able to reuse the email without the tag : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT be able to reuse the email without the tag.", tests.Success)
+		}
+	}
+}
+
+// checkEmails validates emails stored with a tag are found once tags are
+// stripped.
+func checkEmails(t *testing.T, s, tagged *user.DB) {
+	t.Log("Given the need to strip tags only from new emails.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+		t.Log("\tWhen users were stored with a tag.")
+		{
+			if err := tagged.CheckEmails(ctx); err != nil {
+				t.Fatalf("\t%s\tShould accept emails stored without a tag : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould accept emails stored without a tag.", tests.Success)
+
+			nu := user.NewUser{
+				Name:            "Kit Gopher",
+				Email:           "kit+ops@ardanlabs.com",
+				Roles:           []string{auth.RoleUser},
+				Password:        "select",
+				PasswordConfirm: "select",
+			}
+			u, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+			if err := s.CheckEmails(ctx); err != nil {
+				t.Fatalf("\t%s\tShould accept tags that are kept : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould accept tags that are kept.", tests.Success)
+
+			if err := tagged.CheckEmails(ctx); err == nil || !strings.Contains(err.Error(), nu.Email) {
+				t.Fatalf("\t%s\tShould report emails stored with a tag : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould report emails stored with a tag.", tests.Success)
+
+			if err := s.Delete(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+			if _, err := s.Purge(ctx, now.Add(time.Hour)); err != nil {
+				t.Fatalf("\t%s\tShould be able to purge users : %s.", tests.Failed, err)
+			}
+		}
+	}
+}
+
+// softDelete validates deleted users are hidden and can not authenticate but
+// can be restored until they are purged.
+func softDelete(t *testing.T, s user.Store) {
+	t.Log("Given the need to recover deleted Users.")
+	{
+		t.Log("\tWhen deleting a User.")
+		{
+			ctx := tests.Context()
+			now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+			nu := user.NewUser{
+				Name:            "Bill Gopher",
+				Email:           "bill@ardanlabs.com",
+				Roles:           []string{auth.RoleUser},
+				Password:        "interfaces",
+				PasswordConfirm: "interfaces",
+			}
+
+			u, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to create user.", tests.Success)
+
+			admin := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+			deleted := now.Add(time.Hour)
+
+			claims, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+
+			if err := s.Delete(ctx, u.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to delete user.", tests.Success)
+
+			if err := s.CheckClaims(ctx, claims); errors.Cause(err) != user.ErrTokenRevoked {
+				t.Fatalf("\t%s\tShould NOT accept the token of a deleted user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept the token of a deleted user.", tests.Success)
+
+			if _, err := s.Retrieve(ctx, admin, u.ID); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT be able to retrieve a deleted user : %v.", tests.Failed, err)
+			}
+			if _, err := s.Authenticate(ctx, now, "bill@ardanlabs.com", "interfaces", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate a deleted user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould hide a deleted user.", tests.Success)
+
+			list, err := s.List(ctx, user.Filter{IncludeDeleted: true})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list users : %s.", tests.Failed, err)
+			}
+			var found bool
+			for _, lu := range list {
+				if lu.ID == u.ID {
+					found = lu.DeletedAt != nil && lu.DeletedAt.Equal(deleted)
+				}
+			}
+			if !found {
+				t.Fatalf("\t%s\tShould list a deleted user when asked.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould list a deleted user when asked.", tests.Success)
+
+			if err := s.Restore(ctx, u.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to restore user : %s.", tests.Failed, err)
+			}
+			if _, err := s.Authenticate(ctx, now, "bill@ardanlabs.com", "interfaces", source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate a restored user : %s.", tests.Failed, err)
+			}
+			if err := s.CheckClaims(ctx, claims); errors.Cause(err) != user.ErrTokenRevoked {
+				t.Fatalf("\t%s\tShould keep the tokens from before the delete revoked : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould authenticate a restored user.", tests.Success)
+
+			if err := s.Delete(ctx, u.ID, deleted); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+			if _, err := s.Purge(ctx, deleted.Add(time.Second)); err != nil {
+				t.Fatalf("\t%s\tShould be able to purge users : %s.", tests.Failed, err)
+			}
+			if err := s.Restore(ctx, u.ID, deleted); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT be able to restore a purged user : %v.", tests.Failed, err)
+			}
+			if err := s.CheckClaims(ctx, auth.NewClaims(u.ID, nu.Roles, now, time.Hour)); errors.Cause(err) != user.ErrTokenRevoked {
+				t.Fatalf("\t%s\tShould NOT accept the token of a purged user : %v.", tests.Failed, err)
+			}
+			if _, err := s.Create(ctx, creator, nu, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to reuse the email of a purged user : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould purge the deleted user.", tests.Success)
+		}
+	}
+}
+
+// reset validates a forgotten password can be replaced once with a token that
+// expires and that doing so revokes the tokens issued before.
+func reset(t *testing.T, s user.Store) {
+	t.Log("Given the need to reset a forgotten password.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+		nu := user.NewUser{
+			Name:            "Rob Gopher",
+			Email:           "rob@ardanlabs.com",
+			Roles:           []string{auth.RoleUser},
+			Password:        "goroutines",
+			PasswordConfirm: "goroutines",
+		}
+
+		u, err := s.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+		before, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen requesting a reset.")
+		{
+			if _, err := s.RequestReset(ctx, "nobody@ardanlabs.com", time.Hour, now); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT reset the password of an unknown email : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT reset the password of an unknown email.", tests.Success)
+
+			expired, err := s.RequestReset(ctx, nu.Email, time.Minute, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to request a reset : %s.", tests.Failed, err)
+			}
+			if err := s.ConfirmReset(ctx, expired.Token, "stale", now.Add(time.Minute)); errors.Cause(err) != user.ErrInvalidResetToken {
+				t.Fatalf("\t%s\tShould NOT accept an expired token : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept an expired token.", tests.Success)
+
+			if err := s.ConfirmReset(ctx, "unknown", "guess", now); errors.Cause(err) != user.ErrInvalidResetToken {
+				t.Fatalf("\t%s\tShould NOT accept an unknown token : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept an unknown token.", tests.Success)
+		}
+
+		t.Log("\tWhen confirming a reset.")
+		{
+			first, err := s.RequestReset(ctx, nu.Email, time.Hour, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to request a reset : %s.", tests.Failed, err)
+			}
+			second, err := s.RequestReset(ctx, nu.Email, time.Hour, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to request a reset : %s.", tests.Failed, err)
+			}
+			if first.UserID != u.ID || first.Token == "" || first.Token == second.Token || !first.ExpiresAt.Equal(now.Add(time.Hour)) {
+				t.Fatalf("\t%s\tShould get a new token for the user : got %+v.", tests.Failed, first)
+			}
+			t.Logf("\t%s\tShould get a new token for the user.", tests.Success)
+
+			reset := now.Add(10 * time.Minute)
+			if err := s.ConfirmReset(ctx, first.Token, "channels", reset); err != nil {
+				t.Fatalf("\t%s\tShould be able to confirm the reset : %s.", tests.Failed, err)
+			}
+			if _, err := s.Authenticate(ctx, reset, nu.Email, nu.Password, source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with the old password : %v.", tests.Failed, err)
+			}
+			// The failure with the old password delays the next attempt.
+			after, err := s.Authenticate(ctx, reset.Add(time.Second), nu.Email, "channels", source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould authenticate with the new password : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould replace the password.", tests.Success)
+
+			for _, token := range []string{first.Token, second.Token} {
+				if err := s.ConfirmReset(ctx, token, "again", reset); errors.Cause(err) != user.ErrInvalidResetToken {
+					t.Fatalf("\t%s\tShould NOT accept a token after a reset : %v.", tests.Failed, err)
+				}
+			}
+			t.Logf("\t%s\tShould NOT accept any token of the user after a reset.", tests.Success)
+
+			if err := s.CheckClaims(ctx, before); errors.Cause(err) != user.ErrTokenRevoked {
+				t.Fatalf("\t%s\tShould revoke the tokens issued before the reset : %v.", tests.Failed, err)
+			}
+			if err := s.CheckClaims(ctx, after); err != nil {
+				t.Fatalf("\t%s\tShould accept the tokens issued after the reset : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould revoke only the tokens issued before the reset.", tests.Success)
+		}
+
+		t.Log("\tWhen the user is deleted.")
+		{
+			pr, err := s.RequestReset(ctx, nu.Email, time.Hour, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to request a reset : %s.", tests.Failed, err)
+			}
+			if err := s.Delete(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+			if _, err := s.RequestReset(ctx, nu.Email, time.Hour, now); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT reset the password of a deleted user : %v.", tests.Failed, err)
+			}
+			if err := s.ConfirmReset(ctx, pr.Token, "deleted", now); errors.Cause(err) != user.ErrInvalidResetToken {
+				t.Fatalf("\t%s\tShould NOT accept the token of a deleted user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT reset the password of a deleted user.", tests.Success)
+		}
+	}
+}
+
+// lockoutUser validates failed authentications slow down and lock out further
+// attempts of an account or source address until they end or are unlocked.
+func lockoutUser(t *testing.T, s user.Store) {
+	t.Log("Given the need to stop passwords from being guessed.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2018, time.November, 1, 0, 0, 0, 0, time.UTC)
+		admin := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+		nu := user.NewUser{
+			Name:            "Ken Gopher",
+			Email:           "ken@ardanlabs.com",
+			Roles:           []string{auth.RoleUser},
+			Password:        "select",
+			PasswordConfirm: "select",
+		}
+
+		u, err := s.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen a password is wrong.")
+		{
+			if _, err := s.Authenticate(ctx, now, nu.Email, "wrong", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould fail with a wrong password : %v.", tests.Failed, err)
+			}
+			if _, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould delay the next attempt : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould delay the next attempt.", tests.Success)
+
+			login := now.Add(time.Second)
+			if _, err := s.Authenticate(ctx, login, nu.Email, nu.Password, source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate after the delay : %s.", tests.Failed, err)
+			}
+			got, err := s.Retrieve(ctx, admin, u.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+			}
+			if got.LastLogin == nil || !got.LastLogin.Equal(login) || got.LoginFailures != 0 {
+				t.Fatalf("\t%s\tShould record the login and forget the failure : got %v and %d.", tests.Failed, got.LastLogin, got.LoginFailures)
+			}
+			t.Logf("\t%s\tShould record the login and forget the failure.", tests.Success)
+		}
+
+		t.Log("\tWhen a password is wrong too many times.")
+		{
+			at := now
+			for i := 0; i < 5; i++ {
+				at = at.Add(time.Minute)
+				if _, err := s.Authenticate(ctx, at, nu.Email, "wrong", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould fail with a wrong password : %v.", tests.Failed, err)
+				}
+			}
+
+			at = at.Add(5 * time.Minute)
+			if _, err := s.Authenticate(ctx, at, nu.Email, nu.Password, source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould lock the account : %v.", tests.Failed, err)
+			}
+			got, err := s.Retrieve(ctx, admin, u.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+			}
+			if got.LockedUntil == nil || !got.LockedUntil.After(at) {
+				t.Fatalf("\t%s\tShould lock the account : got %v.", tests.Failed, got.LockedUntil)
+			}
+			t.Logf("\t%s\tShould lock the account.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, *got.LockedUntil, nu.Email, nu.Password, source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate once the lock ended : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould authenticate once the lock ended.", tests.Success)
+		}
+
+		t.Log("\tWhen an admin unlocks the account.")
+		{
+			at := now.Add(time.Hour)
+			for i := 0; i < 5; i++ {
+				at = at.Add(time.Minute)
+				s.Authenticate(ctx, at, nu.Email, "wrong", source)
+			}
+			if _, err := s.Authenticate(ctx, at.Add(time.Minute), nu.Email, nu.Password, source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould lock the account : %v.", tests.Failed, err)
+			}
+
+			if err := s.Unlock(ctx, "12345", at); errors.Cause(err) != user.ErrInvalidID {
+				t.Fatalf("\t%s\tShould reject a malformed ID : %v.", tests.Failed, err)
+			}
+			if err := s.Unlock(ctx, admin.Subject, at); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT unlock an unknown user : %v.", tests.Failed, err)
+			}
+			if err := s.Unlock(ctx, u.ID, at); err != nil {
+				t.Fatalf("\t%s\tShould be able to unlock the user : %s.", tests.Failed, err)
+			}
+			if _, err := s.Authenticate(ctx, at.Add(time.Minute), nu.Email, nu.Password, source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate once unlocked : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould authenticate once unlocked.", tests.Success)
+		}
+
+		t.Log("\tWhen a source address fails too many times.")
+		{
+			const guesser = "198.51.100.7"
+			at := now.Add(2 * time.Hour)
+			for i := 0; i < cfg.Lockout.MaxSourceFailures; i++ {
+				if _, err := s.Authenticate(ctx, at, "nobody@ardanlabs.com", "guess", guesser); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould fail for an unknown email : %v.", tests.Failed, err)
+				}
+			}
+
+			if _, err := s.Authenticate(ctx, at, nu.Email, nu.Password, guesser); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould lock the source address : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould lock the source address.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, at, nu.Email, nu.Password, source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate from another address : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould authenticate from another address.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// code gives the current code of an authenticator app with the secret.
+func code(t *testing.T, secret string, now time.Time) string {
+	c, err := totp.Code(secret, totp.Step(now))
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to generate a code : %s.", tests.Failed, err)
+	}
+	return c
+}
+
+// mfaUser validates enrolling in two-factor authentication and completing
+// logins with codes and recovery codes.
+func mfaUser(t *testing.T, s user.Store) {
+	t.Log("Given the need to require a second factor to log in.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2018, time.December, 1, 0, 0, 0, 0, time.UTC)
+		admin := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+		nu := user.NewUser{
+			Name:            "Russ Gopher",
+			Email:           "russ@ardanlabs.com",
+			Roles:           []string{auth.RoleUser},
+			Password:        "interfaces",
+			PasswordConfirm: "interfaces",
+		}
+
+		u, err := s.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+		self := auth.NewClaims(u.ID, []string{auth.RoleUser}, now, time.Hour)
+
+		var secret string
+		var codes []string
+		t.Log("\tWhen enrolling.")
+		{
+			if _, err := s.EnrollMFA(ctx, admin, u.ID, now); errors.Cause(err) != user.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT enroll someone else : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT enroll someone else.", tests.Success)
+
+			if _, err := s.ConfirmMFA(ctx, self, u.ID, "000000", now); errors.Cause(err) != user.ErrMFANotEnrolled {
+				t.Fatalf("\t%s\tShould NOT confirm before enrolling : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT confirm before enrolling.", tests.Success)
+
+			e, err := s.EnrollMFA(ctx, self, u.ID, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to enroll : %s.", tests.Failed, err)
+			}
+			if e.Secret == "" || !strings.HasPrefix(e.URI, "otpauth://totp/") {
+				t.Fatalf("\t%s\tShould get a secret for an authenticator app : got %+v.", tests.Failed, e)
+			}
+			t.Logf("\t%s\tShould get a secret for an authenticator app.", tests.Success)
+			secret = e.Secret
+
+			if _, err := s.ConfirmMFA(ctx, self, u.ID, code(t, secret, now.Add(time.Hour)), now); errors.Cause(err) != user.ErrInvalidMFACode {
+				t.Fatalf("\t%s\tShould NOT confirm with a wrong code : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT confirm with a wrong code.", tests.Success)
+
+			claims, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if claims.Audience == user.ChallengeAudience {
+				t.Fatalf("\t%s\tShould NOT ask for a code before the enrollment is confirmed.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould NOT ask for a code before the enrollment is confirmed.", tests.Success)
+
+			codes, err = s.ConfirmMFA(ctx, self, u.ID, code(t, secret, now), now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to confirm : %s.", tests.Failed, err)
+			}
+			if len(codes) == 0 {
+				t.Fatalf("\t%s\tShould get recovery codes.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get recovery codes.", tests.Success)
+
+			if _, err := s.EnrollMFA(ctx, self, u.ID, now); errors.Cause(err) != user.ErrMFAEnabled {
+				t.Fatalf("\t%s\tShould NOT enroll twice : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT enroll twice.", tests.Success)
+
+			got, err := s.Retrieve(ctx, self, u.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+			}
+			if !got.MFAEnabled {
+				t.Fatalf("\t%s\tShould enable two-factor authentication.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould enable two-factor authentication.", tests.Success)
+		}
+
+		t.Log("\tWhen logging in.")
+		{
+			at := now.Add(time.Minute)
+			challenge, err := s.Authenticate(ctx, at, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if challenge.Audience != user.ChallengeAudience || len(challenge.Roles) != 0 {
+				t.Fatalf("\t%s\tShould only get a challenge : got %+v.", tests.Failed, challenge)
+			}
+			t.Logf("\t%s\tShould only get a challenge.", tests.Success)
+
+			if _, err := s.VerifyMFA(ctx, at, self, code(t, secret, at), source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT verify claims that are not a challenge : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT verify claims that are not a challenge.", tests.Success)
+
+			claims, err := s.VerifyMFA(ctx, at, challenge, code(t, secret, at), source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould complete the login with a code : %s.", tests.Failed, err)
+			}
+			if claims.Audience != "" || !claims.HasRole(auth.RoleUser) {
+				t.Fatalf("\t%s\tShould get the claims of the user : got %+v.", tests.Failed, claims)
+			}
+			t.Logf("\t%s\tShould complete the login with a code.", tests.Success)
+
+			at = at.Add(time.Second)
+			if _, err := s.VerifyMFA(ctx, at, challenge, code(t, secret, at), source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT accept a code twice : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept a code twice.", tests.Success)
+
+			at = at.Add(time.Minute)
+			if _, err := s.VerifyMFA(ctx, at, challenge, strings.ToUpper(codes[0]), source); err != nil {
+				t.Fatalf("\t%s\tShould complete the login with a recovery code : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould complete the login with a recovery code.", tests.Success)
+
+			at = at.Add(time.Minute)
+			if _, err := s.VerifyMFA(ctx, at, challenge, codes[0], source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT accept a recovery code twice : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept a recovery code twice.", tests.Success)
+		}
+
+		t.Log("\tWhen guessing codes.")
+		{
+			at := now.Add(time.Hour)
+			challenge, err := s.Authenticate(ctx, at, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			for i := 0; i < 5; i++ {
+				at = at.Add(time.Minute)
+				if _, err := s.VerifyMFA(ctx, at, challenge, "000000", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+					t.Fatalf("\t%s\tShould fail with a wrong code : %v.", tests.Failed, err)
+				}
+			}
+			at = at.Add(time.Second)
+			if _, err := s.VerifyMFA(ctx, at, challenge, code(t, secret, at), source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould lock the account : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould lock the account.", tests.Success)
+
+			if err := s.Unlock(ctx, u.ID, at); err != nil {
+				t.Fatalf("\t%s\tShould be able to unlock the user : %s.", tests.Failed, err)
+			}
+		}
+
+		t.Log("\tWhen disabling.")
+		{
+			if err := s.DisableMFA(ctx, auth.NewClaims(admin.Subject, []string{auth.RoleUser}, now, time.Hour), u.ID, now); errors.Cause(err) != user.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT disable it for someone else : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT let users disable it for someone else.", tests.Success)
+
+			if err := s.DisableMFA(ctx, admin, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould let an admin disable it : %s.", tests.Failed, err)
+			}
+			claims, err := s.Authenticate(ctx, now.Add(2*time.Hour), nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if claims.Audience != "" || !claims.HasRole(auth.RoleUser) {
+				t.Fatalf("\t%s\tShould no longer ask for a code : got %+v.", tests.Failed, claims)
+			}
+			t.Logf("\t%s\tShould no longer ask for a code once disabled.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// adminMFA validates admins only get the ADMIN role once they use two-factor
+// authentication when the Store requires it.
+func adminMFA(t *testing.T, s user.Store) {
+	t.Log("Given the need to require admins to use a second factor.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+		nu := user.NewUser{
+			Name:            "Ian Gopher",
+			Email:           "ian@ardanlabs.com",
+			Roles:           []string{auth.RoleAdmin, auth.RoleUser},
+			Password:        "generics",
+			PasswordConfirm: "generics",
+		}
+
+		u, err := s.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+
+		t.Log("\tWhen an admin has not enrolled.")
+		{
+			claims, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if claims.HasRole(auth.RoleAdmin) || !claims.HasRole(auth.RoleUser) {
+				t.Fatalf("\t%s\tShould NOT get the ADMIN role : got %v.", tests.Failed, claims.Roles)
+			}
+			t.Logf("\t%s\tShould NOT get the ADMIN role.", tests.Success)
+
+			e, err := s.EnrollMFA(ctx, claims, u.ID, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to enroll : %s.", tests.Failed, err)
+			}
+			if _, err := s.ConfirmMFA(ctx, claims, u.ID, code(t, e.Secret, now), now); err != nil {
+				t.Fatalf("\t%s\tShould be able to confirm : %s.", tests.Failed, err)
+			}
+
+			at := now.Add(time.Minute)
+			challenge, err := s.Authenticate(ctx, at, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			claims, err = s.VerifyMFA(ctx, at, challenge, code(t, e.Secret, at), source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould complete the login with a code : %s.", tests.Failed, err)
+			}
+			if !claims.HasRole(auth.RoleAdmin) {
+				t.Fatalf("\t%s\tShould get the ADMIN role once enrolled : got %v.", tests.Failed, claims.Roles)
+			}
+			t.Logf("\t%s\tShould get the ADMIN role once enrolled.", tests.Success)
+		}
+
+		t.Log("\tWhen an admin uses an API key.")
+		{
+			claims := auth.NewClaims(u.ID, nu.Roles, now, time.Hour)
+			nk := user.NewAPIKey{Name: "ops", Scopes: []string{auth.RoleAdmin, auth.RoleUser}}
+			k, err := s.CreateAPIKey(ctx, claims, u.ID, nk, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a key : %s.", tests.Failed, err)
+			}
+			kc, err := s.AuthenticateAPIKey(ctx, now, k.Key)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if !kc.HasRole(auth.RoleAdmin) {
+				t.Fatalf("\t%s\tShould get the ADMIN role while enrolled : got %v.", tests.Failed, kc.Roles)
+			}
+
+			if err := s.DisableMFA(ctx, claims, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to disable two-factor authentication : %s.", tests.Failed, err)
+			}
+			kc, err = s.AuthenticateAPIKey(ctx, now, k.Key)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if kc.HasRole(auth.RoleAdmin) || !kc.HasRole(auth.RoleUser) {
+				t.Fatalf("\t%s\tShould NOT get the ADMIN role with a key once unenrolled : got %v.", tests.Failed, kc.Roles)
+			}
+			t.Logf("\t%s\tShould NOT get the ADMIN role with a key once unenrolled.", tests.Success)
+		}
+
+		t.Log("\tWhen an admin logs in through an identity provider.")
+		{
+			ext := user.External{
+				Issuer:        "https://idp.example.com",
+				Subject:       "jo",
+				Email:         "jo@ardanlabs.com",
+				EmailVerified: true,
+				Roles:         []string{auth.RoleAdmin, auth.RoleUser},
+			}
+			claims, err := s.AuthenticateExternal(ctx, now, ext, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if claims.HasRole(auth.RoleAdmin) || !claims.HasRole(auth.RoleUser) {
+				t.Fatalf("\t%s\tShould NOT get the ADMIN role : got %v.", tests.Failed, claims.Roles)
+			}
+			idc, err := s.AuthenticateIDToken(ctx, now, ext, now.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate with an ID token : %s.", tests.Failed, err)
+			}
+			if idc.HasRole(auth.RoleAdmin) || !idc.HasRole(auth.RoleUser) {
+				t.Fatalf("\t%s\tShould NOT get the ADMIN role with an ID token : got %v.", tests.Failed, idc.Roles)
+			}
+			t.Logf("\t%s\tShould NOT get the ADMIN role.", tests.Success)
+
+			e, err := s.EnrollMFA(ctx, claims, claims.Subject, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to enroll : %s.", tests.Failed, err)
+			}
+			if _, err := s.ConfirmMFA(ctx, claims, claims.Subject, code(t, e.Secret, now), now); err != nil {
+				t.Fatalf("\t%s\tShould be able to confirm : %s.", tests.Failed, err)
+			}
+
+			at := now.Add(time.Minute)
+			challenge, err := s.AuthenticateExternal(ctx, at, ext, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if challenge.Audience != user.ChallengeAudience {
+				t.Fatalf("\t%s\tShould get a challenge once enrolled : got %+v.", tests.Failed, challenge)
+			}
+			claims, err = s.VerifyMFA(ctx, at, challenge, code(t, e.Secret, at), source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould complete the login with a code : %s.", tests.Failed, err)
+			}
+			if !claims.HasRole(auth.RoleAdmin) {
+				t.Fatalf("\t%s\tShould get the ADMIN role once enrolled : got %v.", tests.Failed, claims.Roles)
+			}
+			t.Logf("\t%s\tShould get a challenge once enrolled.", tests.Success)
+
+			if _, err := s.AuthenticateIDToken(ctx, at, ext, at.Add(time.Minute)); errors.Cause(err) != user.ErrMFARequired {
+				t.Fatalf("\t%s\tShould NOT authenticate with an ID token once enrolled : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate with an ID token once enrolled.", tests.Success)
+
+			if err := s.Delete(ctx, claims.Subject, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// register validates people can sign up and only log in once they verified
+// their email.
+func register(t *testing.T, s user.Store) {
+	t.Log("Given the need to let people sign up themselves.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.February, 1, 0, 0, 0, 0, time.UTC)
+
+		nr := user.NewRegistration{
+			Name:            "Robert Gopher",
+			Email:           "robert@ardanlabs.com",
+			Password:        "select",
+			PasswordConfirm: "select",
+		}
+
+		var v *user.Verification
+		t.Log("\tWhen signing up.")
+		{
+			var err error
+			v, err = s.Register(ctx, nr, time.Minute, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to sign up : %s.", tests.Failed, err)
+			}
+			if v.UserID == "" || v.Email != nr.Email || v.Token == "" {
+				t.Fatalf("\t%s\tShould get a verification for the user : got %+v.", tests.Failed, v)
+			}
+			t.Logf("\t%s\tShould get a verification for the user.", tests.Success)
+
+			self := auth.NewClaims(v.UserID, []string{auth.RoleUser}, now, time.Hour)
+			u, err := s.Retrieve(ctx, self, v.UserID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+			}
+			if !u.Unverified || len(u.Roles) != 1 || u.Roles[0] != auth.RoleUser {
+				t.Fatalf("\t%s\tShould be an unverified user with the USER role : got %+v.", tests.Failed, u)
+			}
+			t.Logf("\t%s\tShould be an unverified user with the USER role.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, now, nr.Email, nr.Password, source); errors.Cause(err) != user.ErrUnverified {
+				t.Fatalf("\t%s\tShould NOT authenticate before verifying : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate before verifying.", tests.Success)
+		}
+
+		t.Log("\tWhen asking for another verification.")
+		{
+			if _, err := s.RequestVerification(ctx, "admin@ardanlabs.com", time.Hour, now); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT verify an unknown email : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT verify an unknown email.", tests.Success)
+
+			if err := s.Verify(ctx, v.Token, now.Add(time.Minute)); errors.Cause(err) != user.ErrInvalidVerificationToken {
+				t.Fatalf("\t%s\tShould NOT accept an expired token : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept an expired token.", tests.Success)
+
+			again, err := s.RequestVerification(ctx, nr.Email, time.Hour, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to request a verification : %s.", tests.Failed, err)
+			}
+			if again.UserID != v.UserID || again.Token == v.Token {
+				t.Fatalf("\t%s\tShould get a new token for the user : got %+v.", tests.Failed, again)
+			}
+			t.Logf("\t%s\tShould get a new token for the user.", tests.Success)
+
+			if err := s.Verify(ctx, again.Token, now.Add(time.Minute)); err != nil {
+				t.Fatalf("\t%s\tShould be able to verify : %s.", tests.Failed, err)
+			}
+			if err := s.Verify(ctx, again.Token, now.Add(time.Minute)); errors.Cause(err) != user.ErrInvalidVerificationToken {
+				t.Fatalf("\t%s\tShould NOT accept a token twice : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould only accept a token once.", tests.Success)
+
+			if _, err := s.RequestVerification(ctx, nr.Email, time.Hour, now); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT verify a verified user again : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT verify a verified user again.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, now.Add(time.Minute), nr.Email, nr.Password, source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate once verified : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould authenticate once verified.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, v.UserID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// signupDomains validates people can only sign up with the allowed email
+// domains when the Store restricts them.
+func signupDomains(t *testing.T, s user.Store) {
+	t.Log("Given the need to only let some people sign up.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+		t.Log("\tWhen signing up.")
+		{
+			nr := user.NewRegistration{
+				Name:            "Eve Gopher",
+				Email:           "eve@example.com",
+				Password:        "select",
+				PasswordConfirm: "select",
+			}
+			if _, err := s.Register(ctx, nr, time.Hour, now); errors.Cause(err) != user.ErrDomainNotAllowed {
+				t.Fatalf("\t%s\tShould NOT sign up with another domain : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT sign up with another domain.", tests.Success)
+
+			nr.Email = "eve@ArdanLabs.com"
+			v, err := s.Register(ctx, nr, time.Hour, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould sign up with an allowed domain : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould sign up with an allowed domain.", tests.Success)
+
+			if err := s.Delete(ctx, v.UserID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+		}
+	}
+}
+
+// apiKeys validates users can create keys for machine clients that only carry
+// the scopes they were given.
+func apiKeys(t *testing.T, s user.Store) {
+	t.Log("Given the need to authenticate machine clients with API keys.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+		nu := user.NewUser{
+			Name:            "Kim Gopher",
+			Email:           "kim@ardanlabs.com",
+			Roles:           []string{auth.RoleAdmin, auth.RoleUser},
+			Password:        "channels",
+			PasswordConfirm: "channels",
+		}
+
+		u, err := s.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+		self := auth.NewClaims(u.ID, nu.Roles, now, time.Hour)
+		other := auth.NewClaims("5cf37266-3473-4006-984f-9325122678b7", []string{auth.RoleUser}, now, time.Hour)
+
+		var k *user.APIKey
+		t.Log("\tWhen creating a key.")
+		{
+			nk := user.NewAPIKey{Name: "ci", Scopes: []string{"DEPLOYER"}}
+			if _, err := s.CreateAPIKey(ctx, self, u.ID, nk, now); errors.Cause(err) != user.ErrInvalidScope {
+				t.Fatalf("\t%s\tShould NOT create a key with a scope the user lacks : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT create a key with a scope the user lacks.", tests.Success)
+
+			nk.Scopes = []string{auth.RoleAdmin, auth.RoleUser}
+			if _, err := s.CreateAPIKey(ctx, other, u.ID, nk, now); errors.Cause(err) != user.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT create a key for someone else : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT create a key for someone else.", tests.Success)
+
+			k, err = s.CreateAPIKey(ctx, self, u.ID, nk, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a key : %s.", tests.Failed, err)
+			}
+			if k.Key == "" || !strings.HasPrefix(k.Key, k.Prefix+".") {
+				t.Fatalf("\t%s\tShould get the full key once : got %+v.", tests.Failed, k)
+			}
+			t.Logf("\t%s\tShould get the full key once.", tests.Success)
+		}
+
+		t.Log("\tWhen authenticating with a key.")
+		{
+			at := now.Add(time.Minute)
+			claims, err := s.AuthenticateAPIKey(ctx, at, k.Key)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if claims.Subject != u.ID || claims.Audience != user.APIKeyAudience || !claims.HasRole(auth.RoleAdmin) {
+				t.Fatalf("\t%s\tShould get the claims of the user : got %+v.", tests.Failed, claims)
+			}
+			t.Logf("\t%s\tShould get the claims of the user.", tests.Success)
+
+			if _, err := s.AuthenticateAPIKey(ctx, at, k.Prefix+".wrong"); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with a wrong secret : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate with a wrong secret.", tests.Success)
+
+			nk := user.NewAPIKey{Name: "more", Scopes: []string{auth.RoleUser}}
+			if _, err := s.CreateAPIKey(ctx, claims, u.ID, nk, at); errors.Cause(err) != user.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT create keys with a key : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT create keys with a key.", tests.Success)
+
+			keys, err := s.ListAPIKeys(ctx, self, u.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list keys : %s.", tests.Failed, err)
+			}
+			if len(keys) != 1 || keys[0].Key != "" || keys[0].LastUsed == nil || !keys[0].LastUsed.Equal(at) {
+				t.Fatalf("\t%s\tShould list the key with when it was last used : got %+v.", tests.Failed, keys)
+			}
+			t.Logf("\t%s\tShould list the key with when it was last used.", tests.Success)
+
+			if _, err := s.ListAPIKeys(ctx, other, u.ID); errors.Cause(err) != user.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT list the keys of someone else : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT list the keys of someone else.", tests.Success)
+		}
+
+		t.Log("\tWhen the user loses a role.")
+		{
+			admin := auth.NewClaims(u.ID, []string{auth.RoleAdmin}, now, time.Hour)
+			if err := s.Update(ctx, admin, u.ID, user.UpdateUser{Roles: []string{auth.RoleUser}}, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to update user : %s.", tests.Failed, err)
+			}
+			claims, err := s.AuthenticateAPIKey(ctx, now, k.Key)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if claims.HasRole(auth.RoleAdmin) || !claims.HasRole(auth.RoleUser) {
+				t.Fatalf("\t%s\tShould only get the scopes the user still has : got %v.", tests.Failed, claims.Roles)
+			}
+			t.Logf("\t%s\tShould only get the scopes the user still has.", tests.Success)
+		}
+
+		t.Log("\tWhen a key expires or is revoked.")
+		{
+			exp := now.Add(time.Hour)
+			self := auth.NewClaims(u.ID, []string{auth.RoleUser}, now, time.Hour)
+			nk := user.NewAPIKey{Name: "short", Scopes: []string{auth.RoleUser}, ExpiresAt: &exp}
+			short, err := s.CreateAPIKey(ctx, self, u.ID, nk, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a key : %s.", tests.Failed, err)
+			}
+			if _, err := s.AuthenticateAPIKey(ctx, exp, short.Key); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with an expired key : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate with an expired key.", tests.Success)
+
+			if err := s.RevokeAPIKey(ctx, other, u.ID, k.ID, now); errors.Cause(err) != user.ErrForbidden {
+				t.Fatalf("\t%s\tShould NOT revoke the key of someone else : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT revoke the key of someone else.", tests.Success)
+
+			if err := s.RevokeAPIKey(ctx, self, u.ID, k.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to revoke the key : %s.", tests.Failed, err)
+			}
+			if _, err := s.AuthenticateAPIKey(ctx, now, k.Key); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with a revoked key : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate with a revoked key.", tests.Success)
+
+			if err := s.RevokeAPIKey(ctx, self, u.ID, other.Subject, now); errors.Cause(err) != user.ErrAPIKeyNotFound {
+				t.Fatalf("\t%s\tShould NOT revoke an unknown key : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT revoke an unknown key.", tests.Success)
+		}
+
+		t.Log("\tWhen the password is reset or the user is disabled.")
+		{
+			self := auth.NewClaims(u.ID, []string{auth.RoleUser}, now, time.Hour)
+			nk := user.NewAPIKey{Name: "cron", Scopes: []string{auth.RoleUser}}
+
+			k, err := s.CreateAPIKey(ctx, self, u.ID, nk, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a key : %s.", tests.Failed, err)
+			}
+			pr, err := s.RequestReset(ctx, nu.Email, time.Hour, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to request a reset : %s.", tests.Failed, err)
+			}
+			if err := s.ConfirmReset(ctx, pr.Token, "goroutines", now); err != nil {
+				t.Fatalf("\t%s\tShould be able to reset the password : %s.", tests.Failed, err)
+			}
+			if _, err := s.AuthenticateAPIKey(ctx, now, k.Key); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with a key after a reset : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould revoke the keys when the password is reset.", tests.Success)
+
+			k, err = s.CreateAPIKey(ctx, self, u.ID, nk, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a key : %s.", tests.Failed, err)
+			}
+			if err := s.Disable(ctx, u.ID, "Leaving", now); err != nil {
+				t.Fatalf("\t%s\tShould be able to disable user : %s.", tests.Failed, err)
+			}
+			if err := s.Enable(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to enable user : %s.", tests.Failed, err)
+			}
+			if _, err := s.AuthenticateAPIKey(ctx, now, k.Key); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with a key of a disabled user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould revoke the keys when the user is disabled.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// passwordPolicy validates new passwords must follow the policy of the Store
+// wherever they are set.
+func passwordPolicy(t *testing.T, s user.Store) {
+	t.Log("Given the need to keep users from choosing weak passwords.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC)
+
+		nu := user.NewUser{
+			Name:  "Pat Gopher",
+			Email: "pat@ardanlabs.com",
+			Roles: []string{auth.RoleUser},
+		}
+
+		var u *user.User
+		t.Log("\tWhen creating a user.")
+		{
+			weak := []struct {
+				password string
+				err      error
+			}{
+				{"Go-1", user.ErrPasswordTooShort},
+				{"gophersgophers", user.ErrPasswordTooSimple},
+				{"GOPHERSgophers", user.ErrPasswordTooSimple},
+				{"correct-HORSE-1", user.ErrPasswordBreached},
+			}
+			for _, w := range weak {
+				nu.Password, nu.PasswordConfirm = w.password, w.password
+				if _, err := s.Create(ctx, creator, nu, now); errors.Cause(err) != w.err {
+					t.Fatalf("\t%s\tShould NOT accept %q : got %v, want %v.", tests.Failed, w.password, err, w.err)
+				}
+			}
+			t.Logf("\t%s\tShould NOT accept passwords against the policy.", tests.Success)
+
+			nu.Password, nu.PasswordConfirm = "Gophers-2019", "Gophers-2019"
+			var err error
+			if u, err = s.Create(ctx, creator, nu, now); err != nil {
+				t.Fatalf("\t%s\tShould accept a password following the policy : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould accept a password following the policy.", tests.Success)
+		}
+
+		t.Log("\tWhen changing the password.")
+		{
+			self := auth.NewClaims(u.ID, []string{auth.RoleUser}, now, time.Hour)
+			weak := "gophers"
+			if err := s.Update(ctx, self, u.ID, user.UpdateUser{Password: &weak}, now); errors.Cause(err) != user.ErrPasswordTooShort {
+				t.Fatalf("\t%s\tShould NOT update to a weak password : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT update to a weak password.", tests.Success)
+
+			pr, err := s.RequestReset(ctx, nu.Email, time.Hour, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to request a reset : %s.", tests.Failed, err)
+			}
+			if err := s.ConfirmReset(ctx, pr.Token, weak, now); errors.Cause(err) != user.ErrPasswordTooShort {
+				t.Fatalf("\t%s\tShould NOT reset to a weak password : %v.", tests.Failed, err)
+			}
+			if err := s.ConfirmReset(ctx, pr.Token, "Gophers-2020", now); err != nil {
+				t.Fatalf("\t%s\tShould keep the token usable after a weak password : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT reset to a weak password.", tests.Success)
+		}
+
+		t.Log("\tWhen signing up.")
+		{
+			nr := user.NewRegistration{
+				Name:            "Sam Gopher",
+				Email:           "sam@ardanlabs.com",
+				Password:        "Correct-Horse-1",
+				PasswordConfirm: "Correct-Horse-1",
+			}
+			if _, err := s.Register(ctx, nr, time.Hour, now); errors.Cause(err) != user.ErrPasswordBreached {
+				t.Fatalf("\t%s\tShould NOT sign up with a breached password : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT sign up with a breached password.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// rehash validates the hashes of users are upgraded when they authenticate
+// with a Store using another hasher than the one that created them. The load
+// func makes a user created in old known to s when they do not share storage.
+func rehash(t *testing.T, old, s user.Store, load func(user.User)) {
+	t.Log("Given the need to upgrade how passwords are hashed.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+		nu := user.NewUser{
+			Name:            "Dana Gopher",
+			Email:           "dana@ardanlabs.com",
+			Roles:           []string{auth.RoleUser},
+			Password:        "interfaces",
+			PasswordConfirm: "interfaces",
+		}
+
+		u, err := old.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+		load(*u)
+
+		stored := func() []byte {
+			users, err := s.List(ctx, user.Filter{})
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list users : %s.", tests.Failed, err)
+			}
+			for _, usr := range users {
+				if usr.ID == u.ID {
+					return usr.PasswordHash
+				}
+			}
+			t.Fatalf("\t%s\tShould find the user.", tests.Failed)
+			return nil
+		}
+
+		t.Log("\tWhen authenticating with an outdated hash.")
+		{
+			if _, err := s.Authenticate(ctx, now, nu.Email, "wrong", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with a wrong password : %v.", tests.Failed, err)
+			}
+			if strings.HasPrefix(string(stored()), "$argon2id$") {
+				t.Fatalf("\t%s\tShould NOT upgrade the hash for a wrong password.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould NOT upgrade the hash for a wrong password.", tests.Success)
+
+			// Waiting out the delay after the failure.
+			at := now.Add(time.Hour)
+			if _, err := s.Authenticate(ctx, at, nu.Email, nu.Password, source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate with the old hash : %s.", tests.Failed, err)
+			}
+			if !strings.HasPrefix(string(stored()), "$argon2id$") {
+				t.Fatalf("\t%s\tShould upgrade the hash : got %s.", tests.Failed, stored())
+			}
+			t.Logf("\t%s\tShould upgrade the hash.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, at, nu.Email, nu.Password, source); err != nil {
+				t.Fatalf("\t%s\tShould authenticate with the new hash : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould authenticate with the new hash.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// disable validates admins can cut off users without deleting them and end
+// their sessions one by one.
+func disable(t *testing.T, s user.Store) {
+	t.Log("Given the need to cut off users without deleting them.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+		nu := user.NewUser{
+			Name:            "Max Gopher",
+			Email:           "max@ardanlabs.com",
+			Roles:           []string{auth.RoleUser},
+			Password:        "mutexes",
+			PasswordConfirm: "mutexes",
+		}
+
+		u, err := s.Create(ctx, creator, nu, now)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+		}
+
+		var first auth.Claims
+		t.Log("\tWhen a user logs in.")
+		{
+			first, err = s.Authenticate(ctx, now, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			sessions, err := s.ListSessions(ctx, u.ID, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to list sessions : %s.", tests.Failed, err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != first.Id || sessions[0].Source != source {
+				t.Fatalf("\t%s\tShould list the session of the login : got %+v.", tests.Failed, sessions)
+			}
+			t.Logf("\t%s\tShould list the session of the login.", tests.Success)
+
+			if sessions, err = s.ListSessions(ctx, u.ID, now.Add(time.Hour)); err != nil || len(sessions) != 0 {
+				t.Fatalf("\t%s\tShould NOT list expired sessions : got %+v %v.", tests.Failed, sessions, err)
+			}
+			t.Logf("\t%s\tShould NOT list expired sessions.", tests.Success)
+		}
+
+		t.Log("\tWhen the user is disabled.")
+		{
+			self := auth.NewClaims(u.ID, []string{auth.RoleUser}, now, time.Hour)
+			k, err := s.CreateAPIKey(ctx, self, u.ID, user.NewAPIKey{Name: "ci", Scopes: []string{auth.RoleUser}}, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create a key : %s.", tests.Failed, err)
+			}
+
+			if err := s.Disable(ctx, "5cf37266-3473-4006-984f-9325122678b7", "left", now); errors.Cause(err) != user.ErrNotFound {
+				t.Fatalf("\t%s\tShould NOT disable an unknown user : %v.", tests.Failed, err)
+			}
+			if err := s.Disable(ctx, u.ID, "left the company", now); err != nil {
+				t.Fatalf("\t%s\tShould be able to disable : %s.", tests.Failed, err)
+			}
+			admin := auth.NewClaims(u.ID, []string{auth.RoleAdmin}, now, time.Hour)
+			got, err := s.Retrieve(ctx, admin, u.ID)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+			}
+			if got.DisabledAt == nil || !got.DisabledAt.Equal(now) || got.DisabledReason != "left the company" {
+				t.Fatalf("\t%s\tShould keep when and why the user was disabled : got %v %q.", tests.Failed, got.DisabledAt, got.DisabledReason)
+			}
+			t.Logf("\t%s\tShould keep when and why the user was disabled.", tests.Success)
+
+			if err := s.CheckClaims(ctx, first); errors.Cause(err) != user.ErrDisabled {
+				t.Fatalf("\t%s\tShould reject the tokens of the user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould reject the tokens of the user.", tests.Success)
+
+			if _, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source); errors.Cause(err) != user.ErrDisabled {
+				t.Fatalf("\t%s\tShould NOT authenticate : %v.", tests.Failed, err)
+			}
+			if _, err := s.AuthenticateAPIKey(ctx, now, k.Key); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with an API key : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate.", tests.Success)
+
+			if sessions, err := s.ListSessions(ctx, u.ID, now); err != nil || len(sessions) != 0 {
+				t.Fatalf("\t%s\tShould end the sessions of the user : got %+v %v.", tests.Failed, sessions, err)
+			}
+			t.Logf("\t%s\tShould end the sessions of the user.", tests.Success)
+		}
+
+		t.Log("\tWhen the user is enabled again.")
+		{
+			if err := s.Enable(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to enable : %s.", tests.Failed, err)
+			}
+			if err := s.CheckClaims(ctx, first); errors.Cause(err) != user.ErrTokenRevoked {
+				t.Fatalf("\t%s\tShould NOT accept the tokens of ended sessions : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept the tokens of ended sessions.", tests.Success)
+
+			claims, err := s.Authenticate(ctx, now, nu.Email, nu.Password, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if err := s.CheckClaims(ctx, claims); err != nil {
+				t.Fatalf("\t%s\tShould accept the tokens of a new session : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould accept the tokens of a new session.", tests.Success)
+
+			if err := s.RevokeSession(ctx, u.ID, first.Subject, now); errors.Cause(err) != user.ErrSessionNotFound {
+				t.Fatalf("\t%s\tShould NOT revoke an unknown session : %v.", tests.Failed, err)
+			}
+			if err := s.RevokeSession(ctx, u.ID, claims.Id, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to revoke the session : %s.", tests.Failed, err)
+			}
+			if err := s.CheckClaims(ctx, claims); errors.Cause(err) != user.ErrTokenRevoked {
+				t.Fatalf("\t%s\tShould NOT accept the tokens of a revoked session : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT accept the tokens of a revoked session.", tests.Success)
+		}
+
+		if err := s.Delete(ctx, u.ID, now); err != nil {
+			t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+		}
+	}
+}
+
+// external validates people an identity provider vouched for are provisioned
+// as local users.
+func external(t *testing.T, s user.Store) {
+	t.Log("Given the need to log in people an identity provider vouched for.")
+	{
+		ctx := tests.Context()
+		now := time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+		admin := auth.NewClaims(tests.AdminID, []string{auth.RoleAdmin}, now, time.Hour)
+
+		ext := user.External{
+			Issuer:        "https://idp.example.com",
+			Subject:       "ada",
+			Email:         "ada@ardanlabs.com",
+			EmailVerified: true,
+			Name:          "Ada Gopher",
+			Roles:         []string{auth.RoleUser},
+		}
+
+		var id string
+		t.Log("\tWhen someone logs in for the first time.")
+		{
+			u, err := s.Provision(ctx, ext, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to provision the user : %s.", tests.Failed, err)
+			}
+			if u.Email != ext.Email || u.Name != ext.Name || !cmp.Equal([]string(u.Roles), ext.Roles) {
+				t.Fatalf("\t%s\tShould create a user from the identity : got %+v.", tests.Failed, u)
+			}
+			t.Logf("\t%s\tShould create a user from the identity.", tests.Success)
+			id = u.ID
+
+			if _, err := s.Authenticate(ctx, now, ext.Email, "", source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with a password : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate with a password.", tests.Success)
+		}
+
+		t.Log("\tWhen someone logs in again.")
+		{
+			ext.Roles = []string{auth.RoleAdmin, auth.RoleUser}
+			ext.Email = "ada@example.com"
+			claims, err := s.AuthenticateExternal(ctx, now, ext, source)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to authenticate : %s.", tests.Failed, err)
+			}
+			if claims.Subject != id || !cmp.Equal(claims.Roles, ext.Roles) {
+				t.Fatalf("\t%s\tShould log in as the linked user with the roles of the provider : got %+v.", tests.Failed, claims)
+			}
+			t.Logf("\t%s\tShould log in as the linked user with the roles of the provider.", tests.Success)
+
+			sessions, err := s.ListSessions(ctx, id, now)
+			if err != nil || len(sessions) != 1 || sessions[0].ID != claims.Id {
+				t.Fatalf("\t%s\tShould start a session : got %+v %v.", tests.Failed, sessions, err)
+			}
+			if err := s.CheckClaims(ctx, claims); err != nil {
+				t.Fatalf("\t%s\tShould accept the claims : %s.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould start a session.", tests.Success)
+
+			u, err := s.Retrieve(ctx, admin, id)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve user : %s.", tests.Failed, err)
+			}
+			if !cmp.Equal([]string(u.Roles), ext.Roles) {
+				t.Fatalf("\t%s\tShould keep the roles of the provider : got %v.", tests.Failed, u.Roles)
+			}
+			t.Logf("\t%s\tShould keep the roles of the provider.", tests.Success)
+		}
+
+		t.Log("\tWhen someone logs in with the email of a local user.")
+		{
+			nu := user.NewUser{
+				Name:            "Bo Gopher",
+				Email:           "bo@ardanlabs.com",
+				Roles:           []string{auth.RoleUser},
+				Password:        "gophers",
+				PasswordConfirm: "gophers",
+			}
+			local, err := s.Create(ctx, creator, nu, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to create user : %s.", tests.Failed, err)
+			}
+
+			bo := user.External{Issuer: ext.Issuer, Subject: "bo", Email: nu.Email, Roles: []string{auth.RoleAdmin, auth.RoleUser}}
+			if _, err := s.Provision(ctx, bo, now); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT link an email the provider did not verify : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT link an email the provider did not verify.", tests.Success)
+
+			bo.EmailVerified = true
+			u, err := s.Provision(ctx, bo, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to provision the user : %s.", tests.Failed, err)
+			}
+			if u.ID != local.ID {
+				t.Fatalf("\t%s\tShould link the local user : got %s.", tests.Failed, u.ID)
+			}
+			t.Logf("\t%s\tShould link the local user.", tests.Success)
+
+			if u, err = s.Provision(ctx, bo, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to provision the user : %s.", tests.Failed, err)
+			}
+			if !cmp.Equal([]string(u.Roles), nu.Roles) {
+				t.Fatalf("\t%s\tShould keep the roles of the local user : got %v.", tests.Failed, u.Roles)
+			}
+			t.Logf("\t%s\tShould keep the roles of the local user.", tests.Success)
+
+			if err := s.Delete(ctx, local.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+		}
+
+		t.Log("\tWhen someone logs in with the email of an unverified user.")
+		{
+			nr := user.NewRegistration{
+				Name:            "Cy Gopher",
+				Email:           "cy@ardanlabs.com",
+				Password:        "hijacked",
+				PasswordConfirm: "hijacked",
+			}
+			if _, err := s.Register(ctx, nr, time.Hour, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to register : %s.", tests.Failed, err)
+			}
+
+			cy := user.External{Issuer: ext.Issuer, Subject: "cy", Email: nr.Email, EmailVerified: true, Roles: []string{auth.RoleUser}}
+			u, err := s.Provision(ctx, cy, now)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to provision the user : %s.", tests.Failed, err)
+			}
+			if u.Unverified {
+				t.Fatalf("\t%s\tShould verify the linked user.", tests.Failed)
+			}
+			if _, err := s.Authenticate(ctx, now, nr.Email, nr.Password, source); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT authenticate with the password set before the link : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate with the password set before the link.", tests.Success)
+
+			if err := s.Delete(ctx, u.ID, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+		}
+
+		t.Log("\tWhen someone can not log in.")
+		{
+			if _, err := s.Provision(ctx, user.External{Issuer: ext.Issuer, Subject: "anon"}, now); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT provision a user without an email : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT provision a user without an email.", tests.Success)
+
+			if err := s.Disable(ctx, id, "left", now); err != nil {
+				t.Fatalf("\t%s\tShould be able to disable : %s.", tests.Failed, err)
+			}
+			if _, err := s.AuthenticateExternal(ctx, now, ext, source); errors.Cause(err) != user.ErrDisabled {
+				t.Fatalf("\t%s\tShould NOT authenticate a disabled user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT authenticate a disabled user.", tests.Success)
+
+			if err := s.Delete(ctx, id, now); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete user : %s.", tests.Failed, err)
+			}
+			if _, err := s.Provision(ctx, ext, now); errors.Cause(err) != user.ErrAuthenticationFailure {
+				t.Fatalf("\t%s\tShould NOT provision a deleted user : %v.", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould NOT provision a deleted user.", tests.Success)
+		}
+	}
+}